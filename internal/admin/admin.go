@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+
+	"lift_learn/internal/events"
+)
+
+//go:embed templates/admin.html
+var templates embed.FS
+
+var page = template.Must(template.New("admin.html").Funcs(template.FuncMap{
+	"bytes":   formatBytes,
+	"percent": func(f float64) int { return int(f*100 + 0.5) },
+	"time":    func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+}).ParseFS(templates, "templates/admin.html"))
+
+// Mapping is one row of the tag mappings table
+type Mapping struct {
+	UID         string
+	ProductName string
+	VideoFile   string
+	FileSize    int64
+	Missing     bool
+}
+
+// Deployment is one row of the recent deployments table
+type Deployment struct {
+	DeploymentId string
+	ProjectId    string
+	Status       string
+	UpdatedAt    time.Time
+}
+
+// Page is everything the dashboard shows
+type Page struct {
+	DeviceId      string
+	RegisteredURL string
+	Uptime        time.Duration
+	DiskUsed      uint64
+	DiskTotal     uint64
+	DiskFraction  float64
+	Mappings      []Mapping
+	Deployments   []Deployment
+	Scans         []events.HistoryEntry
+	// Why Scans is empty when lift_learn couldn't be asked
+	ScansError  string
+	GeneratedAt time.Time
+}
+
+// Render writes the dashboard for p to w
+func Render(w io.Writer, p Page) error {
+	return page.Execute(w, p)
+}
+
+func formatBytes(n interface{}) string {
+	var b float64
+	switch v := n.(type) {
+	case int64:
+		b = float64(v)
+	case uint64:
+		b = float64(v)
+	}
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", b, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", b, units[i])
+}
@@ -0,0 +1,132 @@
+// Package apperr has the error types both binaries wrap failures in at the
+// point they happen, so callers can tell them apart with errors.As instead
+// of matching strings.
+package apperr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of error, as reported by Kind
+const (
+	KindDownload     = "download"
+	KindChecksum     = "checksum"
+	KindFileWrite    = "file_write"
+	KindRegistration = "registration"
+	KindSerial       = "serial"
+	KindOther        = "other"
+)
+
+// DownloadError is a media download that didn't arrive: the request failed,
+// the server answered StatusCode, or the transfer broke off. StatusCode is 0
+// when there was no response.
+type DownloadError struct {
+	ProductId  string
+	URL        string
+	StatusCode int
+	Cause      error
+}
+
+func (e *DownloadError) Error() string {
+	msg := "failed to download " + e.URL
+	if e.ProductId != "" {
+		msg = fmt.Sprintf("failed to download %s for %s", e.URL, e.ProductId)
+	}
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(", status: %d", e.StatusCode)
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *DownloadError) Unwrap() error { return e.Cause }
+
+// ChecksumError is downloaded media whose SHA-256 isn't the one its Thing
+// was pushed with
+type ChecksumError struct {
+	ProductId string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.ProductId != "" {
+		return fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", e.ProductId, e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("checksum mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// FileWriteError is a file on the device that couldn't be created, written
+// or moved into place
+type FileWriteError struct {
+	Path  string
+	Cause error
+}
+
+func (e *FileWriteError) Error() string {
+	return fmt.Sprintf("failed to write %s: %v", e.Path, e.Cause)
+}
+
+func (e *FileWriteError) Unwrap() error { return e.Cause }
+
+// RegistrationError is a failed call to the registration endpoint. StatusCode
+// and Body are only set when the endpoint answered.
+type RegistrationError struct {
+	StatusCode int
+	Body       string
+	Cause      error
+}
+
+func (e *RegistrationError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("registration request failed: %v", e.Cause)
+	}
+	return fmt.Sprintf("registration rejected: status=%d body=%s", e.StatusCode, e.Body)
+}
+
+func (e *RegistrationError) Unwrap() error { return e.Cause }
+
+// Rejected reports whether the endpoint refused the request itself, which
+// retrying the same request won't fix
+func (e *RegistrationError) Rejected() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != 429
+}
+
+// SerialError is an NFC reader's serial port failing to open or read
+type SerialError struct {
+	Port  string
+	Cause error
+}
+
+func (e *SerialError) Error() string {
+	return fmt.Sprintf("serial port %s: %v", e.Port, e.Cause)
+}
+
+func (e *SerialError) Unwrap() error { return e.Cause }
+
+// Kind names the type of err, for grouping errors in API responses
+func Kind(err error) string {
+	var (
+		download     *DownloadError
+		checksum     *ChecksumError
+		fileWrite    *FileWriteError
+		registration *RegistrationError
+		serialErr    *SerialError
+	)
+	switch {
+	case errors.As(err, &checksum):
+		return KindChecksum
+	case errors.As(err, &fileWrite):
+		return KindFileWrite
+	case errors.As(err, &download):
+		return KindDownload
+	case errors.As(err, &registration):
+		return KindRegistration
+	case errors.As(err, &serialErr):
+		return KindSerial
+	}
+	return KindOther
+}
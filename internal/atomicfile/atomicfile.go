@@ -0,0 +1,37 @@
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Write creates path by writing into a temp file in the same directory and
+// renaming it into place only once write succeeds, so no reader ever sees a
+// partially written file. The temp file is removed on any failure.
+func Write(path string, perm os.FileMode, write func(f *os.File) error) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "*"+filepath.Ext(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set permissions on temp file: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %v", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move temp file into place: %v", err)
+	}
+	return nil
+}
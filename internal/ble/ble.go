@@ -0,0 +1,114 @@
+package ble
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Company ID Apple's iBeacon advertisements are sent under
+const appleCompanyID = 0x004C
+
+// Service data UUID Eddystone frames are sent under
+var eddystoneUUID = bluetooth.New16BitUUID(0xFEAA)
+
+// Eddystone frame types
+const (
+	eddystoneUID = 0x00
+	eddystoneURL = 0x10
+)
+
+// Scan reports every beacon advertisement on the default adapter to handler
+// until ctx is cancelled. The ID is the Eddystone URL when the beacon sends
+// one and its MAC address otherwise. With uuidPrefix set only beacons whose
+// iBeacon UUID, Eddystone namespace or service data UUID starts with it are
+// reported. Scanning restarts every window so BlueZ keeps reporting beacons
+// that haven't changed.
+func Scan(ctx context.Context, window time.Duration, uuidPrefix string, handler func(id string)) error {
+	adapter := bluetooth.DefaultAdapter
+	if err := adapter.Enable(); err != nil {
+		return fmt.Errorf("failed to enable bluetooth adapter: %v", err)
+	}
+	prefix := compactUUID(uuidPrefix)
+
+	for ctx.Err() == nil {
+		stop := time.AfterFunc(window, func() { adapter.StopScan() })
+		cancel := context.AfterFunc(ctx, func() { adapter.StopScan() })
+		err := adapter.Scan(func(_ *bluetooth.Adapter, result bluetooth.ScanResult) {
+			if prefix != "" && !hasUUIDPrefix(result, prefix) {
+				return
+			}
+			id := eddystoneURLOf(result)
+			if id == "" {
+				id = result.Address.String()
+			}
+			handler(id)
+		})
+		stop.Stop()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("bluetooth scan failed: %v", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// UUIDs in hex without dashes, lower case, so prefixes compare either way
+func compactUUID(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, "-", ""))
+}
+
+func hasUUIDPrefix(result bluetooth.ScanResult, prefix string) bool {
+	for _, m := range result.ManufacturerData() {
+		if m.CompanyID == appleCompanyID && len(m.Data) >= 18 && m.Data[0] == 0x02 && m.Data[1] == 0x15 {
+			if strings.HasPrefix(hex.EncodeToString(m.Data[2:18]), prefix) {
+				return true
+			}
+		}
+	}
+	for _, s := range result.ServiceData() {
+		if strings.HasPrefix(compactUUID(s.UUID.String()), prefix) {
+			return true
+		}
+		if s.UUID == eddystoneUUID && len(s.Data) >= 12 && s.Data[0] == eddystoneUID {
+			if strings.HasPrefix(hex.EncodeToString(s.Data[2:12]), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var urlSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+
+var urlExpansions = []string{
+	".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+}
+
+// The URL of an Eddystone-URL frame in result, or "" without one
+func eddystoneURLOf(result bluetooth.ScanResult) string {
+	for _, s := range result.ServiceData() {
+		if s.UUID != eddystoneUUID || len(s.Data) < 3 || s.Data[0] != eddystoneURL {
+			continue
+		}
+		if int(s.Data[2]) >= len(urlSchemes) {
+			continue
+		}
+		var url strings.Builder
+		url.WriteString(urlSchemes[s.Data[2]])
+		for _, b := range s.Data[3:] {
+			if int(b) < len(urlExpansions) {
+				url.WriteString(urlExpansions[b])
+			} else {
+				url.WriteByte(b)
+			}
+		}
+		return url.String()
+	}
+	return ""
+}
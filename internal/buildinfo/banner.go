@@ -0,0 +1,56 @@
+package buildinfo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Banner summarises what is running where, printed at startup so the logs
+// of any device show which build and configuration it came up with
+type Banner struct {
+	Version     string   `json:"version"`
+	BuildTime   string   `json:"build_time"`
+	DeviceID    string   `json:"device_id"`
+	Hostname    string   `json:"hostname"`
+	OS          string   `json:"os"`
+	Arch        string   `json:"arch"`
+	SerialPorts []string `json:"serial_ports,omitempty"`
+	StoragePath string   `json:"storage_path"`
+	MappedTags  int      `json:"mapped_tags"`
+	StartedAt   string   `json:"started_at"`
+}
+
+// NewBanner fills in the host details alongside the given build and config
+func NewBanner(version, buildTime, deviceID, storagePath string, serialPorts []string, mappedTags int) Banner {
+	hostname, _ := os.Hostname()
+	return Banner{
+		Version:     version,
+		BuildTime:   buildTime,
+		DeviceID:    deviceID,
+		Hostname:    hostname,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		SerialPorts: serialPorts,
+		StoragePath: storagePath,
+		MappedTags:  mappedTags,
+		StartedAt:   time.Now().Format(time.RFC3339),
+	}
+}
+
+// Print writes the banner to w as a short human-readable block
+func (b Banner) Print(w io.Writer, program string) {
+	ports := strings.Join(b.SerialPorts, ", ")
+	if ports == "" {
+		ports = "auto-detect"
+	}
+	fmt.Fprintf(w, "%s %s (built %s)\n", program, b.Version, b.BuildTime)
+	fmt.Fprintf(w, "  device:   %s on %s (%s/%s)\n", b.DeviceID, b.Hostname, b.OS, b.Arch)
+	fmt.Fprintf(w, "  storage:  %s\n", b.StoragePath)
+	fmt.Fprintf(w, "  readers:  %s\n", ports)
+	fmt.Fprintf(w, "  tags:     %d mapped\n", b.MappedTags)
+	fmt.Fprintf(w, "  started:  %s\n", b.StartedAt)
+}
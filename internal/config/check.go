@@ -0,0 +1,85 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Check runs every validation and then looks at the files the config points
+// to: the serial ports, the storage path, the TLS key pair, the client CA
+// bundle and the idle videos. Unlike Validate it carries on after a problem
+// and returns all of them. Nothing is left behind on disk.
+func (c *Config) Check() []error {
+	var errs []error
+	for _, validate := range []func() error{c.Validate, c.ValidateMQTT, c.ValidateDisplay} {
+		if err := validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, port := range c.ReaderPorts() {
+		if port == BLEReaderPort {
+			continue
+		}
+		if _, err := os.Stat(port); err != nil {
+			errs = append(errs, fmt.Errorf("serial port %s: %v", port, err))
+		}
+	}
+
+	if c.StoragePath != "" {
+		if err := checkWritable(c.StoragePath); err != nil {
+			errs = append(errs, fmt.Errorf("storage_path %s is not writable: %v", c.StoragePath, err))
+		}
+	}
+
+	// A self-signed pair is generated on startup when it doesn't exist yet
+	if c.TLSEnabled() && !(c.GenerateSelfSigned && !exists(c.TLSCertFile) && !exists(c.TLSKeyFile)) {
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("tls_cert_file and tls_key_file: %v", err))
+		}
+	}
+	if c.ClientCAFile != "" {
+		if _, err := os.Stat(c.ClientCAFile); err != nil {
+			errs = append(errs, fmt.Errorf("client_ca_file: %v", err))
+		}
+	}
+
+	idleVideos := []string{c.IdleVideoPath}
+	for _, s := range c.Screens {
+		idleVideos = append(idleVideos, s.IdleVideoPath)
+	}
+	for _, path := range idleVideos {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("idle video %s: %v", path, err))
+		}
+	}
+	return errs
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Reports whether files can be created in dir, or in the nearest existing
+// parent when dir would have to be created first
+func checkWritable(dir string) error {
+	for !exists(dir) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".check-config-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,913 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultPath is the config file used when no --config flag is given
+	DefaultPath = "config.yaml"
+
+	DefaultStoragePath  = "./content"
+	DefaultRegistryFile = "./registry.json"
+
+	DefaultTagDebounceMs = 2000
+	DefaultMpvSocket     = "/tmp/mpv.sock"
+
+	DefaultBLEScanDurationMs = 10000
+
+	DefaultIdleTimeoutSeconds = 30
+
+	DefaultScreensaverMode          = ScreensaverVideo
+	DefaultScreensaverSlideInterval = 10
+
+	DefaultTransitionType       = "none"
+	DefaultTransitionDurationMs = 500
+
+	DefaultMaxPrewarmedVideos = 3
+
+	DefaultOSDDurationSeconds = 5
+	DefaultOSDFontSize        = 48
+	DefaultOSDColor           = "#FFFFFF"
+	DefaultOSDPosition        = "top-left"
+
+	DefaultLetterboxColor = "black"
+
+	DefaultImageViewer         = "feh"
+	DefaultImageDisplaySeconds = 10
+
+	DefaultControlAddr   = ":3001"
+	DefaultMaxSSEClients = 10
+
+	DefaultHistorySize = 100
+
+	DefaultStatsFile = "./stats.json"
+
+	DefaultEventLogFile         = "./events.jsonl"
+	DefaultEventLogMaxSizeBytes = 10 << 20
+	DefaultEventLogMaxRotated   = 5
+
+	DefaultRegistrationMaxAttempts       = 5
+	DefaultRegistrationMaxBackoffSeconds = 60
+
+	DefaultMaxConcurrentDownloads = 4
+
+	DefaultMaxUploadBodyBytes = 1 << 20
+
+	DefaultMinFreeDiskMB = 500
+
+	DefaultPerThingDownloadTimeoutSeconds = 120
+
+	DefaultRateLimitRequestsPerMinute = 10
+	DefaultRateLimitBurst             = 3
+	DefaultRateLimitTTLMinutes        = 10
+
+	DefaultDeploymentsFile = "./deployments.json"
+
+	DefaultExpirationsFile = "./expirations.json"
+
+	DefaultCorruptFile                 = "./corrupt.json"
+	DefaultIntegrityCheckIntervalHours = 24
+
+	DefaultFailedPath = "./failed"
+
+	DefaultRetryQueuePath = "./retry-queue"
+	DefaultMaxJobAgeHours = 24
+
+	DefaultScheduledFile = "./scheduled.json"
+
+	DefaultSnapshotsFile = "./snapshots.json"
+	DefaultMaxSnapshots  = 3
+
+	DefaultStateFile        = "./state.json"
+	DefaultStateMaxAgeHours = 24
+
+	DefaultHeartbeatIntervalSeconds = 300
+	DefaultHeartbeatMaxMisses       = 3
+
+	DefaultKeyFile        = "./device-key.pem"
+	DefaultDeviceCertFile = "./device-cert.pem"
+
+	DefaultShutdownTimeoutSeconds = 30
+
+	DefaultHTTPPort  = 3000
+	DefaultPProfPort = 6060
+
+	DefaultServerReadTimeoutSeconds       = 30
+	DefaultServerWriteTimeoutSeconds      = 60
+	DefaultServerIdleTimeoutSeconds       = 120
+	DefaultServerReadHeaderTimeoutSeconds = 10
+
+	DefaultHTTPMaxRetries  = 3
+	DefaultHTTPBaseDelayMs = 500
+	DefaultHTTPMaxDelayMs  = 10000
+	DefaultHTTPMultiplier  = 2.0
+
+	DefaultTunnelProvider            = "ngrok"
+	DefaultTunnelPollIntervalSeconds = 60
+
+	DefaultMaxWebhookWorkers = 2
+	DefaultMaxWebhookRetries = 3
+
+	DefaultMQTTPort        = 1883
+	DefaultMQTTTopicPrefix = "lift-learn"
+
+	DefaultAWSIoTPort = 8883
+)
+
+// DefaultCORSAllowedMethods covers every method the upload server answers
+var DefaultCORSAllowedMethods = []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"}
+
+// Config holds the per-device settings that used to be compile-time constants
+type Config struct {
+	DeviceID    string `yaml:"device_id"`
+	StoragePath string `yaml:"storage_path"`
+	// Deployments are downloaded here first and only moved into StoragePath
+	// once every Thing has arrived. Defaults to <storage_path>/.staging.
+	StagingPath string `yaml:"staging_path"`
+	// One copy of each downloaded video by SHA-256, hard-linked into projects.
+	// Defaults to <storage_path>/.store.
+	StorePath   string `yaml:"store_path"`
+	AWSEndpoint string `yaml:"aws_endpoint"`
+	// Called by the deregister subcommand; optional otherwise
+	AWSDeregisterEndpoint string `yaml:"aws_deregister_endpoint"`
+	// Network interface ("eth0", "wlan0") whose IPv4 address is registered
+	// as the device's LAN address; the first interface that is up when empty
+	PreferredInterface string `yaml:"preferred_interface"`
+	// Device status is POSTed here every HeartbeatIntervalSeconds; no
+	// heartbeat is sent when empty. After more than HeartbeatMaxMisses
+	// failures in a row the server logs an error, and exits with
+	// HeartbeatExitOnFailure so a supervisor can restart it.
+	HeartbeatEndpoint        string `yaml:"heartbeat_endpoint"`
+	HeartbeatIntervalSeconds int    `yaml:"heartbeat_interval_seconds"`
+	HeartbeatMaxMisses       int    `yaml:"heartbeat_max_misses"`
+	HeartbeatExitOnFailure   bool   `yaml:"heartbeat_exit_on_failure"`
+	// NFC tag registry written by the upload server and read by lift_learn
+	RegistryFile string `yaml:"registry_file"`
+
+	// Registration retries back off from 1s, doubling up to the max backoff
+	RegistrationMaxAttempts       int `yaml:"registration_max_attempts"`
+	RegistrationMaxBackoffSeconds int `yaml:"registration_max_backoff_seconds"`
+
+	// Upper bound on parallel media downloads across all upload requests
+	MaxConcurrentDownloads int `yaml:"max_concurrent_downloads"`
+
+	// Largest upload request body accepted; bigger ones get a 413
+	MaxUploadBodyBytes int64 `yaml:"max_upload_body_bytes"`
+
+	// Longest a single Thing's download may take. Timed-out downloads are
+	// retried up to MaxDownloadRetries times; other failures never are.
+	PerThingDownloadTimeoutSeconds int `yaml:"per_thing_download_timeout_seconds"`
+	MaxDownloadRetries             int `yaml:"max_download_retries"`
+	// Longest all of a deployment's downloads together may take; downloads
+	// still running then are cancelled. Zero means no limit.
+	DeploymentTimeoutSeconds int `yaml:"deployment_timeout_seconds"`
+
+	// Uploads are refused with 507 when storage has less free space than this.
+	// Defaults to DefaultMinFreeDiskMB when unset; 0 turns the guard off.
+	MinFreeDiskMB int `yaml:"min_free_disk_mb"`
+
+	// Delete media no metadata refers to when the upload server starts, as
+	// POST /gc does on demand
+	RunGCOnStartup bool `yaml:"run_gc_on_startup"`
+
+	// Processed DeploymentIds, so a retried push isn't downloaded twice
+	DeploymentsFile string `yaml:"deployments_file"`
+
+	// A project's previous content is kept as a snapshot each time a
+	// deployment replaces it, up to MaxSnapshots per project
+	SnapshotsFile string `yaml:"snapshots_file"`
+	MaxSnapshots  int    `yaml:"max_snapshots"`
+
+	// Videos with an expiresAt that are still waiting to be deleted
+	ExpirationsFile string `yaml:"expirations_file"`
+
+	// Stored media is re-hashed against its metadata checksum every
+	// IntegrityCheckIntervalHours; mismatches are kept in CorruptFile
+	CorruptFile                 string `yaml:"corrupt_file"`
+	IntegrityCheckIntervalHours int    `yaml:"integrity_check_interval_hours"`
+
+	// Things a deployment failed to download, one {deploymentId}.json each,
+	// kept until POST /deployments/{id}/retry or the retry queue gets them all
+	FailedPath string `yaml:"failed_path"`
+	// Failed Things are also queued here, one JSON file each, and retried in
+	// the background with a growing delay until MaxJobAgeHours have passed
+	RetryQueuePath string `yaml:"retry_queue_path"`
+	MaxJobAgeHours int    `yaml:"max_job_age_hours"`
+
+	// Deployments pushed with a future activeAt, downloaded and waiting to go live
+	ScheduledFile string `yaml:"scheduled_file"`
+
+	// Last successful registration, reused on restart while younger than StateMaxAgeHours
+	StateFile        string `yaml:"state_file"`
+	StateMaxAgeHours int    `yaml:"state_max_age_hours"`
+
+	// Shared secret required on upload requests; empty disables authentication
+	APIKey string `yaml:"api_key"`
+
+	// Basic auth credentials for the /admin dashboard, which is only served
+	// when both are set
+	AdminUsername string `yaml:"admin_username"`
+	AdminPassword string `yaml:"admin_password"`
+
+	// Per-IP token bucket on the upload endpoint. Idle clients are forgotten
+	// after RateLimitTTLMinutes.
+	RateLimitRequestsPerMinute int `yaml:"rate_limit_requests_per_minute"`
+	RateLimitBurst             int `yaml:"rate_limit_burst"`
+	RateLimitTTLMinutes        int `yaml:"rate_limit_ttl_minutes"`
+
+	// Serve HTTPS when both files are set. With GenerateSelfSigned a
+	// self-signed pair is created at those paths if they don't exist yet.
+	TLSCertFile        string `yaml:"tls_cert_file"`
+	TLSKeyFile         string `yaml:"tls_key_file"`
+	GenerateSelfSigned bool   `yaml:"generate_self_signed"`
+	// CAs whose client certificates may push to /receive-content. When set,
+	// uploads need a verified client certificate on top of the API key.
+	ClientCAFile string `yaml:"client_ca_file"`
+
+	// The device's P-256 key, created on first start, whose public half is
+	// sent when registering. A certificate AWS returns for it is kept at
+	// DeviceCertFile and presented on outbound requests that ask for one.
+	KeyFile        string `yaml:"key_file"`
+	DeviceCertFile string `yaml:"device_cert_file"`
+
+	// Trust settings for media downloads and registration, for content on
+	// servers with private-CA certificates
+	OutboundTLS TLSConfig `yaml:"outbound_tls"`
+
+	// Backoff for every outbound request, retried on 429, 502, 503, 504
+	// and network errors
+	HTTPRetry HTTPRetryConfig `yaml:"http_retry"`
+
+	// Origins of browser-based tools allowed to call the upload server.
+	// CORS headers are only sent when AllowedOrigins is set.
+	CORS CORSConfig `yaml:"cors"`
+
+	// Connection timeouts of the upload server, so a slow client can't hold
+	// a connection open forever
+	Server ServerConfig `yaml:"server"`
+
+	// Minimum log level ("debug", "info", "warn", "error"), overriding
+	// --log-level when set
+	LogLevel string `yaml:"log_level"`
+
+	// OTLP/HTTP collector URL the upload server sends traces to, e.g.
+	// http://collector:4318. Tracing is off when empty.
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+
+	// Port the upload server listens on and the tunnel forwards to; the
+	// --port flag takes precedence
+	HTTPPort int `yaml:"http_port"`
+
+	// Loopback port the profiling server listens on when the upload server
+	// is started with --enable-pprof
+	PProfPort int `yaml:"pprof_port"`
+
+	// How long the upload server waits for in-flight downloads, and lift_learn
+	// for queued webhooks, on SIGINT/SIGTERM
+	ShutdownTimeoutSeconds int `yaml:"shutdown_timeout_seconds"`
+
+	// Keep the binary replaced by POST /update as lift-learn.backup
+	BackupBinary bool `yaml:"backup_binary"`
+
+	// Which tunnel exposes the upload server ("ngrok" or "cloudflare") and how
+	// often to check whether it has handed out a new public URL
+	TunnelProvider            string `yaml:"tunnel_provider"`
+	TunnelPollIntervalSeconds int    `yaml:"tunnel_poll_interval_seconds"`
+
+	// NFC reader used by lift_learn, auto-detected when unset. SerialPorts
+	// lists several readers for multi-screen installations and takes
+	// precedence over SerialPort.
+	SerialPort  string   `yaml:"serial_port"`
+	SerialPorts []string `yaml:"serial_ports"`
+	// Per-station settings for installations where each reader drives its
+	// own display. Takes precedence over SerialPorts when set.
+	Screens []ScreenConfig `yaml:"screens"`
+	// Beacon scanning next to, or instead of, the NFC readers. NFC readers
+	// aren't auto-detected while it is enabled.
+	BLE BLEConfig `yaml:"ble"`
+	// Repeat reads of the same tag within this window are ignored
+	TagDebounceMs int `yaml:"tag_debounce_ms"`
+	// IPC socket lift_learn uses to control mpv
+	MpvSocket string `yaml:"mpv_socket"`
+
+	// Attract loop played when no tag has been scanned for IdleTimeoutSeconds
+	IdleVideoPath      string `yaml:"idle_video_path"`
+	IdleTimeoutSeconds int    `yaml:"idle_timeout_seconds"`
+	// What an idle screen shows: the idle video, a slideshow or nothing
+	Screensaver ScreensaverConfig `yaml:"screensaver"`
+
+	// How a screen switches between videos: "none", "black" (hold a black
+	// screen for the duration) or "fade" (fade out and back in over it)
+	TransitionType       string `yaml:"transition_type"`
+	TransitionDurationMs int    `yaml:"transition_duration_ms"`
+
+	// Keep the MaxPrewarmedVideos most recently deployed videos open in
+	// paused mpv instances of their own on every screen, so they start
+	// without mpv's load delay. Each one costs an mpv process's memory.
+	PrewarmEnabled     bool `yaml:"prewarm_enabled"`
+	MaxPrewarmedVideos int  `yaml:"max_prewarmed_videos"`
+
+	// Product name, price and description drawn over a scanned video for
+	// OSDDurationSeconds. OSDColor is "#RRGGBB"; OSDPosition is one of
+	// "top-left", "top-right", "bottom-left" or "bottom-right".
+	OSDDurationSeconds int    `yaml:"osd_duration_seconds"`
+	OSDFontSize        int    `yaml:"osd_font_size"`
+	OSDColor           string `yaml:"osd_color"`
+	OSDPosition        string `yaml:"osd_position"`
+	// Short chime played when a scanned tag matches, as the video starts
+	ActivationSoundPath string `yaml:"activation_sound_path"`
+
+	// BCP-47 locale ("fr-CA") product names are shown and logged in, taken
+	// from a Thing's names. Its productName is used when it has none.
+	Locale string `yaml:"locale"`
+
+	// Output size and orientation of every screen's mpv
+	Display DisplayConfig `yaml:"display"`
+
+	// Image Things are shown with ImageViewer ("feh" or ImageMagick's
+	// "display") for ImageDisplaySeconds
+	ImageViewer         string `yaml:"image_viewer"`
+	ImageDisplaySeconds int    `yaml:"image_display_seconds"`
+
+	// Address of lift_learn's own HTTP server for live scan events, and how
+	// many /events streams it will hold open at once
+	ControlAddr   string `yaml:"control_addr"`
+	MaxSSEClients int    `yaml:"max_sse_clients"`
+
+	// Serve POST /simulate-scan on the control server, for demos and testing
+	// without a tag. Requires APIKey when one is set.
+	SimulateEnabled bool `yaml:"simulate_enabled"`
+
+	// Play the media named by a tag's NDEF URI record instead of looking its
+	// UID up in the registry. Local paths must be under StoragePath or in the
+	// registry; http(s) URLs are only fetched, into a temp cache, with
+	// AllowNDEFDownload.
+	AllowNDEFPlayback bool `yaml:"allow_ndef_playback"`
+	AllowNDEFDownload bool `yaml:"allow_ndef_download"`
+
+	// Scans kept in memory for lift_learn's /history endpoint
+	HistorySize int `yaml:"history_size"`
+
+	// Play counts and durations per product, served by lift_learn's /stats
+	StatsFile string `yaml:"stats_file"`
+
+	// Append-only record of every scan, rotated to <file>.<timestamp> past the
+	// max size. Only the newest EventLogMaxRotated rotated files are kept.
+	EventLogFile         string `yaml:"event_log_file"`
+	EventLogMaxSizeBytes int64  `yaml:"event_log_max_size_bytes"`
+	EventLogMaxRotated   int    `yaml:"event_log_max_rotated"`
+
+	// Workers delivering scan webhooks for Things with a webhookUrl, and how
+	// many times each failed call is retried
+	MaxWebhookWorkers int `yaml:"max_webhook_workers"`
+	MaxWebhookRetries int `yaml:"max_webhook_retries"`
+
+	// Broker lift_learn publishes scans to and takes commands from; leave
+	// the section out to run without MQTT
+	MQTT *MQTTConfig `yaml:"mqtt"`
+
+	// AWS IoT Core connection the upload server takes deployments and
+	// commands from, so the cloud needn't reach it through the tunnel.
+	// Leave the section out to only accept them over HTTP.
+	AWSIoT *AWSIoTConfig `yaml:"aws_iot"`
+}
+
+// ScreenConfig ties an NFC reader to the display (mpv's --screen number) its
+// scans play on. IdleVideoPath defaults to the top-level idle_video_path.
+type ScreenConfig struct {
+	SerialPort    string `yaml:"serial_port"`
+	DisplayId     int    `yaml:"display_id"`
+	IdleVideoPath string `yaml:"idle_video_path"`
+}
+
+// BLEReaderPort is the port name scans from the BLE scanner are attributed
+// to. A screens entry with this serial_port picks the BLE scanner's display.
+const BLEReaderPort = "ble"
+
+// BLEConfig turns on scanning for iBeacon and Eddystone advertisements.
+// A beacon's Eddystone URL, or its MAC address, is looked up like a tag UID.
+// Scanning restarts every ScanDurationMs; AdvertisedUUIDPrefix limits it to
+// beacons carrying a UUID that starts with the prefix.
+type BLEConfig struct {
+	Enabled              bool   `yaml:"enabled"`
+	ScanDurationMs       int    `yaml:"scan_duration_ms"`
+	AdvertisedUUIDPrefix string `yaml:"advertised_uuid_prefix"`
+}
+
+// ServerConfig bounds how long the upload server waits on a client. The write
+// timeout isn't applied to requests that wait on downloads, such as uploads.
+type ServerConfig struct {
+	ReadTimeoutSeconds       int `yaml:"read_timeout_seconds"`
+	WriteTimeoutSeconds      int `yaml:"write_timeout_seconds"`
+	IdleTimeoutSeconds       int `yaml:"idle_timeout_seconds"`
+	ReadHeaderTimeoutSeconds int `yaml:"read_header_timeout_seconds"`
+}
+
+// CORSConfig lists the origins whose requests get CORS headers, or "*" for
+// any. AllowedMethods defaults to the methods the upload server routes use.
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins"`
+	AllowedMethods   []string `yaml:"allowed_methods"`
+	AllowCredentials bool     `yaml:"allow_credentials"`
+}
+
+// DisplayConfig describes the monitor mpv draws on. Width and Height set the
+// window geometry and AspectRatio (e.g. "16:9") overrides the video's own.
+// RotationDegrees is 0, 90, 180 or 270; landscape videos on a portrait
+// kiosk are letterboxed in LetterboxColor (a name like "black" or
+// "#RRGGBB"). Zero values leave mpv's defaults alone.
+type DisplayConfig struct {
+	Width           int    `yaml:"width"`
+	Height          int    `yaml:"height"`
+	AspectRatio     string `yaml:"aspect_ratio"`
+	RotationDegrees int    `yaml:"rotation_degrees"`
+	LetterboxColor  string `yaml:"letterbox_color"`
+}
+
+// Screensaver modes
+const (
+	ScreensaverVideo     = "video"
+	ScreensaverSlideshow = "slideshow"
+	ScreensaverOff       = "off"
+)
+
+// ScreensaverConfig is what a screen shows once it has gone idle. In
+// slideshow mode the images matching ImageGlob are shown in name order,
+// SlideInterval seconds each, looping back to the first.
+type ScreensaverConfig struct {
+	Mode          string `yaml:"mode"`
+	SlideInterval int    `yaml:"slide_interval"`
+	ImageGlob     string `yaml:"image_glob"`
+}
+
+// HTTPRetryConfig is how often and how patiently outbound requests are
+// retried. Each wait is random, up to base_delay_ms*multiplier^attempt
+// capped at max_delay_ms.
+type HTTPRetryConfig struct {
+	MaxRetries  int     `yaml:"max_retries"`
+	BaseDelayMs int     `yaml:"base_delay_ms"`
+	MaxDelayMs  int     `yaml:"max_delay_ms"`
+	Multiplier  float64 `yaml:"multiplier"`
+}
+
+// TLSConfig adds the PEM bundle at CACertFile to the trusted roots.
+// InsecureSkipVerify turns certificate checks off entirely and is only
+// meant for testing.
+type TLSConfig struct {
+	CACertFile         string `yaml:"ca_cert_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// MQTTConfig is the broker connection for scan events and remote commands.
+// ClientID defaults to "lift-learn-<device_id>".
+type MQTTConfig struct {
+	Broker      string `yaml:"broker"`
+	Port        int    `yaml:"port"`
+	ClientID    string `yaml:"client_id"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	TopicPrefix string `yaml:"topic_prefix"`
+	QOS         byte   `yaml:"qos"`
+}
+
+// AWSIoTConfig is the device's AWS IoT Core identity. The certificate and
+// key authenticate it to Endpoint, the account's ATS data endpoint.
+// ThingName, also the MQTT client ID, defaults to device_id and CAFile to
+// the system roots.
+type AWSIoTConfig struct {
+	Endpoint  string `yaml:"endpoint"`
+	Port      int    `yaml:"port"`
+	ThingName string `yaml:"thing_name"`
+	CertFile  string `yaml:"cert_file"`
+	KeyFile   string `yaml:"key_file"`
+	CAFile    string `yaml:"ca_file"`
+}
+
+// Load reads the YAML config at path and falls back to LIFT_* environment
+// variables for any field the file leaves empty. A missing file is not an
+// error so a device can be configured from the environment alone.
+func Load(path string) (*Config, error) {
+	// Set before parsing so only a missing key falls back to the default
+	cfg := &Config{MinFreeDiskMB: DefaultMinFreeDiskMB}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	cfg.applyEnv()
+	cfg.applyDefaults()
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() {
+	setFromEnv(&c.DeviceID, "LIFT_DEVICE_ID")
+	setFromEnv(&c.StoragePath, "LIFT_STORAGE_PATH")
+	setFromEnv(&c.AWSEndpoint, "LIFT_AWS_ENDPOINT")
+	setFromEnv(&c.APIKey, "LIFT_API_KEY")
+}
+
+func (c *Config) applyDefaults() {
+	if c.StoragePath == "" {
+		c.StoragePath = DefaultStoragePath
+	}
+	if c.StagingPath == "" {
+		c.StagingPath = filepath.Join(c.StoragePath, ".staging")
+	}
+	if c.StorePath == "" {
+		c.StorePath = filepath.Join(c.StoragePath, ".store")
+	}
+	if c.RegistryFile == "" {
+		c.RegistryFile = DefaultRegistryFile
+	}
+	if c.MaxConcurrentDownloads <= 0 {
+		c.MaxConcurrentDownloads = DefaultMaxConcurrentDownloads
+	}
+	if c.MaxUploadBodyBytes <= 0 {
+		c.MaxUploadBodyBytes = DefaultMaxUploadBodyBytes
+	}
+	if c.HTTPPort <= 0 {
+		c.HTTPPort = DefaultHTTPPort
+	}
+	if c.PProfPort <= 0 {
+		c.PProfPort = DefaultPProfPort
+	}
+	if c.HTTPRetry.MaxRetries <= 0 {
+		c.HTTPRetry.MaxRetries = DefaultHTTPMaxRetries
+	}
+	if c.HTTPRetry.BaseDelayMs <= 0 {
+		c.HTTPRetry.BaseDelayMs = DefaultHTTPBaseDelayMs
+	}
+	if c.HTTPRetry.MaxDelayMs <= 0 {
+		c.HTTPRetry.MaxDelayMs = DefaultHTTPMaxDelayMs
+	}
+	if c.HTTPRetry.Multiplier <= 0 {
+		c.HTTPRetry.Multiplier = DefaultHTTPMultiplier
+	}
+	if c.Server.ReadTimeoutSeconds <= 0 {
+		c.Server.ReadTimeoutSeconds = DefaultServerReadTimeoutSeconds
+	}
+	if c.Server.WriteTimeoutSeconds <= 0 {
+		c.Server.WriteTimeoutSeconds = DefaultServerWriteTimeoutSeconds
+	}
+	if c.Server.IdleTimeoutSeconds <= 0 {
+		c.Server.IdleTimeoutSeconds = DefaultServerIdleTimeoutSeconds
+	}
+	if c.Server.ReadHeaderTimeoutSeconds <= 0 {
+		c.Server.ReadHeaderTimeoutSeconds = DefaultServerReadHeaderTimeoutSeconds
+	}
+	if len(c.CORS.AllowedMethods) == 0 {
+		c.CORS.AllowedMethods = DefaultCORSAllowedMethods
+	}
+	if c.PerThingDownloadTimeoutSeconds <= 0 {
+		c.PerThingDownloadTimeoutSeconds = DefaultPerThingDownloadTimeoutSeconds
+	}
+	if c.RateLimitRequestsPerMinute <= 0 {
+		c.RateLimitRequestsPerMinute = DefaultRateLimitRequestsPerMinute
+	}
+	if c.RateLimitBurst <= 0 {
+		c.RateLimitBurst = DefaultRateLimitBurst
+	}
+	if c.RateLimitTTLMinutes <= 0 {
+		c.RateLimitTTLMinutes = DefaultRateLimitTTLMinutes
+	}
+	if c.DeploymentsFile == "" {
+		c.DeploymentsFile = DefaultDeploymentsFile
+	}
+	if c.SnapshotsFile == "" {
+		c.SnapshotsFile = DefaultSnapshotsFile
+	}
+	if c.MaxSnapshots <= 0 {
+		c.MaxSnapshots = DefaultMaxSnapshots
+	}
+	if c.ExpirationsFile == "" {
+		c.ExpirationsFile = DefaultExpirationsFile
+	}
+	if c.CorruptFile == "" {
+		c.CorruptFile = DefaultCorruptFile
+	}
+	if c.IntegrityCheckIntervalHours <= 0 {
+		c.IntegrityCheckIntervalHours = DefaultIntegrityCheckIntervalHours
+	}
+	if c.FailedPath == "" {
+		c.FailedPath = DefaultFailedPath
+	}
+	if c.RetryQueuePath == "" {
+		c.RetryQueuePath = DefaultRetryQueuePath
+	}
+	if c.MaxJobAgeHours <= 0 {
+		c.MaxJobAgeHours = DefaultMaxJobAgeHours
+	}
+	if c.ScheduledFile == "" {
+		c.ScheduledFile = DefaultScheduledFile
+	}
+	if c.StateFile == "" {
+		c.StateFile = DefaultStateFile
+	}
+	if c.HeartbeatIntervalSeconds <= 0 {
+		c.HeartbeatIntervalSeconds = DefaultHeartbeatIntervalSeconds
+	}
+	if c.HeartbeatMaxMisses <= 0 {
+		c.HeartbeatMaxMisses = DefaultHeartbeatMaxMisses
+	}
+	if c.KeyFile == "" {
+		c.KeyFile = DefaultKeyFile
+	}
+	if c.DeviceCertFile == "" {
+		c.DeviceCertFile = DefaultDeviceCertFile
+	}
+	if c.StateMaxAgeHours <= 0 {
+		c.StateMaxAgeHours = DefaultStateMaxAgeHours
+	}
+	if c.ShutdownTimeoutSeconds <= 0 {
+		c.ShutdownTimeoutSeconds = DefaultShutdownTimeoutSeconds
+	}
+	if c.TunnelProvider == "" {
+		c.TunnelProvider = DefaultTunnelProvider
+	}
+	if c.TunnelPollIntervalSeconds <= 0 {
+		c.TunnelPollIntervalSeconds = DefaultTunnelPollIntervalSeconds
+	}
+	if c.TagDebounceMs <= 0 {
+		c.TagDebounceMs = DefaultTagDebounceMs
+	}
+	if c.BLE.ScanDurationMs <= 0 {
+		c.BLE.ScanDurationMs = DefaultBLEScanDurationMs
+	}
+	if c.MpvSocket == "" {
+		c.MpvSocket = DefaultMpvSocket
+	}
+	if c.IdleTimeoutSeconds <= 0 {
+		c.IdleTimeoutSeconds = DefaultIdleTimeoutSeconds
+	}
+	if c.Screensaver.Mode == "" {
+		c.Screensaver.Mode = DefaultScreensaverMode
+	}
+	if c.Screensaver.SlideInterval <= 0 {
+		c.Screensaver.SlideInterval = DefaultScreensaverSlideInterval
+	}
+	if c.ControlAddr == "" {
+		c.ControlAddr = DefaultControlAddr
+	}
+	if c.MaxSSEClients <= 0 {
+		c.MaxSSEClients = DefaultMaxSSEClients
+	}
+	if c.TransitionType == "" {
+		c.TransitionType = DefaultTransitionType
+	}
+	if c.TransitionDurationMs <= 0 {
+		c.TransitionDurationMs = DefaultTransitionDurationMs
+	}
+	if c.MaxPrewarmedVideos <= 0 {
+		c.MaxPrewarmedVideos = DefaultMaxPrewarmedVideos
+	}
+	if c.OSDDurationSeconds <= 0 {
+		c.OSDDurationSeconds = DefaultOSDDurationSeconds
+	}
+	if c.OSDFontSize <= 0 {
+		c.OSDFontSize = DefaultOSDFontSize
+	}
+	if c.OSDColor == "" {
+		c.OSDColor = DefaultOSDColor
+	}
+	if c.OSDPosition == "" {
+		c.OSDPosition = DefaultOSDPosition
+	}
+	if c.Display.LetterboxColor == "" {
+		c.Display.LetterboxColor = DefaultLetterboxColor
+	}
+	if c.ImageViewer == "" {
+		c.ImageViewer = DefaultImageViewer
+	}
+	if c.ImageDisplaySeconds <= 0 {
+		c.ImageDisplaySeconds = DefaultImageDisplaySeconds
+	}
+	if c.HistorySize <= 0 {
+		c.HistorySize = DefaultHistorySize
+	}
+	if c.StatsFile == "" {
+		c.StatsFile = DefaultStatsFile
+	}
+	if c.EventLogFile == "" {
+		c.EventLogFile = DefaultEventLogFile
+	}
+	if c.EventLogMaxSizeBytes <= 0 {
+		c.EventLogMaxSizeBytes = DefaultEventLogMaxSizeBytes
+	}
+	if c.EventLogMaxRotated <= 0 {
+		c.EventLogMaxRotated = DefaultEventLogMaxRotated
+	}
+	if c.RegistrationMaxAttempts <= 0 {
+		c.RegistrationMaxAttempts = DefaultRegistrationMaxAttempts
+	}
+	if c.RegistrationMaxBackoffSeconds <= 0 {
+		c.RegistrationMaxBackoffSeconds = DefaultRegistrationMaxBackoffSeconds
+	}
+	if c.MaxWebhookWorkers <= 0 {
+		c.MaxWebhookWorkers = DefaultMaxWebhookWorkers
+	}
+	if c.MaxWebhookRetries <= 0 {
+		c.MaxWebhookRetries = DefaultMaxWebhookRetries
+	}
+	if m := c.MQTT; m != nil {
+		if m.Port <= 0 {
+			m.Port = DefaultMQTTPort
+		}
+		if m.TopicPrefix == "" {
+			m.TopicPrefix = DefaultMQTTTopicPrefix
+		}
+		if m.ClientID == "" {
+			m.ClientID = "lift-learn-" + c.DeviceID
+		}
+	}
+	if a := c.AWSIoT; a != nil {
+		if a.Port <= 0 {
+			a.Port = DefaultAWSIoTPort
+		}
+		if a.ThingName == "" {
+			a.ThingName = c.DeviceID
+		}
+	}
+}
+
+// Validate reports every required field that is still missing
+func (c *Config) Validate() error {
+	var missing []string
+	if c.DeviceID == "" {
+		missing = append(missing, "device_id (LIFT_DEVICE_ID)")
+	}
+	if c.StoragePath == "" {
+		missing = append(missing, "storage_path (LIFT_STORAGE_PATH)")
+	}
+	if c.AWSEndpoint == "" {
+		missing = append(missing, "aws_endpoint (LIFT_AWS_ENDPOINT)")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required config fields: %s", strings.Join(missing, ", "))
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	if c.GenerateSelfSigned && !c.TLSEnabled() {
+		return fmt.Errorf("generate_self_signed requires tls_cert_file and tls_key_file")
+	}
+	if c.ClientCAFile != "" && !c.TLSEnabled() {
+		return fmt.Errorf("client_ca_file requires tls_cert_file and tls_key_file")
+	}
+
+	if c.MinFreeDiskMB < 0 {
+		return fmt.Errorf("min_free_disk_mb must not be negative, got %d", c.MinFreeDiskMB)
+	}
+
+	if c.HTTPPort > 65535 {
+		return fmt.Errorf("http_port must be between 1 and 65535, got %d", c.HTTPPort)
+	}
+
+	switch c.TunnelProvider {
+	case "ngrok", "cloudflare":
+	default:
+		return fmt.Errorf("tunnel_provider must be \"ngrok\" or \"cloudflare\", got %q", c.TunnelProvider)
+	}
+	return nil
+}
+
+// PProfListenPort is PProfPort, moved out of the way when it would collide
+// with the upload server or the port after it, where lift_learn's control
+// server usually sits
+func (c *Config) PProfListenPort() int {
+	if c.PProfPort == c.HTTPPort || c.PProfPort == c.HTTPPort+1 {
+		return c.HTTPPort + 2
+	}
+	return c.PProfPort
+}
+
+// ValidateDisplay checks the display section that lift_learn passes to mpv
+func (c *Config) ValidateDisplay() error {
+	switch c.Display.RotationDegrees {
+	case 0, 90, 180, 270:
+	default:
+		return fmt.Errorf("display.rotation_degrees must be 0, 90, 180 or 270, got %d", c.Display.RotationDegrees)
+	}
+	if c.Display.Width < 0 || c.Display.Height < 0 {
+		return fmt.Errorf("display.width and display.height must not be negative")
+	}
+	if (c.Display.Width == 0) != (c.Display.Height == 0) {
+		return fmt.Errorf("display.width and display.height must be set together")
+	}
+	if ar := c.Display.AspectRatio; ar != "" {
+		w, h, ok := strings.Cut(ar, ":")
+		if !ok || w == "" || h == "" || strings.Trim(w+h, "0123456789.") != "" {
+			return fmt.Errorf("display.aspect_ratio must look like 16:9, got %q", ar)
+		}
+	}
+
+	switch c.Screensaver.Mode {
+	case ScreensaverVideo, ScreensaverOff:
+	case ScreensaverSlideshow:
+		if c.Screensaver.ImageGlob == "" {
+			return fmt.Errorf("screensaver.image_glob is required in slideshow mode")
+		}
+		if _, err := filepath.Match(c.Screensaver.ImageGlob, ""); err != nil {
+			return fmt.Errorf("invalid screensaver.image_glob %q: %v", c.Screensaver.ImageGlob, err)
+		}
+	default:
+		return fmt.Errorf("screensaver.mode must be \"video\", \"slideshow\" or \"off\", got %q", c.Screensaver.Mode)
+	}
+	return nil
+}
+
+// ValidateMQTT checks the MQTT section when there is one. The topics embed
+// the device ID, so it has to be set too.
+func (c *Config) ValidateMQTT() error {
+	if c.MQTT == nil {
+		return nil
+	}
+	if c.MQTT.Broker == "" {
+		return fmt.Errorf("mqtt.broker is required when the mqtt section is present")
+	}
+	if c.DeviceID == "" {
+		return fmt.Errorf("device_id (LIFT_DEVICE_ID) is required for MQTT topics")
+	}
+	if c.MQTT.QOS > 2 {
+		return fmt.Errorf("mqtt.qos must be 0, 1 or 2, got %d", c.MQTT.QOS)
+	}
+	return nil
+}
+
+// ValidateAWSIoT checks the aws_iot section, if there is one
+func (c *Config) ValidateAWSIoT() error {
+	a := c.AWSIoT
+	if a == nil {
+		return nil
+	}
+	if a.Endpoint == "" {
+		return fmt.Errorf("aws_iot.endpoint is required when the aws_iot section is present")
+	}
+	if a.CertFile == "" || a.KeyFile == "" {
+		return fmt.Errorf("aws_iot.cert_file and aws_iot.key_file are required for mutual TLS")
+	}
+	if c.DeviceID == "" {
+		return fmt.Errorf("device_id (LIFT_DEVICE_ID) is required for AWS IoT topics")
+	}
+	return nil
+}
+
+// ReaderPorts returns every configured serial port lift_learn should read
+// tags from, or nil if the reader should be auto-detected
+func (c *Config) ReaderPorts() []string {
+	if len(c.Screens) > 0 {
+		ports := make([]string, len(c.Screens))
+		for i, s := range c.Screens {
+			ports[i] = s.SerialPort
+		}
+		return ports
+	}
+	if len(c.SerialPorts) > 0 {
+		return c.SerialPorts
+	}
+	if c.SerialPort != "" {
+		return []string{c.SerialPort}
+	}
+	return nil
+}
+
+// ScreenFor returns the screen settings for the index'th reader port. Ports
+// without a Screens entry get display index and the global idle video.
+func (c *Config) ScreenFor(port string, index int) ScreenConfig {
+	for _, s := range c.Screens {
+		if s.SerialPort == port {
+			if s.IdleVideoPath == "" {
+				s.IdleVideoPath = c.IdleVideoPath
+			}
+			return s
+		}
+	}
+	return ScreenConfig{SerialPort: port, DisplayId: index, IdleVideoPath: c.IdleVideoPath}
+}
+
+// TLSEnabled reports whether the upload server should serve HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+func setFromEnv(field *string, key string) {
+	if *field != "" {
+		return
+	}
+	if v := os.Getenv(key); v != "" {
+		*field = v
+	}
+}
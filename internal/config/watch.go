@@ -0,0 +1,147 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Writes to the config file closer together than this trigger one reload
+const reloadDebounce = 200 * time.Millisecond
+
+// A field compared on reload. Fields without copy only take effect after a
+// restart.
+type reloadField struct {
+	name  string
+	value func(c *Config) interface{}
+	copy  func(dst, src *Config)
+}
+
+// Webhook URLs aren't among them: each Thing carries its own webhookUrl in
+// its metadata, so they already change with every deployment. What the file
+// says about webhooks is how they are delivered; the retry count follows it,
+// while the worker pool is sized once at startup.
+var reloadFields = []reloadField{
+	{"tag_debounce_ms", func(c *Config) interface{} { return c.TagDebounceMs }, func(dst, src *Config) { dst.TagDebounceMs = src.TagDebounceMs }},
+	{"idle_timeout_seconds", func(c *Config) interface{} { return c.IdleTimeoutSeconds }, func(dst, src *Config) { dst.IdleTimeoutSeconds = src.IdleTimeoutSeconds }},
+	{"idle_video_path", func(c *Config) interface{} { return c.IdleVideoPath }, func(dst, src *Config) { dst.IdleVideoPath = src.IdleVideoPath }},
+	{"log_level", func(c *Config) interface{} { return c.LogLevel }, func(dst, src *Config) { dst.LogLevel = src.LogLevel }},
+	{"max_concurrent_downloads", func(c *Config) interface{} { return c.MaxConcurrentDownloads }, func(dst, src *Config) { dst.MaxConcurrentDownloads = src.MaxConcurrentDownloads }},
+	{"rate_limit_requests_per_minute", func(c *Config) interface{} { return c.RateLimitRequestsPerMinute }, func(dst, src *Config) { dst.RateLimitRequestsPerMinute = src.RateLimitRequestsPerMinute }},
+	{"max_webhook_retries", func(c *Config) interface{} { return c.MaxWebhookRetries }, func(dst, src *Config) { dst.MaxWebhookRetries = src.MaxWebhookRetries }},
+
+	{"http_port", func(c *Config) interface{} { return c.HTTPPort }, nil},
+	{"tls_cert_file", func(c *Config) interface{} { return c.TLSCertFile }, nil},
+	{"tls_key_file", func(c *Config) interface{} { return c.TLSKeyFile }, nil},
+	{"serial_port", func(c *Config) interface{} { return c.SerialPort }, nil},
+	{"serial_ports", func(c *Config) interface{} { return c.SerialPorts }, nil},
+	{"screens", func(c *Config) interface{} { return c.Screens }, nil},
+	{"control_addr", func(c *Config) interface{} { return c.ControlAddr }, nil},
+	{"max_webhook_workers", func(c *Config) interface{} { return c.MaxWebhookWorkers }, nil},
+	{"storage_path", func(c *Config) interface{} { return c.StoragePath }, nil},
+}
+
+// ConfigWatcher re-reads the config file whenever it changes and hands the
+// fields that can change while running to apply. Changes to fields that need
+// a restart are only logged; the running config keeps their old values.
+type ConfigWatcher struct {
+	path   string
+	logger *slog.Logger
+	apply  func(next *Config)
+
+	mu      sync.Mutex
+	current Config
+	file    Config // what the file held at the last reload
+}
+
+// NewConfigWatcher watches path, starting from the config the process is
+// running with. apply is called with a copy of current updated with every
+// reloadable field that changed in the file. Changes are detected against
+// the file rather than current, so values overridden by flags aren't
+// reported as edits.
+func NewConfigWatcher(path string, current *Config, logger *slog.Logger, apply func(next *Config)) *ConfigWatcher {
+	file := *current
+	if loaded, err := Load(path); err == nil {
+		file = *loaded
+	}
+	return &ConfigWatcher{path: path, logger: logger, apply: apply, current: *current, file: file}
+}
+
+// Run watches the file until ctx is cancelled. The directory is watched
+// rather than the file, so editors that replace the file are followed.
+func (w *ConfigWatcher) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %v", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(w.path)); err != nil {
+		return fmt.Errorf("failed to watch %s: %v", w.path, err)
+	}
+
+	timer := time.AfterFunc(time.Hour, w.reload)
+	timer.Stop()
+	defer timer.Stop()
+
+	target := filepath.Clean(w.path)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == target && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				timer.Reset(reloadDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.logger.Warn("config watcher error", "err", err)
+		}
+	}
+}
+
+func (w *ConfigWatcher) reload() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next, err := Load(w.path)
+	if err != nil {
+		w.logger.Error("failed to reload config, keeping the running one", "err", err)
+		return
+	}
+
+	merged := w.current
+	var changed, restart []string
+	for _, f := range reloadFields {
+		if reflect.DeepEqual(f.value(&w.file), f.value(next)) {
+			continue
+		}
+		if f.copy == nil {
+			restart = append(restart, f.name)
+			continue
+		}
+		f.copy(&merged, next)
+		changed = append(changed, f.name)
+	}
+	w.file = *next
+	if len(restart) > 0 {
+		w.logger.Warn("config changes need a restart to take effect", "fields", restart)
+	}
+	if len(changed) == 0 {
+		return
+	}
+	w.logger.Info("config reloaded", "changed", changed)
+	w.current = merged
+	applied := merged
+	w.apply(&applied)
+}
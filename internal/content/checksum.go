@@ -0,0 +1,20 @@
+package content
+
+import (
+	"strings"
+
+	"lift_learn/internal/apperr"
+)
+
+// VerifyChecksum compares a downloaded file's hex SHA-256 digest against the
+// checksum its Thing was pushed with, ignoring case. An empty expected
+// checksum skips verification for older payloads.
+func VerifyChecksum(expected, actual string) error {
+	if expected == "" {
+		return nil
+	}
+	if !strings.EqualFold(expected, actual) {
+		return &apperr.ChecksumError{Expected: expected, Actual: actual}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package content
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"lift_learn/internal/apperr"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("lift and learn"))
+	digest := hex.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{"matching digest", digest, false},
+		{"uppercase expected", strings.ToUpper(digest), false},
+		{"mixed case expected", strings.ToUpper(digest[:32]) + digest[32:], false},
+		{"mismatch", hex.EncodeToString(other[:]), true},
+		{"truncated", digest[:63], true},
+		{"empty expected skips verification", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyChecksum(tt.expected, digest)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("VerifyChecksum: %v", err)
+				}
+				return
+			}
+			var checksumErr *apperr.ChecksumError
+			if !errors.As(err, &checksumErr) {
+				t.Fatalf("got %v, want a *apperr.ChecksumError", err)
+			}
+			if checksumErr.Expected != tt.expected || checksumErr.Actual != digest {
+				t.Errorf("error reports expected %s, actual %s", checksumErr.Expected, checksumErr.Actual)
+			}
+			if apperr.Kind(err) != apperr.KindChecksum {
+				t.Errorf("kind = %s, want %s", apperr.Kind(err), apperr.KindChecksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package content
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"lift_learn/internal/fsys"
+)
+
+// FixContentDirectory rewrites the mediaUrl of every metadata file under
+// storagePath to point at the locally downloaded video. Hidden directories
+// (staging, the content store, snapshots) are left alone.
+func FixContentDirectory(storagePath string, logger *slog.Logger) error {
+	return FixContentDirectoryFS(fsys.OS{}, storagePath, logger)
+}
+
+// FixContentDirectoryFS is FixContentDirectory on the given filesystem
+func FixContentDirectoryFS(fs fsys.FileSystem, storagePath string, logger *slog.Logger) error {
+	logger.Info("starting JSON correction", "dir", storagePath)
+
+	err := fs.Walk(storagePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to access path %s: %v", path, err)
+		}
+
+		if info.IsDir() {
+			if path != storagePath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filepath.Ext(path) == ".json" {
+			logger.Debug("processing JSON file", "path", path)
+			if err := fixJsonFile(fs, path); err != nil {
+				logger.Error("failed to fix JSON file", "path", path, "err", err)
+			} else {
+				logger.Info("updated JSON file", "path", path)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("error traversing content directory: %v", err)
+	}
+	return nil
+}
+
+func fixJsonFile(fs fsys.FileSystem, filePath string) error {
+	// Read the JSON file
+	data, err := fs.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read JSON file: %v", err)
+	}
+
+	var thing Thing
+	if err := json.Unmarshal(data, &thing); err != nil {
+		return fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	// Update the `mediaUrl` to point to the local file
+	dir := filepath.Dir(filePath)
+	thing.MediaUrl = filepath.Join(dir, thing.MediaFileName())
+
+	// Write the updated JSON back to the file. Replacing it rather than
+	// writing in place keeps snapshot hard links pointing at the old copy.
+	updatedData, err := json.MarshalIndent(thing, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal updated JSON: %v", err)
+	}
+
+	if err := fs.WriteFile(filePath, updatedData, 0644); err != nil {
+		return fmt.Errorf("failed to write updated JSON file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package content
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"lift_learn/internal/fsys"
+)
+
+func TestFixContentDirectory(t *testing.T) {
+	mem := fsys.NewMem()
+	root := filepath.FromSlash("/content")
+	project := filepath.Join(root, "project-1")
+	put := func(path string, thing Thing) {
+		t.Helper()
+		if err := WriteThing(mem, path, thing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put(filepath.Join(project, "a.json"), Thing{ProductId: "a", MediaUrl: "https://cdn.example.com/a.mp4", NfcTagId: "04A1"})
+	put(filepath.Join(project, "b.json"), Thing{ProductId: "b", MediaUrl: "https://cdn.example.com/b", MediaType: MediaImage})
+	put(filepath.Join(project, "c.json"), Thing{ProductId: "c", MediaUrl: "https://cdn.example.com/c", Extension: ".webm"})
+	hidden := filepath.Join(root, ".staging", "d.json")
+	put(hidden, Thing{ProductId: "d", MediaUrl: "https://cdn.example.com/d.mp4"})
+	broken := filepath.Join(project, "broken.json")
+	if err := mem.WriteFile(broken, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := FixContentDirectoryFS(mem, root, logger); err != nil {
+		t.Fatalf("FixContentDirectoryFS: %v", err)
+	}
+
+	for path, want := range map[string]string{
+		filepath.Join(project, "a.json"): filepath.Join(project, "a.mp4"),
+		filepath.Join(project, "b.json"): filepath.Join(project, "b.jpg"),
+		filepath.Join(project, "c.json"): filepath.Join(project, "c.webm"),
+		hidden:                           "https://cdn.example.com/d.mp4",
+	} {
+		thing, err := ReadThingFS(mem, path)
+		if err != nil {
+			t.Fatalf("ReadThingFS(%s): %v", path, err)
+		}
+		if thing.MediaUrl != want {
+			t.Errorf("%s: mediaUrl = %q, want %q", path, thing.MediaUrl, want)
+		}
+	}
+
+	// The rest of the Thing is kept
+	if thing, _ := ReadThingFS(mem, filepath.Join(project, "a.json")); thing.NfcTagId != "04A1" {
+		t.Errorf("nfcTagId = %q after fixing, want 04A1", thing.NfcTagId)
+	}
+	// A file that can't be parsed is left as it was
+	if data, _ := mem.ReadFile(broken); string(data) != "{not json" {
+		t.Errorf("broken file rewritten to %q", data)
+	}
+}
+
+func TestFixContentDirectoryMissing(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := FixContentDirectoryFS(fsys.NewMem(), filepath.FromSlash("/missing"), logger); err == nil {
+		t.Error("expected an error for a missing storage path")
+	}
+}
+
+func TestFixJsonFileErrors(t *testing.T) {
+	mem := fsys.NewMem()
+	if err := fixJsonFile(mem, filepath.FromSlash("/content/missing.json")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	path := filepath.FromSlash("/content/broken.json")
+	if err := mem.WriteFile(path, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fixJsonFile(mem, path); err == nil {
+		t.Error("expected an error for a file that isn't a Thing")
+	}
+}
@@ -0,0 +1,98 @@
+package content
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"lift_learn/internal/fsys"
+)
+
+// GarbageCollect deletes media files under storagePath that no metadata
+// file refers to, e.g. the video a redeployment replaced with a different
+// format. A metadata file refers to the media named after its Thing next to
+// it, and to the local file its mediaUrl was rewritten to. Hidden
+// directories (staging, the content store, snapshots) are never touched,
+// and neither is anything at or under a keep path, such as a staging
+// directory configured elsewhere or an idle video. Returns the deleted
+// paths and the bytes they took up.
+func GarbageCollect(storagePath string, keep ...string) (deletedFiles []string, freedBytes int64, err error) {
+	return GarbageCollectFS(fsys.OS{}, storagePath, keep...)
+}
+
+// GarbageCollectFS is GarbageCollect on the given filesystem
+func GarbageCollectFS(fs fsys.FileSystem, storagePath string, keep ...string) (deletedFiles []string, freedBytes int64, err error) {
+	referenced := make(map[string]bool)
+	var media []string
+
+	err = fs.Walk(storagePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to access path %s: %v", path, err)
+		}
+		if info.IsDir() {
+			if path != storagePath && (strings.HasPrefix(info.Name(), ".") || underAny(path, keep)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ext := filepath.Ext(path)
+		if ext == ".json" {
+			thing, err := ReadThingFS(fs, path)
+			if err != nil {
+				return nil // not a metadata file
+			}
+			referenced[absPath(filepath.Join(filepath.Dir(path), thing.MediaFileName()))] = true
+			if thing.MediaUrl != "" && !strings.Contains(thing.MediaUrl, "://") {
+				referenced[absPath(thing.MediaUrl)] = true
+			}
+			return nil
+		}
+		if _, ok := MediaTypeForExtension(ext); ok {
+			media = append(media, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("error traversing content directory: %v", err)
+	}
+
+	for _, path := range media {
+		if referenced[absPath(path)] || underAny(path, keep) {
+			continue
+		}
+		info, err := fs.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := fs.Remove(path); err != nil {
+			return deletedFiles, freedBytes, fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+		deletedFiles = append(deletedFiles, path)
+		freedBytes += info.Size()
+	}
+	return deletedFiles, freedBytes, nil
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// underAny reports whether path is one of roots or inside one of them
+func underAny(path string, roots []string) bool {
+	path = absPath(path)
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		root = absPath(root)
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package content
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"lift_learn/internal/fsys"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeThing(t *testing.T, path string, thing Thing) {
+	t.Helper()
+	data, err := json.Marshal(thing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, string(data))
+}
+
+func TestGarbageCollect(t *testing.T) {
+	root := t.TempDir()
+	project := filepath.Join(root, "project-1")
+	staging := filepath.Join(root, "staging")
+	store := filepath.Join(root, "store")
+	idle := filepath.Join(root, "idle.mp4")
+	shared := filepath.Join(root, "shared", "promo.webm")
+
+	// Referenced by name, by extension and by a rewritten mediaUrl
+	writeThing(t, filepath.Join(project, "a.json"), Thing{ProductId: "a"})
+	writeFile(t, filepath.Join(project, "a.mp4"), "aaaa")
+	writeThing(t, filepath.Join(project, "b.json"), Thing{ProductId: "b", Extension: ".webm"})
+	writeFile(t, filepath.Join(project, "b.webm"), "bb")
+	writeThing(t, filepath.Join(project, "c.json"), Thing{ProductId: "c", MediaUrl: shared})
+	writeFile(t, shared, "cc")
+
+	// Orphans: a format left behind by a redeployment, and media with no Thing
+	writeFile(t, filepath.Join(project, "b.mp4"), "12345")
+	writeFile(t, filepath.Join(project, "gone.mp4"), "123")
+
+	// Never collected
+	writeFile(t, filepath.Join(project, "notes.txt"), "not media")
+	writeFile(t, filepath.Join(project, ".staging", "x.mp4"), "hidden")
+	writeFile(t, filepath.Join(staging, "y.mp4"), "staged")
+	writeFile(t, filepath.Join(store, "ab", "abcdef.mp4"), "stored")
+	writeFile(t, idle, "idle")
+
+	deleted, freed, err := GarbageCollect(root, staging, store, idle, "")
+	if err != nil {
+		t.Fatalf("GarbageCollect: %v", err)
+	}
+
+	sort.Strings(deleted)
+	want := []string{filepath.Join(project, "b.mp4"), filepath.Join(project, "gone.mp4")}
+	if len(deleted) != len(want) || deleted[0] != want[0] || deleted[1] != want[1] {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+	if freed != 8 {
+		t.Errorf("freed %d bytes, want 8", freed)
+	}
+	for _, path := range want {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", path)
+		}
+	}
+
+	for _, path := range []string{
+		filepath.Join(project, "a.mp4"),
+		filepath.Join(project, "b.webm"),
+		shared,
+		filepath.Join(project, "notes.txt"),
+		filepath.Join(project, ".staging", "x.mp4"),
+		filepath.Join(staging, "y.mp4"),
+		filepath.Join(store, "ab", "abcdef.mp4"),
+		idle,
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+}
+
+func TestGarbageCollectNothingToDo(t *testing.T) {
+	root := t.TempDir()
+	writeThing(t, filepath.Join(root, "p", "a.json"), Thing{ProductId: "a"})
+	writeFile(t, filepath.Join(root, "p", "a.mp4"), "aaaa")
+
+	deleted, freed, err := GarbageCollect(root)
+	if err != nil {
+		t.Fatalf("GarbageCollect: %v", err)
+	}
+	if len(deleted) != 0 || freed != 0 {
+		t.Errorf("deleted %v (%d bytes), want nothing", deleted, freed)
+	}
+}
+
+func TestGarbageCollectMissingRoot(t *testing.T) {
+	if _, _, err := GarbageCollect(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing storage path")
+	}
+}
+
+func TestGarbageCollectFS(t *testing.T) {
+	mem := fsys.NewMem()
+	root := filepath.FromSlash("/content")
+	write := func(path, data string) {
+		t.Helper()
+		if err := mem.WriteFile(filepath.Join(root, filepath.FromSlash(path)), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteThing(mem, filepath.Join(root, "p", "a.json"), Thing{ProductId: "a", Extension: ".webm"}); err != nil {
+		t.Fatal(err)
+	}
+	write("p/a.webm", "keep")
+	write("p/a.mp4", "orphan")
+	write("idle/idle.mp4", "idle")
+	write(".store/ab/abcd.mp4", "stored")
+
+	deleted, freed, err := GarbageCollectFS(mem, root, filepath.Join(root, "idle"))
+	if err != nil {
+		t.Fatalf("GarbageCollectFS: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != filepath.Join(root, "p", "a.mp4") || freed != 6 {
+		t.Errorf("deleted %v (%d bytes), want only p/a.mp4 (6 bytes)", deleted, freed)
+	}
+	for _, path := range []string{"p/a.webm", "p/a.json", "idle/idle.mp4", ".store/ab/abcd.mp4"} {
+		if _, err := mem.Stat(filepath.Join(root, filepath.FromSlash(path))); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+	if _, err := mem.Stat(filepath.Join(root, "p", "a.mp4")); !os.IsNotExist(err) {
+		t.Errorf("p/a.mp4 still exists: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package content
+
+import (
+	"mime"
+	"sort"
+	"strings"
+)
+
+// Kinds of media a Thing can carry
+const (
+	MediaVideo = "video"
+	MediaImage = "image"
+	MediaAudio = "audio"
+)
+
+var mediaExtensions = map[string]string{
+	MediaVideo: ".mp4",
+	MediaImage: ".jpg",
+	MediaAudio: ".mp3",
+}
+
+// MediaExtension is the file extension media of the given type is stored
+// under. Unknown or empty types are treated as video.
+func MediaExtension(mediaType string) string {
+	if ext, ok := mediaExtensions[mediaType]; ok {
+		return ext
+	}
+	return mediaExtensions[MediaVideo]
+}
+
+// Extensions for common Content-Types, preferred over whatever the system
+// MIME table lists first (which can be ".m4v" for video/mp4, or nothing)
+var contentTypeExtensions = map[string]string{
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"video/quicktime": ".mov",
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"audio/mpeg":      ".mp3",
+}
+
+// SupportedContentTypes lists the Content-Types media can be served as, in
+// sorted order
+func SupportedContentTypes() []string {
+	types := make([]string, 0, len(contentTypeExtensions))
+	for contentType := range contentTypeExtensions {
+		types = append(types, contentType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// MediaTypeForExtension maps a stored file's extension back to its media type
+func MediaTypeForExtension(ext string) (string, bool) {
+	for mediaType, e := range mediaExtensions {
+		if strings.EqualFold(e, ext) {
+			return mediaType, true
+		}
+	}
+	for contentType, e := range contentTypeExtensions {
+		if strings.EqualFold(e, ext) {
+			return MediaTypeForContentType(contentType), true
+		}
+	}
+	contentType := mime.TypeByExtension(ext)
+	for _, prefix := range []string{"video/", "image/", "audio/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return MediaTypeForContentType(contentType), true
+		}
+	}
+	return "", false
+}
+
+// ExtensionForContentType is the file extension for media served with
+// contentType, or "" if it isn't recognised
+func ExtensionForContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := contentTypeExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// MediaTypeForContentType guesses the media type from an HTTP Content-Type,
+// defaulting to video
+func MediaTypeForContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return MediaVideo
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return MediaImage
+	case strings.HasPrefix(mediaType, "audio/"):
+		return MediaAudio
+	default:
+		return MediaVideo
+	}
+}
+
+// MediaFileName is the name the Thing's media is stored under in its project
+func (t Thing) MediaFileName() string {
+	if t.Extension != "" {
+		return t.ProductId + t.Extension
+	}
+	return t.ProductId + MediaExtension(t.MediaType)
+}
@@ -0,0 +1,31 @@
+package content
+
+import "testing"
+
+func TestExtensionForContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"video/mp4", ".mp4"},
+		{"video/webm", ".webm"},
+		{"video/quicktime", ".mov"},
+		{"image/jpeg", ".jpg"},
+		{"image/png", ".png"},
+		{"audio/mpeg", ".mp3"},
+		{`video/mp4; codecs="avc1.42E01E, mp4a.40.2"`, ".mp4"},
+		{"video/webm;codecs=vp9", ".webm"},
+		{"Video/MP4", ".mp4"},
+		{"image/jpeg; charset=binary", ".jpg"},
+		{"application/x-lift-learn-unknown", ""},
+		{"", ""},
+		{"not a content type;;", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := ExtensionForContentType(tt.contentType); got != tt.want {
+				t.Errorf("ExtensionForContentType(%q) = %q, want %q", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package content
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"lift_learn/internal/fsys"
+)
+
+// ProjectContent lists the Things stored under one project directory
+type ProjectContent struct {
+	ProjectId string        `json:"projectId"`
+	Things    []ThingStatus `json:"things"`
+}
+
+// ThingStatus describes what is actually on disk for one product
+type ThingStatus struct {
+	ProductId       string `json:"productId"`
+	ProductName     string `json:"productName"`
+	NfcTagId        string `json:"nfcTagId"`
+	MediaType       string `json:"mediaType,omitempty"`
+	LocalVideoPath  string `json:"localVideoPath"`
+	MetadataPath    string `json:"metadataPath,omitempty"`
+	FileSizeBytes   int64  `json:"fileSizeBytes"`
+	VideoPresent    bool   `json:"videoPresent"`
+	MetadataPresent bool   `json:"metadataPresent"`
+}
+
+// ScanDirectory walks storagePath and reports every project's Things by
+// pairing each {productId}.json with its media file ({productId}.mp4, .jpg or
+// .mp3). Media without metadata is listed too. Hidden directories are skipped.
+func ScanDirectory(storagePath string) ([]ProjectContent, error) {
+	return ScanDirectoryFS(fsys.OS{}, storagePath)
+}
+
+// ScanDirectoryFS is ScanDirectory on the given filesystem
+func ScanDirectoryFS(fs fsys.FileSystem, storagePath string) ([]ProjectContent, error) {
+	projects := make(map[string]map[string]*ThingStatus)
+
+	thingFor := func(projectId, productId string) *ThingStatus {
+		things, ok := projects[projectId]
+		if !ok {
+			things = make(map[string]*ThingStatus)
+			projects[projectId] = things
+		}
+		t, ok := things[productId]
+		if !ok {
+			t = &ThingStatus{ProductId: productId}
+			things[productId] = t
+		}
+		return t
+	}
+
+	err := fs.Walk(storagePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to access path %s: %v", path, err)
+		}
+		if info.IsDir() {
+			if path != storagePath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		projectId, err := filepath.Rel(storagePath, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if projectId == "." {
+			projectId = ""
+		}
+
+		ext := filepath.Ext(path)
+		productId := strings.TrimSuffix(info.Name(), ext)
+		if ext == ".json" {
+			thing, err := ReadThingFS(fs, path)
+			if err != nil {
+				return nil // not a metadata file
+			}
+			t := thingFor(projectId, thing.ProductId)
+			t.ProductName = thing.ProductName
+			t.NfcTagId = thing.NfcTagId
+			t.MetadataPresent = true
+			t.MetadataPath = path
+			if t.LocalVideoPath == "" {
+				t.MediaType = thing.MediaType
+				t.LocalVideoPath = filepath.Join(filepath.Dir(path), thing.MediaFileName())
+			}
+			return nil
+		}
+		if mediaType, ok := MediaTypeForExtension(ext); ok {
+			t := thingFor(projectId, productId)
+			t.MediaType = mediaType
+			t.LocalVideoPath = path
+			t.FileSizeBytes = info.Size()
+			t.VideoPresent = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ProjectContent, 0, len(projects))
+	for projectId, things := range projects {
+		pc := ProjectContent{ProjectId: projectId}
+		for _, t := range things {
+			pc.Things = append(pc.Things, *t)
+		}
+		sort.Slice(pc.Things, func(i, j int) bool { return pc.Things[i].ProductId < pc.Things[j].ProductId })
+		result = append(result, pc)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ProjectId < result[j].ProjectId })
+	return result, nil
+}
+
+// ReadThing parses a metadata file saved by the upload server
+func ReadThing(path string) (Thing, error) {
+	return ReadThingFS(fsys.OS{}, path)
+}
+
+// ReadThingFS is ReadThing on the given filesystem
+func ReadThingFS(fs fsys.FileSystem, path string) (Thing, error) {
+	var thing Thing
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return thing, err
+	}
+	if err := json.Unmarshal(data, &thing); err != nil {
+		return thing, err
+	}
+	if thing.ProductId == "" {
+		return thing, fmt.Errorf("%s has no productId", path)
+	}
+	return thing, nil
+}
+
+// WriteThing saves thing as the metadata file at path. fs replaces the file
+// rather than writing in place, so a crash never leaves a truncated file
+// that looks complete.
+func WriteThing(fs fsys.FileSystem, path string, thing Thing) error {
+	data, err := json.Marshal(thing)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Checksums returns the lowercase checksum of every Thing whose metadata is
+// stored under storagePath, skipping hidden directories
+func Checksums(storagePath string) (map[string]bool, error) {
+	sums := make(map[string]bool)
+	err := filepath.Walk(storagePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to access path %s: %v", path, err)
+		}
+		if info.IsDir() {
+			if path != storagePath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".json" {
+			return nil
+		}
+		thing, err := ReadThing(path)
+		if err != nil || thing.Checksum == "" {
+			return nil
+		}
+		sums[strings.ToLower(thing.Checksum)] = true
+		return nil
+	})
+	return sums, err
+}
@@ -0,0 +1,78 @@
+package content
+
+import (
+	"path/filepath"
+	"testing"
+
+	"lift_learn/internal/fsys"
+)
+
+func TestWriteThingRoundTrip(t *testing.T) {
+	mem := fsys.NewMem()
+	path := filepath.FromSlash("/content/p/a.json")
+	want := Thing{ProductId: "a", NfcTagId: "04A1", ProductName: "Drill", Checksum: "abc", PlaybackOptions: &PlaybackOptions{LoopCount: 2}}
+	if err := WriteThing(mem, path, want); err != nil {
+		t.Fatalf("WriteThing: %v", err)
+	}
+	got, err := ReadThingFS(mem, path)
+	if err != nil {
+		t.Fatalf("ReadThingFS: %v", err)
+	}
+	if got.ProductId != want.ProductId || got.NfcTagId != want.NfcTagId || got.ProductName != want.ProductName ||
+		got.Checksum != want.Checksum || got.Playback().LoopCount != 2 {
+		t.Errorf("read back %+v, want %+v", got, want)
+	}
+}
+
+func TestReadThingFSNoProductId(t *testing.T) {
+	mem := fsys.NewMem()
+	path := filepath.FromSlash("/content/p/a.json")
+	if err := mem.WriteFile(path, []byte(`{"mediaUrl":"x"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadThingFS(mem, path); err == nil {
+		t.Error("expected an error for metadata without a productId")
+	}
+}
+
+func TestScanDirectoryFS(t *testing.T) {
+	mem := fsys.NewMem()
+	root := filepath.FromSlash("/content")
+	write := func(path, data string) {
+		t.Helper()
+		if err := mem.WriteFile(filepath.Join(root, filepath.FromSlash(path)), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteThing(mem, filepath.Join(root, "p1", "a.json"), Thing{ProductId: "a", NfcTagId: "04A1"}); err != nil {
+		t.Fatal(err)
+	}
+	write("p1/a.mp4", "1234")
+	if err := WriteThing(mem, filepath.Join(root, "p1", "b.json"), Thing{ProductId: "b", MediaType: MediaAudio}); err != nil {
+		t.Fatal(err)
+	}
+	write("p2/c.jpg", "12")
+	write(".snapshots/p1/a.mp4", "old")
+
+	projects, err := ScanDirectoryFS(mem, root)
+	if err != nil {
+		t.Fatalf("ScanDirectoryFS: %v", err)
+	}
+	if len(projects) != 2 || projects[0].ProjectId != "p1" || projects[1].ProjectId != "p2" {
+		t.Fatalf("projects = %+v, want p1 and p2", projects)
+	}
+
+	things := projects[0].Things
+	if len(things) != 2 {
+		t.Fatalf("p1 has %d Things, want 2", len(things))
+	}
+	if a := things[0]; !a.VideoPresent || !a.MetadataPresent || a.FileSizeBytes != 4 || a.NfcTagId != "04A1" {
+		t.Errorf("a = %+v, want media and metadata present", a)
+	}
+	if b := things[1]; b.VideoPresent || !b.MetadataPresent || b.LocalVideoPath != filepath.Join(root, "p1", "b.mp3") {
+		t.Errorf("b = %+v, want metadata only, expecting b.mp3", b)
+	}
+	if c := projects[1].Things; len(c) != 1 || !c[0].VideoPresent || c[0].MetadataPresent || c[0].MediaType != MediaImage {
+		t.Errorf("p2 = %+v, want an image without metadata", c)
+	}
+}
@@ -0,0 +1,116 @@
+package content
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PlaySchedule limits a Thing's media to windows of the week, e.g. a
+// promotion that only runs during business hours. A schedule without
+// windows doesn't restrict playback.
+type PlaySchedule struct {
+	// IANA name such as "America/Toronto"; empty means the device's local time
+	TimeZone     string        `json:"timeZone,omitempty"`
+	DailyWindows []DailyWindow `json:"dailyWindows,omitempty"`
+}
+
+// DailyWindow is a span of the day, on the given weekdays (0 is Sunday) or
+// every day when there are none. A window ending before it starts runs past
+// midnight into the next day, and an end of 24:00 is the end of the day.
+type DailyWindow struct {
+	Weekday []time.Weekday `json:"weekday,omitempty"`
+	StartHH int            `json:"startHH"`
+	StartMM int            `json:"startMM"`
+	EndHH   int            `json:"endHH"`
+	EndMM   int            `json:"endMM"`
+}
+
+// Validate reports the first problem with the schedule's time zone or windows
+func (s *PlaySchedule) Validate() error {
+	if _, err := s.location(); err != nil {
+		return err
+	}
+	for i, w := range s.DailyWindows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("dailyWindows[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (w DailyWindow) validate() error {
+	for _, d := range w.Weekday {
+		if d < time.Sunday || d > time.Saturday {
+			return fmt.Errorf("weekday %d is not 0 (Sunday) to 6 (Saturday)", d)
+		}
+	}
+	if w.StartHH < 0 || w.StartHH > 23 || w.StartMM < 0 || w.StartMM > 59 {
+		return fmt.Errorf("start %02d:%02d is not a time of day", w.StartHH, w.StartMM)
+	}
+	if w.EndHH < 0 || w.EndHH > 24 || w.EndMM < 0 || w.EndMM > 59 || (w.EndHH == 24 && w.EndMM != 0) {
+		return fmt.Errorf("end %02d:%02d is not a time of day", w.EndHH, w.EndMM)
+	}
+	if w.start() == w.end() {
+		return errors.New("window starts and ends at the same time")
+	}
+	return nil
+}
+
+// LoadLocation treats an empty name as UTC rather than local time
+func (s *PlaySchedule) location() (*time.Location, error) {
+	if s.TimeZone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeZone %q: %v", s.TimeZone, err)
+	}
+	return loc, nil
+}
+
+// Minutes since midnight
+func (w DailyWindow) start() int { return w.StartHH*60 + w.StartMM }
+func (w DailyWindow) end() int   { return w.EndHH*60 + w.EndMM }
+
+func (w DailyWindow) on(day time.Weekday) bool {
+	if len(w.Weekday) == 0 {
+		return true
+	}
+	for _, d := range w.Weekday {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether now falls within one of the schedule's windows, in
+// its time zone. A nil schedule, or one without windows, allows any time.
+func (s *PlaySchedule) Allows(now time.Time) (bool, error) {
+	if s == nil || len(s.DailyWindows) == 0 {
+		return true, nil
+	}
+	loc, err := s.location()
+	if err != nil {
+		return false, err
+	}
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range s.DailyWindows {
+		if w.start() < w.end() {
+			if w.on(today) && minute >= w.start() && minute < w.end() {
+				return true, nil
+			}
+			continue
+		}
+		// Past midnight: the evening part on its own days, and the early
+		// hours of the day after
+		if (w.on(today) && minute >= w.start()) || (w.on(yesterday) && minute < w.end()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
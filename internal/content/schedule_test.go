@@ -0,0 +1,109 @@
+package content
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlayScheduleAllows(t *testing.T) {
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	business := DailyWindow{Weekday: weekdays, StartHH: 9, EndHH: 17}
+	// Friday and Saturday nights, into the early hours of the next day
+	lateNight := DailyWindow{Weekday: []time.Weekday{time.Friday, time.Saturday}, StartHH: 22, EndHH: 2}
+	evening := DailyWindow{StartHH: 18, StartMM: 30, EndHH: 24}
+
+	// 2024-06-07 is a Friday
+	at := func(day, hh, mm int) time.Time {
+		return time.Date(2024, time.June, day, hh, mm, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		schedule *PlaySchedule
+		now      time.Time
+		want     bool
+	}{
+		{"nil schedule", nil, at(7, 3, 0), true},
+		{"no windows", &PlaySchedule{}, at(7, 3, 0), true},
+		{"inside on a weekday", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{business}}, at(7, 9, 0), true},
+		{"end is exclusive", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{business}}, at(7, 17, 0), false},
+		{"before start", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{business}}, at(7, 8, 59), false},
+		{"wrong weekday", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{business}}, at(8, 12, 0), false},
+		{"past midnight, evening part", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{lateNight}}, at(7, 23, 0), true},
+		{"past midnight, early hours after Friday", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{lateNight}}, at(8, 1, 59), true},
+		{"past midnight, early hours after Saturday", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{lateNight}}, at(9, 1, 0), true},
+		{"past midnight, after it ends", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{lateNight}}, at(8, 2, 0), false},
+		{"past midnight, early hours after Thursday", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{lateNight}}, at(7, 1, 0), false},
+		{"past midnight, evening on Sunday", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{lateNight}}, at(9, 23, 0), false},
+		{"24:00 end, last minute", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{evening}}, at(7, 23, 59), true},
+		{"24:00 end, midnight", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{evening}}, at(8, 0, 0), false},
+		{"any window", &PlaySchedule{TimeZone: "UTC", DailyWindows: []DailyWindow{business, evening}}, at(8, 19, 0), true},
+		// 13:00 UTC is 09:00 in Toronto (EDT)
+		{"time zone, inside", &PlaySchedule{TimeZone: "America/Toronto", DailyWindows: []DailyWindow{business}}, at(7, 13, 0), true},
+		{"time zone, outside", &PlaySchedule{TimeZone: "America/Toronto", DailyWindows: []DailyWindow{business}}, at(7, 12, 59), false},
+		// 02:00 UTC Saturday is still 22:00 Friday in Toronto
+		{"time zone shifts the weekday", &PlaySchedule{TimeZone: "America/Toronto", DailyWindows: []DailyWindow{lateNight}}, at(8, 2, 30), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.schedule.Allows(tt.now)
+			if err != nil {
+				t.Fatalf("Allows: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Allows(%s) = %v, want %v", tt.now.Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlayScheduleAllowsBadTimeZone(t *testing.T) {
+	s := &PlaySchedule{TimeZone: "Mars/Olympus_Mons", DailyWindows: []DailyWindow{{StartHH: 9, EndHH: 17}}}
+	if _, err := s.Allows(time.Now()); err == nil {
+		t.Error("expected an error for an unknown time zone")
+	}
+}
+
+func TestPlayScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   DailyWindow
+		timeZone string
+		wantErr  string
+	}{
+		{"valid", DailyWindow{StartHH: 9, EndHH: 17}, "", ""},
+		{"valid past midnight", DailyWindow{StartHH: 22, EndHH: 2}, "", ""},
+		{"valid 24:00 end", DailyWindow{StartHH: 18, EndHH: 24}, "", ""},
+		{"valid time zone", DailyWindow{StartHH: 9, EndHH: 17}, "America/Toronto", ""},
+		{"unknown time zone", DailyWindow{StartHH: 9, EndHH: 17}, "Mars/Olympus_Mons", "invalid timeZone"},
+		{"weekday too high", DailyWindow{Weekday: []time.Weekday{7}, StartHH: 9, EndHH: 17}, "", "weekday 7"},
+		{"negative weekday", DailyWindow{Weekday: []time.Weekday{-1}, StartHH: 9, EndHH: 17}, "", "weekday -1"},
+		{"start hour", DailyWindow{StartHH: 24, EndHH: 2}, "", "start 24:00"},
+		{"start minute", DailyWindow{StartHH: 9, StartMM: 60, EndHH: 17}, "", "start 09:60"},
+		{"end hour", DailyWindow{StartHH: 9, EndHH: 25}, "", "end 25:00"},
+		{"end past 24:00", DailyWindow{StartHH: 9, EndHH: 24, EndMM: 30}, "", "end 24:30"},
+		{"empty window", DailyWindow{StartHH: 9, StartMM: 30, EndHH: 9, EndMM: 30}, "", "same time"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &PlaySchedule{TimeZone: tt.timeZone, DailyWindows: []DailyWindow{{StartHH: 0, EndHH: 1}, tt.window}}
+			err := s.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %q does not contain %q", err, tt.wantErr)
+			}
+			if tt.timeZone == "" && !strings.HasPrefix(err.Error(), "dailyWindows[1]: ") {
+				t.Errorf("error %q does not name the window", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package content
+
+import (
+	"strings"
+	"time"
+)
+
+// Thing structure within UploadRequest, also saved as {productId}.json next to its media
+type Thing struct {
+	ProductId   string `json:"productId"`
+	MediaUrl    string `json:"mediaUrl"`
+	NfcTagId    string `json:"nfcTagId"`
+	ProductName string `json:"productName"`
+	// Product name per BCP-47 locale ("en-CA", "fr-CA"), for devices with a
+	// locale configured
+	Names map[string]string `json:"names,omitempty"`
+	// Project the Thing is stored under; the upload request's projectId when empty
+	ProjectId string `json:"projectId,omitempty"`
+	// Shown over the video with the product name when the tag is scanned
+	Price           string `json:"price,omitempty"`
+	DescriptionText string `json:"descriptionText,omitempty"`
+	// "video", "image" or "audio"; empty means it is sniffed at download time
+	MediaType string `json:"mediaType,omitempty"`
+	// File extension of the stored media (".webm"), taken from the
+	// Content-Type it was downloaded with. Empty means the type's default.
+	Extension string `json:"extension,omitempty"`
+	Checksum  string `json:"checksum,omitempty"` // hex-encoded SHA-256 of the media file
+	// Deleted along with its tag mapping once this time has passed
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// POSTed to by lift_learn each time the Thing's tag is scanned
+	WebhookURL string `json:"webhookUrl,omitempty"`
+	// Set by the upload server to the deployment that delivered the Thing
+	DeploymentId string `json:"deploymentId,omitempty"`
+	// Flattened into the Thing's JSON; nil when none of its fields are given
+	*PlaybackOptions
+	// Also flattened; nil means the Thing plays whenever its tag is scanned
+	*PlaySchedule
+}
+
+// LocalizedName is the Thing's name for locale, matched ignoring case and
+// then by language alone ("fr" for "fr-CA"). ProductName is used when Names
+// has neither, or locale is empty.
+func (t Thing) LocalizedName(locale string) string {
+	if locale == "" {
+		return t.ProductName
+	}
+	lang, _, _ := strings.Cut(locale, "-")
+	for _, want := range []string{locale, lang} {
+		for key, name := range t.Names {
+			if name != "" && strings.EqualFold(key, want) {
+				return name
+			}
+		}
+	}
+	return t.ProductName
+}
+
+// PlaybackOptions tune how a Thing's video is played. Things without any
+// use DefaultPlaybackOptions.
+type PlaybackOptions struct {
+	LoopCount          int     `json:"loopCount,omitempty"` // 0 loops forever
+	MuteAudio          bool    `json:"muteAudio,omitempty"`
+	StartOffsetSeconds float64 `json:"startOffsetSeconds,omitempty"`
+	PlaybackSpeed      float64 `json:"playbackSpeed,omitempty"` // 0 means 1.0
+}
+
+// DefaultPlaybackOptions loop forever, muted, from the start at normal speed
+var DefaultPlaybackOptions = PlaybackOptions{MuteAudio: true, PlaybackSpeed: 1.0}
+
+// Playback returns the Thing's playback options, or the defaults if it has none
+func (t Thing) Playback() PlaybackOptions {
+	if t.PlaybackOptions == nil {
+		return DefaultPlaybackOptions
+	}
+	opts := *t.PlaybackOptions
+	if opts.PlaybackSpeed <= 0 {
+		opts.PlaybackSpeed = 1.0
+	}
+	return opts
+}
@@ -0,0 +1,63 @@
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"lift_learn/internal/content"
+)
+
+// MediaCheck is the dry-run result for one Thing's media URL
+type MediaCheck struct {
+	ProductId          string `json:"productId"`
+	MediaUrl           string `json:"mediaUrl"`
+	Reachable          bool   `json:"reachable"`
+	StatusCode         int    `json:"status_code,omitempty"`
+	ContentLengthBytes int64  `json:"content_length_bytes"`
+	ContentType        string `json:"content_type"`
+	Error              string `json:"error,omitempty"`
+}
+
+// DryRun sends a HEAD request to every Thing's media URL and reports what
+// came back, without downloading anything. Results are in the Things' order.
+func DryRun(ctx context.Context, client *http.Client, things []content.Thing) []MediaCheck {
+	results := make([]MediaCheck, len(things))
+
+	var wg sync.WaitGroup
+	for i, t := range things {
+		wg.Add(1)
+		go func(i int, t content.Thing) {
+			defer wg.Done()
+			results[i] = checkMedia(ctx, client, t)
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+func checkMedia(ctx context.Context, client *http.Client, t content.Thing) MediaCheck {
+	check := MediaCheck{ProductId: t.ProductId, MediaUrl: t.MediaUrl}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, t.MediaUrl, nil)
+	if err != nil {
+		check.Error = fmt.Sprintf("invalid media URL: %v", err)
+		return check
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	resp.Body.Close()
+
+	check.StatusCode = resp.StatusCode
+	check.ContentLengthBytes = resp.ContentLength
+	check.ContentType = resp.Header.Get("Content-Type")
+	check.Reachable = resp.StatusCode == http.StatusOK
+	if !check.Reachable {
+		check.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return check
+}
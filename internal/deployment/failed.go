@@ -0,0 +1,101 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"lift_learn/internal/apperr"
+	"lift_learn/internal/atomicfile"
+	"lift_learn/internal/content"
+)
+
+// FailedThing is a Thing that could not be downloaded, and why. Kind is the
+// apperr kind of the error.
+type FailedThing struct {
+	Thing content.Thing `json:"thing"`
+	Error string        `json:"error"`
+	Kind  string        `json:"kind,omitempty"`
+}
+
+// Failed is what is kept of a deployment that did not fully download: the
+// Things already waiting in its staging directory and those still to fetch.
+// It is saved as {deploymentId}.json so the deployment can be retried.
+type Failed struct {
+	DeploymentId string          `json:"deploymentId"`
+	ProjectId    string          `json:"projectId"`
+	Staged       []content.Thing `json:"staged"`
+	Failed       []FailedThing   `json:"failed"`
+	UpdatedAt    time.Time       `json:"updatedAt"`
+}
+
+// Errors lists each failed Thing's error for an API response
+func (f Failed) Errors() []string {
+	errors := make([]string, len(f.Failed))
+	for i, ft := range f.Failed {
+		errors[i] = fmt.Sprintf("failed to process %s: %s", ft.Thing.ProductId, ft.Error)
+	}
+	return errors
+}
+
+// ErrorsByKind groups the errors of Errors by the kind of failure, so a
+// caller can tell media that wouldn't download from files the device
+// couldn't write. Records saved before kinds existed count as "other".
+func (f Failed) ErrorsByKind() map[string][]string {
+	byKind := make(map[string][]string)
+	for i, msg := range f.Errors() {
+		kind := f.Failed[i].Kind
+		if kind == "" {
+			kind = apperr.KindOther
+		}
+		byKind[kind] = append(byKind[kind], msg)
+	}
+	return byKind
+}
+
+func failedPath(dir, deploymentId string) string {
+	return filepath.Join(dir, deploymentId+".json")
+}
+
+// SaveFailed writes f into dir, replacing any earlier record for the deployment
+func SaveFailed(dir string, f Failed) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	f.UpdatedAt = time.Now()
+	return atomicfile.Write(failedPath(dir, f.DeploymentId), 0644, func(file *os.File) error {
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		return enc.Encode(f)
+	})
+}
+
+// LoadFailed reads the record for deploymentId. The error satisfies
+// os.IsNotExist when the deployment has nothing left to retry.
+func LoadFailed(dir, deploymentId string) (Failed, error) {
+	var f Failed
+	data, err := os.ReadFile(failedPath(dir, deploymentId))
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("failed to parse failed deployment %s: %v", deploymentId, err)
+	}
+	return f, nil
+}
+
+// HasFailed reports whether deploymentId has a record in dir
+func HasFailed(dir, deploymentId string) bool {
+	_, err := os.Stat(failedPath(dir, deploymentId))
+	return err == nil
+}
+
+// RemoveFailed deletes the record for deploymentId if there is one
+func RemoveFailed(dir, deploymentId string) error {
+	if err := os.Remove(failedPath(dir, deploymentId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package deployment
+
+import (
+	"sync"
+	"time"
+)
+
+// StatusPending is a deployment that has been accepted but hasn't started downloading
+const StatusPending = "pending"
+
+// How long the progress of a finished deployment stays queryable
+const progressRetention = time.Hour
+
+// Progress counts how far the downloads of a running deployment have got.
+// The staging goroutines update it concurrently. It is an io.Writer so the
+// bytes of a download can be counted as they are copied.
+type Progress struct {
+	mu              sync.Mutex
+	status          string
+	thingsTotal     int
+	thingsCompleted int
+	thingsFailed    int
+	bytesDownloaded int64
+	startedAt       time.Time
+	finishedAt      time.Time
+}
+
+// ProgressReport is a point-in-time copy of a Progress, as served by
+// GET /deployments/{id}/status
+type ProgressReport struct {
+	DeploymentId         string    `json:"deployment_id"`
+	Status               string    `json:"status"`
+	ThingsTotal          int       `json:"things_total"`
+	ThingsCompleted      int       `json:"things_completed"`
+	ThingsFailed         int       `json:"things_failed"`
+	BytesDownloadedTotal int64     `json:"bytes_downloaded_total"`
+	StartedAt            time.Time `json:"started_at"`
+}
+
+// Downloading marks the deployment in progress once its Things are being fetched
+func (p *Progress) Downloading() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = StatusInProgress
+}
+
+// Completed counts a Thing that was staged
+func (p *Progress) Completed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.thingsCompleted++
+}
+
+// Failed counts a Thing that could not be staged
+func (p *Progress) Failed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.thingsFailed++
+}
+
+// Write counts len(b) downloaded bytes
+func (p *Progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytesDownloaded += int64(len(b))
+	return len(b), nil
+}
+
+func (p *Progress) report(deploymentId string) ProgressReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ProgressReport{
+		DeploymentId:         deploymentId,
+		Status:               p.status,
+		ThingsTotal:          p.thingsTotal,
+		ThingsCompleted:      p.thingsCompleted,
+		ThingsFailed:         p.thingsFailed,
+		BytesDownloadedTotal: p.bytesDownloaded,
+		StartedAt:            p.startedAt,
+	}
+}
+
+// Tracker holds the Progress of recent deployments by DeploymentId. It is
+// only kept in memory; after a restart the persisted State is all there is.
+type Tracker struct {
+	mu       sync.Mutex
+	progress map[string]*Progress
+}
+
+// NewTracker returns a Tracker with nothing in it
+func NewTracker() *Tracker {
+	return &Tracker{progress: make(map[string]*Progress)}
+}
+
+// Start begins tracking deploymentId as pending, with total Things of which
+// done are already staged, replacing any earlier progress for it.
+// Deployments finished longer than progressRetention ago are forgotten.
+func (t *Tracker) Start(deploymentId string, total, done int) *Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, p := range t.progress {
+		p.mu.Lock()
+		stale := !p.finishedAt.IsZero() && time.Since(p.finishedAt) > progressRetention
+		p.mu.Unlock()
+		if stale {
+			delete(t.progress, id)
+		}
+	}
+
+	p := &Progress{status: StatusPending, thingsTotal: total, thingsCompleted: done, startedAt: time.Now()}
+	t.progress[deploymentId] = p
+	return p
+}
+
+// Finish records the final status of deploymentId, if it is being tracked
+func (t *Tracker) Finish(deploymentId, status string) {
+	t.mu.Lock()
+	p, ok := t.progress[deploymentId]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = status
+	p.finishedAt = time.Now()
+}
+
+// Report returns the progress of deploymentId, if it is being tracked
+func (t *Tracker) Report(deploymentId string) (ProgressReport, bool) {
+	t.mu.Lock()
+	p, ok := t.progress[deploymentId]
+	t.mu.Unlock()
+	if !ok {
+		return ProgressReport{}, false
+	}
+	return p.report(deploymentId), true
+}
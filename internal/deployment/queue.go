@@ -0,0 +1,142 @@
+package deployment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lift_learn/internal/atomicfile"
+	"lift_learn/internal/content"
+)
+
+// Wait before the first background retry, doubled after every failure
+const (
+	retryBaseDelay = time.Minute
+	retryMaxDelay  = time.Hour
+)
+
+// RetryJob is a failed Thing waiting to be downloaded again in the
+// background
+type RetryJob struct {
+	DeploymentId  string        `json:"deployment_id"`
+	ProjectId     string        `json:"project_id"`
+	Thing         content.Thing `json:"thing"`
+	Attempts      int           `json:"attempts"`
+	LastError     string        `json:"last_error"`
+	CreatedAt     time.Time     `json:"created_at"`
+	NextAttemptAt time.Time     `json:"next_attempt_at"`
+}
+
+// Queue keeps RetryJobs as one JSON file each in a directory, so they
+// survive restarts
+type Queue struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewQueue opens the queue in dir, creating the directory if needed
+func NewQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	return &Queue{dir: dir}, nil
+}
+
+// Product IDs can hold anything, so files are named after a hash of them
+func (q *Queue) path(deploymentId, productId string) string {
+	sum := sha256.Sum256([]byte(productId))
+	return filepath.Join(q.dir, deploymentId+"-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// Add records a failed attempt at ft, queueing it if it isn't already.
+// Each failure pushes its next attempt further out.
+func (q *Queue) Add(deploymentId, projectId string, ft FailedThing) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	path := q.path(deploymentId, ft.Thing.ProductId)
+	job, err := readJob(path)
+	if os.IsNotExist(err) {
+		job = RetryJob{DeploymentId: deploymentId, ProjectId: projectId, CreatedAt: time.Now()}
+	} else if err != nil {
+		return err
+	}
+	job.Thing = ft.Thing
+	job.LastError = ft.Error
+	job.Attempts++
+	job.NextAttemptAt = time.Now().Add(backoff(job.Attempts))
+	return writeJob(path, job)
+}
+
+// Remove drops the job for productId in deploymentId if there is one
+func (q *Queue) Remove(deploymentId, productId string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := os.Remove(q.path(deploymentId, productId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Jobs returns every queued job, soonest first
+func (q *Queue) Jobs() ([]RetryJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", q.dir, err)
+	}
+	jobs := []RetryJob{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		job, err := readJob(filepath.Join(q.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].NextAttemptAt.Before(jobs[j].NextAttemptAt) })
+	return jobs, nil
+}
+
+func backoff(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+func readJob(path string) (RetryJob, error) {
+	var job RetryJob
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return job, err
+	}
+	if err := json.Unmarshal(data, &job); err != nil {
+		return job, fmt.Errorf("failed to parse retry job %s: %v", path, err)
+	}
+	return job, nil
+}
+
+func writeJob(path string, job RetryJob) error {
+	return atomicfile.Write(path, 0644, func(file *os.File) error {
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		return enc.Encode(job)
+	})
+}
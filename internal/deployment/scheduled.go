@@ -0,0 +1,147 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"lift_learn/internal/atomicfile"
+	"lift_learn/internal/content"
+)
+
+// Scheduled is a deployment whose Things are already downloaded into its
+// staging directory but which should only go live at ActiveAt
+type Scheduled struct {
+	DeploymentId string          `json:"deploymentId"`
+	ProjectId    string          `json:"projectId"`
+	Staged       []content.Thing `json:"staged"`
+	ActiveAt     time.Time       `json:"activeAt"`
+}
+
+// Scheduler runs a timer per scheduled deployment, keyed by DeploymentId,
+// and persists them to a JSON file so they survive a restart
+type Scheduler struct {
+	mu         sync.Mutex
+	path       string
+	pending    map[string]Scheduled
+	timers     map[string]*time.Timer
+	onActivate func(Scheduled)
+}
+
+// LoadScheduler reads the scheduled deployments file at path, where a
+// missing file means nothing is scheduled, and starts a timer for each.
+// Deployments whose time passed while the server was down activate
+// straight away.
+func LoadScheduler(path string, onActivate func(Scheduled)) (*Scheduler, error) {
+	s := &Scheduler{
+		path:       path,
+		pending:    make(map[string]Scheduled),
+		timers:     make(map[string]*time.Timer),
+		onActivate: onActivate,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled deployments %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.pending); err != nil {
+		return nil, fmt.Errorf("failed to parse scheduled deployments %s: %v", path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.pending {
+		s.startTimerLocked(d)
+	}
+	return s, nil
+}
+
+// Schedule records d and arranges for it to activate at d.ActiveAt,
+// replacing any earlier schedule for the same deployment
+func (s *Scheduler) Schedule(d Scheduled) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopTimerLocked(d.DeploymentId)
+	s.pending[d.DeploymentId] = d
+	s.startTimerLocked(d)
+	return s.saveLocked()
+}
+
+// Cancel drops the scheduled activation of deploymentId, if there is one
+func (s *Scheduler) Cancel(deploymentId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pending[deploymentId]; !ok {
+		return nil
+	}
+	s.stopTimerLocked(deploymentId)
+	delete(s.pending, deploymentId)
+	return s.saveLocked()
+}
+
+// Has reports whether deploymentId is waiting to activate
+func (s *Scheduler) Has(deploymentId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.pending[deploymentId]
+	return ok
+}
+
+// Pending returns a copy of every deployment that hasn't activated yet
+func (s *Scheduler) Pending() []Scheduled {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Scheduled, 0, len(s.pending))
+	for _, d := range s.pending {
+		out = append(out, d)
+	}
+	return out
+}
+
+func (s *Scheduler) startTimerLocked(d Scheduled) {
+	delay := time.Until(d.ActiveAt)
+	if delay < 0 {
+		delay = 0
+	}
+	s.timers[d.DeploymentId] = time.AfterFunc(delay, func() { s.fire(d) })
+}
+
+func (s *Scheduler) stopTimerLocked(deploymentId string) {
+	if t, ok := s.timers[deploymentId]; ok {
+		t.Stop()
+		delete(s.timers, deploymentId)
+	}
+}
+
+func (s *Scheduler) fire(d Scheduled) {
+	s.mu.Lock()
+	current, ok := s.pending[d.DeploymentId]
+	if !ok || !current.ActiveAt.Equal(d.ActiveAt) {
+		// Cancelled or rescheduled after this timer was started
+		s.mu.Unlock()
+		return
+	}
+	delete(s.pending, d.DeploymentId)
+	delete(s.timers, d.DeploymentId)
+	s.saveLocked()
+	s.mu.Unlock()
+
+	s.onActivate(d)
+}
+
+func (s *Scheduler) saveLocked() error {
+	return atomicfile.Write(s.path, 0644, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s.pending)
+	})
+}
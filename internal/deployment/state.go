@@ -0,0 +1,160 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"lift_learn/internal/atomicfile"
+)
+
+const (
+	StatusInProgress     = "in_progress"
+	StatusSuccess        = "success"
+	StatusPartialSuccess = "partial_success"
+	StatusFailed         = "failed"
+	// Downloaded and waiting for its activeAt
+	StatusScheduled = "scheduled"
+	// Left behind by a process that exited mid-deployment
+	StatusInterrupted = "interrupted"
+)
+
+// Status records how far a deployment got
+type Status struct {
+	Status    string `json:"status"`
+	ProjectId string `json:"projectId"`
+	// Every project a deployment wrote to, when its Things name their own
+	ProjectIds []string  `json:"projectIds,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Projects lists the projects the deployment wrote to
+func (s Status) Projects() []string {
+	if len(s.ProjectIds) > 0 {
+		return s.ProjectIds
+	}
+	if s.ProjectId != "" {
+		return []string{s.ProjectId}
+	}
+	return nil
+}
+
+// State tracks processed deployments by DeploymentId and persists them to a
+// JSON file so a retried push is recognised across restarts
+type State struct {
+	mu          sync.Mutex
+	path        string
+	deployments map[string]Status
+}
+
+// Load reads the state file at path; a missing file yields an empty state.
+// Deployments still marked in progress cannot be running any more and are
+// marked interrupted so they can be pushed again.
+func Load(path string) (*State, error) {
+	s := &State{path: path, deployments: make(map[string]Status)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deployment state %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.deployments); err != nil {
+		return nil, fmt.Errorf("failed to parse deployment state %s: %v", path, err)
+	}
+
+	for id, st := range s.deployments {
+		if st.Status == StatusInProgress {
+			st.Status = StatusInterrupted
+			s.deployments[id] = st
+		}
+	}
+	return s, nil
+}
+
+// Begin marks id as in progress unless it has already succeeded or is still
+// running. started is false in that case and existing holds its status.
+func (s *State) Begin(id, projectId string) (existing Status, started bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.deployments[id]; ok && (st.Status == StatusSuccess || st.Status == StatusInProgress) {
+		return st, false, nil
+	}
+
+	s.deployments[id] = Status{Status: StatusInProgress, ProjectId: projectId, UpdatedAt: time.Now()}
+	return Status{}, true, s.saveLocked()
+}
+
+// SetProjects records every project a deployment started with Begin writes to
+func (s *State) SetProjects(id string, projectIds []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.deployments[id]
+	st.ProjectIds = projectIds
+	s.deployments[id] = st
+	return s.saveLocked()
+}
+
+// Finish records the final status of a deployment started with Begin
+func (s *State) Finish(id, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.deployments[id]
+	st.Status = status
+	st.UpdatedAt = time.Now()
+	s.deployments[id] = st
+	return s.saveLocked()
+}
+
+// Get returns the recorded status of a deployment
+func (s *State) Get(id string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.deployments[id]
+	return st, ok
+}
+
+// All returns a copy of every recorded deployment, keyed by DeploymentId
+func (s *State) All() map[string]Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]Status, len(s.deployments))
+	for id, st := range s.deployments {
+		out[id] = st
+	}
+	return out
+}
+
+// Remove forgets a single deployment
+func (s *State) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deployments, id)
+	return s.saveLocked()
+}
+
+// Clear forgets every recorded deployment
+func (s *State) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deployments = make(map[string]Status)
+	return s.saveLocked()
+}
+
+func (s *State) saveLocked() error {
+	return atomicfile.Write(s.path, 0644, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s.deployments)
+	})
+}
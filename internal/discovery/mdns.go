@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Service lift-and-learn devices announce themselves under
+const (
+	ServiceType = "_liftlearn._tcp"
+	Domain      = "local."
+)
+
+// Device is one upload server found on the LAN
+type Device struct {
+	DeviceID   string
+	Version    string
+	APIVersion string
+	Addresses  []string
+	Port       int
+}
+
+// Announce registers the upload server on port over mDNS, with the device ID
+// and versions as TXT records, until ctx is cancelled
+func Announce(ctx context.Context, deviceID, version, apiVersion string, port int) error {
+	txt := []string{
+		"device_id=" + deviceID,
+		"version=" + version,
+		"api_version=" + apiVersion,
+	}
+	server, err := zeroconf.Register(deviceID, ServiceType, Domain, port, txt, nil)
+	if err != nil {
+		return fmt.Errorf("failed to register mDNS service: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown()
+	}()
+	return nil
+}
+
+// Browse collects every device that answers before ctx is done
+func Browse(ctx context.Context) ([]Device, error) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start mDNS resolver: %v", err)
+	}
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, ServiceType, Domain, entries); err != nil {
+		return nil, fmt.Errorf("failed to browse for %s: %v", ServiceType, err)
+	}
+
+	// The resolver closes entries once ctx is done
+	var devices []Device
+	for entry := range entries {
+		d := Device{Port: entry.Port}
+		for _, record := range entry.Text {
+			key, value, _ := strings.Cut(record, "=")
+			switch key {
+			case "device_id":
+				d.DeviceID = value
+			case "version":
+				d.Version = value
+			case "api_version":
+				d.APIVersion = value
+			}
+		}
+		for _, ip := range entry.AddrIPv4 {
+			d.Addresses = append(d.Addresses, ip.String())
+		}
+		for _, ip := range entry.AddrIPv6 {
+			d.Addresses = append(d.Addresses, ip.String())
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
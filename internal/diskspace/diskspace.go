@@ -0,0 +1,33 @@
+package diskspace
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Usage describes the filesystem holding a path
+type Usage struct {
+	AvailableBytes uint64
+	TotalBytes     uint64
+}
+
+// UsedFraction is how full the filesystem is, from 0 to 1
+func (u Usage) UsedFraction() float64 {
+	if u.TotalBytes == 0 {
+		return 0
+	}
+	return 1 - float64(u.AvailableBytes)/float64(u.TotalBytes)
+}
+
+// Stat reports the space available to unprivileged users on the filesystem
+// containing path
+func Stat(path string) (Usage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return Usage{}, fmt.Errorf("failed to stat filesystem of %s: %v", path, err)
+	}
+	return Usage{
+		AvailableBytes: stat.Bavail * uint64(stat.Bsize),
+		TotalBytes:     stat.Blocks * uint64(stat.Bsize),
+	}, nil
+}
@@ -0,0 +1,67 @@
+package events
+
+import "sync"
+
+// HistoryEntry is one scan as kept in ScanHistory and served by /history
+type HistoryEntry struct {
+	Timestamp    string `json:"timestamp"`
+	UID          string `json:"uid"`
+	ProductId    string `json:"productId,omitempty"`
+	ProductName  string `json:"productName,omitempty"`
+	DeploymentId string `json:"deploymentId,omitempty"`
+	Action       string `json:"action"`
+}
+
+// ScanHistory keeps the most recent scans in a fixed-size ring. Once full,
+// every new entry overwrites the oldest.
+type ScanHistory struct {
+	mu      sync.RWMutex
+	entries []HistoryEntry
+	head    int // where the next entry goes
+	full    bool
+}
+
+// NewScanHistory returns a history holding up to size entries
+func NewScanHistory(size int) *ScanHistory {
+	return &ScanHistory{entries: make([]HistoryEntry, size)}
+}
+
+// Add records e, evicting the oldest entry if the history is full
+func (h *ScanHistory) Add(e HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries[h.head] = e
+	h.head = (h.head + 1) % len(h.entries)
+	if h.head == 0 {
+		h.full = true
+	}
+}
+
+// Recent returns up to limit entries, newest first, optionally only those
+// for uid. A limit of 0 or less returns everything that matches.
+func (h *ScanHistory) Recent(limit int, uid string) []HistoryEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	n := h.head
+	if h.full {
+		n = len(h.entries)
+	}
+
+	result := []HistoryEntry{}
+	for i := 1; i <= n; i++ {
+		e := h.entries[(h.head-i+len(h.entries))%len(h.entries)]
+		if uid != "" && e.UID != uid {
+			continue
+		}
+		result = append(result, e)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScanHistoryEvictsOldest(t *testing.T) {
+	h := NewScanHistory(100)
+	for i := 1; i <= 101; i++ {
+		h.Add(HistoryEntry{UID: fmt.Sprintf("uid-%d", i), Action: "scan"})
+	}
+
+	got := h.Recent(0, "")
+	if len(got) != 100 {
+		t.Fatalf("got %d entries, want 100", len(got))
+	}
+	if got[0].UID != "uid-101" {
+		t.Errorf("newest entry = %s, want uid-101", got[0].UID)
+	}
+	if got[99].UID != "uid-2" {
+		t.Errorf("oldest entry = %s, want uid-2", got[99].UID)
+	}
+	if e := h.Recent(0, "uid-1"); len(e) != 0 {
+		t.Errorf("entry 1 is still there: %v", e)
+	}
+}
+
+func TestScanHistoryRecent(t *testing.T) {
+	h := NewScanHistory(10)
+	for i := 1; i <= 6; i++ {
+		uid := "A"
+		if i%2 == 0 {
+			uid = "B"
+		}
+		h.Add(HistoryEntry{UID: uid, ProductId: fmt.Sprintf("p%d", i)})
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		uid   string
+		want  []string
+	}{
+		{"everything", 0, "", []string{"p6", "p5", "p4", "p3", "p2", "p1"}},
+		{"limit", 3, "", []string{"p6", "p5", "p4"}},
+		{"negative limit", -1, "", []string{"p6", "p5", "p4", "p3", "p2", "p1"}},
+		{"limit above count", 20, "", []string{"p6", "p5", "p4", "p3", "p2", "p1"}},
+		{"uid", 0, "A", []string{"p5", "p3", "p1"}},
+		{"uid and limit", 2, "B", []string{"p6", "p4"}},
+		{"unknown uid", 0, "C", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := h.Recent(tt.limit, tt.uid)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d entries, want %d", len(got), len(tt.want))
+			}
+			for i, e := range got {
+				if e.ProductId != tt.want[i] {
+					t.Errorf("entry %d = %s, want %s", i, e.ProductId, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestScanHistoryEmpty(t *testing.T) {
+	if got := NewScanHistory(5).Recent(0, ""); got == nil || len(got) != 0 {
+		t.Errorf("got %v, want an empty non-nil slice", got)
+	}
+	h := NewScanHistory(0)
+	h.Add(HistoryEntry{UID: "A"})
+	if got := h.Recent(0, ""); len(got) != 0 {
+		t.Errorf("zero-size history kept %v", got)
+	}
+}
@@ -0,0 +1,130 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Scan outcomes recorded in the event log
+const (
+	ActionPlayed     = "played"
+	ActionDebounced  = "debounced"
+	ActionUnknownTag = "unknown_tag"
+	// Matched a Thing whose play schedule doesn't cover the scan time
+	ActionOutsideSchedule = "outside_schedule"
+	// Played from the tag's NDEF URI record rather than the registry
+	ActionNDEFPlayed = "ndef_played"
+)
+
+// Event is one NFC scan as written to the event log
+type Event struct {
+	Timestamp        string `json:"timestamp"`
+	UID              string `json:"uid"`
+	MatchedVideoPath string `json:"matched_video_path"`
+	Action           string `json:"action"`
+	SerialPort       string `json:"serial_port"`
+}
+
+// NewEvent stamps a scan with the current time
+func NewEvent(uid, videoPath, action, port string) Event {
+	return Event{
+		Timestamp:        time.Now().Format(time.RFC3339),
+		UID:              uid,
+		MatchedVideoPath: videoPath,
+		Action:           action,
+		SerialPort:       port,
+	}
+}
+
+// EventLogger appends events to a newline-delimited JSON file, rotated by a
+// RotatingFileWriter once it grows past the max size
+type EventLogger struct {
+	w *RotatingFileWriter
+}
+
+// NewEventLogger opens path for appending, creating it if needed. Up to
+// maxRotatedFiles rotated logs are kept beside it.
+func NewEventLogger(path string, maxSizeBytes int64, maxRotatedFiles int) (*EventLogger, error) {
+	w, err := NewRotatingFileWriter(path, maxSizeBytes, maxRotatedFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %v", err)
+	}
+	return &EventLogger{w: w}, nil
+}
+
+// Log appends ev to the file, rotating first if it would pass the max size
+func (l *EventLogger) Log(ev Event) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+// Rotate starts a new log file now, whatever the size of the current one
+func (l *EventLogger) Rotate() error {
+	return l.w.Rotate()
+}
+
+// Close implements io.Closer
+func (l *EventLogger) Close() error {
+	return l.w.Close()
+}
+
+// ReadLast returns up to the last n events from the log at path, reaching
+// back into rotated files when the current one holds fewer than n. An n of 0
+// or less returns everything.
+func ReadLast(path string, n int) ([]Event, error) {
+	rotated, err := rotatedFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	files := append(rotated, path)
+
+	var all []Event
+	for i := len(files) - 1; i >= 0; i-- {
+		if n > 0 && len(all) >= n {
+			break
+		}
+		evs, err := readFile(files[i])
+		if err != nil {
+			return nil, err
+		}
+		all = append(evs, all...)
+	}
+
+	if n > 0 && len(all) > n {
+		all = all[len(all)-n:]
+	}
+	return all, nil
+}
+
+func readFile(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var evs []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			// A partially written last line shouldn't hide the rest
+			continue
+		}
+		evs = append(evs, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read event log %s: %v", path, err)
+	}
+	return evs, nil
+}
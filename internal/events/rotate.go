@@ -0,0 +1,148 @@
+package events
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix given to rotated files; fixed width so they sort oldest first
+const rotatedSuffixLayout = "20060102T150405.000000000Z"
+
+// RotatingFileWriter appends to the file at its path. When a write would
+// take the file past MaxFileSizeBytes, the file is renamed to
+// <path>.<timestamp> and a fresh one started, keeping at most
+// MaxRotatedFiles older files. Zero for either disables the limit.
+type RotatingFileWriter struct {
+	MaxFileSizeBytes int64
+	MaxRotatedFiles  int
+
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+// NewRotatingFileWriter opens path for appending, creating it if needed
+func NewRotatingFileWriter(path string, maxFileSizeBytes int64, maxRotatedFiles int) (*RotatingFileWriter, error) {
+	w := &RotatingFileWriter{
+		MaxFileSizeBytes: maxFileSizeBytes,
+		MaxRotatedFiles:  maxRotatedFiles,
+		path:             path,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingFileWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", w.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat %s: %v", w.path, err)
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// Write implements io.Writer. p is never split across two files.
+func (w *RotatingFileWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.MaxFileSizeBytes > 0 && w.size > 0 && w.size+int64(len(p)) > w.MaxFileSizeBytes {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate starts a new file now, whatever the size of the current one
+func (w *RotatingFileWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+func (w *RotatingFileWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	rotated := w.path + "." + time.Now().UTC().Format(rotatedSuffixLayout)
+	if err := os.Rename(w.path, rotated); err != nil {
+		// Keep appending to the old file rather than losing writes
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to rotate %s: %v", w.path, err)
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	return w.prune()
+}
+
+// Delete the oldest rotated files beyond MaxRotatedFiles
+func (w *RotatingFileWriter) prune() error {
+	if w.MaxRotatedFiles <= 0 {
+		return nil
+	}
+	files, err := rotatedFiles(w.path)
+	if err != nil {
+		return err
+	}
+	for len(files) > w.MaxRotatedFiles {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove rotated file %s: %v", files[0], err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Close implements io.Closer
+func (w *RotatingFileWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Files rotated out of path, oldest first
+func rotatedFiles(path string) ([]string, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+
+	var files []string
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), base+".")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(rotatedSuffixLayout, suffix); err != nil {
+			continue
+		}
+		files = append(files, filepath.Join(filepath.Dir(path), e.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
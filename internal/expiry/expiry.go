@@ -0,0 +1,136 @@
+package expiry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"lift_learn/internal/atomicfile"
+)
+
+// Expiration is a stored video and its metadata that should be deleted at ExpiresAt
+type Expiration struct {
+	VideoPath    string    `json:"videoPath"`
+	MetadataPath string    `json:"metadataPath"`
+	NfcTagId     string    `json:"nfcTagId,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// Scheduler runs a timer per pending expiration, keyed by video path, and
+// persists them to a JSON file so they survive a restart
+type Scheduler struct {
+	mu       sync.Mutex
+	path     string
+	pending  map[string]Expiration
+	timers   map[string]*time.Timer
+	onExpire func(Expiration)
+}
+
+// Load reads the expirations file at path, where a missing file means
+// nothing is pending, and schedules each entry for its remaining time.
+// Entries whose time has already passed fire straight away.
+func Load(path string, onExpire func(Expiration)) (*Scheduler, error) {
+	s := &Scheduler{
+		path:     path,
+		pending:  make(map[string]Expiration),
+		timers:   make(map[string]*time.Timer),
+		onExpire: onExpire,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expirations %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.pending); err != nil {
+		return nil, fmt.Errorf("failed to parse expirations %s: %v", path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.pending {
+		s.startTimerLocked(e)
+	}
+	return s, nil
+}
+
+// Schedule records e and arranges for it to fire at e.ExpiresAt, replacing
+// any expiration already pending for the same video
+func (s *Scheduler) Schedule(e Expiration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopTimerLocked(e.VideoPath)
+	s.pending[e.VideoPath] = e
+	s.startTimerLocked(e)
+	return s.saveLocked()
+}
+
+// Cancel drops the pending expiration for videoPath, e.g. because the video
+// was redeployed without an expiry
+func (s *Scheduler) Cancel(videoPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pending[videoPath]; !ok {
+		return nil
+	}
+	s.stopTimerLocked(videoPath)
+	delete(s.pending, videoPath)
+	return s.saveLocked()
+}
+
+// Pending returns a copy of every expiration that hasn't fired yet
+func (s *Scheduler) Pending() []Expiration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Expiration, 0, len(s.pending))
+	for _, e := range s.pending {
+		out = append(out, e)
+	}
+	return out
+}
+
+func (s *Scheduler) startTimerLocked(e Expiration) {
+	delay := time.Until(e.ExpiresAt)
+	if delay < 0 {
+		delay = 0
+	}
+	s.timers[e.VideoPath] = time.AfterFunc(delay, func() { s.fire(e) })
+}
+
+func (s *Scheduler) stopTimerLocked(videoPath string) {
+	if t, ok := s.timers[videoPath]; ok {
+		t.Stop()
+		delete(s.timers, videoPath)
+	}
+}
+
+func (s *Scheduler) fire(e Expiration) {
+	s.mu.Lock()
+	current, ok := s.pending[e.VideoPath]
+	if !ok || !current.ExpiresAt.Equal(e.ExpiresAt) {
+		// Cancelled or rescheduled after this timer was started
+		s.mu.Unlock()
+		return
+	}
+	delete(s.pending, e.VideoPath)
+	delete(s.timers, e.VideoPath)
+	s.saveLocked()
+	s.mu.Unlock()
+
+	s.onExpire(e)
+}
+
+func (s *Scheduler) saveLocked() error {
+	return atomicfile.Write(s.path, 0644, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s.pending)
+	})
+}
@@ -0,0 +1,51 @@
+package fsys
+
+import (
+	"os"
+	"path/filepath"
+
+	"lift_learn/internal/atomicfile"
+)
+
+// FileSystem is the file I/O the registry, metadata and garbage collection
+// code need, so an in-memory Mem can stand in for the disk
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	// Walk behaves like filepath.Walk, including SkipDir
+	Walk(root string, fn filepath.WalkFunc) error
+}
+
+// OS is the real filesystem. WriteFile replaces files atomically, as every
+// writer in this repo expects.
+type OS struct{}
+
+func (OS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (OS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return atomicfile.Write(name, perm, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+func (OS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
@@ -0,0 +1,189 @@
+package fsys
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Mem is a FileSystem held in a map. Parent directories are created
+// implicitly, and errors match the os ones closely enough for os.IsNotExist.
+type Mem struct {
+	mu    sync.RWMutex
+	files map[string]memFile
+	dirs  map[string]time.Time
+}
+
+type memFile struct {
+	data    []byte
+	perm    os.FileMode
+	modTime time.Time
+}
+
+// NewMem returns an empty in-memory filesystem
+func NewMem() *Mem {
+	return &Mem{files: make(map[string]memFile), dirs: make(map[string]time.Time)}
+}
+
+func (m *Mem) ReadFile(name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (m *Mem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, isDir := m.dirs[name]; isDir {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	m.mkdirAllLocked(filepath.Dir(name))
+	m.files[name] = memFile{data: append([]byte(nil), data...), perm: perm, modTime: time.Now()}
+	return nil
+}
+
+func (m *Mem) MkdirAll(dir string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if _, isFile := m.files[dir]; isFile {
+		return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+	}
+	m.mkdirAllLocked(dir)
+	return nil
+}
+
+func (m *Mem) mkdirAllLocked(dir string) {
+	for ; ; dir = filepath.Dir(dir) {
+		if _, ok := m.dirs[dir]; !ok {
+			m.dirs[dir] = time.Now()
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return
+		}
+	}
+}
+
+func (m *Mem) Stat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name = filepath.Clean(name)
+	if f, ok := m.files[name]; ok {
+		return memInfo{name: path.Base(filepath.ToSlash(name)), size: int64(len(f.data)), mode: f.perm, modTime: f.modTime}, nil
+	}
+	if modTime, ok := m.dirs[name]; ok {
+		return memInfo{name: path.Base(filepath.ToSlash(name)), mode: fs.ModeDir | 0755, modTime: modTime}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *Mem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(m.childrenLocked(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+// Walk visits root and everything under it in lexical order, as
+// filepath.Walk does. fn is called without the lock held, so it may change
+// the filesystem.
+func (m *Mem) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := m.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = m.walk(root, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (m *Mem) walk(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+	if err := fn(path, info, nil); err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	names := m.childrenLocked(filepath.Clean(path))
+	m.mu.RUnlock()
+
+	for _, name := range names {
+		child := filepath.Join(path, name)
+		childInfo, err := m.Stat(child)
+		if err != nil {
+			// Removed by fn since the listing
+			if err := fn(child, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := m.walk(child, childInfo, fn); err != nil {
+			if !childInfo.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sorted names of the files and directories directly inside dir
+func (m *Mem) childrenLocked(dir string) []string {
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() interface{}   { return nil }
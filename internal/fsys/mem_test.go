@@ -0,0 +1,120 @@
+package fsys
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Builds the same tree on the disk and in a Mem
+func buildTree(t *testing.T, files ...string) (diskRoot string, mem *Mem, memRoot string) {
+	t.Helper()
+	diskRoot = t.TempDir()
+	memRoot = filepath.FromSlash("/root")
+	mem = NewMem()
+	for _, name := range files {
+		for _, fs := range []struct {
+			fs   FileSystem
+			root string
+		}{{OS{}, diskRoot}, {mem, memRoot}} {
+			path := filepath.Join(fs.root, filepath.FromSlash(name))
+			if err := fs.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.fs.WriteFile(path, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return diskRoot, mem, memRoot
+}
+
+// Relative paths Walk visits, skipping directories named skip and the rest
+// of a directory after a file named stop
+func visited(t *testing.T, fs FileSystem, root string) []string {
+	t.Helper()
+	var paths []string
+	err := fs.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		paths = append(paths, filepath.ToSlash(rel))
+		if info.Name() == "skip" && info.IsDir() {
+			return filepath.SkipDir
+		}
+		if info.Name() == "stop" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	return paths
+}
+
+func TestMemWalkMatchesOS(t *testing.T) {
+	diskRoot, mem, memRoot := buildTree(t,
+		"b.txt", "a/2.txt", "a/1.txt", "a/skip/hidden.txt", "c/stop", "c/z.txt", "c/d/e.txt", "a.txt")
+
+	disk := visited(t, OS{}, diskRoot)
+	inMem := visited(t, mem, memRoot)
+	if !reflect.DeepEqual(disk, inMem) {
+		t.Errorf("Mem walked %v\nOS walked  %v", inMem, disk)
+	}
+}
+
+func TestMemWalkMissingRoot(t *testing.T) {
+	called := false
+	err := NewMem().Walk(filepath.FromSlash("/missing"), func(path string, info os.FileInfo, err error) error {
+		called = true
+		if !os.IsNotExist(err) {
+			t.Errorf("fn got %v, want a not-exist error", err)
+		}
+		return err
+	})
+	if !called || !os.IsNotExist(err) {
+		t.Errorf("Walk = %v (fn called: %v), want a not-exist error", err, called)
+	}
+}
+
+func TestMemWalkRemoveDuringWalk(t *testing.T) {
+	_, mem, root := buildTree(t, "a.mp4", "b.mp4", "d/c.mp4")
+	err := mem.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return mem.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	for _, name := range []string{"a.mp4", "b.mp4", "d/c.mp4"} {
+		if _, err := mem.Stat(filepath.Join(root, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", name)
+		}
+	}
+}
+
+func TestMemRemove(t *testing.T) {
+	_, mem, root := buildTree(t, "d/a.txt")
+	dir := filepath.Join(root, "d")
+
+	if err := mem.Remove(dir); err == nil {
+		t.Error("removed a directory that isn't empty")
+	}
+	if err := mem.Remove(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatalf("Remove file: %v", err)
+	}
+	if err := mem.Remove(dir); err != nil {
+		t.Fatalf("Remove empty directory: %v", err)
+	}
+	if err := mem.Remove(dir); !os.IsNotExist(err) {
+		t.Errorf("Remove of a missing path = %v, want a not-exist error", err)
+	}
+}
@@ -0,0 +1,102 @@
+package httpclient
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryConfig sets how a retrying client backs off. The delay before retry
+// n is BaseDelay*Multiplier^(n-1), capped at MaxDelay, and the actual wait
+// is a random duration up to that ("full jitter"), so devices that lost the
+// same server don't all come back at once.
+type RetryConfig struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	// What the requests finally go through; http.DefaultTransport if nil
+	Transport http.RoundTripper
+}
+
+// NewRetryingHTTPClient returns a client whose requests are retried on 429,
+// 502, 503 and 504 responses and on network errors. Other responses,
+// including any other 4xx, are returned as they are. A request with a body
+// is only retried if the body can be replayed (http.NewRequest sets that up
+// for bytes and strings readers).
+func NewRetryingHTTPClient(cfg RetryConfig) *http.Client {
+	if cfg.Transport == nil {
+		cfg.Transport = http.DefaultTransport
+	}
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = 1
+	}
+	return &http.Client{Transport: &retryTransport{cfg: cfg}}
+}
+
+type retryTransport struct {
+	cfg RetryConfig
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.cfg.Transport.RoundTrip(req)
+		retry := err != nil || retryableStatus(resp.StatusCode)
+		replayable := req.Body == nil || req.GetBody != nil
+		if !retry || !replayable || attempt >= t.cfg.MaxRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		delay := t.delay(attempt, resp)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// How long to wait before retrying after the given attempt. A Retry-After
+// in seconds is honoured up to MaxDelay.
+func (t *retryTransport) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			d := time.Duration(secs) * time.Second
+			if t.cfg.MaxDelay > 0 && d > t.cfg.MaxDelay {
+				d = t.cfg.MaxDelay
+			}
+			return d
+		}
+	}
+
+	backoff := float64(t.cfg.BaseDelay) * math.Pow(t.cfg.Multiplier, float64(attempt))
+	if t.cfg.MaxDelay > 0 && backoff > float64(t.cfg.MaxDelay) {
+		backoff = float64(t.cfg.MaxDelay)
+	}
+	if backoff < 1 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
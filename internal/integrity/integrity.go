@@ -0,0 +1,196 @@
+package integrity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lift_learn/internal/atomicfile"
+	"lift_learn/internal/content"
+)
+
+// ErrRunning is returned by Check while another check is still going
+var ErrRunning = errors.New("integrity check already running")
+
+// Corruption is a stored media file whose SHA-256 no longer matches the
+// checksum in its Thing's metadata
+type Corruption struct {
+	ProductId        string    `json:"productId"`
+	MediaPath        string    `json:"mediaPath"`
+	MetadataPath     string    `json:"metadataPath"`
+	ExpectedChecksum string    `json:"expectedChecksum"`
+	ActualChecksum   string    `json:"actualChecksum"`
+	DetectedAt       time.Time `json:"detectedAt"`
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Checked  int          `json:"checked"`
+	Corrupt  []Corruption `json:"corrupt"`
+	Repaired []string     `json:"repaired"`
+}
+
+// Checker hashes every stored media file that has a checksum and keeps the
+// ones that don't match in a JSON index, so they are still known after a
+// restart. The index only ever holds what the last check found.
+type Checker struct {
+	StoragePath string
+	// Called for a corrupt file whose Thing's mediaUrl is still http(s);
+	// the file counts as repaired when it returns nil. Nil never repairs.
+	Redownload func(thing content.Thing, mediaPath string) error
+
+	logger  *slog.Logger
+	running sync.Mutex
+
+	mu        sync.RWMutex
+	indexPath string
+	corrupt   map[string]Corruption
+}
+
+// Load reads the corrupt file index at indexPath, where a missing file means
+// nothing has been found corrupt
+func Load(indexPath, storagePath string, logger *slog.Logger) (*Checker, error) {
+	c := &Checker{
+		StoragePath: storagePath,
+		logger:      logger,
+		indexPath:   indexPath,
+		corrupt:     make(map[string]Corruption),
+	}
+	data, err := os.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read corrupt file index %s: %v", indexPath, err)
+	}
+	if err := json.Unmarshal(data, &c.corrupt); err != nil {
+		return nil, fmt.Errorf("failed to parse corrupt file index %s: %v", indexPath, err)
+	}
+	return c, nil
+}
+
+// Check verifies every Thing under StoragePath that has both a checksum and
+// its media file on disk. Files that can't be read are logged and skipped.
+func (c *Checker) Check() (Result, error) {
+	if !c.running.TryLock() {
+		return Result{}, ErrRunning
+	}
+	defer c.running.Unlock()
+
+	projects, err := content.ScanDirectory(c.StoragePath)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to scan content directory: %v", err)
+	}
+
+	c.mu.RLock()
+	previous := c.corrupt
+	c.mu.RUnlock()
+
+	result := Result{Corrupt: []Corruption{}, Repaired: []string{}}
+	found := make(map[string]Corruption)
+	for _, p := range projects {
+		for _, t := range p.Things {
+			if !t.MetadataPresent || !t.VideoPresent {
+				continue
+			}
+			thing, err := content.ReadThing(t.MetadataPath)
+			if err != nil || thing.Checksum == "" {
+				continue
+			}
+			sum, err := fileSHA256(t.LocalVideoPath)
+			if err != nil {
+				c.logger.Warn("failed to hash media file", "path", t.LocalVideoPath, "err", err)
+				continue
+			}
+			result.Checked++
+			if strings.EqualFold(sum, thing.Checksum) {
+				continue
+			}
+
+			c.logger.Error("media file corrupt", "path", t.LocalVideoPath, "product_id", t.ProductId, "expected", thing.Checksum, "actual", sum)
+			if c.repair(thing, t.LocalVideoPath) {
+				result.Repaired = append(result.Repaired, t.LocalVideoPath)
+				continue
+			}
+			corruption := Corruption{
+				ProductId:        t.ProductId,
+				MediaPath:        t.LocalVideoPath,
+				MetadataPath:     t.MetadataPath,
+				ExpectedChecksum: strings.ToLower(thing.Checksum),
+				ActualChecksum:   sum,
+				DetectedAt:       time.Now(),
+			}
+			if prev, ok := previous[t.LocalVideoPath]; ok {
+				corruption.DetectedAt = prev.DetectedAt
+			}
+			found[t.LocalVideoPath] = corruption
+			result.Corrupt = append(result.Corrupt, corruption)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.corrupt = found
+	if err := c.saveLocked(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Re-download thing's media over mediaPath if it still has a remote URL
+func (c *Checker) repair(thing content.Thing, mediaPath string) bool {
+	if c.Redownload == nil {
+		return false
+	}
+	if !strings.HasPrefix(thing.MediaUrl, "http://") && !strings.HasPrefix(thing.MediaUrl, "https://") {
+		return false
+	}
+	if err := c.Redownload(thing, mediaPath); err != nil {
+		c.logger.Warn("failed to re-download corrupt media", "path", mediaPath, "url", thing.MediaUrl, "err", err)
+		return false
+	}
+	c.logger.Info("re-downloaded corrupt media", "path", mediaPath, "url", thing.MediaUrl)
+	return true
+}
+
+// Corrupt returns the files the last check found corrupt, by path
+func (c *Checker) Corrupt() []Corruption {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	list := make([]Corruption, 0, len(c.corrupt))
+	for _, corruption := range c.corrupt {
+		list = append(list, corruption)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].MediaPath < list[j].MediaPath })
+	return list
+}
+
+func (c *Checker) saveLocked() error {
+	return atomicfile.Write(c.indexPath, 0644, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c.corrupt)
+	})
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,96 @@
+// Package logging builds the slog.Logger shared by lift_learn and the upload
+// server from their --log-format and --log-level flags.
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Level of every logger built by New, so SetLevel can change it while
+// running, and the level New was last given
+var (
+	levelVar  = new(slog.LevelVar)
+	baseLevel slog.Level
+)
+
+// Options are the logging flags common to every binary
+type Options struct {
+	Format string
+	Level  string
+}
+
+// RegisterFlags adds --log-format and --log-level to fs
+func RegisterFlags(fs *flag.FlagSet) *Options {
+	o := &Options{}
+	fs.StringVar(&o.Format, "log-format", "text", `log output format, "text" or "json"`)
+	fs.StringVar(&o.Level, "log-level", "info", `minimum log level: "debug", "info", "warn" or "error"`)
+	return o
+}
+
+// Logger builds a logger writing to stderr with the chosen format and level
+func (o *Options) Logger() (*slog.Logger, error) {
+	return New(os.Stderr, o.Format, o.Level)
+}
+
+// New builds a logger writing to w. Loggers built by New share one level;
+// the last call, or SetLevel, decides it.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	baseLevel = lvl
+	levelVar.Set(lvl)
+	opts := &slog.HandlerOptions{Level: levelVar}
+
+	switch format {
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected \"text\" or \"json\"", format)
+	}
+}
+
+// SetLevel changes the minimum level of the loggers built by New. An empty
+// name goes back to the level New was given.
+func SetLevel(name string) error {
+	if name == "" {
+		levelVar.Set(baseLevel)
+		return nil
+	}
+	lvl, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	levelVar.Set(lvl)
+	return nil
+}
+
+// ParseLevel maps a --log-level value to a slog.Level
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+// Discard returns a logger that drops everything, for tests and tools that
+// don't want library output
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
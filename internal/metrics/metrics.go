@@ -0,0 +1,106 @@
+// Package metrics holds the Prometheus collectors shared by lift_learn and the
+// upload server. Each process serves its own copy of Registry on /metrics;
+// collectors a process never touches simply stay at zero.
+//
+// Metrics:
+//
+//	nfc_scans_total{uid, action}        tags read by the NFC readers, by outcome
+//	                                    (played, debounced, unknown_tag)
+//	video_plays_total{product_id}       videos started in response to a scan
+//	content_downloads_total{status}     media downloads, status=success|failure
+//	content_files_on_disk               media files in storage, updated after
+//	                                    each deployment
+//	upload_requests_total{status}       /receive-content requests by HTTP status
+//	registration_attempts_total{result} AWS registration attempts,
+//	                                    result=success|failure
+//	disk_free_bytes                     free space on the storage filesystem,
+//	                                    checked every 5 minutes
+//	store_hits_total                    videos linked from the content store
+//	                                    instead of downloaded
+//	store_misses_total                  videos not in the store yet
+//	panics_recovered_total              handler panics caught by the upload
+//	                                    server's recover middleware
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry is used instead of the default registerer so only these metrics
+// are exposed and tests can gather them directly
+var Registry = prometheus.NewRegistry()
+
+var (
+	NFCScans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nfc_scans_total",
+		Help: "NFC tags read, by UID and outcome.",
+	}, []string{"uid", "action"})
+
+	VideoPlays = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "video_plays_total",
+		Help: "Videos played in response to a scan, by product.",
+	}, []string{"product_id"})
+
+	ContentDownloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "content_downloads_total",
+		Help: "Media downloads, by result.",
+	}, []string{"status"})
+
+	ContentFilesOnDisk = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "content_files_on_disk",
+		Help: "Media files currently in storage.",
+	})
+
+	UploadRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "upload_requests_total",
+		Help: "Content upload requests, by HTTP status.",
+	}, []string{"status"})
+
+	RegistrationAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registration_attempts_total",
+		Help: "Registration attempts with the AWS endpoint, by result.",
+	}, []string{"result"})
+
+	DiskFreeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "disk_free_bytes",
+		Help: "Bytes available on the filesystem holding the content storage.",
+	})
+
+	StoreHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "store_hits_total",
+		Help: "Videos reused from the content store instead of downloaded.",
+	})
+
+	StoreMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "store_misses_total",
+		Help: "Videos that had to be downloaded because the store lacked them.",
+	})
+
+	PanicsRecovered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "panics_recovered_total",
+		Help: "HTTP handler panics recovered without crashing the server.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		NFCScans,
+		VideoPlays,
+		ContentDownloads,
+		ContentFilesOnDisk,
+		UploadRequests,
+		RegistrationAttempts,
+		DiskFreeBytes,
+		StoreHits,
+		StoreMisses,
+		PanicsRecovered,
+	)
+}
+
+// Handler serves Registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// RequireAPIKey rejects requests that don't present key in an X-API-Key
+// header or an "Authorization: Bearer" token. An empty key disables the check.
+func RequireAPIKey(key string, next http.Handler) http.Handler {
+	if key == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := r.Header.Get("X-API-Key")
+		if presented == "" {
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+				presented = strings.TrimPrefix(auth, "Bearer ")
+			}
+		}
+
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "missing or invalid API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireClientCert rejects requests that didn't come with a client
+// certificate verified during the TLS handshake
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			writeJSONError(w, http.StatusUnauthorized, "a verified client certificate is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireBasicAuth rejects requests whose basic auth credentials aren't
+// username and password, asking the browser to prompt for them
+func RequireBasicAuth(username, password, realm string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		key        string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"no key presented", "secret", nil, http.StatusUnauthorized},
+		{"wrong X-API-Key", "secret", map[string]string{"X-API-Key": "guess"}, http.StatusUnauthorized},
+		{"wrong bearer token", "secret", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"key in another scheme", "secret", map[string]string{"Authorization": "Basic secret"}, http.StatusUnauthorized},
+		{"correct X-API-Key", "secret", map[string]string{"X-API-Key": "secret"}, http.StatusOK},
+		{"correct bearer token", "secret", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{"no key configured", "", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/receive-content", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			RequireAPIKey(tt.key, ok).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && rec.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("Content-Type %q, want application/json", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"lift_learn/internal/config"
+)
+
+// Request headers browser tools send that the upload server understands
+const corsAllowedHeaders = "Content-Type, Authorization, X-API-Key, " + RequestIDHeader
+
+// CORSMiddleware adds CORS headers for requests from cfg.AllowedOrigins and
+// answers preflight OPTIONS requests with 204. Requests from other origins
+// are passed through without CORS headers, so the browser blocks the
+// response. With no AllowedOrigins the middleware does nothing.
+func CORSMiddleware(cfg config.CORSConfig) func(http.Handler) http.Handler {
+	wildcard := false
+	allowed := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, o := range cfg.AllowedOrigins {
+		if o == "*" {
+			wildcard = true
+		}
+		allowed[strings.TrimSuffix(o, "/")] = true
+	}
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+
+	return func(next http.Handler) http.Handler {
+		if len(allowed) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !(wildcard || allowed[origin]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			// Browsers refuse a wildcard on credentialed requests, so the
+			// origin is echoed back instead
+			if wildcard && !cfg.AllowCredentials {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+				h.Add("Vary", "Origin")
+			}
+			if cfg.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			h.Set("Access-Control-Expose-Headers", RequestIDHeader)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", methods)
+				h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				h.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader carries the request ID in both directions
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// StatusRecorder remembers the status code written through it
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+// NewStatusRecorder wraps w, assuming 200 until WriteHeader says otherwise
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// ResponseRecorder is a ResponseWriter that keeps the status and body, for
+// running handlers on requests that didn't come from an HTTP client
+type ResponseRecorder struct {
+	header      http.Header
+	wroteHeader bool
+	Status      int
+	Body        bytes.Buffer
+}
+
+// NewResponseRecorder starts out at 200 like a real response
+func NewResponseRecorder() *ResponseRecorder {
+	return &ResponseRecorder{header: make(http.Header), Status: http.StatusOK}
+}
+
+func (r *ResponseRecorder) Header() http.Header {
+	return r.header
+}
+
+// Only the first status written counts, as with net/http
+func (r *ResponseRecorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.Status = status
+}
+
+func (r *ResponseRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.Body.Write(p)
+}
+
+// LoggingMiddleware tags each request with an ID, taken from X-Request-ID or
+// generated, and logs it on the way in and on the way out with its status
+// and duration. The ID is echoed back in the response header.
+func LoggingMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if id == "" {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+			log := logger.With("request_id", id)
+			log.Info("request started", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+
+			start := time.Now()
+			rec := NewStatusRecorder(w)
+			next.ServeHTTP(rec, r)
+			log.Info("request finished", "method", r.Method, "path", r.URL.Path, "status", rec.Status, "duration", time.Since(start))
+		})
+	}
+}
+
+// RequestID returns the ID LoggingMiddleware gave the request, or "" outside it
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestLogger returns logger with the request's ID attached
+func RequestLogger(r *http.Request, logger *slog.Logger) *slog.Logger {
+	if id := RequestID(r.Context()); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
+
+// Random version 4 UUID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
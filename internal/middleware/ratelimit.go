@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter applies a token bucket per client IP. Buckets for clients that
+// haven't been seen within the TTL are evicted so the map can't grow forever.
+type RateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	ttl       time.Duration
+	clients   map[string]*rateClient
+	lastSweep time.Time
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewRateLimiter(requestsPerMinute, burst int, ttl time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:     rate.Limit(float64(requestsPerMinute) / 60),
+		burst:     burst,
+		ttl:       ttl,
+		clients:   make(map[string]*rateClient),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetLimit changes the rate of every bucket, including those of clients
+// already seen
+func (rl *RateLimiter) SetLimit(requestsPerMinute int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limit = rate.Limit(float64(requestsPerMinute) / 60)
+	for _, c := range rl.clients {
+		c.limiter.SetLimit(rl.limit)
+	}
+}
+
+// Middleware answers 429 with a Retry-After header once a client's bucket is empty
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		limiter := rl.limiterFor(ClientIP(r), now)
+
+		reservation := limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rl *RateLimiter) limiterFor(ip string, now time.Time) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) >= rl.ttl {
+		for key, c := range rl.clients {
+			if now.Sub(c.lastSeen) >= rl.ttl {
+				delete(rl.clients, key)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	c, ok := rl.clients[ip]
+	if !ok {
+		c = &rateClient{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
+
+// ClientIP is the address r came from, without the port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
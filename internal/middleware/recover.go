@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"lift_learn/internal/metrics"
+)
+
+// RecoverMiddleware turns a panic in next into a logged stack trace and a 500
+// response, so one bad request can't take the whole server down
+func RecoverMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// net/http uses this panic to abort a response on purpose
+				panic(v)
+			}
+
+			metrics.PanicsRecovered.Inc()
+			RequestLogger(r, logger).Error("recovered from handler panic",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", v,
+				"stack", string(debug.Stack()))
+			writeJSONError(w, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
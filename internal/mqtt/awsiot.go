@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"lift_learn/internal/config"
+)
+
+// AWS IoT Core only delivers QoS 0 and 1
+const awsIoTQOS = 1
+
+// IoTClient receives deployments on lift-learn/{deviceId}/deploy and
+// commands on lift-learn/{deviceId}/command from AWS IoT Core
+type IoTClient struct {
+	client       paho.Client
+	deployTopic  string
+	commandTopic string
+}
+
+// ConnectAWSIoT dials the endpoint in cfg with the device's certificate and
+// subscribes to both topics, renewing the subscriptions after each
+// automatic reconnect. The session is persistent, so messages sent while
+// the device was offline are delivered when it reconnects. The handlers are
+// called on paho's goroutine and should hand long work off.
+func ConnectAWSIoT(cfg *config.AWSIoTConfig, deviceID string, logger *slog.Logger, onDeploy, onCommand func([]byte)) (*IoTClient, error) {
+	tlsConfig, err := awsIoTTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &IoTClient{
+		deployTopic:  fmt.Sprintf("%s/%s/deploy", config.DefaultMQTTTopicPrefix, deviceID),
+		commandTopic: fmt.Sprintf("%s/%s/command", config.DefaultMQTTTopicPrefix, deviceID),
+	}
+	handlers := map[string]func([]byte){c.deployTopic: onDeploy, c.commandTopic: onCommand}
+
+	opts := paho.NewClientOptions().
+		AddBroker(fmt.Sprintf("ssl://%s:%d", cfg.Endpoint, cfg.Port)).
+		SetClientID(cfg.ThingName).
+		SetTLSConfig(tlsConfig).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(maxReconnectInterval).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logger.Warn("AWS IoT connection lost", "endpoint", cfg.Endpoint, "err", err)
+		}).
+		SetOnConnectHandler(func(pc paho.Client) {
+			logger.Info("AWS IoT connected", "endpoint", cfg.Endpoint, "thing_name", cfg.ThingName)
+			for topic, handle := range handlers {
+				handle := handle
+				token := pc.Subscribe(topic, awsIoTQOS, func(_ paho.Client, msg paho.Message) {
+					handle(msg.Payload())
+				})
+				if token.WaitTimeout(operationTimeout) && token.Error() != nil {
+					logger.Error("AWS IoT subscribe failed", "topic", topic, "err", token.Error())
+				}
+			}
+		})
+
+	c.client = paho.NewClient(opts)
+	token := c.client.Connect()
+	if !token.WaitTimeout(operationTimeout) {
+		return nil, fmt.Errorf("timed out connecting to AWS IoT endpoint %s", cfg.Endpoint)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect to AWS IoT endpoint %s: %v", cfg.Endpoint, err)
+	}
+	return c, nil
+}
+
+// Mutual TLS with the device certificate, trusting CAFile when it is set
+func awsIoTTLSConfig(cfg *config.AWSIoTConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS IoT certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read AWS IoT CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// DeployTopic is where deployments are received
+func (c *IoTClient) DeployTopic() string {
+	return c.deployTopic
+}
+
+// CommandTopic is where commands are received
+func (c *IoTClient) CommandTopic() string {
+	return c.commandTopic
+}
+
+// Close disconnects from AWS IoT
+func (c *IoTClient) Close() error {
+	c.client.Disconnect(250)
+	return nil
+}
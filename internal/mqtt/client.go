@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"lift_learn/internal/config"
+)
+
+// Reconnect attempts back off from paho's 1s start, doubling up to this
+const maxReconnectInterval = 2 * time.Minute
+
+// How long Connect and Publish wait for the broker before giving up
+const operationTimeout = 10 * time.Second
+
+// Client publishes scan events to {prefix}/events/{deviceId} and receives
+// playback commands on {prefix}/commands/{deviceId}
+type Client struct {
+	client        paho.Client
+	qos           byte
+	eventsTopic   string
+	commandsTopic string
+	logger        *slog.Logger
+}
+
+// Connect dials the broker in cfg. onCommand gets the raw payload of every
+// message on the commands topic and may be nil for publish-only use. The
+// subscription is renewed after each automatic reconnect.
+func Connect(cfg *config.MQTTConfig, deviceID string, logger *slog.Logger, onCommand func([]byte)) (*Client, error) {
+	c := &Client{
+		qos:           cfg.QOS,
+		eventsTopic:   fmt.Sprintf("%s/events/%s", cfg.TopicPrefix, deviceID),
+		commandsTopic: fmt.Sprintf("%s/commands/%s", cfg.TopicPrefix, deviceID),
+		logger:        logger,
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(fmt.Sprintf("tcp://%s:%d", cfg.Broker, cfg.Port)).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(maxReconnectInterval).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logger.Warn("MQTT connection lost", "broker", cfg.Broker, "err", err)
+		}).
+		SetOnConnectHandler(func(pc paho.Client) {
+			logger.Info("MQTT connected", "broker", cfg.Broker)
+			if onCommand == nil {
+				return
+			}
+			token := pc.Subscribe(c.commandsTopic, c.qos, func(_ paho.Client, msg paho.Message) {
+				onCommand(msg.Payload())
+			})
+			if token.WaitTimeout(operationTimeout) && token.Error() != nil {
+				logger.Error("MQTT subscribe failed", "topic", c.commandsTopic, "err", token.Error())
+			}
+		})
+
+	c.client = paho.NewClient(opts)
+	token := c.client.Connect()
+	if !token.WaitTimeout(operationTimeout) {
+		return nil, fmt.Errorf("timed out connecting to MQTT broker %s", cfg.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker %s: %v", cfg.Broker, err)
+	}
+	return c, nil
+}
+
+// Publish sends v as JSON on the events topic
+func (c *Client) Publish(v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode MQTT payload: %v", err)
+	}
+	token := c.client.Publish(c.eventsTopic, c.qos, false, payload)
+	if !token.WaitTimeout(operationTimeout) {
+		return fmt.Errorf("timed out publishing to %s", c.eventsTopic)
+	}
+	return token.Error()
+}
+
+// EventsTopic is where Publish sends its messages
+func (c *Client) EventsTopic() string {
+	return c.eventsTopic
+}
+
+// Close disconnects, giving queued messages a moment to go out
+func (c *Client) Close() error {
+	c.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,70 @@
+package ndef
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"lift_learn/internal/atomicfile"
+)
+
+// Cache downloads media named by NDEF URI records into Dir, keyed by URL, so
+// a tag scanned again plays from disk
+type Cache struct {
+	Dir    string
+	Client *http.Client
+
+	mu sync.Mutex // one download at a time
+}
+
+// Fetch returns the local copy of rawURL, downloading it first if it isn't
+// cached yet. The file keeps the URL's extension so its media type can be
+// told from the name.
+func (c *Cache) Fetch(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("not an http(s) URL: %q", rawURL)
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	dest := filepath.Join(c.Dir, hex.EncodeToString(sum[:16])+path.Ext(u.Path))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := os.Stat(dest); err == nil {
+		return dest, nil
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create NDEF cache %s: %v", c.Dir, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: status %d", rawURL, resp.StatusCode)
+	}
+
+	err = atomicfile.Write(dest, 0644, func(f *os.File) error {
+		_, err := io.Copy(f, resp.Body)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s: %v", rawURL, err)
+	}
+	return dest, nil
+}
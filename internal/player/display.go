@@ -0,0 +1,54 @@
+package player
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Display is the monitor an MpvController draws on. Zero values are left to
+// mpv's defaults.
+type Display struct {
+	Width           int
+	Height          int
+	AspectRatio     string
+	RotationDegrees int
+	// Color around a video that doesn't fill the screen, as a name such as
+	// "black" or "#RRGGBB"
+	Background string
+}
+
+// mpv only takes colors as hex, so the common names are translated
+var colorNames = map[string]string{
+	"black": "#000000",
+	"white": "#FFFFFF",
+	"gray":  "#808080",
+	"grey":  "#808080",
+	"red":   "#FF0000",
+	"green": "#00FF00",
+	"blue":  "#0000FF",
+}
+
+func (d Display) background() string {
+	if hex, ok := colorNames[strings.ToLower(d.Background)]; ok {
+		return hex
+	}
+	return d.Background
+}
+
+// Args are the mpv command-line options for d
+func (d Display) Args() []string {
+	var args []string
+	if d.Width > 0 && d.Height > 0 {
+		args = append(args, fmt.Sprintf("--geometry=%dx%d", d.Width, d.Height))
+	}
+	if d.AspectRatio != "" {
+		args = append(args, "--video-aspect-override="+d.AspectRatio)
+	}
+	if d.RotationDegrees != 0 {
+		args = append(args, fmt.Sprintf("--video-rotate=%d", d.RotationDegrees))
+	}
+	if d.Background != "" {
+		args = append(args, "--background="+d.background())
+	}
+	return args
+}
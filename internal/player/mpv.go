@@ -0,0 +1,390 @@
+package player
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for mpv to create its IPC socket after starting
+const socketWaitTimeout = 5 * time.Second
+
+// MpvController keeps a single mpv process running and switches videos by
+// writing JSON IPC commands to its --input-ipc-server socket, so the screen
+// never goes blank between videos.
+type MpvController struct {
+	mu         sync.Mutex
+	logger     *slog.Logger
+	socketPath string
+	args       []string
+	display    Display
+	cmd        *exec.Cmd
+	conn       net.Conn
+	requestID  int
+	current    string // file most recently passed to LoadFile
+	ended      chan PlaybackEnded
+	osdTimer   *time.Timer
+}
+
+// ipcCommand is one line of mpv's JSON IPC protocol. Command is either a list
+// of arguments or, for commands with named arguments, a map.
+type ipcCommand struct {
+	Command   interface{} `json:"command"`
+	RequestID int         `json:"request_id"`
+}
+
+// Overlay ID the product text is drawn under, so each one replaces the last
+const osdOverlayID = 1
+
+// OSDStyle is how ShowOSD draws its text. Color is "#RRGGBB"; Position is
+// "top-left", "top-right", "bottom-left" or "bottom-right".
+type OSDStyle struct {
+	FontSize int
+	Color    string
+	Position string
+}
+
+// ASS alignment codes (numpad layout) for each OSD position
+var osdAlignments = map[string]int{
+	"top-left":     7,
+	"top-right":    9,
+	"bottom-left":  1,
+	"bottom-right": 3,
+}
+
+// ipcMessage is a reply or event read back from the socket
+type ipcMessage struct {
+	RequestID int    `json:"request_id"`
+	Error     string `json:"error"`
+	Event     string `json:"event"`
+	// Why an "end-file" event happened: "eof" when the file played out,
+	// "stop" when loadfile replaced it
+	Reason string `json:"reason"`
+}
+
+// NewMpvController returns a controller that runs mpv with args plus the IPC
+// server on socketPath. mpv is not started until Start or the first command.
+func NewMpvController(logger *slog.Logger, socketPath string, args ...string) *MpvController {
+	return &MpvController{
+		logger:     logger,
+		socketPath: socketPath,
+		args:       args,
+		ended:      make(chan PlaybackEnded, 4),
+	}
+}
+
+// Ended delivers a PlaybackEnded each time a file finishes on its own. Files
+// replaced by the next LoadFile are not reported.
+func (m *MpvController) Ended() <-chan PlaybackEnded {
+	return m.ended
+}
+
+// SetDisplay replaces the display options mpv is started with, e.g. after
+// the config was reloaded. Rotation, aspect ratio and background are applied
+// to a running mpv straight away; a new geometry needs mpv to be restarted.
+func (m *MpvController) SetDisplay(d Display) error {
+	m.mu.Lock()
+	m.display = d
+	running := m.conn != nil
+	m.mu.Unlock()
+	if !running {
+		return nil
+	}
+
+	aspect := d.AspectRatio
+	if aspect == "" {
+		aspect = "no"
+	}
+	if err := m.send("set_property", "video-aspect-override", aspect); err != nil {
+		return err
+	}
+	if err := m.send("set_property", "video-rotate", d.RotationDegrees); err != nil {
+		return err
+	}
+	if d.Background != "" {
+		return m.send("set_property", "background", d.background())
+	}
+	return nil
+}
+
+// Start launches mpv in idle mode and connects to its IPC socket
+func (m *MpvController) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.startLocked()
+}
+
+// LoadFile replaces whatever is playing with the file at path. Options are
+// mpv command-line style ("--speed=1.5", "--no-audio") and are applied as
+// properties first, so they stay in effect until changed again.
+func (m *MpvController) LoadFile(path string, options ...string) error {
+	for _, opt := range options {
+		name, value, err := parseOption(opt)
+		if err != nil {
+			return err
+		}
+		if err := m.send("set_property", name, value); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.current = path
+	m.mu.Unlock()
+	return m.send("loadfile", path, "replace")
+}
+
+// ShowOSD draws lines over the video with mpv's osd-overlay and clears them
+// again after duration. A new call replaces the previous text.
+func (m *MpvController) ShowOSD(lines []string, style OSDStyle, duration time.Duration) error {
+	if err := m.sendOverlay("ass-events", osdEvents(lines, style)); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.osdTimer != nil {
+		m.osdTimer.Stop()
+	}
+	m.osdTimer = time.AfterFunc(duration, func() {
+		if err := m.sendOverlay("none", ""); err != nil {
+			m.logger.Warn("failed to clear OSD", "err", err)
+		}
+	})
+	return nil
+}
+
+func (m *MpvController) sendOverlay(format, data string) error {
+	return m.sendCommand(map[string]interface{}{
+		"name":   "osd-overlay",
+		"id":     osdOverlayID,
+		"format": format,
+		"data":   data,
+	})
+}
+
+// ASS markup for lines in style. Override blocks and escapes in the text
+// itself are stripped so product names can't restyle the overlay.
+func osdEvents(lines []string, style OSDStyle) string {
+	align, ok := osdAlignments[style.Position]
+	if !ok {
+		align = osdAlignments["top-left"]
+	}
+	color := strings.TrimPrefix(style.Color, "#")
+	if len(color) != 6 {
+		color = "FFFFFF"
+	}
+	// ASS colours are blue, green, red
+	bgr := color[4:6] + color[2:4] + color[0:2]
+
+	clean := strings.NewReplacer("{", "", "}", "", "\\", "")
+	escaped := make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = clean.Replace(line)
+	}
+	return fmt.Sprintf("{\\an%d\\fs%d\\1c&H%s&}%s", align, style.FontSize, bgr, strings.Join(escaped, "\\N"))
+}
+
+// SetProperty sets one mpv property on the running instance
+func (m *MpvController) SetProperty(name string, value interface{}) error {
+	return m.send("set_property", name, value)
+}
+
+// Seek jumps to seconds into the current file, to the exact frame
+func (m *MpvController) Seek(seconds float64) error {
+	return m.send("seek", seconds, "absolute+exact")
+}
+
+// Stop clears the screen to black, leaving mpv idle
+func (m *MpvController) Stop() error {
+	return m.send("stop")
+}
+
+// Fade moves each property from its first value to its second over duration,
+// in fadeSteps even steps
+func (m *MpvController) Fade(duration time.Duration, properties map[string][2]float64) error {
+	for step := 1; step <= fadeSteps; step++ {
+		for name, r := range properties {
+			value := r[0] + (r[1]-r[0])*float64(step)/fadeSteps
+			if err := m.send("set_property", name, value); err != nil {
+				return err
+			}
+		}
+		time.Sleep(duration / fadeSteps)
+	}
+	return nil
+}
+
+// Options whose command-line name differs from the property that controls them
+var optionProperties = map[string]string{
+	"audio": "aid",
+	"video": "vid",
+}
+
+// Split "--name=value" into a property and value; "--no-name" sets it to "no"
+func parseOption(opt string) (string, string, error) {
+	if !strings.HasPrefix(opt, "--") {
+		return "", "", fmt.Errorf("invalid mpv option %q", opt)
+	}
+	opt = strings.TrimPrefix(opt, "--")
+
+	name, value, ok := strings.Cut(opt, "=")
+	if !ok {
+		if strings.HasPrefix(name, "no-") {
+			name, value = strings.TrimPrefix(name, "no-"), "no"
+		} else {
+			value = "yes"
+		}
+	}
+	if prop, ok := optionProperties[name]; ok {
+		name = prop
+	}
+	return name, value, nil
+}
+
+// Quit asks mpv to exit and releases the socket
+func (m *MpvController) Quit() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		return nil
+	}
+	err := m.writeLocked([]interface{}{"quit"})
+	m.closeLocked()
+	return err
+}
+
+func (m *MpvController) startLocked() error {
+	os.Remove(m.socketPath)
+
+	args := append([]string{"--idle=yes", "--input-ipc-server=" + m.socketPath}, m.args...)
+	args = append(args, m.display.Args()...)
+	cmd := exec.Command("mpv", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start mpv: %v", err)
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			m.logger.Warn("mpv process exited", "socket", m.socketPath, "err", err)
+		}
+	}()
+
+	conn, err := dialSocket(m.socketPath, socketWaitTimeout)
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	m.cmd = cmd
+	m.conn = conn
+	go m.readReplies(conn)
+	m.logger.Info("mpv started", "socket", m.socketPath)
+	return nil
+}
+
+// Send a command, restarting mpv once if it has crashed and the socket is gone
+func (m *MpvController) send(args ...interface{}) error {
+	return m.sendCommand(args)
+}
+
+// send for a command given as an argument list or a named-argument map
+func (m *MpvController) sendCommand(command interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		if err := m.startLocked(); err != nil {
+			return err
+		}
+	}
+
+	if err := m.writeLocked(command); err != nil {
+		m.logger.Warn("mpv IPC write failed, restarting mpv", "socket", m.socketPath, "err", err)
+		m.closeLocked()
+		if err := m.startLocked(); err != nil {
+			return err
+		}
+		return m.writeLocked(command)
+	}
+	return nil
+}
+
+func (m *MpvController) writeLocked(command interface{}) error {
+	m.requestID++
+	data, err := json.Marshal(ipcCommand{Command: command, RequestID: m.requestID})
+	if err != nil {
+		return fmt.Errorf("failed to encode mpv command: %v", err)
+	}
+
+	m.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := m.conn.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write to mpv socket: %v", err)
+	}
+	return nil
+}
+
+func (m *MpvController) closeLocked() {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	if m.cmd != nil && m.cmd.Process != nil {
+		m.cmd.Process.Kill()
+		m.cmd = nil
+	}
+}
+
+// Drain replies so mpv never blocks on a full socket, logging failed commands.
+// When mpv exits the socket closes and the next command restarts it.
+func (m *MpvController) readReplies(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var msg ipcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		if msg.RequestID != 0 && msg.Error != "success" {
+			m.logger.Warn("mpv command failed", "request_id", msg.RequestID, "error", msg.Error)
+		}
+		if msg.Event == "end-file" && msg.Reason == "eof" {
+			m.mu.Lock()
+			path := m.current
+			m.mu.Unlock()
+			select {
+			case m.ended <- PlaybackEnded{Path: path}:
+			default:
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == conn {
+		m.logger.Warn("mpv IPC socket closed", "socket", m.socketPath)
+		m.closeLocked()
+	}
+}
+
+// Wait for mpv to create the socket and connect to it
+func dialSocket(path string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to connect to mpv socket %s: %v", path, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
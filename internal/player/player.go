@@ -0,0 +1,162 @@
+package player
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PlaybackEnded reports that the media at Path finished by itself, as opposed
+// to being stopped for something else
+type PlaybackEnded struct {
+	Path string
+}
+
+// Player shows one kind of media. Play starts path and returns a cancel
+// func that stops it again; cancel is safe to call more than once.
+type Player interface {
+	Play(path string) (cancel func(), err error)
+}
+
+// Ways MpvVideoPlayer can switch from one video to the next
+const (
+	TransitionNone  = "none"
+	TransitionBlack = "black" // stop, hold a black screen, then start
+	TransitionFade  = "fade"  // fade picture and sound out, then back in
+)
+
+// Transition is applied every time MpvVideoPlayer loads a video
+type Transition struct {
+	Type     string
+	Duration time.Duration
+}
+
+// Steps a fade is broken into; each is one set_property round per property
+const fadeSteps = 10
+
+// MpvVideoPlayer plays videos in the screen's long-running mpv instance.
+// Cancelling is a no-op: the next video or the idle loop simply replaces it.
+type MpvVideoPlayer struct {
+	mpv        *MpvController
+	transition Transition
+}
+
+func NewMpvVideoPlayer(mpv *MpvController, transition Transition) *MpvVideoPlayer {
+	return &MpvVideoPlayer{mpv: mpv, transition: transition}
+}
+
+func (p *MpvVideoPlayer) Play(path string) (func(), error) {
+	return p.PlayWithOptions(path)
+}
+
+// PlayWithOptions plays path with per-file mpv options, see LoadFile
+// Blocks for the length of the transition.
+func (p *MpvVideoPlayer) PlayWithOptions(path string, options ...string) (func(), error) {
+	switch p.transition.Type {
+	case TransitionBlack:
+		if err := p.mpv.Stop(); err != nil {
+			return nil, err
+		}
+		time.Sleep(p.transition.Duration)
+	case TransitionFade:
+		// One window per screen rules out a true crossfade, so fade
+		// through black: brightness and volume down, switch, back up
+		half := p.transition.Duration / 2
+		if err := p.mpv.Fade(half, map[string][2]float64{"brightness": {0, -100}, "volume": {100, 0}}); err != nil {
+			return nil, err
+		}
+		if err := p.mpv.LoadFile(path, append(options, "--volume=0")...); err != nil {
+			return nil, err
+		}
+		if err := p.mpv.Fade(half, map[string][2]float64{"brightness": {-100, 0}, "volume": {0, 100}}); err != nil {
+			return nil, err
+		}
+		return func() {}, nil
+	}
+
+	if err := p.mpv.LoadFile(path, options...); err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
+
+// ImageDisplayPlayer shows a still image full screen with feh, or with
+// ImageMagick's display, for a fixed duration. Reaching the end of the
+// duration is reported on ended.
+type ImageDisplayPlayer struct {
+	logger   *slog.Logger
+	viewer   string
+	duration time.Duration
+	ended    chan<- PlaybackEnded
+}
+
+func NewImageDisplayPlayer(logger *slog.Logger, viewer string, duration time.Duration, ended chan<- PlaybackEnded) *ImageDisplayPlayer {
+	return &ImageDisplayPlayer{logger: logger, viewer: viewer, duration: duration, ended: ended}
+}
+
+func (p *ImageDisplayPlayer) Play(path string) (func(), error) {
+	var args []string
+	if filepath.Base(p.viewer) == "display" {
+		args = []string{"-backdrop", "-window", "root", path}
+	} else {
+		args = []string{"--fullscreen", "--hide-pointer", path}
+	}
+	return startProcess(p.logger, p.duration, p.ended, path, p.viewer, args...)
+}
+
+// MpvAudioPlayer plays an audio clip in a separate, windowless mpv and
+// reports on ended when the clip has played out
+type MpvAudioPlayer struct {
+	logger *slog.Logger
+	ended  chan<- PlaybackEnded
+}
+
+func NewMpvAudioPlayer(logger *slog.Logger, ended chan<- PlaybackEnded) *MpvAudioPlayer {
+	return &MpvAudioPlayer{logger: logger, ended: ended}
+}
+
+func (p *MpvAudioPlayer) Play(path string) (func(), error) {
+	return startProcess(p.logger, 0, p.ended, path, "mpv", "--no-video", "--really-quiet", path)
+}
+
+// Run name with args until it exits, cancel is called or, when duration is
+// non-zero, duration has passed. Unless it was cancelled, the end of path's
+// playback is sent on ended.
+func startProcess(logger *slog.Logger, duration time.Duration, ended chan<- PlaybackEnded, path, name string, args ...string) (func(), error) {
+	cmd := exec.Command(name, args...)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", name, err)
+	}
+
+	// The process is killed either way; only a kill through cancel is deliberate
+	var cancelled atomic.Bool
+	var once sync.Once
+	kill := func() {
+		once.Do(func() { cmd.Process.Kill() })
+	}
+	cancel := func() {
+		cancelled.Store(true)
+		kill()
+	}
+	if duration > 0 {
+		time.AfterFunc(duration, kill)
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logger.Debug("media process exited", "command", name, "err", err)
+		}
+		if cancelled.Load() || ended == nil {
+			return
+		}
+		select {
+		case ended <- PlaybackEnded{Path: path}:
+		default:
+		}
+	}()
+	return cancel, nil
+}
@@ -0,0 +1,297 @@
+package player
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PrewarmPool keeps up to max videos loaded in mpv instances of their own,
+// paused on the first frame in a minimized window, so a scan only has to
+// unpause one instead of waiting for mpv to open the file. Once the pool is
+// full, the least recently played video makes room for a new one.
+type PrewarmPool struct {
+	logger     *slog.Logger
+	socketBase string
+	args       []string
+	max        int
+	ended      chan PlaybackEnded
+
+	// Held across a whole Warm, which starts mpv processes, so that only
+	// one runs at a time; mu alone is never held while waiting on mpv
+	warmMu sync.Mutex
+
+	mu      sync.Mutex
+	display Display
+	entries map[string]*prewarmed
+	nextID  int
+}
+
+// One warmed video and the mpv instance holding it
+type prewarmed struct {
+	mpv        *MpvController
+	modTime    time.Time // of the file when it was loaded
+	lastPlayed time.Time
+	done       chan struct{}
+}
+
+// NewPrewarmPool returns an empty pool whose mpv instances run with args and
+// IPC sockets named after socketBase
+func NewPrewarmPool(logger *slog.Logger, socketBase string, max int, args ...string) *PrewarmPool {
+	return &PrewarmPool{
+		logger:     logger,
+		socketBase: socketBase,
+		args:       args,
+		max:        max,
+		ended:      make(chan PlaybackEnded, 4),
+		entries:    make(map[string]*prewarmed),
+	}
+}
+
+// Ended delivers a PlaybackEnded each time a warmed video that was playing
+// finishes on its own
+func (p *PrewarmPool) Ended() <-chan PlaybackEnded {
+	return p.ended
+}
+
+// SetDisplay sets the display options instances are started with and
+// passes them on to the running ones
+func (p *PrewarmPool) SetDisplay(d Display) {
+	p.mu.Lock()
+	p.display = d
+	var running []*MpvController
+	for _, e := range p.entries {
+		running = append(running, e.mpv)
+	}
+	p.mu.Unlock()
+
+	for _, m := range running {
+		if err := m.SetDisplay(d); err != nil {
+			p.logger.Warn("failed to update pre-warmed display", "err", err)
+		}
+	}
+}
+
+// Warm makes the pool hold the first max of paths, which are in order of
+// preference, e.g. most recently deployed first. Warmed videos no longer in
+// paths are dropped, and so are those whose file was replaced since, e.g. by
+// a redeployment, to be loaded afresh. When every slot is taken by one still
+// wanted, the least recently played of those not among the first max gives
+// way.
+func (p *PrewarmPool) Warm(paths []string) {
+	p.warmMu.Lock()
+	defer p.warmMu.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, path := range paths {
+		if len(wanted) == p.max {
+			break
+		}
+		wanted[path] = true
+	}
+	listed := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		listed[path] = true
+	}
+
+	p.mu.Lock()
+	var evicted []*prewarmed
+	for path, e := range p.entries {
+		if !listed[path] || !unchanged(path, e.modTime) {
+			delete(p.entries, path)
+			evicted = append(evicted, e)
+		}
+	}
+	var missing []string
+	for path := range wanted {
+		if _, ok := p.entries[path]; !ok {
+			missing = append(missing, path)
+		}
+	}
+	for range missing {
+		if len(p.entries) < p.max {
+			break
+		}
+		if e := p.evictLocked(wanted); e != nil {
+			evicted = append(evicted, e)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, e := range evicted {
+		close(e.done)
+		e.mpv.Quit()
+	}
+
+	for _, path := range missing {
+		p.mu.Lock()
+		full := len(p.entries) >= p.max
+		p.mu.Unlock()
+		if full {
+			break
+		}
+		e, err := p.load(path)
+		if err != nil {
+			p.logger.Warn("failed to pre-warm video", "path", path, "err", err)
+			continue
+		}
+		p.mu.Lock()
+		p.entries[path] = e
+		p.mu.Unlock()
+		p.logger.Info("pre-warmed video", "path", path)
+	}
+}
+
+// Remove and return the least recently played entry not in keep
+func (p *PrewarmPool) evictLocked(keep map[string]bool) *prewarmed {
+	var oldestPath string
+	var oldest *prewarmed
+	for path, e := range p.entries {
+		if keep[path] {
+			continue
+		}
+		if oldest == nil || e.lastPlayed.Before(oldest.lastPlayed) {
+			oldestPath, oldest = path, e
+		}
+	}
+	if oldest != nil {
+		delete(p.entries, oldestPath)
+	}
+	return oldest
+}
+
+// Start an instance with path loaded and paused on its first frame
+func (p *PrewarmPool) load(path string) (*prewarmed, error) {
+	p.mu.Lock()
+	p.nextID++
+	socket := fmt.Sprintf("%s-prewarm-%d", p.socketBase, p.nextID)
+	display := p.display
+	p.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"--pause", "--window-minimized=yes", "--keep-open=yes"}, p.args...)
+	m := NewMpvController(p.logger.With("prewarm", path), socket, args...)
+	if err := m.SetDisplay(display); err != nil {
+		return nil, err
+	}
+	if err := m.LoadFile(path); err != nil {
+		m.Quit()
+		return nil, err
+	}
+
+	e := &prewarmed{mpv: m, modTime: info.ModTime(), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case ended := <-m.Ended():
+				select {
+				case p.ended <- ended:
+				default:
+				}
+			case <-e.done:
+				return
+			}
+		}
+	}()
+	return e, nil
+}
+
+// Play brings the warmed instance for path to the front and unpauses it,
+// after applying options as LoadFile would; --start seeks instead, as the
+// file is already open. ok is false when path isn't warmed. The returned
+// stop pauses it again, rewinds it to the first frame and hides it.
+func (p *PrewarmPool) Play(path string, options ...string) (stop func(), ok bool, err error) {
+	p.mu.Lock()
+	e, ok := p.entries[path]
+	if ok {
+		e.lastPlayed = time.Now()
+	}
+	p.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	m := e.mpv
+	for _, opt := range options {
+		name, value, err := parseOption(opt)
+		if err != nil {
+			return nil, true, err
+		}
+		if name == "start" {
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, true, fmt.Errorf("invalid start offset %q", value)
+			}
+			err = m.Seek(seconds)
+		} else {
+			err = m.SetProperty(name, value)
+		}
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	if err := setProperties(m, property{"window-minimized", false}, property{"ontop", true}, property{"pause", false}); err != nil {
+		return nil, true, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			// An evicted instance has quit; talking to it would restart it
+			p.mu.Lock()
+			current := p.entries[path] == e
+			p.mu.Unlock()
+			if !current {
+				return
+			}
+			if err := setProperties(m, property{"pause", true}, property{"ontop", false}, property{"window-minimized", true}); err != nil {
+				p.logger.Warn("failed to park pre-warmed video", "path", path, "err", err)
+				return
+			}
+			if err := m.Seek(0); err != nil {
+				p.logger.Warn("failed to rewind pre-warmed video", "path", path, "err", err)
+			}
+		})
+	}, true, nil
+}
+
+// Reports whether the file at path still has modTime
+func unchanged(path string, modTime time.Time) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.ModTime().Equal(modTime)
+}
+
+type property struct {
+	name  string
+	value interface{}
+}
+
+// Set each property in turn, stopping at the first that fails
+func setProperties(m *MpvController, props ...property) error {
+	for _, prop := range props {
+		if err := m.SetProperty(prop.name, prop.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close quits every instance in the pool
+func (p *PrewarmPool) Close() {
+	p.mu.Lock()
+	entries := p.entries
+	p.entries = make(map[string]*prewarmed)
+	p.mu.Unlock()
+
+	for _, e := range entries {
+		close(e.done)
+		e.mpv.Quit()
+	}
+}
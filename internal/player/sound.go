@@ -0,0 +1,28 @@
+package player
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PlaySound plays the audio file at path in the background and returns
+// straight away. WAV files go to aplay, anything else to an audio-only mpv.
+// The player is killed after timeout, so a hung audio device never leaves it
+// running.
+func PlaySound(logger *slog.Logger, path string, timeout time.Duration) {
+	name, args := "mpv", []string{"--no-video", "--really-quiet", path}
+	if strings.EqualFold(filepath.Ext(path), ".wav") {
+		name, args = "aplay", []string{"-q", path}
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := exec.CommandContext(ctx, name, args...).Run(); err != nil && ctx.Err() == nil {
+			logger.Warn("failed to play sound", "path", path, "player", name, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,98 @@
+// Package profiling serves runtime profiles in the format go tool pprof
+// reads, on a server of its own. net/http/pprof is deliberately not used:
+// importing it registers its handlers on http.DefaultServeMux, which the
+// upload server's routes live on.
+//
+// With the server running on a device, from a workstation:
+//
+//	ssh -L 6060:localhost:6060 pi@device
+//	go tool pprof http://localhost:6060/debug/pprof/profile?seconds=30
+//	go tool pprof http://localhost:6060/debug/pprof/heap
+//	go tool pprof http://localhost:6060/debug/pprof/mutex
+//	curl 'http://localhost:6060/debug/pprof/goroutine?debug=2'
+package profiling
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+)
+
+// Longest CPU profile a single request may ask for
+const maxCPUProfile = 5 * time.Minute
+
+// NewServer returns a server for the profiles on localhost:port. It only
+// listens on loopback, so reaching it from elsewhere needs an SSH tunnel.
+// Mutex contention sampling is switched on as a side effect.
+func NewServer(port int) *http.Server {
+	runtime.SetMutexProfileFraction(5)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", handleIndex)
+	mux.HandleFunc("/debug/pprof/profile", handleCPU)
+	for _, p := range pprof.Profiles() {
+		mux.HandleFunc("/debug/pprof/"+p.Name(), handleProfile(p.Name()))
+	}
+	return &http.Server{Addr: fmt.Sprintf("127.0.0.1:%d", port), Handler: mux}
+}
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/debug/pprof/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "profile?seconds=N  CPU profile")
+	for _, p := range pprof.Profiles() {
+		fmt.Fprintf(w, "%-18s %d\n", p.Name(), p.Count())
+	}
+}
+
+// Serves a named profile such as heap or goroutine. debug=1 or 2 gives text
+// instead of the binary format.
+func handleProfile(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if name == "heap" && r.URL.Query().Get("gc") != "" {
+			runtime.GC()
+		}
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		}
+		if err := pprof.Lookup(name).WriteTo(w, debug); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Records a CPU profile for ?seconds (default 30) and sends it
+func handleCPU(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = 30
+	}
+	duration := time.Duration(seconds) * time.Second
+	if duration > maxCPUProfile {
+		duration = maxCPUProfile
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Most likely another CPU profile is already running
+		w.Header().Del("Content-Disposition")
+		http.Error(w, fmt.Sprintf("Could not enable CPU profiling: %v", err), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-time.After(duration):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+}
@@ -0,0 +1,118 @@
+// Package provision manages the device's own keypair and the certificate the
+// cloud issues for it, which identify the device more strongly than its
+// configured device ID.
+package provision
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"lift_learn/internal/atomicfile"
+)
+
+// LoadOrCreateKey reads the P-256 private key at path, generating and saving
+// a new one (readable by the owner only) when there is none yet or when
+// regenerate is set. created reports whether a new key was made.
+func LoadOrCreateKey(path string, regenerate bool) (key *ecdsa.PrivateKey, created bool, err error) {
+	if !regenerate {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			key, err := parseKey(data)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to parse device key %s: %v", path, err)
+			}
+			return key, false, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("failed to read device key %s: %v", path, err)
+		}
+	}
+
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to generate device key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode device key: %v", err)
+	}
+	err = atomicfile.Write(path, 0600, func(f *os.File) error {
+		return pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to write device key %s: %v", path, err)
+	}
+	return key, true, nil
+}
+
+func parseKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, fmt.Errorf("no EC PRIVATE KEY block")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("key is not on P-256")
+	}
+	return key, nil
+}
+
+// PublicKeyPEM is the key's public half as a PEM "PUBLIC KEY" block
+func PublicKeyPEM(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// SaveCertificate stores a PEM certificate issued for key at path, after
+// checking it really is for that key
+func SaveCertificate(path string, certPEM []byte, key *ecdsa.PrivateKey) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("device certificate is not a PEM CERTIFICATE")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse device certificate: %v", err)
+	}
+	if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+		return fmt.Errorf("device certificate is not for the device key")
+	}
+
+	err = atomicfile.Write(path, 0644, func(f *os.File) error {
+		_, err := f.Write(certPEM)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write device certificate %s: %v", path, err)
+	}
+	return nil
+}
+
+// ClientCertificate returns a tls.Config.GetClientCertificate that presents
+// the device certificate at certFile with the key at keyFile. The files are
+// read on every handshake, so a certificate saved after startup is used
+// without rebuilding the client. No certificate is sent while there is none.
+func ClientCertificate(certFile, keyFile string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			return &tls.Certificate{}, nil
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load device certificate: %v", err)
+		}
+		return &cert, nil
+	}
+}
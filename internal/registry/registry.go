@@ -0,0 +1,273 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"lift_learn/internal/content"
+	"lift_learn/internal/fsys"
+)
+
+// Entry maps one NFC tag to the content it plays
+type Entry struct {
+	NfcTagId     string `json:"nfcTagId"`
+	ProductId    string `json:"productId"`
+	ProductName  string `json:"productName"`
+	ProjectId    string `json:"projectId"`
+	MediaType    string `json:"mediaType,omitempty"`
+	VideoPath    string `json:"videoPath"`
+	MetadataPath string `json:"metadataPath,omitempty"`
+}
+
+// Registry is the single source of NFC-to-video mappings shared by the
+// upload server (which writes it) and lift_learn (which reads it). It is
+// persisted as a JSON object keyed by tag UID and rewritten atomically.
+type Registry struct {
+	mu      sync.RWMutex
+	fs      fsys.FileSystem
+	path    string
+	entries map[string]Entry
+}
+
+// Load reads the registry file at path; a missing file yields an empty registry
+func Load(path string) (*Registry, error) {
+	return LoadFS(fsys.OS{}, path)
+}
+
+// LoadFS is Load on the given filesystem, which the registry also saves to
+func LoadFS(fs fsys.FileSystem, path string) (*Registry, error) {
+	r := &Registry{fs: fs, path: path, entries: make(map[string]Entry)}
+
+	data, err := fs.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry %s: %v", path, err)
+	}
+	var entries map[string]Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse registry %s: %v", path, err)
+	}
+	// Files written before UIDs were normalized can hold a tag in any
+	// reader's format. Keys are visited in order so a tag saved under two
+	// spellings always keeps the same one.
+	uids := make([]string, 0, len(entries))
+	for uid := range entries {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		e := entries[uid]
+		e.NfcTagId = uid
+		r.putLocked(e)
+	}
+	return r, nil
+}
+
+// Lookup returns the entry for a tag UID in any of the forms NormalizeUID
+// accepts
+func (r *Registry) Lookup(uid string) (Entry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e, ok := r.entries[NormalizeUID(uid)]
+	return e, ok
+}
+
+// Entries returns a copy of every mapping keyed by tag UID
+func (r *Registry) Entries() map[string]Entry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entries := make(map[string]Entry, len(r.entries))
+	for uid, e := range r.entries {
+		entries[uid] = e
+	}
+	return entries
+}
+
+// Set adds or replaces the mapping for e.NfcTagId and saves the registry.
+// Like every write, it stores the tag under its normalized UID.
+func (r *Registry) Set(e Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.putLocked(e)
+	return r.saveLocked()
+}
+
+// SetAll adds or replaces the mappings for every entry and saves the
+// registry once, so readers see either none or all of them
+func (r *Registry) SetAll(entries []Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range entries {
+		r.putLocked(e)
+	}
+	return r.saveLocked()
+}
+
+// Reassign moves a mapping from oldUID to e.NfcTagId and saves the registry
+// once. An empty or unknown oldUID only adds e.
+func (r *Registry) Reassign(oldUID string, e Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if oldUID != "" {
+		delete(r.entries, NormalizeUID(oldUID))
+	}
+	r.putLocked(e)
+	return r.saveLocked()
+}
+
+// Update hands fn a copy of every mapping to change in place. The registry
+// takes on the changed copy, with its keys normalized, and is saved only if
+// fn returns nil, so a batch of changes is applied either entirely or not
+// at all.
+func (r *Registry) Update(fn func(entries map[string]Entry) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make(map[string]Entry, len(r.entries))
+	for uid, e := range r.entries {
+		entries[uid] = e
+	}
+	if err := fn(entries); err != nil {
+		return err
+	}
+
+	old := r.entries
+	r.entries = make(map[string]Entry, len(entries))
+	for uid, e := range entries {
+		e.NfcTagId = uid
+		r.putLocked(e)
+	}
+	if err := r.saveLocked(); err != nil {
+		r.entries = old
+		return err
+	}
+	return nil
+}
+
+// ReplaceUnder swaps every mapping whose video lives under dir for entries
+// and saves the registry once
+func (r *Registry) ReplaceUnder(dir string, entries []Entry) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for uid, e := range r.entries {
+		absVideo, err := filepath.Abs(e.VideoPath)
+		if err == nil && strings.HasPrefix(absVideo, absDir+string(filepath.Separator)) {
+			delete(r.entries, uid)
+		}
+	}
+	for _, e := range entries {
+		r.putLocked(e)
+	}
+	return r.saveLocked()
+}
+
+// RemoveVideo drops every mapping that still plays videoPath and saves the
+// registry, returning how many were removed
+func (r *Registry) RemoveVideo(videoPath string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed := 0
+	for uid, e := range r.entries {
+		if e.VideoPath == videoPath {
+			delete(r.entries, uid)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, r.saveLocked()
+}
+
+// RemoveUnder drops every mapping whose video lives under dir and saves the
+// registry, returning how many were removed
+func (r *Registry) RemoveUnder(dir string) (int, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed := 0
+	for uid, e := range r.entries {
+		absVideo, err := filepath.Abs(e.VideoPath)
+		if err == nil && strings.HasPrefix(absVideo, absDir+string(filepath.Separator)) {
+			delete(r.entries, uid)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, r.saveLocked()
+}
+
+// Rebuild replaces the registry with mappings reconstructed from the
+// per-Thing metadata files under storagePath, for recovery when the
+// registry file is lost or out of sync
+func (r *Registry) Rebuild(storagePath string) error {
+	projects, err := content.ScanDirectoryFS(r.fs, storagePath)
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %v", storagePath, err)
+	}
+
+	entries := make(map[string]Entry)
+	for _, p := range projects {
+		for _, t := range p.Things {
+			if !t.MetadataPresent || t.NfcTagId == "" {
+				continue
+			}
+			uid := NormalizeUID(t.NfcTagId)
+			entries[uid] = Entry{
+				NfcTagId:     uid,
+				ProductId:    t.ProductId,
+				ProductName:  t.ProductName,
+				ProjectId:    p.ProjectId,
+				MediaType:    t.MediaType,
+				VideoPath:    t.LocalVideoPath,
+				MetadataPath: t.MetadataPath,
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = entries
+	return r.saveLocked()
+}
+
+// Stores e under its normalized UID, so a tag written in any reader's
+// format replaces rather than duplicates its existing mapping
+func (r *Registry) putLocked(e Entry) {
+	e.NfcTagId = NormalizeUID(e.NfcTagId)
+	r.entries[e.NfcTagId] = e
+}
+
+func (r *Registry) saveLocked() error {
+	data, err := json.MarshalIndent(r.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.fs.WriteFile(r.path, append(data, '\n'), 0644)
+}
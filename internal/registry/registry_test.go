@@ -0,0 +1,284 @@
+package registry
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"lift_learn/internal/content"
+	"lift_learn/internal/fsys"
+)
+
+var registryPath = filepath.FromSlash("/var/lib/lift_learn/registry.json")
+
+func entry(uid, project, product string) Entry {
+	return Entry{
+		NfcTagId:  uid,
+		ProductId: product,
+		ProjectId: project,
+		VideoPath: filepath.Join(filepath.FromSlash("/content"), project, product+".mp4"),
+	}
+}
+
+// Loads the registry back from mem, as lift_learn would
+func reload(t *testing.T, mem *fsys.Mem) map[string]Entry {
+	t.Helper()
+	r, err := LoadFS(mem, registryPath)
+	if err != nil {
+		t.Fatalf("LoadFS: %v", err)
+	}
+	return r.Entries()
+}
+
+func TestLoadFSMissingFile(t *testing.T) {
+	r, err := LoadFS(fsys.NewMem(), registryPath)
+	if err != nil {
+		t.Fatalf("LoadFS: %v", err)
+	}
+	if n := len(r.Entries()); n != 0 {
+		t.Errorf("got %d entries, want none", n)
+	}
+}
+
+func TestLoadFSCorruptFile(t *testing.T) {
+	mem := fsys.NewMem()
+	if err := mem.WriteFile(registryPath, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFS(mem, registryPath); err == nil {
+		t.Error("expected an error for a corrupt registry")
+	}
+}
+
+func TestLoadFSNormalizesUIDs(t *testing.T) {
+	mem := fsys.NewMem()
+	legacy := `{
+  "a1:b2:c3:d4": {"nfcTagId": "a1:b2:c3:d4", "productId": "a"},
+  "e5 f6": {"nfcTagId": "e5 f6", "productId": "e"}
+}`
+	if err := mem.WriteFile(registryPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadFS(mem, registryPath)
+	if err != nil {
+		t.Fatalf("LoadFS: %v", err)
+	}
+
+	got := r.Entries()
+	if len(got) != 2 || got["A1B2C3D4"].NfcTagId != "A1B2C3D4" || got["E5F6"].ProductId != "e" {
+		t.Errorf("loaded entries = %v, want A1B2C3D4 and E5F6", got)
+	}
+	// The legacy spelling is replaced, not kept next to the new mapping
+	if err := r.Reassign("a1:b2:c3:d4", entry("07:08", "p1", "a")); err != nil {
+		t.Fatalf("Reassign: %v", err)
+	}
+	if got := reload(t, mem); len(got) != 2 || got["0708"].ProductId != "a" {
+		t.Errorf("saved entries = %v, want 0708 and E5F6", got)
+	}
+}
+
+func TestRegistrySaves(t *testing.T) {
+	mem := fsys.NewMem()
+	r, err := LoadFS(mem, registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Set(entry("A1", "p1", "a")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := r.SetAll([]Entry{entry("B2", "p1", "b"), entry("C3", "p2", "c")}); err != nil {
+		t.Fatalf("SetAll: %v", err)
+	}
+	if e, ok := r.Lookup("B2"); !ok || e.ProductId != "b" {
+		t.Errorf("Lookup(B2) = %+v, %v", e, ok)
+	}
+	if got := reload(t, mem); len(got) != 3 || got["C3"].ProductId != "c" {
+		t.Errorf("saved entries = %v, want A1, B2 and C3", got)
+	}
+
+	if err := r.Reassign("A1", entry("D4", "p1", "a")); err != nil {
+		t.Fatalf("Reassign: %v", err)
+	}
+	got := reload(t, mem)
+	if _, ok := got["A1"]; ok {
+		t.Error("A1 is still mapped after Reassign")
+	}
+	if got["D4"].ProductId != "a" {
+		t.Errorf("D4 = %+v, want product a", got["D4"])
+	}
+}
+
+func TestRegistryNormalizesUIDs(t *testing.T) {
+	mem := fsys.NewMem()
+	r, err := LoadFS(mem, registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Set(entry("a1:b2:c3:d4", "p1", "a")); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := r.SetAll([]Entry{entry("A1 B2 C3 D4", "p1", "b"), entry("e5-f6", "p1", "e")}); err != nil {
+		t.Fatalf("SetAll: %v", err)
+	}
+	got := reload(t, mem)
+	if len(got) != 2 || got["A1B2C3D4"].ProductId != "b" || got["E5F6"].ProductId != "e" {
+		t.Errorf("saved entries = %v, want A1B2C3D4 (b) and E5F6", got)
+	}
+	if got["A1B2C3D4"].NfcTagId != "A1B2C3D4" {
+		t.Errorf("NfcTagId = %q, want the normalized UID", got["A1B2C3D4"].NfcTagId)
+	}
+	if e, ok := r.Lookup("a1b2c3d4"); !ok || e.ProductId != "b" {
+		t.Errorf("Lookup(a1b2c3d4) = %+v, %v", e, ok)
+	}
+
+	if err := r.Reassign("e5:f6", entry("07:08", "p1", "e")); err != nil {
+		t.Fatalf("Reassign: %v", err)
+	}
+	if err := r.Update(func(entries map[string]Entry) error {
+		entries["0a 0b"] = entry("0a 0b", "p1", "f")
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := r.ReplaceUnder(filepath.FromSlash("/content/p2"), []Entry{entry("c3:d4", "p2", "c")}); err != nil {
+		t.Fatalf("ReplaceUnder: %v", err)
+	}
+
+	got = reload(t, mem)
+	for _, uid := range []string{"A1B2C3D4", "0708", "0A0B", "C3D4"} {
+		if e, ok := got[uid]; !ok || e.NfcTagId != uid {
+			t.Errorf("%s = %+v, %v; want it stored under its normalized UID", uid, e, ok)
+		}
+	}
+	if len(got) != 4 {
+		t.Errorf("saved entries = %v, want only normalized keys", got)
+	}
+}
+
+func TestRegistryUpdateAllOrNothing(t *testing.T) {
+	mem := fsys.NewMem()
+	r, err := LoadFS(mem, registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Set(entry("A1", "p1", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("stop")
+	err = r.Update(func(entries map[string]Entry) error {
+		delete(entries, "A1")
+		entries["B2"] = entry("B2", "p1", "b")
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Update returned %v, want %v", err, failed)
+	}
+	if _, ok := r.Lookup("A1"); !ok {
+		t.Error("a failed Update removed A1")
+	}
+	if _, ok := r.Lookup("B2"); ok {
+		t.Error("a failed Update added B2")
+	}
+
+	if err := r.Update(func(entries map[string]Entry) error {
+		entries["B2"] = entry("B2", "p1", "b")
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got := reload(t, mem); len(got) != 2 {
+		t.Errorf("saved entries = %v, want A1 and B2", got)
+	}
+}
+
+func TestRegistryRemove(t *testing.T) {
+	mem := fsys.NewMem()
+	r, err := LoadFS(mem, registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := entry("A1", "p1", "a")
+	shared := entry("A2", "p1", "a") // a second tag for the same video
+	if err := r.SetAll([]Entry{a, shared, entry("B2", "p1", "b"), entry("C3", "p2", "c")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := r.RemoveVideo(a.VideoPath); err != nil || n != 2 {
+		t.Errorf("RemoveVideo = %d, %v; want 2", n, err)
+	}
+	if n, err := r.RemoveVideo(a.VideoPath); err != nil || n != 0 {
+		t.Errorf("second RemoveVideo = %d, %v; want 0", n, err)
+	}
+
+	if err := r.ReplaceUnder(filepath.FromSlash("/content/p1"), []Entry{entry("E5", "p1", "e")}); err != nil {
+		t.Fatalf("ReplaceUnder: %v", err)
+	}
+	got := reload(t, mem)
+	if _, ok := got["B2"]; ok || got["E5"].ProductId != "e" || got["C3"].ProductId != "c" {
+		t.Errorf("after ReplaceUnder = %v, want C3 and E5", got)
+	}
+
+	// A directory sharing p2's prefix isn't under it
+	if n, err := r.RemoveUnder(filepath.FromSlash("/content/p")); err != nil || n != 0 {
+		t.Errorf("RemoveUnder(/content/p) = %d, %v; want 0", n, err)
+	}
+	if n, err := r.RemoveUnder(filepath.FromSlash("/content/p2")); err != nil || n != 1 {
+		t.Errorf("RemoveUnder(/content/p2) = %d, %v; want 1", n, err)
+	}
+	if got := reload(t, mem); len(got) != 1 || got["E5"].ProductId != "e" {
+		t.Errorf("saved entries = %v, want only E5", got)
+	}
+}
+
+func TestRegistryRebuild(t *testing.T) {
+	mem := fsys.NewMem()
+	root := filepath.FromSlash("/content")
+	things := []struct {
+		project string
+		thing   content.Thing
+	}{
+		{"p1", content.Thing{ProductId: "a", NfcTagId: "A1", ProductName: "Drill"}},
+		{"p1", content.Thing{ProductId: "b", NfcTagId: "B2", MediaType: content.MediaImage}},
+		{"p1", content.Thing{ProductId: "untagged"}},
+		{"p2", content.Thing{ProductId: "c", NfcTagId: "C3", Extension: ".webm"}},
+		{".staging", content.Thing{ProductId: "d", NfcTagId: "D4"}},
+	}
+	for _, th := range things {
+		path := filepath.Join(root, th.project, th.thing.ProductId+".json")
+		if err := content.WriteThing(mem, path, th.thing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := LoadFS(mem, registryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Set(entry("STALE", "gone", "x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Rebuild(root); err != nil {
+		t.Fatalf("Rebuild: %v", err)
+	}
+
+	got := reload(t, mem)
+	want := map[string]Entry{
+		"A1": {NfcTagId: "A1", ProductId: "a", ProductName: "Drill", ProjectId: "p1",
+			VideoPath: filepath.Join(root, "p1", "a.mp4"), MetadataPath: filepath.Join(root, "p1", "a.json")},
+		"B2": {NfcTagId: "B2", ProductId: "b", ProjectId: "p1", MediaType: content.MediaImage,
+			VideoPath: filepath.Join(root, "p1", "b.jpg"), MetadataPath: filepath.Join(root, "p1", "b.json")},
+		"C3": {NfcTagId: "C3", ProductId: "c", ProjectId: "p2",
+			VideoPath: filepath.Join(root, "p2", "c.webm"), MetadataPath: filepath.Join(root, "p2", "c.json")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("rebuilt entries = %v, want %v", got, want)
+	}
+	for uid, w := range want {
+		if got[uid] != w {
+			t.Errorf("%s = %+v, want %+v", uid, got[uid], w)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package registry
+
+import "strings"
+
+// Strips the separators reader firmwares put between UID bytes
+var uidSeparators = strings.NewReplacer(" ", "", ":", "", "-", "")
+
+// NormalizeUID is the canonical form of a tag UID, so "A1:B2:C3:D4",
+// "a1b2c3d4" and "A1 B2 C3 D4" all map to the same registry entry
+func NormalizeUID(raw string) string {
+	return strings.ToUpper(uidSeparators.Replace(strings.TrimSpace(raw)))
+}
@@ -0,0 +1,34 @@
+package registry
+
+import "testing"
+
+func TestNormalizeUID(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"canonical", "04A1B2C3D4E580", "04A1B2C3D4E580"},
+		{"lowercase", "04a1b2c3d4e580", "04A1B2C3D4E580"},
+		{"mixed case", "04a1B2c3D4e580", "04A1B2C3D4E580"},
+		{"colons", "04:A1:B2:C3:D4:E5:80", "04A1B2C3D4E580"},
+		{"lowercase colons", "a1:b2:c3:d4", "A1B2C3D4"},
+		{"spaces", "A1 B2 C3 D4", "A1B2C3D4"},
+		{"dashes", "a1-b2-c3-d4", "A1B2C3D4"},
+		{"mixed separators", "A1:b2 C3-d4", "A1B2C3D4"},
+		{"surrounding whitespace", "  A1B2C3D4\r\n", "A1B2C3D4"},
+		{"tab inside", "\tA1 B2\t", "A1B2"},
+		{"4-byte UID", "DEADBEEF", "DEADBEEF"},
+		{"10-byte UID", "04 11 22 33 44 55 66 77 88 99", "04112233445566778899"},
+		{"empty", "", ""},
+		{"whitespace only", " \t\n", ""},
+		{"separators only", " : - ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeUID(tt.raw); got != tt.want {
+				t.Errorf("NormalizeUID(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
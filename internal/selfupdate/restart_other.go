@@ -0,0 +1,11 @@
+//go:build !unix
+
+package selfupdate
+
+import "errors"
+
+// Restart can't replace the process without exec. The new binary is already
+// in place and runs once the service manager restarts the service.
+func Restart(path string) error {
+	return errors.New("restarting in place is not supported on this platform, restart the service to run the update")
+}
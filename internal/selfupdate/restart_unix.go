@@ -0,0 +1,18 @@
+//go:build unix
+
+package selfupdate
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Restart replaces the current process with the binary at path, keeping its
+// arguments and environment. It only returns on failure.
+func Restart(path string) error {
+	if err := syscall.Exec(path, os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("failed to exec %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package selfupdate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BackupName is the copy of the previous binary kept next to it when
+// backups are enabled
+const BackupName = "lift-learn.backup"
+
+// Updater replaces the running executable with a downloaded build
+type Updater struct {
+	Client *http.Client
+	// Copy the current binary to BackupName before replacing it
+	Backup bool
+}
+
+// UpdateBinary installs the binary at binaryURL and restarts into it. It
+// only returns on failure; nothing has been replaced unless the download
+// matched expectedSHA256.
+func (u *Updater) UpdateBinary(binaryURL, expectedSHA256 string) error {
+	path, err := u.Install(binaryURL, expectedSHA256)
+	if err != nil {
+		return err
+	}
+	return Restart(path)
+}
+
+// Install downloads the binary at binaryURL next to the running executable,
+// verifies it against expectedSHA256 and moves it into place. It returns the
+// path of the replaced executable.
+func (u *Updater) Install(binaryURL, expectedSHA256 string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the running executable: %v", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", fmt.Errorf("failed to resolve the running executable: %v", err)
+	}
+	dir := filepath.Dir(exe)
+
+	// Same directory as the executable, so the final rename is atomic
+	tmp, err := os.CreateTemp(dir, ".lift-learn-update-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	installed := false
+	defer func() {
+		if !installed {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	err = u.download(binaryURL, tmp, expectedSHA256)
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to make update executable: %v", err)
+	}
+
+	if u.Backup {
+		if err := copyFile(exe, filepath.Join(dir, BackupName)); err != nil {
+			return "", fmt.Errorf("failed to back up current binary: %v", err)
+		}
+	}
+	if err := os.Rename(tmpPath, exe); err != nil {
+		return "", fmt.Errorf("failed to replace binary: %v", err)
+	}
+	installed = true
+	return exe, nil
+}
+
+// Stream binaryURL into out, failing unless its SHA-256 is expectedSHA256
+func (u *Updater) download(binaryURL string, out io.Writer, expectedSHA256 string) error {
+	resp, err := u.Client.Get(binaryURL)
+	if err != nil {
+		return fmt.Errorf("failed to download update: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download update, status: %d", resp.StatusCode)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hasher), resp.Body); err != nil {
+		return fmt.Errorf("failed to download update: %v", err)
+	}
+	got := hex.EncodeToString(hasher.Sum(nil))
+	if !strings.EqualFold(got, expectedSHA256) {
+		return fmt.Errorf("update checksum mismatch: expected %s, got %s", expectedSHA256, got)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
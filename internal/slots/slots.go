@@ -0,0 +1,47 @@
+package slots
+
+import "sync"
+
+// Pool is a counting semaphore whose size can change while it is in use.
+// Shrinking it never interrupts a holder; new ones wait until enough have
+// released.
+type Pool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int
+	used int
+}
+
+// NewPool returns a pool that lets size holders in at once
+func NewPool(size int) *Pool {
+	p := &Pool{size: size}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Acquire blocks until a slot is free and takes it
+func (p *Pool) Acquire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.used >= p.size {
+		p.cond.Wait()
+	}
+	p.used++
+}
+
+// Release gives back a slot taken by Acquire
+func (p *Pool) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used--
+	p.cond.Signal()
+}
+
+// Resize changes how many holders are let in. Growing it wakes waiters
+// straight away.
+func (p *Pool) Resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = size
+	p.cond.Broadcast()
+}
@@ -0,0 +1,113 @@
+package slots
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Runs workers goroutines that each hold a slot for hold, and returns the
+// most that held one at the same time
+func maxConcurrent(p *Pool, workers int, hold time.Duration) int64 {
+	var running, peak atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Acquire()
+			defer p.Release()
+			n := running.Add(1)
+			for {
+				old := peak.Load()
+				if n <= old || peak.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			time.Sleep(hold)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+	return peak.Load()
+}
+
+func TestPoolLimitsConcurrency(t *testing.T) {
+	for _, size := range []int{1, 3, 8} {
+		if peak := maxConcurrent(NewPool(size), 50, 2*time.Millisecond); peak != int64(size) {
+			t.Errorf("size %d: %d ran at once", size, peak)
+		}
+	}
+}
+
+// Takes size slots and returns a channel that receives once per waiter
+// let in after the pool is full
+func fill(p *Pool, size, waiters int) chan struct{} {
+	for i := 0; i < size; i++ {
+		p.Acquire()
+	}
+	entered := make(chan struct{}, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			p.Acquire()
+			entered <- struct{}{}
+		}()
+	}
+	return entered
+}
+
+func expectEntered(t *testing.T, entered chan struct{}, want int) {
+	t.Helper()
+	for i := 0; i < want; i++ {
+		select {
+		case <-entered:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d waiters got a slot", i, want)
+		}
+	}
+	select {
+	case <-entered:
+		t.Fatalf("more than %d waiters got a slot", want)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPoolGrow(t *testing.T) {
+	p := NewPool(2)
+	entered := fill(p, 2, 5)
+	expectEntered(t, entered, 0)
+
+	// Growing lets waiters in without anyone releasing
+	p.Resize(5)
+	expectEntered(t, entered, 3)
+
+	p.Release()
+	expectEntered(t, entered, 1)
+}
+
+func TestPoolShrink(t *testing.T) {
+	p := NewPool(4)
+	entered := fill(p, 4, 3)
+
+	// Holders keep their slots; waiters need the pool to drop below its
+	// new size
+	p.Resize(2)
+	p.Release()
+	p.Release()
+	expectEntered(t, entered, 0)
+	p.Release()
+	expectEntered(t, entered, 1)
+
+	p.Release()
+	p.Release()
+	expectEntered(t, entered, 2)
+}
+
+func TestPoolShrinkUnderLoad(t *testing.T) {
+	p := NewPool(8)
+	p.Resize(2)
+	if peak := maxConcurrent(p, 30, 2*time.Millisecond); peak != 2 {
+		t.Errorf("%d ran at once after shrinking to 2", peak)
+	}
+}
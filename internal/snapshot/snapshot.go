@@ -0,0 +1,183 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"lift_learn/internal/atomicfile"
+)
+
+var (
+	// ErrNoSnapshot means there is nothing to roll back to
+	ErrNoSnapshot = errors.New("no previous snapshot")
+	// ErrNotLatest means a newer deployment has replaced the one being rolled back
+	ErrNotLatest = errors.New("deployment is not the latest for its project")
+)
+
+// Snapshot is the content a project had before DeploymentId replaced it,
+// kept as hard links in Dir (a hidden .v{Version} directory in the project)
+type Snapshot struct {
+	Version      int       `json:"version"`
+	DeploymentId string    `json:"deploymentId"`
+	Dir          string    `json:"dir"`
+	Files        []string  `json:"files"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Manager keeps the snapshots of every project, oldest first, and persists
+// their manifests to a JSON file
+type Manager struct {
+	mu           sync.Mutex
+	path         string
+	maxSnapshots int
+	state        manifest
+}
+
+type manifest struct {
+	NextVersion int                   `json:"nextVersion"`
+	Projects    map[string][]Snapshot `json:"projects"`
+}
+
+// Load reads the manifest file at path; a missing file means no snapshots
+func Load(path string, maxSnapshots int) (*Manager, error) {
+	m := &Manager{
+		path:         path,
+		maxSnapshots: maxSnapshots,
+		state:        manifest{NextVersion: 1, Projects: make(map[string][]Snapshot)},
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &m.state); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshots %s: %v", path, err)
+	}
+	if m.state.Projects == nil {
+		m.state.Projects = make(map[string][]Snapshot)
+	}
+	return m, nil
+}
+
+// Take snapshots the files currently in projectDir before deploymentId
+// replaces them. A project with no content yet has nothing to snapshot.
+// Snapshots beyond the configured maximum are deleted, oldest first.
+func (m *Manager) Take(projectId, projectDir, deploymentId string) error {
+	files, err := liveFiles(projectDir)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap := Snapshot{
+		Version:      m.state.NextVersion,
+		DeploymentId: deploymentId,
+		Dir:          filepath.Join(projectDir, fmt.Sprintf(".v%d", m.state.NextVersion)),
+		Files:        files,
+		CreatedAt:    time.Now(),
+	}
+	if err := os.MkdirAll(snap.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	for _, name := range files {
+		if err := os.Link(filepath.Join(projectDir, name), filepath.Join(snap.Dir, name)); err != nil {
+			os.RemoveAll(snap.Dir)
+			return fmt.Errorf("failed to snapshot %s: %v", name, err)
+		}
+	}
+	m.state.NextVersion++
+
+	snaps := append(m.state.Projects[projectId], snap)
+	for m.maxSnapshots > 0 && len(snaps) > m.maxSnapshots {
+		os.RemoveAll(snaps[0].Dir)
+		snaps = snaps[1:]
+	}
+	m.state.Projects[projectId] = snaps
+	return m.saveLocked()
+}
+
+// Rollback restores the snapshot deploymentId replaced, provided no later
+// deployment has replaced the project's content since
+func (m *Manager) Rollback(projectId, projectDir, deploymentId string) (Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snaps := m.state.Projects[projectId]
+	idx := -1
+	for i, s := range snaps {
+		if s.DeploymentId == deploymentId {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return Snapshot{}, ErrNoSnapshot
+	}
+	if idx != len(snaps)-1 {
+		return Snapshot{}, ErrNotLatest
+	}
+	snap := snaps[idx]
+
+	current, err := liveFiles(projectDir)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, name := range current {
+		if err := os.Remove(filepath.Join(projectDir, name)); err != nil {
+			return Snapshot{}, fmt.Errorf("failed to remove %s: %v", name, err)
+		}
+	}
+	for _, name := range snap.Files {
+		if err := os.Rename(filepath.Join(snap.Dir, name), filepath.Join(projectDir, name)); err != nil {
+			return Snapshot{}, fmt.Errorf("failed to restore %s: %v", name, err)
+		}
+	}
+	os.RemoveAll(snap.Dir)
+
+	m.state.Projects[projectId] = snaps[:idx]
+	return snap, m.saveLocked()
+}
+
+// Empty reports whether projectDir has no content Take would snapshot, e.g.
+// because nothing has been deployed to it yet
+func Empty(projectDir string) (bool, error) {
+	files, err := liveFiles(projectDir)
+	return len(files) == 0, err
+}
+
+// Regular, non-hidden files directly in dir
+func liveFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			files = append(files, e.Name())
+		}
+	}
+	return files, nil
+}
+
+func (m *Manager) saveLocked() error {
+	return atomicfile.Write(m.path, 0644, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m.state)
+	})
+}
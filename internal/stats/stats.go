@@ -0,0 +1,135 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"lift_learn/internal/atomicfile"
+)
+
+// PlayStats is how often and how long one product has been played
+type PlayStats struct {
+	ProductId           string    `json:"productId"`
+	PlayCount           int64     `json:"playCount"`
+	TotalPlayDurationMs int64     `json:"totalPlayDurationMs"`
+	LastPlayedAt        time.Time `json:"lastPlayedAt"`
+}
+
+// A play still running on a screen
+type play struct {
+	productId string
+	startedAt time.Time
+}
+
+// Tracker counts plays per product and persists them to a JSON file, which
+// is rewritten atomically whenever a play starts or ends. Each screen has at
+// most one play running; starting another ends it.
+type Tracker struct {
+	mu      sync.Mutex
+	path    string
+	stats   map[string]*PlayStats
+	playing map[string]play
+}
+
+// Load reads the stats file at path; a missing file means nothing has been
+// played yet
+func Load(path string) (*Tracker, error) {
+	t := &Tracker{path: path, stats: make(map[string]*PlayStats), playing: make(map[string]play)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stats %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &t.stats); err != nil {
+		return nil, fmt.Errorf("failed to parse stats %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// Reset replaces the stats file at path with an empty one
+func Reset(path string) error {
+	return atomicfile.Write(path, 0644, func(f *os.File) error {
+		_, err := f.Write([]byte("{}\n"))
+		return err
+	})
+}
+
+// Started counts a play of productId on screen, ending whatever the screen
+// was playing before
+func (t *Tracker) Started(screen, productId string, at time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.endLocked(screen, at)
+	s := t.statsLocked(productId)
+	s.PlayCount++
+	s.LastPlayedAt = at
+	t.playing[screen] = play{productId: productId, startedAt: at}
+	return t.saveLocked()
+}
+
+// Stopped ends the play running on screen, adding its duration to the
+// product's total. Nothing happens if none is running.
+func (t *Tracker) Stopped(screen string, at time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.endLocked(screen, at) {
+		return nil
+	}
+	return t.saveLocked()
+}
+
+// All returns a copy of every product's stats, most played first
+func (t *Tracker) All() []PlayStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]PlayStats, 0, len(t.stats))
+	for _, s := range t.stats {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].PlayCount != out[j].PlayCount {
+			return out[i].PlayCount > out[j].PlayCount
+		}
+		return out[i].ProductId < out[j].ProductId
+	})
+	return out
+}
+
+func (t *Tracker) endLocked(screen string, at time.Time) bool {
+	p, ok := t.playing[screen]
+	if !ok {
+		return false
+	}
+	delete(t.playing, screen)
+	if d := at.Sub(p.startedAt); d > 0 {
+		t.statsLocked(p.productId).TotalPlayDurationMs += d.Milliseconds()
+	}
+	return true
+}
+
+func (t *Tracker) statsLocked(productId string) *PlayStats {
+	s, ok := t.stats[productId]
+	if !ok {
+		s = &PlayStats{ProductId: productId}
+		t.stats[productId] = s
+	}
+	return s
+}
+
+func (t *Tracker) saveLocked() error {
+	return atomicfile.Write(t.path, 0644, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t.stats)
+	})
+}
@@ -0,0 +1,129 @@
+package stats
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrackerCountsPlays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	tr, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	start := time.Date(2024, time.June, 7, 12, 0, 0, 0, time.UTC)
+	steps := []func() error{
+		func() error { return tr.Started("main", "a", start) },
+		// Starting b on the same screen ends a after 10s
+		func() error { return tr.Started("main", "b", start.Add(10*time.Second)) },
+		func() error { return tr.Started("main", "a", start.Add(15*time.Second)) },
+		func() error { return tr.Stopped("main", start.Add(18*time.Second)) },
+		// Nothing is playing, so this changes nothing
+		func() error { return tr.Stopped("main", start.Add(60*time.Second)) },
+		func() error { return tr.Started("side", "a", start.Add(20*time.Second)) },
+		func() error { return tr.Stopped("side", start.Add(21*time.Second)) },
+		func() error { return tr.Started("side", "c", start.Add(30*time.Second)) },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+
+	want := []PlayStats{
+		{ProductId: "a", PlayCount: 3, TotalPlayDurationMs: 14000, LastPlayedAt: start.Add(20 * time.Second)},
+		{ProductId: "b", PlayCount: 1, TotalPlayDurationMs: 5000, LastPlayedAt: start.Add(10 * time.Second)},
+		// Still playing, so no duration yet
+		{ProductId: "c", PlayCount: 1, TotalPlayDurationMs: 0, LastPlayedAt: start.Add(30 * time.Second)},
+	}
+	checkStats(t, tr.All(), want)
+
+	// The file holds what was counted
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load after plays: %v", err)
+	}
+	checkStats(t, reloaded.All(), want)
+}
+
+func TestTrackerAllSortsByPlayCount(t *testing.T) {
+	tr, err := Load(filepath.Join(t.TempDir(), "stats.json"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	now := time.Now()
+	for product, plays := range map[string]int{"few": 1, "most": 4, "some": 2, "also-some": 2} {
+		for i := 0; i < plays; i++ {
+			if err := tr.Started("main", product, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var got []string
+	for _, s := range tr.All() {
+		got = append(got, s.ProductId)
+	}
+	// Ties are broken by product ID
+	want := []string{"most", "also-some", "some", "few"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("All() order = %v, want %v", got, want)
+	}
+}
+
+func TestReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	tr, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := tr.Started("main", "a", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Reset(path); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(data)) != "{}" {
+		t.Errorf("stats file after Reset = %q, want {}", data)
+	}
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load after Reset: %v", err)
+	}
+	if all := reloaded.All(); len(all) != 0 {
+		t.Errorf("stats after Reset = %v, want none", all)
+	}
+}
+
+func TestLoadCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("expected an error for a corrupt stats file")
+	}
+}
+
+func checkStats(t *testing.T, got, want []PlayStats) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d products, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.ProductId != w.ProductId || g.PlayCount != w.PlayCount ||
+			g.TotalPlayDurationMs != w.TotalPlayDurationMs || !g.LastPlayedAt.Equal(w.LastPlayedAt) {
+			t.Errorf("stats[%d] = %+v, want %+v", i, g, w)
+		}
+	}
+}
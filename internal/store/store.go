@@ -0,0 +1,109 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ContentStore keeps one copy of every downloaded video, named by its
+// SHA-256 digest, so the same bytes are never fetched twice. Project files
+// are hard links into the store where the filesystem allows it.
+type ContentStore struct {
+	dir string
+}
+
+// New returns a store rooted at dir, creating the directory if needed
+func New(dir string) (*ContentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create content store %s: %v", dir, err)
+	}
+	return &ContentStore{dir: dir}, nil
+}
+
+func (s *ContentStore) path(digest string) string {
+	return filepath.Join(s.dir, strings.ToLower(digest)+".mp4")
+}
+
+// Has reports whether the store holds a file with the given digest
+func (s *ContentStore) Has(digest string) bool {
+	if digest == "" {
+		return false
+	}
+	_, err := os.Stat(s.path(digest))
+	return err == nil
+}
+
+// LinkTo places the stored file for digest at dst
+func (s *ContentStore) LinkTo(digest, dst string) error {
+	os.Remove(dst)
+	return linkOrCopy(s.path(digest), dst)
+}
+
+// Add records the file at src under digest unless the store already has it
+func (s *ContentStore) Add(src, digest string) error {
+	if s.Has(digest) {
+		return nil
+	}
+	return linkOrCopy(src, s.path(digest))
+}
+
+// Remove drops the stored file for digest, e.g. because it was found corrupt
+func (s *ContentStore) Remove(digest string) error {
+	if err := os.Remove(s.path(digest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// GC removes every stored digest that isn't in referenced, returning how
+// many files were deleted
+func (s *ContentStore) GC(referenced map[string]bool) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || filepath.Ext(name) != ".mp4" {
+			continue
+		}
+		if referenced[strings.TrimSuffix(name, ".mp4")] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Hard link src to dst, copying instead when the two are on different
+// filesystems or links aren't supported
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy %s to %s: %v", src, dst, err)
+	}
+	return out.Close()
+}
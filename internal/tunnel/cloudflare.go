@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Quick tunnels print their assigned hostname in cloudflared's log output
+var trycloudflareURL = regexp.MustCompile(`https://[a-z0-9-]+\.trycloudflare\.com`)
+
+// CloudflareTunneler runs a Cloudflare quick tunnel and scrapes the public
+// URL from cloudflared's output
+type CloudflareTunneler struct {
+	localURL string
+	logger   *slog.Logger
+
+	mu  sync.Mutex
+	url string
+}
+
+func NewCloudflareTunneler(localURL string, logger *slog.Logger) *CloudflareTunneler {
+	return &CloudflareTunneler{localURL: localURL, logger: logger}
+}
+
+func (t *CloudflareTunneler) Start(ctx context.Context) error {
+	args := []string{"tunnel", "--url", t.localURL}
+	if strings.HasPrefix(t.localURL, "https://") {
+		// The local server may be using a self-signed certificate
+		args = append(args, "--no-tls-verify")
+	}
+	cmd := exec.CommandContext(ctx, "cloudflared", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture cloudflared output: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture cloudflared output: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start cloudflared: %v", err)
+	}
+
+	// cloudflared logs to stderr, but older releases printed the URL on stdout
+	go t.scanOutput(stdout, os.Stdout)
+	go t.scanOutput(stderr, os.Stderr)
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			t.logger.Warn("cloudflared exited", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (t *CloudflareTunneler) PublicURL() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.url == "" {
+		return "", fmt.Errorf("cloudflared has not reported a public URL yet")
+	}
+	t.logger.Debug("cloudflare tunnel URL", "url", t.url)
+	return t.url, nil
+}
+
+// Echo cloudflared output and remember the most recent tunnel URL in it
+func (t *CloudflareTunneler) scanOutput(r io.Reader, echo io.Writer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(echo, line)
+
+		if url := trycloudflareURL.FindString(line); url != "" {
+			t.mu.Lock()
+			t.url = url
+			t.mu.Unlock()
+		}
+	}
+}
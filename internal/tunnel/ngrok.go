@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+)
+
+const ngrokAPIURL = "http://localhost:4040/api/tunnels"
+
+// NgrokTunneler runs `ngrok http LOCAL_URL` and reads the public URL from ngrok's local API
+type NgrokTunneler struct {
+	localURL string
+	logger   *slog.Logger
+}
+
+func NewNgrokTunneler(localURL string, logger *slog.Logger) *NgrokTunneler {
+	return &NgrokTunneler{localURL: localURL, logger: logger}
+}
+
+func (t *NgrokTunneler) Start(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "ngrok", "http", t.localURL)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ngrok: %v", err)
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			t.logger.Warn("ngrok exited", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (t *NgrokTunneler) PublicURL() (string, error) {
+	resp, err := http.Get(ngrokAPIURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch ngrok URL: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse ngrok response: %v", err)
+	}
+
+	tunnels, ok := result["tunnels"].([]interface{})
+	if !ok || len(tunnels) == 0 {
+		return "", fmt.Errorf("no tunnels found in ngrok response")
+	}
+
+	publicURL, ok := tunnels[0].(map[string]interface{})["public_url"].(string)
+	if !ok {
+		return "", fmt.Errorf("failed to extract public URL from ngrok response")
+	}
+
+	t.logger.Debug("ngrok tunnel URL", "url", publicURL)
+	return publicURL, nil
+}
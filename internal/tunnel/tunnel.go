@@ -0,0 +1,28 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Tunneler exposes the local upload server on a public URL
+type Tunneler interface {
+	// Start launches the tunnel process and returns once it is running
+	Start(ctx context.Context) error
+	// PublicURL reports the tunnel's current public URL
+	PublicURL() (string, error)
+}
+
+// New returns the Tunneler for a config provider name, forwarding to
+// localURL (e.g. "http://localhost:3000")
+func New(provider string, localURL string, logger *slog.Logger) (Tunneler, error) {
+	switch provider {
+	case "", "ngrok":
+		return NewNgrokTunneler(localURL, logger), nil
+	case "cloudflare":
+		return NewCloudflareTunneler(localURL, logger), nil
+	default:
+		return nil, fmt.Errorf("unknown tunnel provider %q", provider)
+	}
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Requests queued beyond this are dropped rather than holding up scans
+const queueSize = 64
+
+// First retry waits this long, doubling after each failed attempt
+const initialBackoff = time.Second
+
+// Payload is the JSON body POSTed to a Thing's webhookUrl on each scan
+type Payload struct {
+	DeviceId     string `json:"deviceId"`
+	ProductId    string `json:"productId"`
+	NfcTagId     string `json:"nfcTagId"`
+	ScannedAt    string `json:"scannedAt"`
+	DeploymentId string `json:"deploymentId,omitempty"`
+}
+
+type job struct {
+	url     string
+	payload Payload
+}
+
+// Dispatcher delivers webhooks from a fixed pool of workers so a slow or
+// unreachable endpoint never delays playback
+type Dispatcher struct {
+	client     *http.Client
+	maxRetries atomic.Int64
+	queue      chan job
+	logger     *slog.Logger
+
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// NewDispatcher starts workers goroutines, each retrying a failed call up to
+// maxRetries times
+func NewDispatcher(workers, maxRetries int, logger *slog.Logger) *Dispatcher {
+	d := &Dispatcher{
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan job, queueSize),
+		logger: logger,
+	}
+	d.SetMaxRetries(maxRetries)
+	d.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// SetMaxRetries changes how often calls are retried from their next failed
+// attempt on, e.g. when max_webhook_retries is edited in config.yaml
+func (d *Dispatcher) SetMaxRetries(maxRetries int) {
+	d.maxRetries.Store(int64(maxRetries))
+}
+
+// Send queues a POST of payload to url and returns immediately. Calls made
+// after Close are dropped.
+func (d *Dispatcher) Send(url string, payload Payload) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.queue <- job{url: url, payload: payload}:
+	default:
+		d.logger.Warn("webhook queue full, dropping call", "url", url, "product_id", payload.ProductId)
+	}
+}
+
+// Close stops taking calls and waits for the queued ones to be delivered,
+// or for ctx to end, in which case the rest are abandoned
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("webhooks still pending: %v", ctx.Err())
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.workers.Done()
+	for j := range d.queue {
+		d.deliver(j)
+	}
+}
+
+func (d *Dispatcher) deliver(j job) {
+	body, err := json.Marshal(j.payload)
+	if err != nil {
+		d.logger.Error("failed to encode webhook payload", "err", err)
+		return
+	}
+
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		err := d.post(j.url, body)
+		if err == nil {
+			d.logger.Info("webhook delivered", "url", j.url, "product_id", j.payload.ProductId, "attempts", attempt+1)
+			return
+		}
+		if attempt >= int(d.maxRetries.Load()) {
+			d.logger.Error("webhook failed", "url", j.url, "product_id", j.payload.ProductId, "attempts", attempt+1, "err", err)
+			return
+		}
+		d.logger.Warn("webhook failed, retrying", "url", j.url, "attempt", attempt+1, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (d *Dispatcher) post(url string, body []byte) error {
+	resp, err := d.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -1,111 +1,1897 @@
 package main
 import (
+    "bufio"
+    "context"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
-    "io/ioutil"
-    "log"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/url"
     "os"
-    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "sort"
+    "strconv"
     "strings"
+    "sync"
+    "syscall"
+    "time"
+    "github.com/fsnotify/fsnotify"
+    "github.com/gorilla/websocket"
     "go.bug.st/serial"
+
+    "lift_learn/internal/apperr"
+    "lift_learn/internal/ble"
+    "lift_learn/internal/buildinfo"
+    "lift_learn/internal/config"
+    "lift_learn/internal/content"
+    "lift_learn/internal/events"
+    "lift_learn/internal/logging"
+    "lift_learn/internal/metrics"
+    "lift_learn/internal/middleware"
+    "lift_learn/internal/mqtt"
+    "lift_learn/internal/ndef"
+    "lift_learn/internal/player"
+    "lift_learn/internal/registry"
+    "lift_learn/internal/stats"
+    "lift_learn/internal/webhook"
+)
+
+// How long to wait between attempts to re-open a disconnected reader
+const serialReconnectDelay = 2 * time.Second
+
+// Longest the activation sound may play before it's cut off
+const activationSoundTimeout = time.Second
+
+// How long a probed port has to answer before it's ruled out as a reader
+const probeTimeout = 500 * time.Millisecond
+
+// Output that identifies an NFC reader during auto-detection
+var readerGreetings = []string{"UID Value:", "Found chip PN5", "Waiting for an ISO14443A"}
+
+// Set at build time with -ldflags "-X main.Version=... -X main.BuildTime=..."
+var (
+    Version   = "dev"
+    BuildTime = "unknown"
+)
+
+// Logger for the whole process, built from the --log-* flags in main
+var logger = slog.Default()
+
+// Log msg at error level and exit, the slog counterpart of log.Fatal
+func fatal(msg string, args ...any) {
+    logger.Error(msg, args...)
+    os.Exit(1)
+}
+
+// Comment sent to /events subscribers so idle proxies keep the stream open
+const sseKeepaliveInterval = 15 * time.Second
+
+// /ws keepalive: clients are pinged often enough that a pong always lands
+// inside the 60s read deadline
+const (
+    maxWebSocketClients = 20
+    wsPongWait          = 60 * time.Second
+    wsPingInterval      = wsPongWait * 9 / 10
+    wsWriteWait         = 10 * time.Second
 )
 
-type VideoMapping struct {
-    TagToVideo map[string]string
+// Writes to the registry closer together than this trigger a single reload
+const reloadDebounce = 200 * time.Millisecond
+
+// NFC UID to registry entry, replaced wholesale on reload so the reader never
+// sees a partially loaded map
+type tagMapping struct {
+    mu   sync.RWMutex
+    tags map[string]registry.Entry
+}
+
+// Entry for a product, for commands that name the product rather than the tag
+func (m *tagMapping) findProduct(productId string) (registry.Entry, bool) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    for _, e := range m.tags {
+        if e.ProductId == productId {
+            return e, true
+        }
+    }
+    return registry.Entry{}, false
+}
+
+func (m *tagMapping) lookup(uid string) (registry.Entry, bool) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    entry, ok := m.tags[uid]
+    return entry, ok
+}
+
+// Reports whether some tag maps to the media at the absolute path
+func (m *tagMapping) hasVideo(path string) bool {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    for _, e := range m.tags {
+        if abs, err := filepath.Abs(e.VideoPath); err == nil && abs == path {
+            return true
+        }
+    }
+    return false
+}
+
+// Mapped videos, most recently deployed first by file modification time.
+// Videos that are missing on disk are left out.
+func (m *tagMapping) recentVideos() []string {
+    m.mu.RLock()
+    modified := make(map[string]time.Time)
+    for _, e := range m.tags {
+        if e.MediaType != "" && e.MediaType != content.MediaVideo {
+            continue
+        }
+        modified[e.VideoPath] = time.Time{}
+    }
+    m.mu.RUnlock()
+
+    paths := make([]string, 0, len(modified))
+    for path := range modified {
+        info, err := os.Stat(path)
+        if err != nil {
+            continue
+        }
+        modified[path] = info.ModTime()
+        paths = append(paths, path)
+    }
+    sort.Slice(paths, func(i, j int) bool { return modified[paths[i]].After(modified[paths[j]]) })
+    return paths
+}
+
+// Install a new map, returning how many mappings the old one had and the
+// UIDs whose mapping was added, removed or changed
+func (m *tagMapping) swap(tags map[string]registry.Entry) (int, []string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    old := m.tags
+    m.tags = tags
+
+    var changed []string
+    for uid, e := range tags {
+        if prev, ok := old[uid]; !ok || prev != e {
+            changed = append(changed, uid)
+        }
+    }
+    for uid := range old {
+        if _, ok := tags[uid]; !ok {
+            changed = append(changed, uid)
+        }
+    }
+    return len(old), changed
+}
+
+// Install a reloaded map and pass the UIDs it changed, possibly none, to the
+// dispatch loop. A loop that is behind misses the notice rather than holding
+// up the reload.
+func (m *tagMapping) reload(tags map[string]registry.Entry, remapped chan<- []string) {
+    old, changed := m.swap(tags)
+    logger.Info("reloaded registry", "previous", old, "tags", len(tags), "changed", len(changed))
+    select {
+    case remapped <- changed:
+    default:
+    }
+}
+
+// Scan as pushed to /events subscribers
+type scanMessage struct {
+    UID                string `json:"uid"`
+    MatchedProductName string `json:"matched_product_name"`
+    Timestamp          string `json:"timestamp"`
+}
+
+// Fan-out of scans to live subscribers. A single goroutine drains in and
+// hands each message to every client channel, dropping it for clients that
+// can't keep up so a slow browser never stalls the readers.
+type eventBus struct {
+    in         chan scanMessage
+    maxClients int
+
+    mu      sync.Mutex
+    clients []chan scanMessage
+}
+
+func newEventBus(maxClients int) *eventBus {
+    b := &eventBus{in: make(chan scanMessage, 16), maxClients: maxClients}
+    go b.run()
+    return b
+}
+
+func (b *eventBus) run() {
+    for msg := range b.in {
+        b.mu.Lock()
+        for _, ch := range b.clients {
+            select {
+            case ch <- msg:
+            default:
+            }
+        }
+        b.mu.Unlock()
+    }
+}
+
+// Queue msg for broadcast without blocking the caller
+func (b *eventBus) publish(msg scanMessage) {
+    select {
+    case b.in <- msg:
+    default:
+    }
+}
+
+func (b *eventBus) subscribe() (chan scanMessage, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if len(b.clients) >= b.maxClients {
+        return nil, fmt.Errorf("too many event subscribers (max %d)", b.maxClients)
+    }
+    ch := make(chan scanMessage, 16)
+    b.clients = append(b.clients, ch)
+    return ch, nil
+}
+
+func (b *eventBus) unsubscribe(ch chan scanMessage) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for i, c := range b.clients {
+        if c == ch {
+            b.clients = append(b.clients[:i], b.clients[i+1:]...)
+            return
+        }
+    }
+}
+
+// Settings shared by every NFC reader
+var serialMode = &serial.Mode{
+    BaudRate: 9600,
+    DataBits: 8,
+    Parity:   serial.NoParity,
+    StopBits: serial.OneStopBit,
+}
+
+// A tag read by one of the NFC readers
+type NFCEvent struct {
+    PortName  string
+    UID       string
+    Timestamp time.Time
+    // NDEF records read from the tag, for readers that report them
+    NDEFText string
+    NDEFURI  string
+}
+
+// Tracks when each UID was last seen so a tag held on the reader doesn't
+// keep restarting its video. Every UID has its own timer.
+type tagDebouncer struct {
+    mu       sync.Mutex
+    window   time.Duration
+    lastSeen map[string]time.Time
+}
+
+func newTagDebouncer(window time.Duration) *tagDebouncer {
+    return &tagDebouncer{
+        window:   window,
+        lastSeen: make(map[string]time.Time),
+    }
+}
+
+// Reports whether uid should be handled, i.e. it hasn't been seen within the
+// debounce window. Every sighting refreshes the timer.
+func (d *tagDebouncer) allow(uid string, now time.Time) bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    last, seen := d.lastSeen[uid]
+    d.lastSeen[uid] = now
+    return !seen || now.Sub(last) >= d.window
+}
+
+// Change the debounce window, e.g. after tag_debounce_ms was edited
+func (d *tagDebouncer) setWindow(window time.Duration) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.window = window
+}
+
+// Drop what is remembered of a tag on every port, so a sticker that was
+// just remapped plays on its next scan instead of being debounced
+func (d *tagDebouncer) forget(uid string) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    for key := range d.lastSeen {
+        if strings.HasSuffix(key, "|"+uid) {
+            delete(d.lastSeen, key)
+        }
+    }
 }
 
 func main() {
+    configPath := flag.String("config", config.DefaultPath, "path to the YAML config file")
+    listPorts := flag.Bool("list-ports", false, "print the detected serial ports and exit")
+    dumpEvents := flag.Int("dump-events", 0, "print the last N scan events from the event log and exit")
+    simulate := flag.Bool("simulate", false, "read tag UIDs from stdin, one per line, instead of the NFC reader")
+    showVersion := flag.Bool("version", false, "print the version and exit")
+    mqttTest := flag.Bool("mqtt-test", false, "publish a test event to the configured MQTT broker and exit")
+    resetStats := flag.Bool("reset-stats", false, "zero the play stats file and exit")
+    logOpts := logging.RegisterFlags(flag.CommandLine)
+    flag.Parse()
+
+    var err error
+    logger, err = logOpts.Logger()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+
+    if *showVersion {
+        fmt.Printf("lift_learn %s (built %s)\n", Version, BuildTime)
+        return
+    }
+
+    if *listPorts {
+        printPorts()
+        return
+    }
+
+    cfg, err := config.Load(*configPath)
+    if err != nil {
+        fatal("failed to load config", "err", err)
+    }
+    if cfg.LogLevel != "" {
+        if err := logging.SetLevel(cfg.LogLevel); err != nil {
+            fatal("invalid log_level", "err", err)
+        }
+    }
+
+    if *dumpEvents > 0 {
+        if err := printEvents(cfg.EventLogFile, *dumpEvents); err != nil {
+            fatal("failed to read event log", "err", err)
+        }
+        return
+    }
+
+    if *resetStats {
+        if err := stats.Reset(cfg.StatsFile); err != nil {
+            fatal("failed to reset play stats", "err", err)
+        }
+        fmt.Printf("reset play stats in %s\n", cfg.StatsFile)
+        return
+    }
+
+    if err := cfg.ValidateMQTT(); err != nil {
+        fatal("invalid MQTT config", "err", err)
+    }
+    if err := cfg.ValidateDisplay(); err != nil {
+        fatal("invalid display config", "err", err)
+    }
+    switch cfg.TransitionType {
+    case player.TransitionNone, player.TransitionBlack, player.TransitionFade:
+    default:
+        logger.Warn("unknown transition type, switching videos without one", "transition_type", cfg.TransitionType)
+    }
+
+    if *mqttTest {
+        if err := sendMQTTTest(cfg); err != nil {
+            fatal("MQTT test failed", "err", err)
+        }
+        return
+    }
+
+    // Deferred first so it's logged once everything below has been closed
+    defer logger.Info("shutdown complete")
+
+    eventLog, err := events.NewEventLogger(cfg.EventLogFile, cfg.EventLogMaxSizeBytes, cfg.EventLogMaxRotated)
+    if err != nil {
+        fatal("failed to open event log", "err", err)
+    }
+    defer eventLog.Close()
+
+    // systemd stops the service with SIGTERM; readers, webhooks and mpv are
+    // wound down rather than killed mid-write
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+    defer stop()
+
     // Set XDG_RUNTIME_DIR if not set
     if os.Getenv("XDG_RUNTIME_DIR") == "" {
         os.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
     }
 
-    // Read mapping file
-    data, err := ioutil.ReadFile("tag_video_map.json")
+    // Read tag registry, then keep it up to date as new content is deployed
+    tags, err := reloadMapping(cfg.RegistryFile)
+    if err != nil {
+        fatal("failed to load registry", "err", err)
+    }
+    mapping := &tagMapping{tags: tags}
+    buildinfo.NewBanner(Version, BuildTime, cfg.DeviceID, cfg.StoragePath, cfg.ReaderPorts(), len(tags)).Print(os.Stdout, "lift_learn")
+    // UIDs whose mapping changed on a reload, e.g. a tag assigned to a Thing
+    remapped := make(chan []string, 4)
+    go func() {
+        if err := watchMapping(ctx, cfg.RegistryFile, mapping, remapped); err != nil && ctx.Err() == nil {
+            logger.Warn("registry hot-reload disabled", "err", err)
+        }
+    }()
+
+    debouncer := newTagDebouncer(time.Duration(cfg.TagDebounceMs) * time.Millisecond)
+
+    // Each display has its own mpv instance, driven by one or more readers
+    ports := cfg.ReaderPorts()
+    if *simulate {
+        ports = []string{simulatedPort}
+    } else if cfg.BLE.Enabled {
+        ports = append(ports, config.BLEReaderPort)
+    } else if len(ports) == 0 {
+        port, err := autoDetectNFCPort()
+        if err != nil {
+            fatal("NFC reader auto-detection failed", "err", err)
+        }
+        logger.Info("detected NFC reader", "port", port)
+        ports = []string{port}
+    }
+    playStats, err := stats.Load(cfg.StatsFile)
     if err != nil {
-        log.Fatal(err)
+        fatal("failed to load play stats", "err", err)
+    }
+
+    // Readers configured for the same display share its screen
+    screens := make(map[string]*screen)
+    displays := make(map[int]*screen)
+    ended := make(chan playbackEnded, 4)
+    for i, port := range ports {
+        screenCfg := cfg.ScreenFor(port, i)
+        sc, ok := displays[screenCfg.DisplayId]
+        if !ok {
+            sc = newScreen(cfg, screenCfg, ended, playStats)
+            displays[screenCfg.DisplayId] = sc
+            defer sc.close()
+        }
+        screens[port] = sc
     }
-    
-    var mapping VideoMapping
-    if err := json.Unmarshal(data, &mapping.TagToVideo); err != nil {
-        log.Fatal(err)
+
+    webhooks := webhook.NewDispatcher(cfg.MaxWebhookWorkers, cfg.MaxWebhookRetries, logger)
+
+    // Safe fields are applied as config.yaml is edited; the rest wait for
+    // a restart
+    watcher := config.NewConfigWatcher(*configPath, cfg, logger, func(next *config.Config) {
+        debouncer.setWindow(time.Duration(next.TagDebounceMs) * time.Millisecond)
+        webhooks.SetMaxRetries(next.MaxWebhookRetries)
+        if err := logging.SetLevel(next.LogLevel); err != nil {
+            logger.Warn("ignoring log_level", "err", err)
+        }
+        updated := make(map[int]bool)
+        for i, port := range ports {
+            screenCfg := next.ScreenFor(port, i)
+            if sc, ok := displays[screenCfg.DisplayId]; ok && !updated[screenCfg.DisplayId] {
+                sc.setIdle(screenCfg.IdleVideoPath, time.Duration(next.IdleTimeoutSeconds)*time.Second)
+                updated[screenCfg.DisplayId] = true
+            }
+        }
+    })
+    go func() {
+        if err := watcher.Run(ctx); err != nil && ctx.Err() == nil {
+            logger.Warn("config hot-reload disabled", "err", err)
+        }
+    }()
+
+    // Pools are filled in the background; until a video is warmed, scans
+    // load it into the screen's mpv as usual
+    warmScreens := func() {
+        if !cfg.PrewarmEnabled {
+            return
+        }
+        videos := mapping.recentVideos()
+        for _, sc := range displays {
+            sc.warm(videos)
+        }
     }
+    go warmScreens()
 
-    mode := &serial.Mode{
-        BaudRate: 9600,
-        DataBits: 8,
-        Parity:   serial.NoParity,
-        StopBits: serial.OneStopBit,
+    bus := newEventBus(cfg.MaxSSEClients)
+
+    // Playback commands arriving over the control connections
+    handleCommand := func(cmd controlCommand) error {
+        switch cmd.Action {
+        case "play":
+            entry, ok := mapping.findProduct(cmd.ProductId)
+            if !ok {
+                return fmt.Errorf("unknown product %q", cmd.ProductId)
+            }
+            sc, ok := screens[cmd.Port]
+            if !ok {
+                sc = screens[ports[0]]
+            }
+            if err := sc.play(entry.MediaType, entry.VideoPath, readMetadata(entry).Playback()); err != nil {
+                return err
+            }
+            sc.played(entry.ProductId)
+            return nil
+        case "stop":
+            for _, sc := range displays {
+                sc.playIdle()
+            }
+            return nil
+        case "reload_mapping":
+            tags, err := reloadMapping(cfg.RegistryFile)
+            if err != nil {
+                return err
+            }
+            mapping.reload(tags, remapped)
+            return nil
+        default:
+            return fmt.Errorf("unknown action %q", cmd.Action)
+        }
     }
 
-    port, err := serial.Open("/dev/ttyACM0", mode)
+    hub, err := newWebSocketHub(bus, maxWebSocketClients, handleCommand)
     if err != nil {
-        log.Fatal(err)
+        fatal("failed to start WebSocket hub", "err", err)
     }
-    defer port.Close()
 
-    var currentCmd *exec.Cmd
-    buff := make([]byte, 100)
+    // MQTT is optional; a broker that can't be reached at startup only
+    // disables publishing, it doesn't stop the kiosk
+    var broker *mqtt.Client
+    if cfg.MQTT != nil {
+        broker, err = mqtt.Connect(cfg.MQTT, cfg.DeviceID, logger, func(payload []byte) {
+            var cmd controlCommand
+            if err := json.Unmarshal(payload, &cmd); err != nil {
+                logger.Warn("ignoring malformed MQTT command", "err", err)
+                return
+            }
+            if err := handleCommand(cmd); err != nil {
+                logger.Warn("MQTT command failed", "action", cmd.Action, "err", err)
+            }
+        })
+        if err != nil {
+            logger.Error("MQTT disabled", "err", err)
+        } else {
+            defer broker.Close()
+        }
+    }
+
+    history := events.NewScanHistory(cfg.HistorySize)
+
+    recordScan := func(ev NFCEvent, entry registry.Entry, deploymentId, action string) {
+        metrics.NFCScans.WithLabelValues(ev.UID, action).Inc()
+        history.Add(events.HistoryEntry{
+            Timestamp:    ev.Timestamp.Format(time.RFC3339),
+            UID:          ev.UID,
+            ProductId:    entry.ProductId,
+            ProductName:  entry.ProductName,
+            DeploymentId: deploymentId,
+            Action:       action,
+        })
+        event := events.NewEvent(ev.UID, entry.VideoPath, action, ev.PortName)
+        if err := eventLog.Log(event); err != nil {
+            logger.Error("failed to write event log", "err", err)
+        }
+        if broker != nil {
+            if err := broker.Publish(event); err != nil {
+                logger.Warn("failed to publish scan to MQTT", "err", err)
+            }
+        }
+    }
+
+    ndefCache := &ndef.Cache{Dir: filepath.Join(os.TempDir(), "lift-learn-ndef"), Client: &http.Client{Timeout: 5 * time.Minute}}
+    startNDEF := func(sc *screen, ev NFCEvent, path string) {
+        mediaType, _ := content.MediaTypeForExtension(filepath.Ext(path))
+        logger.Info("playing NDEF media", "uid", ev.UID, "uri", ev.NDEFURI, "media_type", mediaType, "path", path)
+        if err := sc.play(mediaType, path, content.DefaultPlaybackOptions); err != nil {
+            logger.Error("failed to start media", "path", path, "err", err)
+            return
+        }
+        recordScan(ev, registry.Entry{NfcTagId: ev.UID, MediaType: mediaType, VideoPath: path}, "", events.ActionNDEFPlayed)
+    }
+    // Play what a tag's NDEF URI names, reporting false when it isn't
+    // something this device will play so the registry is tried instead.
+    // Remote media is downloaded in the background, off the dispatch loop.
+    playNDEF := func(sc *screen, ev NFCEvent) bool {
+        if path, ok := ndefLocalPath(ev.NDEFURI, cfg.StoragePath, mapping); ok {
+            startNDEF(sc, ev, path)
+            return true
+        }
+        u, err := url.Parse(ev.NDEFURI)
+        if !cfg.AllowNDEFDownload || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            logger.Warn("ignoring NDEF URI", "uid", ev.UID, "uri", ev.NDEFURI)
+            return false
+        }
+        go func() {
+            path, err := ndefCache.Fetch(context.Background(), ev.NDEFURI)
+            if err != nil {
+                logger.Error("failed to fetch NDEF media", "uri", ev.NDEFURI, "err", err)
+                return
+            }
+            startNDEF(sc, ev, path)
+        }()
+        return true
+    }
+
+    handleTag := func(ev NFCEvent) {
+        logger.Info("tag scanned", "uid", ev.UID, "port", ev.PortName, "ndef_text", ev.NDEFText, "ndef_uri", ev.NDEFURI)
+
+        sc, ok := screens[ev.PortName]
+        if !ok {
+            return
+        }
+
+        entry, exists := mapping.lookup(ev.UID)
+        videoPath := entry.VideoPath
+        bus.publish(scanMessage{
+            UID:                ev.UID,
+            MatchedProductName: entry.ProductName,
+            Timestamp:          ev.Timestamp.Format(time.RFC3339),
+        })
+        if !debouncer.allow(ev.PortName+"|"+ev.UID, ev.Timestamp) {
+            recordScan(ev, entry, "", events.ActionDebounced)
+            return
+        }
+        if ev.NDEFURI != "" && cfg.AllowNDEFPlayback && playNDEF(sc, ev) {
+            return
+        }
+        if !exists {
+            recordScan(ev, entry, "", events.ActionUnknownTag)
+            return
+        }
+
+        // Check if file exists
+        if _, err := os.Stat(videoPath); err != nil {
+            logger.Error("video file unavailable", "uid", ev.UID, "product_id", entry.ProductId, "err", err)
+            return
+        }
+
+        thing := readMetadata(entry)
+        if thing.ProductName == "" {
+            thing.ProductName = entry.ProductName
+        }
+
+        // A scheduled Thing only plays within its windows; a schedule that
+        // can't be checked doesn't keep it off the screen
+        allowed, err := thing.PlaySchedule.Allows(ev.Timestamp)
+        if err != nil {
+            logger.Warn("ignoring play schedule", "product_id", entry.ProductId, "err", err)
+            allowed = true
+        }
+        if !allowed {
+            logger.Info("tag scanned outside schedule", "uid", ev.UID, "product_id", entry.ProductId)
+            recordScan(ev, entry, thing.DeploymentId, events.ActionOutsideSchedule)
+            sc.returnToIdle()
+            return
+        }
+
+        if cfg.ActivationSoundPath != "" {
+            if _, err := os.Stat(cfg.ActivationSoundPath); err != nil {
+                logger.Warn("activation sound unavailable", "path", cfg.ActivationSoundPath, "err", err)
+            } else {
+                player.PlaySound(logger, cfg.ActivationSoundPath, activationSoundTimeout)
+            }
+        }
+        logger.Info("playing media", "uid", ev.UID, "product_id", entry.ProductId, "product_name", thing.LocalizedName(cfg.Locale), "media_type", entry.MediaType, "path", videoPath)
+        if err := sc.play(entry.MediaType, videoPath, thing.Playback()); err != nil {
+            logger.Error("failed to start media", "path", videoPath, "err", err)
+            return
+        }
+        sc.played(entry.ProductId)
+        if thing.LocalizedName(cfg.Locale) != "" && (entry.MediaType == "" || entry.MediaType == content.MediaVideo) {
+            sc.showProduct(thing)
+        }
+        if thing.WebhookURL != "" {
+            webhooks.Send(thing.WebhookURL, webhook.Payload{
+                DeviceId:     cfg.DeviceID,
+                ProductId:    entry.ProductId,
+                NfcTagId:     entry.NfcTagId,
+                ScannedAt:    ev.Timestamp.Format(time.RFC3339),
+                DeploymentId: thing.DeploymentId,
+            })
+        }
+        recordScan(ev, entry, thing.DeploymentId, events.ActionPlayed)
+        metrics.VideoPlays.WithLabelValues(entry.ProductId).Inc()
+    }
+
+    scans := make(chan NFCEvent, 16)
+
+    var simulateScan http.Handler
+    if cfg.SimulateEnabled {
+        simulateScan = middleware.RequireAPIKey(cfg.APIKey, handleSimulateScan(mapping, ports, scans))
+    }
+    go func() {
+        if err := startControlServer(cfg, bus, hub, history, playStats, eventLog, simulateScan); err != nil {
+            logger.Error("control server stopped", "err", err)
+        }
+    }()
+
+    // Ends the dispatch loop, and lift_learn, once stdin is exhausted. scans
+    // stays open since /simulate-scan may still send on it.
+    var stdinDone chan struct{}
+    if *simulate {
+        stdinDone = make(chan struct{})
+        go func() {
+            runSimulatedReader(os.Stdin, scans)
+            close(stdinDone)
+        }()
+    }
+    var readers sync.WaitGroup
+    if !*simulate {
+        for _, port := range ports {
+            readerType := ReaderSerial
+            if port == config.BLEReaderPort {
+                readerType = ReaderBLE
+            }
+            readers.Add(1)
+            go func(port string) {
+                defer readers.Done()
+                runReader(ctx, cfg, readerType, port, scans)
+            }(port)
+        }
+    }
 
+    // Central dispatch: every scan goes to the screen of the reader that saw
+    // it, and a screen whose media has played out returns to its idle video
     for {
-        n, err := port.Read(buff)
+        select {
+        case ev := <-scans:
+            handleTag(ev)
+        case <-stdinDone:
+            // Scans still buffered were read before stdin ran out
+            for len(scans) > 0 {
+                handleTag(<-scans)
+            }
+            return
+        case e := <-ended:
+            if sc, ok := screens[e.port]; ok {
+                sc.finished(e.path)
+            }
+        case uids := <-remapped:
+            for _, uid := range uids {
+                debouncer.forget(uid)
+            }
+            // Content may have been deployed even if no tag moved
+            go warmScreens()
+        case <-ctx.Done():
+            // A second signal kills the process outright
+            stop()
+            logger.Info("shutting down")
+            readers.Wait()
+            drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeoutSeconds)*time.Second)
+            if err := webhooks.Close(drainCtx); err != nil {
+                logger.Warn("shutdown timed out", "err", err)
+            }
+            cancel()
+            // Deferred closes quit mpv and close the event log and broker
+            return
+        }
+    }
+}
+
+// Serve the live endpoints for the admin side of the device
+// simulateScan is nil unless simulate_enabled is set.
+func startControlServer(cfg *config.Config, bus *eventBus, hub *WebSocketHub, history *events.ScanHistory, playStats *stats.Tracker, eventLog *events.EventLogger, simulateScan http.Handler) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/events", handleEvents(bus))
+    mux.HandleFunc("/history", handleHistory(history))
+    mux.HandleFunc("/stats", handleStats(playStats))
+    mux.Handle("/admin/rotate-log", middleware.RequireAPIKey(cfg.APIKey, handleRotateLog(eventLog)))
+    if simulateScan != nil {
+        mux.Handle("/simulate-scan", simulateScan)
+    }
+    // Clients can drive playback over /ws, so it takes the API key
+    mux.Handle("/ws", middleware.RequireAPIKey(cfg.APIKey, http.HandlerFunc(hub.handleWebSocket)))
+    mux.Handle("/metrics", metrics.Handler())
+
+    logger.Info("control server listening", "addr", cfg.ControlAddr)
+    return http.ListenAndServe(cfg.ControlAddr, mux)
+}
+
+// Body of POST /simulate-scan. Port picks the reader the scan is attributed
+// to, and so the screen it plays on; the first reader is used without it.
+// Any other port than a configured reader's is refused.
+type simulateScanRequest struct {
+    UID  string `json:"uid"`
+    Port string `json:"port,omitempty"`
+}
+
+// Answer to /simulate-scan: whether the UID maps to anything, and what
+type simulateScanResponse struct {
+    Matched   bool   `json:"matched"`
+    ProductId string `json:"productId,omitempty"`
+    VideoPath string `json:"videoPath,omitempty"`
+}
+
+// Feed a synthetic scan into the dispatch loop, exactly as if a reader had
+// seen the tag, so debounce, playback, webhooks and MQTT all apply
+func handleSimulateScan(mapping *tagMapping, ports []string, scans chan<- NFCEvent) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        var req simulateScanRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+        uid := registry.NormalizeUID(req.UID)
+        if uid == "" {
+            http.Error(w, "uid is required", http.StatusBadRequest)
+            return
+        }
+        port := req.Port
+        if port == "" {
+            port = ports[0]
+        }
+        // The dispatch loop drops scans from readers it doesn't know
+        known := false
+        for _, p := range ports {
+            known = known || p == port
+        }
+        if !known {
+            http.Error(w, fmt.Sprintf("Unknown port %q", port), http.StatusBadRequest)
+            return
+        }
+
+        logger.Info("simulated scan", "uid", uid, "port", port, "remote_addr", r.RemoteAddr)
+        // Nothing reads scans any more once the dispatch loop has returned
+        select {
+        case scans <- NFCEvent{PortName: port, UID: uid, Timestamp: time.Now()}:
+        case <-r.Context().Done():
+            http.Error(w, "Scan not delivered", http.StatusServiceUnavailable)
+            return
+        }
+
+        var resp simulateScanResponse
+        if entry, ok := mapping.lookup(uid); ok {
+            resp = simulateScanResponse{Matched: true, ProductId: entry.ProductId, VideoPath: entry.VideoPath}
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(resp)
+    }
+}
+
+// Recent scans, newest first. ?limit=N caps how many are returned and ?uid=X
+// keeps only that tag's.
+func handleHistory(history *events.ScanHistory) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        limit := 0
+        if s := r.URL.Query().Get("limit"); s != "" {
+            n, err := strconv.Atoi(s)
+            if err != nil || n < 0 {
+                http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+                return
+            }
+            limit = n
+        }
+        uid := r.URL.Query().Get("uid")
+        if uid != "" {
+            uid = registry.NormalizeUID(uid)
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(history.Recent(limit, uid))
+    }
+}
+
+// Play counts and durations per product, most played first
+func handleStats(playStats *stats.Tracker) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(playStats.All())
+    }
+}
+
+// Rotate the event log now, e.g. before copying it off the device
+func handleRotateLog(eventLog *events.EventLogger) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if err := eventLog.Rotate(); err != nil {
+            logger.Error("failed to rotate event log", "err", err)
+            http.Error(w, "Failed to rotate event log", http.StatusInternalServerError)
+            return
+        }
+        logger.Info("event log rotated")
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]string{"status": "rotated"})
+    }
+}
+
+// Stream every scan to the client as Server-Sent Events until it disconnects
+func handleEvents(bus *eventBus) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+            http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+            return
+        }
+
+        ch, err := bus.subscribe()
         if err != nil {
-            log.Fatal(err)
-        }
-
-        if n > 0 {
-            data := string(buff[:n])
-            if strings.Contains(data, "UID Value:") {
-                uid := data[strings.Index(data, "UID Value:")+11:]
-                uid = strings.TrimSpace(strings.Split(uid, "\r\n")[0])
-                fmt.Printf("Tag UID: %s\n", uid)
-
-                if videoPath, exists := mapping.TagToVideo[uid]; exists {
-                    fmt.Printf("Full video path: %s\n", videoPath)
-                    
-                    // Check if file exists
-                    if _, err := os.Stat(videoPath); err != nil {
-                        log.Printf("Video file error: %v\n", err)
-                        continue
-                    }
+            http.Error(w, err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+        defer bus.unsubscribe(ch)
 
-                    // Kill previous video if it's still running
-                    if currentCmd != nil && currentCmd.Process != nil {
-                        fmt.Println("Killing previous video")
-                        currentCmd.Process.Kill()
-                    }
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("Connection", "keep-alive")
+        w.WriteHeader(http.StatusOK)
+        flusher.Flush()
 
-                    fmt.Printf("Playing video: %s\n", videoPath)
-                    currentCmd = exec.Command("mpv", 
-                        "--msg-level=all=v",  // Added verbose logging
-                        "--no-audio",
-                        "--fs",
-                        "--loop",
-                        videoPath)
-
-                    // Print the full command being executed
-                    fmt.Printf("Running command: mpv %s\n", strings.Join(currentCmd.Args[1:], " "))
-
-                    // Capture and display any error output
-                    currentCmd.Stderr = os.Stderr
-                    currentCmd.Stdout = os.Stdout
-
-                    // Start the command without waiting for it to complete
-                    err := currentCmd.Start()
-                    if err != nil {
-                        log.Printf("Error starting video: %v\n", err)
-                    } else {
-                        log.Printf("MPV started successfully\n")
-                        // Add error checking on the process
-                        go func() {
-                            err := currentCmd.Wait()
-                            if err != nil {
-                                log.Printf("MPV process error: %v\n", err)
-                            }
-                        }()
-                    }
+        keepalive := time.NewTicker(sseKeepaliveInterval)
+        defer keepalive.Stop()
+
+        for {
+            select {
+            case <-r.Context().Done():
+                return
+            case <-keepalive.C:
+                if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+                    return
+                }
+                flusher.Flush()
+            case msg := <-ch:
+                data, err := json.Marshal(msg)
+                if err != nil {
+                    continue
                 }
+                if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+                    return
+                }
+                flusher.Flush()
             }
         }
     }
 }
+
+// Inbound message on /ws, e.g. {"action": "play", "productId": "coffee"}.
+// Port picks the screen for "play"; the first screen is used without it.
+type controlCommand struct {
+    Action    string `json:"action"`
+    ProductId string `json:"productId,omitempty"`
+    Port      string `json:"port,omitempty"`
+}
+
+// Sent back to the client that issued a command
+type commandReply struct {
+    Action string `json:"action"`
+    OK     bool   `json:"ok"`
+    Error  string `json:"error,omitempty"`
+}
+
+// Without CheckOrigin the upgrader refuses browsers on pages from another
+// host, so a site open on the kiosk's network can't drive playback
+var upgrader = websocket.Upgrader{}
+
+// WebSocketHub pushes every scan from the event bus to the connected /ws
+// clients and hands the commands they send to handleCommand
+type WebSocketHub struct {
+    maxClients    int
+    handleCommand func(controlCommand) error
+
+    mu      sync.RWMutex
+    clients map[*wsClient]struct{}
+}
+
+type wsClient struct {
+    conn *websocket.Conn
+    send chan []byte
+}
+
+func newWebSocketHub(bus *eventBus, maxClients int, handleCommand func(controlCommand) error) (*WebSocketHub, error) {
+    scans, err := bus.subscribe()
+    if err != nil {
+        return nil, err
+    }
+    h := &WebSocketHub{
+        maxClients:    maxClients,
+        handleCommand: handleCommand,
+        clients:       make(map[*wsClient]struct{}),
+    }
+    go h.broadcast(scans)
+    return h, nil
+}
+
+func (h *WebSocketHub) broadcast(scans <-chan scanMessage) {
+    for msg := range scans {
+        data, err := json.Marshal(msg)
+        if err != nil {
+            continue
+        }
+        h.mu.RLock()
+        for c := range h.clients {
+            select {
+            case c.send <- data:
+            default:
+                // Slow client, drop the event rather than block the rest
+            }
+        }
+        h.mu.RUnlock()
+    }
+}
+
+func (h *WebSocketHub) register(c *wsClient) bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if len(h.clients) >= h.maxClients {
+        return false
+    }
+    h.clients[c] = struct{}{}
+    return true
+}
+
+func (h *WebSocketHub) unregister(c *wsClient) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if _, ok := h.clients[c]; ok {
+        delete(h.clients, c)
+        close(c.send)
+    }
+}
+
+func (h *WebSocketHub) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // Upgrade has already answered the request
+        return
+    }
+
+    c := &wsClient{conn: conn, send: make(chan []byte, 16)}
+    if !h.register(c) {
+        msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too many clients")
+        conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+        conn.Close()
+        return
+    }
+
+    go c.writePump()
+    h.readPump(c)
+}
+
+// Read commands until the client goes away. Every pong pushes the read
+// deadline out again, so a client that stops answering pings is dropped.
+func (h *WebSocketHub) readPump(c *wsClient) {
+    defer func() {
+        h.unregister(c)
+        c.conn.Close()
+    }()
+
+    c.conn.SetReadLimit(4096)
+    c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+    c.conn.SetPongHandler(func(string) error {
+        return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+    })
+
+    for {
+        var cmd controlCommand
+        if err := c.conn.ReadJSON(&cmd); err != nil {
+            if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+                logger.Warn("WebSocket client error", "err", err)
+            }
+            return
+        }
+
+        reply := commandReply{Action: cmd.Action, OK: true}
+        if err := h.handleCommand(cmd); err != nil {
+            reply.OK = false
+            reply.Error = err.Error()
+        }
+        if data, err := json.Marshal(reply); err == nil {
+            h.mu.RLock()
+            select {
+            case c.send <- data:
+            default:
+            }
+            h.mu.RUnlock()
+        }
+    }
+}
+
+// Write queued messages and keepalive pings; send a close frame once the
+// hub drops the client
+func (c *wsClient) writePump() {
+    ticker := time.NewTicker(wsPingInterval)
+    defer func() {
+        ticker.Stop()
+        c.conn.Close()
+    }()
+
+    for {
+        select {
+        case data, ok := <-c.send:
+            c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+            if !ok {
+                c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+                return
+            }
+            if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+                return
+            }
+        case <-ticker.C:
+            c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+            if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                return
+            }
+        }
+    }
+}
+
+// One display and the players driving it, fed by a single NFC reader
+type screen struct {
+    port        string
+    logger      *slog.Logger
+    mpv         *player.MpvController
+    prewarm     *player.PrewarmPool // nil unless prewarm_enabled is set
+    players     map[string]player.Player
+    idleVideo   string
+    idleTimeout time.Duration
+    screensaver config.ScreensaverConfig
+    idleTimer   *time.Timer
+    osdStyle    player.OSDStyle
+    osdDuration time.Duration
+    locale      string
+    stats       *stats.Tracker
+
+    // Stops whatever was started last, so an image or audio clip doesn't
+    // outlive the scan that replaced it
+    mu      sync.Mutex
+    stop    func()
+    current string
+}
+
+// Media on a screen that played to its end without being replaced
+type playbackEnded struct {
+    port string
+    path string
+}
+
+func newScreen(cfg *config.Config, screenCfg config.ScreenConfig, ended chan<- playbackEnded, playStats *stats.Tracker) *screen {
+    port := screenCfg.SerialPort
+    display := screenCfg.DisplayId
+    screenLogger := logger.With("port", port, "display", display)
+    screenArgs := []string{
+        "--msg-level=all=v",  // Added verbose logging
+        "--no-audio",
+        "--fs",
+        "--loop",
+        fmt.Sprintf("--screen=%d", display),
+        fmt.Sprintf("--fs-screen=%d", display),
+    }
+    sc := &screen{
+        port:        port,
+        logger:      screenLogger,
+        mpv:         player.NewMpvController(screenLogger, socketPath(cfg.MpvSocket, display), screenArgs...),
+        idleVideo:   screenCfg.IdleVideoPath,
+        idleTimeout: time.Duration(cfg.IdleTimeoutSeconds) * time.Second,
+        screensaver: cfg.Screensaver,
+        osdStyle: player.OSDStyle{
+            FontSize: cfg.OSDFontSize,
+            Color:    cfg.OSDColor,
+            Position: cfg.OSDPosition,
+        },
+        osdDuration: time.Duration(cfg.OSDDurationSeconds) * time.Second,
+        locale:      cfg.Locale,
+        stats:       playStats,
+    }
+    displayOpts := player.Display{
+        Width:           cfg.Display.Width,
+        Height:          cfg.Display.Height,
+        AspectRatio:     cfg.Display.AspectRatio,
+        RotationDegrees: cfg.Display.RotationDegrees,
+        Background:      cfg.Display.LetterboxColor,
+    }
+    sc.mpv.SetDisplay(displayOpts)
+    var prewarmEnded <-chan player.PlaybackEnded // never ready without a pool
+    if cfg.PrewarmEnabled {
+        sc.prewarm = player.NewPrewarmPool(screenLogger, socketPath(cfg.MpvSocket, display), cfg.MaxPrewarmedVideos, screenArgs...)
+        sc.prewarm.SetDisplay(displayOpts)
+        prewarmEnded = sc.prewarm.Ended()
+    }
+    processEnded := make(chan player.PlaybackEnded, 4)
+    sc.players = map[string]player.Player{
+        content.MediaVideo: player.NewMpvVideoPlayer(sc.mpv, player.Transition{
+            Type:     cfg.TransitionType,
+            Duration: time.Duration(cfg.TransitionDurationMs) * time.Millisecond,
+        }),
+        content.MediaImage: player.NewImageDisplayPlayer(sc.logger, cfg.ImageViewer,
+            time.Duration(cfg.ImageDisplaySeconds)*time.Second, processEnded),
+        content.MediaAudio: player.NewMpvAudioPlayer(sc.logger, processEnded),
+    }
+    go func() {
+        for {
+            var e player.PlaybackEnded
+            select {
+            case e = <-sc.mpv.Ended():
+            case e = <-processEnded:
+            case e = <-prewarmEnded:
+            }
+            ended <- playbackEnded{port: port, path: e.Path}
+        }
+    }()
+    if err := sc.mpv.Start(); err != nil {
+        // LoadFile retries the start on the first scan
+        sc.logger.Error("failed to start mpv", "err", err)
+    }
+
+    // Fall back to the idle video whenever no tag has been handled for a while
+    sc.playIdle()
+    sc.idleTimer = time.AfterFunc(sc.idleTimeout, sc.playIdle)
+    return sc
+}
+
+func (sc *screen) playIdle() {
+    // Whatever product was on screen has stopped playing either way
+    if err := sc.stats.Stopped(sc.port, time.Now()); err != nil {
+        sc.logger.Warn("failed to save play stats", "err", err)
+    }
+    switch sc.screensaver.Mode {
+    case config.ScreensaverOff:
+        sc.blank()
+        return
+    case config.ScreensaverSlideshow:
+        if err := sc.startSlideshow(); err != nil {
+            sc.logger.Error("failed to start slideshow", "err", err)
+        }
+        return
+    }
+    idleVideo, _ := sc.idle()
+    if idleVideo == "" {
+        sc.logger.Warn("no idle video configured")
+        return
+    }
+    if _, err := os.Stat(idleVideo); err != nil {
+        sc.logger.Warn("idle video unavailable", "err", err)
+        return
+    }
+    sc.logger.Info("playing idle video", "path", idleVideo)
+    if err := sc.start(content.MediaVideo, idleVideo, content.DefaultPlaybackOptions); err != nil {
+        sc.logger.Error("failed to start idle video", "err", err)
+    }
+}
+
+// The idle video and how long the screen waits before going back to it
+func (sc *screen) idle() (string, time.Duration) {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    return sc.idleVideo, sc.idleTimeout
+}
+
+// Change the idle settings after a config reload. They take effect the next
+// time the screen goes idle or the countdown restarts.
+func (sc *screen) setIdle(video string, timeout time.Duration) {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    sc.idleVideo = video
+    sc.idleTimeout = timeout
+}
+
+// Stop whatever is playing and leave the screen empty
+func (sc *screen) blank() {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    if sc.stop != nil {
+        sc.stop()
+        sc.stop = nil
+    }
+    sc.current = ""
+    if err := sc.mpv.Stop(); err != nil {
+        sc.logger.Warn("failed to stop mpv", "err", err)
+    }
+}
+
+// Cycle through the screensaver images in the screen's mpv until the next
+// start replaces the slideshow. The glob is matched afresh each time, so
+// images added since the last run are picked up.
+func (sc *screen) startSlideshow() error {
+    images, err := filepath.Glob(sc.screensaver.ImageGlob)
+    if err != nil {
+        return err
+    }
+    if len(images) == 0 {
+        sc.logger.Warn("no slideshow images", "image_glob", sc.screensaver.ImageGlob)
+        return nil
+    }
+    sort.Strings(images)
+
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    if sc.stop != nil {
+        sc.stop()
+        sc.stop = nil
+    }
+    // Looped like every other file, an image stays up until the next one
+    opts := mpvArgs(content.DefaultPlaybackOptions)
+    if err := sc.mpv.LoadFile(images[0], opts...); err != nil {
+        return err
+    }
+    sc.logger.Info("starting slideshow", "images", len(images))
+
+    ticker := time.NewTicker(time.Duration(sc.screensaver.SlideInterval) * time.Second)
+    done := make(chan struct{})
+    go func() {
+        for i := 1; ; i++ {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            }
+            sc.mu.Lock()
+            // A scan may have stopped the slideshow while this waited
+            select {
+            case <-done:
+                sc.mu.Unlock()
+                return
+            default:
+            }
+            image := images[i%len(images)]
+            if err := sc.mpv.LoadFile(image, opts...); err != nil {
+                sc.logger.Warn("failed to show slide", "path", image, "err", err)
+            }
+            sc.current = image
+            sc.mu.Unlock()
+        }
+    }()
+    sc.stop = func() {
+        ticker.Stop()
+        close(done)
+    }
+    sc.current = images[0]
+    return nil
+}
+
+// Switch to the media at path and restart the idle countdown
+func (sc *screen) play(mediaType, path string, opts content.PlaybackOptions) error {
+    if err := sc.start(mediaType, path, opts); err != nil {
+        return err
+    }
+    _, idleTimeout := sc.idle()
+    sc.idleTimer.Reset(idleTimeout)
+    return nil
+}
+
+// Stop the current media and hand path to the player for its type,
+// treating unknown types as video
+func (sc *screen) start(mediaType, path string, opts content.PlaybackOptions) error {
+    p, ok := sc.players[mediaType]
+    if !ok {
+        p = sc.players[content.MediaVideo]
+    }
+
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    if sc.stop != nil {
+        sc.stop()
+        sc.stop = nil
+    }
+    var stop func()
+    var err error
+    if vp, ok := p.(*player.MpvVideoPlayer); ok {
+        // A pre-warmed copy only needs unpausing; anything else is loaded
+        // into the screen's own mpv
+        warmed := false
+        if sc.prewarm != nil {
+            stop, warmed, err = sc.prewarm.Play(path, mpvArgs(opts)...)
+            if warmed && err != nil {
+                sc.logger.Warn("pre-warmed video failed to start, loading it instead", "path", path, "err", err)
+                warmed = false
+            }
+        }
+        if !warmed {
+            stop, err = vp.PlayWithOptions(path, mpvArgs(opts)...)
+        }
+    } else {
+        stop, err = p.Play(path)
+    }
+    if err != nil {
+        return err
+    }
+    sc.stop = stop
+    sc.current = path
+    return nil
+}
+
+// Count a play of productId, which was just started on this screen. The
+// play lasts until the next one or until the screen goes back to idle.
+func (sc *screen) played(productId string) {
+    if err := sc.stats.Started(sc.port, productId, time.Now()); err != nil {
+        sc.logger.Warn("failed to save play stats", "err", err)
+    }
+}
+
+// Put the product's name in the configured locale and its price, and its
+// description if it has one, over the video that was just started
+func (sc *screen) showProduct(thing content.Thing) {
+    lines := []string{thing.LocalizedName(sc.locale)}
+    if thing.Price != "" {
+        lines = append(lines, thing.Price)
+    }
+    if thing.DescriptionText != "" {
+        lines = append(lines, thing.DescriptionText)
+    }
+    if err := sc.mpv.ShowOSD(lines, sc.osdStyle, sc.osdDuration); err != nil {
+        sc.logger.Warn("failed to show product overlay", "err", err)
+    }
+}
+
+// Go back to the idle video once the product media that ended is still the
+// one on screen. A report for something already replaced is ignored.
+func (sc *screen) finished(path string) {
+    sc.mu.Lock()
+    current, idleVideo := sc.current, sc.idleVideo
+    sc.mu.Unlock()
+    if path != current || path == idleVideo {
+        return
+    }
+    sc.logger.Info("playback ended", "path", path)
+    sc.playIdle()
+}
+
+// Go back to the idle video unless it's already on screen, or there is none
+func (sc *screen) returnToIdle() {
+    sc.mu.Lock()
+    current, idleVideo := sc.current, sc.idleVideo
+    sc.mu.Unlock()
+    if idleVideo == "" || current == idleVideo {
+        return
+    }
+    sc.playIdle()
+}
+
+// Pre-warm the first of paths, if this screen keeps a pool
+func (sc *screen) warm(paths []string) {
+    if sc.prewarm != nil {
+        sc.prewarm.Warm(paths)
+    }
+}
+
+func (sc *screen) close() {
+    sc.idleTimer.Stop()
+    sc.mu.Lock()
+    if sc.stop != nil {
+        sc.stop()
+    }
+    sc.mu.Unlock()
+    if sc.prewarm != nil {
+        sc.prewarm.Close()
+    }
+    sc.mpv.Quit()
+}
+
+// Read the Thing saved as a registry entry's metadata. An empty Thing is
+// returned if there is none, which plays with the default options.
+func readMetadata(entry registry.Entry) content.Thing {
+    if entry.MetadataPath == "" {
+        return content.Thing{}
+    }
+    thing, err := content.ReadThing(entry.MetadataPath)
+    if err != nil {
+        logger.Warn("failed to read metadata", "path", entry.MetadataPath, "err", err)
+        return content.Thing{}
+    }
+    return thing
+}
+
+// mpv options for opts. Every option is always given because they persist
+// in the running mpv from one file to the next.
+func mpvArgs(opts content.PlaybackOptions) []string {
+    loop := "inf"
+    if opts.LoopCount > 0 {
+        loop = strconv.Itoa(opts.LoopCount)
+    }
+    // The screen's mpv is started with --loop; without turning the playlist
+    // loop off a finite loop count would never let the file end
+    args := []string{"--loop-file=" + loop, "--loop-playlist=no"}
+    if opts.MuteAudio {
+        args = append(args, "--no-audio")
+    } else {
+        args = append(args, "--audio=auto", "--volume=100")
+    }
+    return append(args,
+        fmt.Sprintf("--start=%g", opts.StartOffsetSeconds),
+        fmt.Sprintf("--speed=%g", opts.PlaybackSpeed))
+}
+
+// IPC socket for a display: the configured path for display 0, then
+// /tmp/mpv-1.sock, /tmp/mpv-2.sock, ...
+func socketPath(base string, index int) string {
+    if index == 0 {
+        return base
+    }
+    ext := filepath.Ext(base)
+    return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), index, ext)
+}
+
+// Load the tag registry keyed by normalized UID
+func reloadMapping(path string) (map[string]registry.Entry, error) {
+    reg, err := registry.Load(path)
+    if err != nil {
+        return nil, err
+    }
+
+    tags := make(map[string]registry.Entry)
+    for uid, entry := range reg.Entries() {
+        tags[registry.NormalizeUID(uid)] = entry
+    }
+    return tags, nil
+}
+
+// Reload the registry into mapping whenever its file changes, passing the
+// UIDs that changed to remapped. The directory is watched because the upload
+// server replaces the file by renaming over it.
+func watchMapping(ctx context.Context, path string, mapping *tagMapping, remapped chan<- []string) error {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return err
+    }
+    defer watcher.Close()
+
+    if err := watcher.Add(filepath.Dir(path)); err != nil {
+        return err
+    }
+
+    reload := func() {
+        tags, err := reloadMapping(path)
+        if err != nil {
+            logger.Error("failed to reload registry", "err", err)
+            return
+        }
+        mapping.reload(tags, remapped)
+    }
+
+    // Each change restarts the timer so a burst of writes reloads once
+    timer := time.AfterFunc(time.Hour, reload)
+    timer.Stop()
+    defer timer.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return nil
+            }
+            if filepath.Clean(event.Name) != filepath.Clean(path) {
+                continue
+            }
+            if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+                timer.Reset(reloadDebounce)
+            }
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return nil
+            }
+            logger.Warn("registry watcher error", "err", err)
+        }
+    }
+}
+
+// Connect with the configured MQTT settings and publish one event, so an
+// installer can check the broker and topics from the command line
+func sendMQTTTest(cfg *config.Config) error {
+    if cfg.MQTT == nil {
+        return fmt.Errorf("no mqtt section in config")
+    }
+    client, err := mqtt.Connect(cfg.MQTT, cfg.DeviceID, logger, nil)
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+
+    if err := client.Publish(events.NewEvent("test", "", "test", "")); err != nil {
+        return err
+    }
+    fmt.Printf("Published test event to %s\n", client.EventsTopic())
+    return nil
+}
+
+// Print the last n events from the event log as indented JSON
+func printEvents(path string, n int) error {
+    evs, err := events.ReadLast(path, n)
+    if err != nil {
+        return err
+    }
+    for _, ev := range evs {
+        out, err := json.MarshalIndent(ev, "", "  ")
+        if err != nil {
+            return err
+        }
+        fmt.Println(string(out))
+    }
+    return nil
+}
+
+// Find the NFC reader by probing every serial port for reader output
+func autoDetectNFCPort() (string, error) {
+    ports, err := serial.GetPortsList()
+    if err != nil {
+        return "", fmt.Errorf("failed to list serial ports: %v", err)
+    }
+
+    for _, port := range ports {
+        if probePort(port) {
+            return port, nil
+        }
+    }
+    return "", fmt.Errorf("no NFC reader found, tried ports: %v", ports)
+}
+
+// Open portName briefly, send a probe byte and check whether the reply looks
+// like one of the reader greetings
+func probePort(portName string) bool {
+    port, err := serial.Open(portName, serialMode)
+    if err != nil {
+        return false
+    }
+    defer port.Close()
+
+    if err := port.SetReadTimeout(50 * time.Millisecond); err != nil {
+        return false
+    }
+    if _, err := port.Write([]byte{'\n'}); err != nil {
+        return false
+    }
+
+    var received strings.Builder
+    buff := make([]byte, 100)
+    deadline := time.Now().Add(probeTimeout)
+    for time.Now().Before(deadline) {
+        n, err := port.Read(buff)
+        if err != nil {
+            return false
+        }
+        received.Write(buff[:n])
+        for _, greeting := range readerGreetings {
+            if strings.Contains(received.String(), greeting) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Print every serial port, marking the ones that answer like an NFC reader
+func printPorts() {
+    ports, err := serial.GetPortsList()
+    if err != nil {
+        fatal("failed to list serial ports", "err", err)
+    }
+    if len(ports) == 0 {
+        fmt.Println("No serial ports found")
+        return
+    }
+
+    for _, port := range ports {
+        if probePort(port) {
+            fmt.Printf("%s (NFC reader)\n", port)
+        } else {
+            fmt.Println(port)
+        }
+    }
+}
+
+// Kinds of reader a scan can come from
+type ReaderType string
+
+const (
+    ReaderSerial ReaderType = "serial"
+    ReaderBLE    ReaderType = "ble"
+)
+
+// Publish every tag read on portName to scans. The reader reconnects on
+// its own, so a failing port never affects the other readers. A BLE reader
+// reports beacons instead, keyed by Eddystone URL or MAC address.
+func runReader(ctx context.Context, cfg *config.Config, readerType ReaderType, portName string, scans chan<- NFCEvent) {
+    publish := func(read tagRead) {
+        select {
+        case scans <- NFCEvent{PortName: portName, UID: read.UID, Timestamp: time.Now(), NDEFText: read.NDEFText, NDEFURI: read.NDEFURI}:
+        case <-ctx.Done():
+        }
+    }
+    var err error
+    switch readerType {
+    case ReaderBLE:
+        err = ble.Scan(ctx, time.Duration(cfg.BLE.ScanDurationMs)*time.Millisecond, cfg.BLE.AdvertisedUUIDPrefix, func(id string) {
+            publish(tagRead{UID: registry.NormalizeUID(id)})
+        })
+    default:
+        err = runSerialLoop(ctx, portName, serialMode, cfg.AllowNDEFPlayback, publish)
+    }
+    if err != nil && ctx.Err() == nil {
+        logger.Error("reader stopped", "port", portName, "err", err)
+    }
+}
+
+// Port name scans read with --simulate are attributed to
+const simulatedPort = "stdin"
+
+// Stand-in for runReader with --simulate: every non-empty line of r is a raw
+// UID, sent through the same normalisation as one read from a real reader
+func runSimulatedReader(r io.Reader, scans chan<- NFCEvent) {
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        uid := registry.NormalizeUID(scanner.Text())
+        if uid == "" {
+            continue
+        }
+        scans <- NFCEvent{PortName: simulatedPort, UID: uid, Timestamp: time.Now()}
+    }
+    if err := scanner.Err(); err != nil {
+        logger.Error("simulated reader stopped", "err", err)
+    }
+}
+
+// What a reader reported for one tag: its UID and the NDEF records printed
+// after it, if any
+type tagRead struct {
+    UID      string
+    NDEFText string
+    NDEFURI  string
+}
+
+// Prefixes of the reader output lines that describe a tag
+const (
+    uidLinePrefix      = "UID Value:"
+    ndefTextLinePrefix = "NDEF Text:"
+    ndefURILinePrefix  = "NDEF URI:"
+)
+
+// How long to wait after a UID for NDEF record lines to follow it
+const ndefLineWait = 150 * time.Millisecond
+
+// Longest partial line kept while waiting for its newline; anything longer
+// isn't reader output worth parsing
+const maxReaderLine = 4096
+
+// Read tags from the NFC reader on portName and pass each one to handler.
+// With waitForNDEF a tag is only handed on once its NDEF lines have had time
+// to arrive, otherwise as soon as its UID is read. If the reader disconnects,
+// the port is closed and re-opened until it comes back, so only ctx
+// cancellation ends the loop.
+func runSerialLoop(ctx context.Context, portName string, mode *serial.Mode, waitForNDEF bool, handler func(read tagRead)) error {
+    buff := make([]byte, 100)
+
+    for {
+        port, err := openSerialPort(ctx, portName, mode)
+        if err != nil {
+            return err
+        }
+        // Closing the port is what unblocks a pending Read on cancellation
+        closeOnCancel := context.AfterFunc(ctx, func() { port.Close() })
+        if waitForNDEF {
+            // A read that times out means the last tag's lines are all in
+            if err := port.SetReadTimeout(ndefLineWait); err != nil {
+                logger.Warn("failed to set reader timeout", "port", portName, "err", err)
+            }
+        }
+
+        var partial string
+        var pending *tagRead
+        flush := func() {
+            if pending != nil {
+                handler(*pending)
+                pending = nil
+            }
+        }
+
+        for {
+            n, err := port.Read(buff)
+            if err != nil {
+                if !closeOnCancel() {
+                    return ctx.Err()
+                }
+                logger.Warn("lost connection to reader", "port", portName, "err", &apperr.SerialError{Port: portName, Cause: err})
+                flush()
+                port.Close()
+                break
+            }
+            if n == 0 {
+                flush()
+            }
+
+            partial += string(buff[:n])
+            for {
+                i := strings.IndexByte(partial, '\n')
+                if i < 0 {
+                    break
+                }
+                line := strings.TrimSpace(partial[:i])
+                partial = partial[i+1:]
+
+                if _, uid, ok := strings.Cut(line, uidLinePrefix); ok {
+                    flush()
+                    pending = &tagRead{UID: registry.NormalizeUID(uid)}
+                    if !waitForNDEF {
+                        flush()
+                    }
+                } else if text, ok := strings.CutPrefix(line, ndefTextLinePrefix); ok && pending != nil {
+                    pending.NDEFText = strings.TrimSpace(text)
+                } else if uri, ok := strings.CutPrefix(line, ndefURILinePrefix); ok && pending != nil {
+                    pending.NDEFURI = strings.TrimSpace(uri)
+                }
+            }
+            if len(partial) > maxReaderLine {
+                partial = ""
+            }
+
+            if ctx.Err() != nil {
+                if closeOnCancel() {
+                    port.Close()
+                }
+                return ctx.Err()
+            }
+        }
+    }
+}
+
+// Local file an NDEF URI names, given as a file:// URL or a plain path. Only
+// media under storagePath or mapped in the registry is accepted, so a tag
+// can't point the player at arbitrary files.
+func ndefLocalPath(uri, storagePath string, mapping *tagMapping) (string, bool) {
+    path := uri
+    if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+        path = u.Path
+    } else if err == nil && u.Scheme != "" {
+        return "", false
+    }
+    path, err := filepath.Abs(path)
+    if err != nil {
+        return "", false
+    }
+
+    if !mapping.hasVideo(path) {
+        root, err := filepath.Abs(storagePath)
+        if err != nil || !strings.HasPrefix(path, root+string(filepath.Separator)) {
+            return "", false
+        }
+    }
+    if _, ok := content.MediaTypeForExtension(filepath.Ext(path)); !ok {
+        return "", false
+    }
+    if _, err := os.Stat(path); err != nil {
+        return "", false
+    }
+    return path, true
+}
+
+// Open portName, retrying every serialReconnectDelay until it succeeds or ctx is cancelled
+func openSerialPort(ctx context.Context, portName string, mode *serial.Mode) (serial.Port, error) {
+    for {
+        port, err := serial.Open(portName, mode)
+        if err == nil {
+            logger.Info("opened serial port", "port", portName)
+            return port, nil
+        }
+        serialErr := &apperr.SerialError{Port: portName, Cause: err}
+        // A missing reader may be plugged back in; missing permissions won't fix themselves
+        level := slog.LevelWarn
+        var portErr *serial.PortError
+        if errors.As(serialErr, &portErr) && portErr.Code() == serial.PermissionDenied {
+            level = slog.LevelError
+        }
+        logger.Log(ctx, level, "could not open serial port", "port", portName, "retry_in", serialReconnectDelay, "err", serialErr)
+
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(serialReconnectDelay):
+        }
+    }
+}
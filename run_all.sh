@@ -9,8 +9,5 @@ sudo python3 wifi_listener.py
 echo "Registering Device...."
 go run upload_server.go
 
-echo "Fixing JSON files..."
-go run fix_json.go
-
 echo "Starting Lift Learn application..."
 sudo go run lift_learn.go
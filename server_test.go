@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"lift_learn/internal/config"
+	"lift_learn/internal/content"
+	"lift_learn/internal/deployment"
+	"lift_learn/internal/expiry"
+	"lift_learn/internal/middleware"
+	"lift_learn/internal/registry"
+	"lift_learn/internal/slots"
+	"lift_learn/internal/snapshot"
+	"lift_learn/internal/store"
+)
+
+// Run with the server it tests: go test upload_server.go server_test.go
+
+const testAPIKey = "test-key"
+
+// Stand-in for an MP4; nothing downstream parses it
+var testMP4 = append([]byte("\x00\x00\x00\x18ftypmp42"), bytes.Repeat([]byte{0x42}, 4096)...)
+
+// TestServer is the upload handler mounted as startServer mounts it, with a
+// fake media server to download from and a fake AWS registration endpoint.
+// Every file the config names lives under a temp directory.
+type TestServer struct {
+	*httptest.Server
+	cfg   *config.Config
+	media *httptest.Server
+	aws   *httptest.Server
+
+	mu            sync.Mutex
+	registrations []DeviceRegistration
+}
+
+func newTestServer(t *testing.T) *TestServer {
+	t.Helper()
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	dir := t.TempDir()
+	cfg, err := config.Load(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DeviceID = "test-device"
+	cfg.APIKey = testAPIKey
+	cfg.StoragePath = filepath.Join(dir, "content")
+	cfg.StagingPath = filepath.Join(dir, "content", ".staging")
+	cfg.StorePath = filepath.Join(dir, "content", ".store")
+	cfg.FailedPath = filepath.Join(dir, "failed")
+	cfg.RetryQueuePath = filepath.Join(dir, "retry-queue")
+	cfg.RegistryFile = filepath.Join(dir, "registry.json")
+	cfg.DeploymentsFile = filepath.Join(dir, "deployments.json")
+	cfg.SnapshotsFile = filepath.Join(dir, "snapshots.json")
+	cfg.ExpirationsFile = filepath.Join(dir, "expirations.json")
+	cfg.ScheduledFile = filepath.Join(dir, "scheduled.json")
+	cfg.StateFile = filepath.Join(dir, "state.json")
+	cfg.RegistrationMaxAttempts = 1
+	// Disable the free-space guard; disk space is not under test here
+	cfg.MinFreeDiskMB = 0
+	if err := os.MkdirAll(cfg.StoragePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if deployments, err = deployment.Load(cfg.DeploymentsFile); err != nil {
+		t.Fatal(err)
+	}
+	if tagRegistry, err = registry.Load(cfg.RegistryFile); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, err = snapshot.Load(cfg.SnapshotsFile, cfg.MaxSnapshots); err != nil {
+		t.Fatal(err)
+	}
+	if contentStore, err = store.New(cfg.StorePath); err != nil {
+		t.Fatal(err)
+	}
+	if expirations, err = expiry.Load(cfg.ExpirationsFile, func(expiry.Expiration) {}); err != nil {
+		t.Fatal(err)
+	}
+	if scheduled, err = deployment.LoadScheduler(cfg.ScheduledFile, func(deployment.Scheduled) {}); err != nil {
+		t.Fatal(err)
+	}
+	if retryQueue, err = deployment.NewQueue(cfg.RetryQueuePath); err != nil {
+		t.Fatal(err)
+	}
+	downloadSlots = slots.NewPool(cfg.MaxConcurrentDownloads)
+
+	ts := &TestServer{cfg: cfg}
+	ts.media = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/video.mp4" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(testMP4)
+	}))
+	t.Cleanup(ts.media.Close)
+	ts.aws = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reg DeviceRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ts.mu.Lock()
+		ts.registrations = append(ts.registrations, reg)
+		ts.mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(ts.aws.Close)
+	cfg.AWSEndpoint = ts.aws.URL
+
+	ts.Server = httptest.NewServer(countUploads(middleware.RequireAPIKey(cfg.APIKey, handleUpload(cfg))))
+	t.Cleanup(ts.Server.Close)
+	return ts
+}
+
+// POST body to /receive-content, with the API key unless apiKey is ""
+func (ts *TestServer) upload(t *testing.T, body []byte, apiKey string) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/receive-content", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+	return resp, decoded
+}
+
+// Upload request for one Thing per media path on the fake media server
+func (ts *TestServer) request(t *testing.T, deploymentId string, mediaPaths ...string) []byte {
+	t.Helper()
+	req := UploadRequest{DeploymentId: deploymentId, ProjectId: "project-1"}
+	for i, p := range mediaPaths {
+		req.Things = append(req.Things, content.Thing{
+			ProductId: "product-" + string(rune('a'+i)),
+			MediaUrl:  ts.media.URL + p,
+			NfcTagId:  "04A1B2C3D4E5" + string(rune('0'+i)) + "0",
+			MediaType: content.MediaVideo,
+		})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   func(t *testing.T, ts *TestServer) []byte
+		apiKey string
+		// Sent, and expected to succeed, before body
+		first      func(t *testing.T, ts *TestServer) []byte
+		wantStatus int
+		check      func(t *testing.T, ts *TestServer, resp map[string]interface{})
+	}{
+		{
+			name: "every Thing succeeds",
+			body: func(t *testing.T, ts *TestServer) []byte {
+				return ts.request(t, "deploy-ok", "/video.mp4", "/video.mp4")
+			},
+			apiKey:     testAPIKey,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, ts *TestServer, resp map[string]interface{}) {
+				if resp["status"] != "success" {
+					t.Errorf("status = %v, want success", resp["status"])
+				}
+				for _, id := range []string{"product-a", "product-b"} {
+					if _, err := os.Stat(filepath.Join(ts.cfg.StoragePath, "project-1", id+".json")); err != nil {
+						t.Errorf("metadata for %s not committed: %v", id, err)
+					}
+				}
+				if n := len(tagRegistry.Entries()); n != 2 {
+					t.Errorf("registry has %d entries, want 2", n)
+				}
+				if d, ok := deployments.Get("deploy-ok"); !ok || d.Status != deployment.StatusSuccess {
+					t.Errorf("deployment state = %+v, want %s", d, deployment.StatusSuccess)
+				}
+			},
+		},
+		{
+			name: "one media URL is missing",
+			body: func(t *testing.T, ts *TestServer) []byte {
+				return ts.request(t, "deploy-partial", "/video.mp4", "/missing.mp4")
+			},
+			apiKey:     testAPIKey,
+			wantStatus: http.StatusBadGateway,
+			check: func(t *testing.T, ts *TestServer, resp map[string]interface{}) {
+				if resp["status"] != deployment.StatusPartialSuccess {
+					t.Errorf("status = %v, want %s", resp["status"], deployment.StatusPartialSuccess)
+				}
+				if d, ok := deployments.Get("deploy-partial"); !ok || d.Status != deployment.StatusPartialSuccess {
+					t.Errorf("deployment state = %+v, want %s", d, deployment.StatusPartialSuccess)
+				}
+				// Nothing goes live unless everything arrived
+				if n := len(tagRegistry.Entries()); n != 0 {
+					t.Errorf("registry has %d entries, want 0", n)
+				}
+				if _, err := os.Stat(filepath.Join(ts.cfg.StoragePath, "project-1", "product-a.json")); !os.IsNotExist(err) {
+					t.Errorf("product-a committed despite the failed deployment: %v", err)
+				}
+			},
+		},
+		{
+			name: "deployment ID already processed",
+			first: func(t *testing.T, ts *TestServer) []byte {
+				return ts.request(t, "deploy-twice", "/video.mp4")
+			},
+			body: func(t *testing.T, ts *TestServer) []byte {
+				return ts.request(t, "deploy-twice", "/video.mp4")
+			},
+			apiKey:     testAPIKey,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, ts *TestServer, resp map[string]interface{}) {
+				if resp["status"] != "success" {
+					t.Errorf("status = %v, want success", resp["status"])
+				}
+				if n := len(tagRegistry.Entries()); n != 1 {
+					t.Errorf("registry has %d entries, want 1", n)
+				}
+			},
+		},
+		{
+			name: "body over the size limit",
+			body: func(t *testing.T, ts *TestServer) []byte {
+				return bytes.Repeat([]byte(" "), int(ts.cfg.MaxUploadBodyBytes)+1)
+			},
+			apiKey:     testAPIKey,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "no API key",
+			body: func(t *testing.T, ts *TestServer) []byte {
+				return ts.request(t, "deploy-anonymous", "/video.mp4")
+			},
+			wantStatus: http.StatusUnauthorized,
+			check: func(t *testing.T, ts *TestServer, resp map[string]interface{}) {
+				if _, ok := deployments.Get("deploy-anonymous"); ok {
+					t.Error("unauthenticated deployment was recorded")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			if tt.first != nil {
+				if resp, body := ts.upload(t, tt.first(t, ts), testAPIKey); resp.StatusCode != http.StatusOK {
+					t.Fatalf("first upload: status %d, body %v", resp.StatusCode, body)
+				}
+			}
+			resp, body := ts.upload(t, tt.body(t, ts), tt.apiKey)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status %d, want %d; body %v", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.check != nil {
+				tt.check(t, ts, body)
+			}
+		})
+	}
+}
+
+func TestRegisterWithAWS(t *testing.T) {
+	ts := newTestServer(t)
+	if err := registerWithAWS(context.Background(), ts.cfg, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.registrations) != 1 {
+		t.Fatalf("AWS got %d registrations, want 1", len(ts.registrations))
+	}
+	reg := ts.registrations[0]
+	if reg.DeviceId != ts.cfg.DeviceID || reg.IpAddress != ts.URL {
+		t.Errorf("registered %s at %s, want %s at %s", reg.DeviceId, reg.IpAddress, ts.cfg.DeviceID, ts.URL)
+	}
+	st, err := loadPersistedState(ts.cfg.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.RegisteredURL != ts.URL {
+		t.Errorf("saved URL %q, want %q", st.RegisteredURL, ts.URL)
+	}
+}
+
+// Signals once the first bytes of a download have arrived
+type firstWrite struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (f *firstWrite) Write(p []byte) (int, error) {
+	f.once.Do(func() { close(f.ch) })
+	return len(p), nil
+}
+
+func TestDownloadMediaCancelled(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	// Sends part of the file, then stalls until the client goes away
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(testMP4[:1024])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	finalPath := filepath.Join(t.TempDir(), "product.mp4")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := &firstWrite{ch: make(chan struct{})}
+	go func() {
+		<-started.ch
+		cancel()
+	}()
+
+	_, _, err := downloadMedia(ctx, slow.URL+"/video.mp4", finalPath, "", time.Minute, started)
+	if err == nil || !strings.Contains(err.Error(), "download cancelled") {
+		t.Fatalf("err = %v, want a cancelled download", err)
+	}
+	if _, err := os.Stat(finalPath + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind after cancelling: %v", err)
+	}
+	if _, err := os.Stat(finalPath); !os.IsNotExist(err) {
+		t.Errorf("final file exists after cancelling: %v", err)
+	}
+}
+
+func TestDownloadMediaDroppedKeepsPartial(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	// Promises the whole file, then drops the connection part way through
+	dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", strconv.Itoa(len(testMP4)))
+		w.Write(testMP4[:1024])
+		w.(http.Flusher).Flush()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer dropping.Close()
+
+	finalPath := filepath.Join(t.TempDir(), "product.mp4")
+	if _, _, err := downloadMedia(context.Background(), dropping.URL+"/video.mp4", finalPath, "", time.Minute, io.Discard); err == nil {
+		t.Fatal("download of a dropped connection succeeded")
+	}
+	info, err := os.Stat(finalPath + partialSuffix)
+	if err != nil {
+		t.Fatalf("partial file not kept for resume: %v", err)
+	}
+	if info.Size() != 1024 {
+		t.Errorf("partial file has %d bytes, want 1024", info.Size())
+	}
+}
+
+func TestUploadBodyTooLarge(t *testing.T) {
+	ts := newTestServer(t)
+	var logs bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	// Well-formed JSON, so only its size can be what's wrong with it
+	body := `{"deploymentId":"deploy-big","projectId":"project-1","customerId":"` + strings.Repeat("a", 2<<20) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/receive-content", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handleUpload(ts.cfg).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	wantMsg := fmt.Sprintf("Request body exceeds %d bytes", ts.cfg.MaxUploadBodyBytes)
+	if got := strings.TrimSpace(rec.Body.String()); got != wantMsg {
+		t.Errorf("body %q, want %q", got, wantMsg)
+	}
+	// Logged from the *http.MaxBytesError branch, not as a malformed body
+	if !strings.Contains(logs.String(), "upload request body too large") || !strings.Contains(logs.String(), fmt.Sprintf("limit_bytes=%d", ts.cfg.MaxUploadBodyBytes)) {
+		t.Errorf("oversized body not classified as *http.MaxBytesError; logs:\n%s", logs.String())
+	}
+	if _, ok := deployments.Get("deploy-big"); ok {
+		t.Error("oversized deployment was recorded")
+	}
+}
+
+// Start a server with cfg's timeouts, serving mux the way startServer does
+func startTimeoutServer(t *testing.T, cfg *config.Config, mux http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config = newHTTPServer(cfg, mux, context.Background())
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.Server.ReadTimeoutSeconds = 1
+	mux := http.NewServeMux()
+	mux.Handle("/receive-content", withoutWriteTimeout(middleware.RequireAPIKey(ts.cfg.APIKey, handleUpload(ts.cfg))))
+	srv := startTimeoutServer(t, ts.cfg, mux)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Promise a body, send a sliver of it and then nothing
+	fmt.Fprintf(conn, "POST /receive-content HTTP/1.1\r\nHost: device\r\nX-API-Key: %s\r\nContent-Type: application/json\r\nContent-Length: 1000\r\n\r\n{\"deploymentId\":", testAPIKey)
+
+	started := time.Now()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	elapsed := time.Since(started)
+	if elapsed < 900*time.Millisecond {
+		t.Errorf("server gave up after %s, before the 1s read timeout", elapsed)
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("server still waiting for the body after %s", elapsed)
+	}
+	if err != nil {
+		// A reset or close is as good as a 408: the slow client is gone
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("connection still open after the read timeout: %v", err)
+		}
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status %d, want %d or a closed connection", resp.StatusCode, http.StatusRequestTimeout)
+	}
+}
+
+func TestWriteTimeoutExemption(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.Server.WriteTimeoutSeconds = 1
+	// Answers only after the write timeout, like a large synchronous deployment
+	slowAnswer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/receive-content", withoutWriteTimeout(slowAnswer))
+	mux.Handle("/health", slowAnswer)
+	srv := startTimeoutServer(t, ts.cfg, mux)
+
+	resp, err := http.Post(srv.URL+"/receive-content", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("/receive-content cut off by the write timeout: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("/receive-content answered %q, want done", body)
+	}
+
+	// Everything else stays bound by it. POST, so the client doesn't retry.
+	if resp, err := http.Post(srv.URL+"/health", "application/json", strings.NewReader("{}")); err == nil {
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr == nil && string(body) == "done" {
+			t.Error("/health answered after the write timeout")
+		}
+	}
+}
+
+func TestCommitDeploymentUndoesEarlierProjects(t *testing.T) {
+	ts := newTestServer(t)
+	if resp, body := ts.upload(t, ts.request(t, "deploy-1", "/video.mp4"), testAPIKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first deployment: status %d, body %v", resp.StatusCode, body)
+	}
+	before, _ := tagRegistry.Lookup("04A1B2C3D4E500")
+
+	// project-1 stages cleanly; project-2's media never made it to staging
+	stagingDir := filepath.Join(ts.cfg.StagingPath, "deploy-2")
+	staged := []content.Thing{
+		{ProductId: "product-a", NfcTagId: "04A1B2C3D4E500", ProjectId: "project-1", MediaType: content.MediaVideo, Extension: ".mp4"},
+		{ProductId: "product-b", NfcTagId: "04A1B2C3D4E510", ProjectId: "project-2", MediaType: content.MediaVideo, Extension: ".mp4"},
+	}
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"product-a.mp4": "new video", "product-a.json": `{"productId":"product-a"}`, "product-b.json": `{"productId":"product-b"}`}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(stagingDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := commitDeployment(ts.cfg, "deploy-2", "project-1", stagingDir, staged); err == nil {
+		t.Fatal("commit with missing media succeeded")
+	}
+
+	video, err := os.ReadFile(filepath.Join(ts.cfg.StoragePath, "project-1", "product-a.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(video, testMP4) {
+		t.Error("project-1 kept the failed deployment's video")
+	}
+	if after, _ := tagRegistry.Lookup("04A1B2C3D4E500"); after.VideoPath != before.VideoPath {
+		t.Errorf("tag maps to %s, want %s", after.VideoPath, before.VideoPath)
+	}
+	if _, ok := tagRegistry.Lookup("04A1B2C3D4E510"); ok {
+		t.Error("project-2's tag was mapped")
+	}
+	if _, err := os.Stat(filepath.Join(ts.cfg.StoragePath, "project-2", "product-b.json")); !os.IsNotExist(err) {
+		t.Errorf("project-2 metadata left live: %v", err)
+	}
+}
+
+func TestPlanTagMappings(t *testing.T) {
+	things := map[string]storedThing{
+		"product-a": {ThingStatus: content.ThingStatus{ProductId: "product-a", NfcTagId: "A1B2C3D4"}},
+		"product-b": {ThingStatus: content.ThingStatus{ProductId: "product-b", NfcTagId: "E5F60708"}},
+		"product-c": {ThingStatus: content.ThingStatus{ProductId: "product-c"}},
+	}
+	entries := map[string]registry.Entry{
+		"A1B2C3D4": {NfcTagId: "A1B2C3D4", ProductId: "product-a"},
+		"E5F60708": {NfcTagId: "E5F60708", ProductId: "product-b"},
+	}
+
+	tests := []struct {
+		name      string
+		mappings  []TagMapping
+		changes   []string // new tag of each change
+		problems  []int    // index of each refused mapping
+		unchanged int
+	}{
+		{"same tag in another spelling", []TagMapping{{"a1:b2:c3:d4", "product-a"}}, nil, nil, 1},
+		{"new tag normalized", []TagMapping{{"0a 0b 0c 0d", "product-c"}}, []string{"0A0B0C0D"}, nil, 0},
+		{"two spellings of one UID", []TagMapping{{"0a0b0c0d", "product-c"}, {"0A:0B:0C:0D", "product-b"}}, nil, []int{1}, 0},
+		{"mapped tag in another spelling", []TagMapping{{"e5-f6-07-08", "product-c"}}, nil, []int{0}, 0},
+		{"swap across spellings", []TagMapping{{"e5:f6:07:08", "product-a"}, {"a1b2c3d4", "product-b"}}, []string{"E5F60708", "A1B2C3D4"}, nil, 0},
+		{"separators only", []TagMapping{{" : ", "product-c"}}, nil, []int{0}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, problems, unchanged := planTagMappings(tt.mappings, things, entries)
+			var newTags []string
+			for _, c := range changes {
+				newTags = append(newTags, c.newTagId)
+			}
+			var refused []int
+			for _, p := range problems {
+				refused = append(refused, p.Index)
+			}
+			// A refused batch is never applied, so its changes don't matter
+			if len(refused) > 0 {
+				newTags = nil
+			}
+			if fmt.Sprint(newTags) != fmt.Sprint(tt.changes) || fmt.Sprint(refused) != fmt.Sprint(tt.problems) || unchanged != tt.unchanged {
+				t.Errorf("changes %v, problems %v, unchanged %d; want %v, %v, %d", newTags, problems, unchanged, tt.changes, tt.problems, tt.unchanged)
+			}
+		})
+	}
+}
+
+func TestAssignTag(t *testing.T) {
+	ts := newTestServer(t)
+	if resp, body := ts.upload(t, ts.request(t, "deploy-1", "/video.mp4", "/video.mp4"), testAPIKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("deployment: status %d, body %v", resp.StatusCode, body)
+	}
+	assign := func(productId, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleAssignTag(ts.cfg)(rec, httptest.NewRequest(http.MethodPost, "/things/"+productId+"/assign-tag", strings.NewReader(body)))
+		return rec
+	}
+
+	// product-b's tag in another reader's format
+	if rec := assign("product-a", `{"nfcTagId":"04:a1:b2:c3:d4:e5:10"}`); rec.Code != http.StatusConflict {
+		t.Errorf("claiming product-b's tag: status %d, want 409", rec.Code)
+	}
+	if rec := assign("product-a", `{"nfcTagId":"`+strings.Repeat("A", int(ts.cfg.MaxUploadBodyBytes))+`"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("oversized body: status %d, want 400", rec.Code)
+	}
+
+	if rec := assign("product-a", `{"nfcTagId":"aa:bb:cc:dd"}`); rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	if _, ok := tagRegistry.Lookup("04A1B2C3D4E500"); ok {
+		t.Error("product-a's old tag is still mapped")
+	}
+	if e, ok := tagRegistry.Lookup("AABBCCDD"); !ok || e.ProductId != "product-a" {
+		t.Errorf("AABBCCDD = %+v, %v; want product-a", e, ok)
+	}
+	thing, err := content.ReadThing(filepath.Join(ts.cfg.StoragePath, "project-1", "product-a.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thing.NfcTagId != "AABBCCDD" {
+		t.Errorf("metadata tag = %q, want AABBCCDD", thing.NfcTagId)
+	}
+}
+
+func TestValidateUploadRequestTagSpellings(t *testing.T) {
+	req := UploadRequest{DeploymentId: "deploy-1", ProjectId: "project-1", Things: []content.Thing{
+		{ProductId: "product-a", NfcTagId: "a1:b2", MediaUrl: "https://example.com/a.mp4"},
+		{ProductId: "product-b", NfcTagId: "A1B2", MediaUrl: "https://example.com/b.mp4"},
+		{ProductId: "product-c", NfcTagId: " : ", MediaUrl: "https://example.com/c.mp4"},
+	}}
+	var invalid *ValidationError
+	if !errors.As(validateUploadRequest(req), &invalid) {
+		t.Fatal("request with one tag in two spellings passed validation")
+	}
+	want := []string{
+		`things[1]: nfcTagId "A1B2" duplicates things[0]`,
+		"things[2]: nfcTagId is required",
+	}
+	if fmt.Sprint(invalid.Problems) != fmt.Sprint(want) {
+		t.Errorf("problems = %q, want %q", invalid.Problems, want)
+	}
+}
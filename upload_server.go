@@ -1,252 +1,4001 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"lift_learn/internal/admin"
+	"lift_learn/internal/apperr"
+	"lift_learn/internal/atomicfile"
+	"lift_learn/internal/buildinfo"
+	"lift_learn/internal/config"
+	"lift_learn/internal/content"
+	"lift_learn/internal/deployment"
+	"lift_learn/internal/discovery"
+	"lift_learn/internal/diskspace"
+	"lift_learn/internal/events"
+	"lift_learn/internal/expiry"
+	"lift_learn/internal/fsys"
+	"lift_learn/internal/httpclient"
+	"lift_learn/internal/integrity"
+	"lift_learn/internal/logging"
+	"lift_learn/internal/metrics"
+	"lift_learn/internal/middleware"
+	"lift_learn/internal/mqtt"
+	"lift_learn/internal/profiling"
+	"lift_learn/internal/provision"
+	"lift_learn/internal/registry"
+	"lift_learn/internal/selfupdate"
+	"lift_learn/internal/slots"
+	"lift_learn/internal/snapshot"
+	"lift_learn/internal/store"
+	"lift_learn/internal/tracing"
+	"lift_learn/internal/tunnel"
+
+	"go.bug.st/serial"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Set at build time with -ldflags "-X main.Version=... -X main.BuildTime=..."
+var (
+	Version   = "dev"
+	BuildTime = "unknown"
+)
+
+// Printed at startup and included in /health
+var banner buildinfo.Banner
+
+// Sent along with every registration, refreshed before each one
+var deviceCapabilities Capabilities
+
+// The device's own key, loaded or created by provisionDevice
+var deviceKey *ecdsa.PrivateKey
+
+// Revision of the HTTP API, announced over mDNS for clients to check
+const apiVersion = "1"
+
+// How often storage usage is checked, and how full it may get before that is
+// logged as a warning and then as an error
+const (
+	diskCheckInterval = 5 * time.Minute
+	diskWarnFraction  = 0.75
+	diskErrorFraction = 0.90
 )
 
+// Suffixes of a download still being written, and of one abandoned at shutdown
 const (
-	AWS_REGISTRY_ENDPOINT = "https://on9p48hjz3.execute-api.us-east-2.amazonaws.com/default/RegisterDevice"
-	DEVICE_ID             = "OP5-MAX-TEST-001"
-	STORAGE_PATH          = "./content"
+	partialSuffix    = ".partial"
+	incompleteSuffix = ".incomplete"
+)
+
+// How long downloads cancelled at the end of the shutdown timeout get to
+// stop and delete their partial files
+const cancelGracePeriod = 5 * time.Second
+
+// Tracked across all requests so shutdown can wait for every processContent
+// goroutine, and report how many uploads it interrupted
+var (
+	downloadsInFlight sync.WaitGroup
+	uploadsInFlight   atomic.Int64
 )
 
+// Semaphore capping concurrent processContent calls across all upload
+// requests. Sized from the config in startServer.
+var downloadSlots *slots.Pool
+
+var serverState = &ServerState{startedAt: time.Now()}
+
+// Logger for the whole server, built from the --log-* flags in main
+var logger = slog.Default()
+
+// How long a /content listing is reused before the storage directory is rescanned
+const contentCacheTTL = 5 * time.Second
+
+var contentCache struct {
+	mu        sync.Mutex
+	scannedAt time.Time
+	projects  []content.ProjectContent
+}
+
+// NFC tag mappings, updated as content is processed. Loaded in main.
+var tagRegistry *registry.Registry
+
+// Deployments already processed, loaded from the config's deployments file in main
+var deployments *deployment.State
+
+// Downloaded videos by SHA-256, shared between projects. Opened in main.
+var contentStore *store.ContentStore
+
+// Previous content of each project, for rollback. Loaded in main.
+var snapshots *snapshot.Manager
+
+// Pending deletions of time-limited content, loaded in main
+var expirations *expiry.Scheduler
+
+// Stored media found not to match its checksum, loaded in main
+var integrityChecker *integrity.Checker
+
+// Downloaded deployments waiting for their activeAt, loaded in main
+var scheduled *deployment.Scheduler
+
+// Download progress of recent deployments, for GET /deployments/{id}/status
+var progress = deployment.NewTracker()
+
+// Failed Things the background worker keeps retrying
+var retryQueue *deployment.Queue
+
+// Spans go nowhere until tracing.Setup installs a provider
+var tracer = otel.Tracer("lift_learn/upload_server")
+
+// Registration status shared between registerWithAWS and the /health handler
+type ServerState struct {
+	mu               sync.RWMutex
+	startedAt        time.Time
+	registeredURL    string
+	lastRegistration time.Time
+	lastError        string
+}
+
+func (s *ServerState) recordRegistration(url string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registeredURL = url
+	s.lastRegistration = at
+	s.lastError = ""
+}
+
+func (s *ServerState) recordRegistrationError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+}
+
+// Registration details persisted to the state file between restarts
+type PersistedState struct {
+	RegisteredURL string    `json:"registeredUrl"`
+	RegisteredAt  time.Time `json:"registeredAt"`
+}
+
+func loadPersistedState(path string) (*PersistedState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var st PersistedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+	return &st, nil
+}
+
+func savePersistedState(path string, st PersistedState) error {
+	return atomicfile.Write(path, 0644, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	})
+}
+
+// Health check response structure
+type HealthResponse struct {
+	Status               string           `json:"status"`
+	DeviceId             string           `json:"device_id"`
+	Port                 int              `json:"port"`
+	RegisteredUrl        string           `json:"registered_url"`
+	UptimeSeconds        int64            `json:"uptime_seconds"`
+	StorageBytesUsed     int64            `json:"storage_bytes_used"`
+	LastRegistrationTime *time.Time       `json:"last_registration_time"`
+	LastError            string           `json:"last_error,omitempty"`
+	Build                buildinfo.Banner `json:"build"`
+	RetryQueue           RetryQueueHealth `json:"retry_queue"`
+	// Media files the last integrity check found corrupt
+	CorruptFiles []integrity.Corruption `json:"corrupt_files,omitempty"`
+	Capabilities *Capabilities          `json:"capabilities,omitempty"`
+}
+
+// Failed Things waiting for a background retry, as reported by /health
+type RetryQueueHealth struct {
+	Depth   int                   `json:"depth"`
+	Pending []deployment.RetryJob `json:"pending"`
+}
+
 // Device registration structure
 type DeviceRegistration struct {
 	DeviceId  string `json:"deviceId"`
 	IpAddress string `json:"ipAddress"`
+	// The device's address on its own network, for clients on the same LAN
+	LocalIpAddress string        `json:"localIpAddress,omitempty"`
+	PublicKey      string        `json:"publicKey,omitempty"`
+	Capabilities   *Capabilities `json:"capabilities,omitempty"`
 }
 
-// Upload request structure
-type UploadRequest struct {
-	DeploymentId string  `json:"deploymentId"`
-	ProjectId    string  `json:"projectId"`
-	CustomerId   string  `json:"customerId"`
-	Things       []Thing `json:"things"`
+// What the registration endpoint may answer with. Certificate is a PEM
+// device certificate signed for the registered public key.
+type RegistrationResponse struct {
+	Certificate string `json:"certificate"`
 }
 
-// Thing structure within UploadRequest
-type Thing struct {
-	ProductId   string `json:"productId"`
-	MediaUrl    string `json:"mediaUrl"`
-	NfcTagId    string `json:"nfcTagId"`
-	ProductName string `json:"productName"`
+// What the device can take, so the cloud can hold back content it couldn't
+// store or play, e.g. 4K video when there's only 2 GB free
+type Capabilities struct {
+	StorageAvailableBytes int64    `json:"storageAvailableBytes"`
+	SupportedMediaTypes   []string `json:"supportedMediaTypes"`
+	AppVersion            string   `json:"appVersion"`
+	GoVersion             string   `json:"goVersion"`
+	SerialPorts           []string `json:"serialPorts"`
+	ScreenCount           int      `json:"screenCount"`
+}
+
+// Gather the device's capabilities. A probe that fails leaves its field
+// empty and is reported in the error; the rest are still filled in.
+func CapabilityProbe(cfg *config.Config) (Capabilities, error) {
+	caps := Capabilities{
+		SupportedMediaTypes: content.SupportedContentTypes(),
+		AppVersion:          Version,
+		GoVersion:           runtime.Version(),
+		SerialPorts:         []string{},
+	}
+
+	var errs []error
+	if usage, err := diskspace.Stat(cfg.StoragePath); err != nil {
+		errs = append(errs, err)
+	} else {
+		caps.StorageAvailableBytes = int64(usage.AvailableBytes)
+	}
+	if ports, err := serial.GetPortsList(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to list serial ports: %v", err))
+	} else if ports != nil {
+		caps.SerialPorts = ports
+	}
+
+	// Same reader-to-display assignment lift_learn makes; an auto-detected
+	// reader drives a single screen
+	ports := cfg.ReaderPorts()
+	if cfg.BLE.Enabled {
+		ports = append(ports, config.BLEReaderPort)
+	}
+	displays := make(map[int]bool)
+	for i, port := range ports {
+		displays[cfg.ScreenFor(port, i).DisplayId] = true
+	}
+	caps.ScreenCount = len(displays)
+	if caps.ScreenCount == 0 {
+		caps.ScreenCount = 1
+	}
+	return caps, errors.Join(errs...)
 }
 
-// Function to fetch the public ngrok URL
-func getNgrokURL() (string, error) {
-	resp, err := http.Get("http://localhost:4040/api/tunnels")
+// Refresh deviceCapabilities ahead of a registration
+func probeCapabilities(cfg *config.Config) {
+	caps, err := CapabilityProbe(cfg)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch ngrok URL: %v", err)
+		logger.Warn("capability probe incomplete", "err", err)
 	}
-	defer resp.Body.Close()
+	deviceCapabilities = caps
+}
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to parse ngrok response: %v", err)
+// Upload request structure
+type UploadRequest struct {
+	DeploymentId string          `json:"deploymentId"`
+	ProjectId    string          `json:"projectId"`
+	CustomerId   string          `json:"customerId"`
+	Things       []content.Thing `json:"things"`
+	// When set in the future, the Things are downloaded now but only go live then
+	ActiveAt *time.Time `json:"activeAt,omitempty"`
+}
+
+// ContentManifest is the full set of content a device should hold, as sent
+// to POST /sync. Each project is laid out like an UploadRequest, but the
+// manifest describes a steady state rather than a deployment, so there is
+// no DeploymentId.
+type ContentManifest struct {
+	Projects []ManifestProject `json:"projects"`
+}
+
+// ManifestProject is one project's Things in a ContentManifest
+type ManifestProject struct {
+	ProjectId  string          `json:"projectId"`
+	CustomerId string          `json:"customerId"`
+	Things     []content.Thing `json:"things"`
+}
+
+// SyncReport is what a sync changed. Added and Deleted list Things as
+// projectId/productId.
+type SyncReport struct {
+	Added     []string `json:"added"`
+	Deleted   []string `json:"deleted"`
+	Unchanged int      `json:"unchanged"`
+	Errors    []string `json:"errors"`
+}
+
+// Only one sync may rewrite the content directory at a time
+var syncMu sync.Mutex
+
+// DryRunReport is what a dry run found wrong with an upload request, and
+// whether each media URL could be reached
+type DryRunReport struct {
+	Valid  bool                    `json:"valid"`
+	Errors []string                `json:"errors,omitempty"`
+	Things []deployment.MediaCheck `json:"things,omitempty"`
+}
+
+// ValidationError lists everything wrong with an upload request, so the
+// caller can fix it all in one go
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid upload request: " + strings.Join(e.Problems, "; ")
+}
+
+// Check an upload request before anything is downloaded. The IDs end up in
+// paths, so they must not be able to leave the staging or storage directory.
+// Returns a *ValidationError listing every problem found.
+func validateUploadRequest(req UploadRequest) error {
+	var problems []string
+	switch {
+	case req.DeploymentId == "":
+		problems = append(problems, "deploymentId is required")
+	case !utf8.ValidString(req.DeploymentId):
+		problems = append(problems, "deploymentId must be valid UTF-8")
+	case strings.ContainsAny(req.DeploymentId, `/\`) || req.DeploymentId == "." || req.DeploymentId == "..":
+		problems = append(problems, "deploymentId must not contain path separators")
+	}
+	// Things naming their own project don't need the request's
+	needsProjectId := false
+	for _, t := range req.Things {
+		needsProjectId = needsProjectId || t.ProjectId == ""
+	}
+	switch {
+	case req.ProjectId == "" && needsProjectId:
+		problems = append(problems, "projectId is required unless every Thing has one")
+	case strings.Contains(req.ProjectId, ".."):
+		problems = append(problems, `projectId must not contain ".."`)
+	}
+	if len(req.Things) == 0 {
+		problems = append(problems, "things must not be empty")
 	}
 
-	tunnels, ok := result["tunnels"].([]interface{})
-	if !ok || len(tunnels) == 0 {
-		return "", fmt.Errorf("no tunnels found in ngrok response")
+	productIds := make(map[string]int)
+	tagIds := make(map[string]int)
+	for i, t := range req.Things {
+		if t.ProductId == "" {
+			problems = append(problems, fmt.Sprintf("things[%d]: productId is required", i))
+		} else if j, ok := productIds[t.ProductId]; ok {
+			problems = append(problems, fmt.Sprintf("things[%d]: productId %q duplicates things[%d]", i, t.ProductId, j))
+		} else {
+			productIds[t.ProductId] = i
+		}
+		// Keyed as the registry keys them, so two spellings of one tag clash
+		if tagId := registry.NormalizeUID(t.NfcTagId); tagId == "" {
+			problems = append(problems, fmt.Sprintf("things[%d]: nfcTagId is required", i))
+		} else if j, ok := tagIds[tagId]; ok {
+			problems = append(problems, fmt.Sprintf("things[%d]: nfcTagId %q duplicates things[%d]", i, t.NfcTagId, j))
+		} else {
+			tagIds[tagId] = i
+		}
+		if strings.Contains(t.ProjectId, "..") || strings.ContainsAny(t.ProjectId, `/\`) {
+			problems = append(problems, fmt.Sprintf(`things[%d]: projectId must not contain ".." or path separators`, i))
+		}
+		if t.MediaUrl == "" {
+			problems = append(problems, fmt.Sprintf("things[%d]: mediaUrl is required", i))
+		} else if u, err := url.Parse(t.MediaUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("things[%d]: mediaUrl must be an http or https URL", i))
+		}
+		if t.PlaySchedule != nil {
+			if err := t.PlaySchedule.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("things[%d]: %v", i, err))
+			}
+		}
 	}
 
-	publicURL, ok := tunnels[0].(map[string]interface{})["public_url"].(string)
-	if !ok {
-		return "", fmt.Errorf("failed to extract public URL from ngrok response")
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
 	}
+	return nil
+}
 
-	log.Printf("Ngrok URL: %s", publicURL)
-	return publicURL, nil
+// Directory a project's content lives in, refusing project IDs that would
+// put it outside the storage path
+func projectDirFor(storagePath, projectId string) (string, error) {
+	if projectId == "" || strings.Contains(projectId, "..") {
+		return "", fmt.Errorf("invalid project id %q", projectId)
+	}
+	dir := filepath.Join(storagePath, projectId)
+	rel, err := filepath.Rel(storagePath, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("invalid project id %q", projectId)
+	}
+	return dir, nil
 }
 
-// Function to register the device with AWS
-func registerWithAWS(publicUrl string) error {
-	log.Printf("Registering device %s with URL %s", DEVICE_ID, publicUrl)
+// Check that an upload request is well-formed and, with checkMedia, that
+// every media URL answers a HEAD request. Nothing is downloaded or written.
+func dryRunUpload(ctx context.Context, req UploadRequest, checkMedia bool) DryRunReport {
+	report := DryRunReport{}
+	var invalid *ValidationError
+	if errors.As(validateUploadRequest(req), &invalid) {
+		report.Errors = append(report.Errors, invalid.Problems...)
+	}
 
-	registration := DeviceRegistration{
-		DeviceId:  DEVICE_ID,
-		IpAddress: publicUrl,
+	if checkMedia {
+		report.Things = deployment.DryRun(ctx, outboundClient(10*time.Second), req.Things)
+		for _, c := range report.Things {
+			if !c.Reachable {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: media not reachable: %s", c.ProductId, c.Error))
+			}
+		}
 	}
+	report.Valid = len(report.Errors) == 0
+	return report
+}
 
-	jsonData, err := json.Marshal(registration)
+// validate-deployment subcommand: check an upload request file locally,
+// without a running server. --dry-run also checks the media URLs.
+func runValidateDeployment(args []string) {
+	fs := flag.NewFlagSet("validate-deployment", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "send a HEAD request to every media URL as well")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: upload_server validate-deployment [--dry-run] request.json")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
 	if err != nil {
-		return fmt.Errorf("failed to marshal registration data: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var req UploadRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid request JSON: %v\n", err)
+		os.Exit(1)
 	}
 
-	log.Printf("Payload for registration: %s", string(jsonData))
+	report := dryRunUpload(context.Background(), req, *dryRun)
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if !report.Valid {
+		os.Exit(1)
+	}
+}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second, // Increased timeout for network reliability
+// fix-json subcommand: point every stored Thing's mediaUrl at its local
+// file. Deployments already do this; it is kept for content copied on by hand.
+func runFixJSON(args []string) {
+	fs := flag.NewFlagSet("fix-json", flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultPath, "path to the YAML config file")
+	logOpts := logging.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: upload_server fix-json [--config file] [dir]")
+		fs.PrintDefaults()
 	}
-	resp, err := client.Post(AWS_REGISTRY_ENDPOINT, "application/json", bytes.NewBuffer(jsonData))
+	fs.Parse(args)
+
+	var err error
+	logger, err = logOpts.Logger()
 	if err != nil {
-		return fmt.Errorf("failed to send registration request: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	defer resp.Body.Close()
 
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("Response from AWS: %s", string(body))
+	dir := fs.Arg(0)
+	if dir == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			fatal("failed to load config", "err", err)
+		}
+		dir = cfg.StoragePath
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to register device: status=%d body=%s", resp.StatusCode, string(body))
+	if err := content.FixContentDirectory(dir, logger); err != nil {
+		fatal("JSON correction failed", "err", err)
+	}
+	logger.Info("JSON correction completed successfully")
+}
+
+// Load and validate the config at path and set up the outbound transport it
+// describes. Shared by the server and the subcommands that talk to AWS.
+func loadConfig(path string) *config.Config {
+	cfg, err := config.Load(path)
+	if err != nil {
+		fatal("failed to load config", "err", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		fatal("invalid config", "err", err)
 	}
+	if err := cfg.ValidateAWSIoT(); err != nil {
+		fatal("invalid AWS IoT config", "err", err)
+	}
+	if err := setupOutboundHTTP(cfg); err != nil {
+		fatal("failed to set up outbound TLS", "err", err)
+	}
+	if cfg.OutboundTLS.InsecureSkipVerify {
+		logger.Warn("TLS certificate verification is disabled for outbound requests")
+	}
+	return cfg
+}
 
-	log.Printf("Successfully registered device %s", DEVICE_ID)
+// Build the client every outbound request goes through
+func setupOutboundHTTP(cfg *config.Config) error {
+	transport, err := httpclient.NewTransport(cfg.OutboundTLS)
+	if err != nil {
+		return err
+	}
+	// Servers asking for a client certificate get the device certificate
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.GetClientCertificate = provision.ClientCertificate(cfg.DeviceCertFile, cfg.KeyFile)
+	outboundHTTP = httpclient.NewRetryingHTTPClient(httpclient.RetryConfig{
+		MaxRetries: cfg.HTTPRetry.MaxRetries,
+		BaseDelay:  time.Duration(cfg.HTTPRetry.BaseDelayMs) * time.Millisecond,
+		MaxDelay:   time.Duration(cfg.HTTPRetry.MaxDelayMs) * time.Millisecond,
+		Multiplier: cfg.HTTPRetry.Multiplier,
+		Transport:  transport,
+	})
 	return nil
 }
 
-// Function to handle incoming upload requests
-func handleUpload(w http.ResponseWriter, r *http.Request) {
-	log.Printf("============ NEW UPLOAD REQUEST ============")
-	log.Printf("Received upload request from: %s", r.RemoteAddr)
+// --check-config: go through the setup the server does before it starts
+// anything, report every problem found and exit 1 if there were any
+func runCheckConfig(path string) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	errs := cfg.Check()
+	if err := setupOutboundHTTP(cfg); err != nil {
+		errs = append(errs, fmt.Errorf("outbound_tls: %v", err))
+	}
+	if _, err := deployment.Load(cfg.DeploymentsFile); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := registry.Load(cfg.RegistryFile); err != nil {
+		errs = append(errs, err)
 	}
 
-	var req UploadRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Error decoding JSON: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	if len(errs) > 0 {
+		fmt.Printf("%s has %d problem(s):\n", path, len(errs))
+		for _, err := range errs {
+			fmt.Printf("  - %v\n", err)
+		}
+		os.Exit(1)
 	}
-	log.Printf("Decoded request: %+v", req)
+	fmt.Println("Config OK")
+}
 
-	projectDir := filepath.Join(STORAGE_PATH, req.ProjectId)
-	log.Printf("Creating project directory: %s", projectDir)
-	if err := os.MkdirAll(projectDir, 0755); err != nil {
-		log.Printf("Failed to create project directory: %v", err)
-		http.Error(w, "Failed to create project directory", http.StatusInternalServerError)
-		return
+// Parse a subcommand's --config and log flags, set up the logger and load the
+// config the same way the server does
+func parseCommandFlags(fs *flag.FlagSet, args []string) *config.Config {
+	configPath := fs.String("config", config.DefaultPath, "path to the YAML config file")
+	logOpts := logging.RegisterFlags(fs)
+	fs.Parse(args)
+
+	var err error
+	logger, err = logOpts.Logger()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return loadConfig(*configPath)
+}
+
+// Tunneler for the configured provider, forwarding to the local server
+func newTunneler(cfg *config.Config) (tunnel.Tunneler, error) {
+	scheme := "http"
+	if cfg.TLSEnabled() {
+		scheme = "https"
 	}
+	return tunnel.New(cfg.TunnelProvider, fmt.Sprintf("%s://localhost:%d", scheme, cfg.HTTPPort), logger)
+}
 
-	var wg sync.WaitGroup
-	errorsChan := make(chan error, len(req.Things))
+// register subcommand: register the current tunnel URL with AWS straight
+// away, e.g. after a network change, without restarting the server
+func runRegister(args []string) {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	cfg := parseCommandFlags(fs, args)
 
-	for _, thing := range req.Things {
-		wg.Add(1)
-		go func(t Thing) {
-			defer wg.Done()
-			log.Printf("Processing thing: %+v", t)
-			if err := processContent(projectDir, t); err != nil {
-				log.Printf("Error processing thing %s: %v", t.ProductId, err)
-				errorsChan <- fmt.Errorf("failed to process %s: %v", t.ProductId, err)
-			} else {
-				log.Printf("Successfully processed thing: %s", t.ProductId)
-			}
-		}(thing)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	tunneler, err := newTunneler(cfg)
+	if err != nil {
+		fatal("failed to set up tunnel", "err", err)
 	}
+	publicURL, err := tunneler.PublicURL()
+	if err != nil {
+		fatal("error fetching tunnel URL", "err", err)
+	}
+	if _, err := provisionDevice(cfg, false); err != nil {
+		fatal("device provisioning failed", "err", err)
+	}
+	probeCapabilities(cfg)
+	if err := registerWithAWS(ctx, cfg, publicURL); err != nil {
+		fatal("device registration failed", "err", err)
+	}
+	fmt.Printf("Registered %s at %s\n", cfg.DeviceID, publicURL)
+}
 
-	wg.Wait()
-	close(errorsChan)
+// show-public-key subcommand: print the device's public key, creating the
+// keypair first if this device doesn't have one yet
+func runShowPublicKey(args []string) {
+	fs := flag.NewFlagSet("show-public-key", flag.ExitOnError)
+	cfg := parseCommandFlags(fs, args)
 
-	var errors []string
-	for err := range errorsChan {
-		errors = append(errors, err.Error())
+	if _, err := provisionDevice(cfg, false); err != nil {
+		fatal("device provisioning failed", "err", err)
+	}
+	publicKey, err := provision.PublicKeyPEM(deviceKey)
+	if err != nil {
+		fatal("failed to encode public key", "err", err)
 	}
+	fmt.Print(publicKey)
+}
 
-	if len(errors) > 0 {
-		log.Printf("Processing completed with errors: %v", errors)
-		response := map[string]interface{}{
-			"status": "partial_success",
-			"errors": errors,
+// Load the device key into deviceKey, creating it on first start or when
+// regenerate is set, and report whether it is new. A certificate issued for
+// a replaced key is removed, as it no longer matches.
+func provisionDevice(cfg *config.Config, regenerate bool) (created bool, err error) {
+	key, created, err := provision.LoadOrCreateKey(cfg.KeyFile, regenerate)
+	if err != nil {
+		return false, err
+	}
+	if created {
+		logger.Info("generated device key", "path", cfg.KeyFile)
+		if err := os.Remove(cfg.DeviceCertFile); err == nil {
+			logger.Info("removed certificate of the previous device key", "path", cfg.DeviceCertFile)
+		} else if !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to remove old device certificate: %v", err)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		return
 	}
+	deviceKey = key
+	return created, nil
+}
 
-	log.Printf("All content processed successfully")
-	response := map[string]string{
-		"status":  "success",
-		"message": fmt.Sprintf("Successfully processed deployment %s", req.DeploymentId),
+// deregister subcommand: tell AWS the device is going away and forget the
+// saved registration so the next start registers afresh
+func runDeregister(args []string) {
+	fs := flag.NewFlagSet("deregister", flag.ExitOnError)
+	cfg := parseCommandFlags(fs, args)
+	if cfg.AWSDeregisterEndpoint == "" {
+		fatal("aws_deregister_endpoint is not configured")
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := deregisterWithAWS(ctx, cfg); err != nil {
+		fatal("device deregistration failed", "err", err)
+	}
+	if err := os.Remove(cfg.StateFile); err != nil && !os.IsNotExist(err) {
+		logger.Warn("failed to remove state file", "path", cfg.StateFile, "err", err)
+	}
+	fmt.Printf("Deregistered %s\n", cfg.DeviceID)
 }
 
-// Function to download and store content
-func processContent(projectDir string, thing Thing) error {
-	log.Printf("Downloading content from: %s", thing.MediaUrl)
+// discover subcommand: list the lift-and-learn devices announcing
+// themselves over mDNS on the local network
+func runDiscover(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for devices to answer")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
 
-	resp, err := http.Get(thing.MediaUrl)
+	devices, err := discovery.Browse(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to download content: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download content, status: %d", resp.StatusCode)
+	if len(devices) == 0 {
+		fmt.Println("No devices found")
+		return
 	}
+	for _, d := range devices {
+		fmt.Printf("%s\t%s\t%d\tversion=%s api_version=%s\n", d.DeviceID, strings.Join(d.Addresses, ","), d.Port, d.Version, d.APIVersion)
+	}
+}
 
-	filename := filepath.Join(projectDir, fmt.Sprintf("%s.mp4", thing.ProductId))
-	out, err := os.Create(filename)
+func deregisterWithAWS(ctx context.Context, cfg *config.Config) error {
+	jsonData, err := json.Marshal(DeviceRegistration{DeviceId: cfg.DeviceID})
 	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+		return fmt.Errorf("failed to marshal deregistration data: %v", err)
 	}
-	defer out.Close()
 
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		return fmt.Errorf("failed to save content: %v", err)
-	}
+	client := outboundClient(30 * time.Second)
+	maxBackoff := time.Duration(cfg.RegistrationMaxBackoffSeconds) * time.Second
+	return retryWithBackoff(ctx, cfg.RegistrationMaxAttempts, time.Second, maxBackoff, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.AWSDeregisterEndpoint, bytes.NewReader(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to build deregistration request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
 
-	metadataFilename := filepath.Join(projectDir, fmt.Sprintf("%s.json", thing.ProductId))
-	metadataFile, err := os.Create(metadataFilename)
-	if err != nil {
-		return fmt.Errorf("failed to create metadata file: %v", err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return &apperr.RegistrationError{Cause: err}
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return &apperr.RegistrationError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+		return nil
+	})
+}
+
+// Retry fn until it succeeds, waiting base, 2*base, 4*base... (capped at maxDelay)
+// between attempts. Cancelling ctx aborts the wait. A registration the
+// endpoint rejected outright isn't retried.
+func retryWithBackoff(ctx context.Context, maxAttempts int, base, maxDelay time.Duration, fn func() error) error {
+	delay := base
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var regErr *apperr.RegistrationError
+		if errors.As(err, &regErr) && regErr.Rejected() {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		logger.Warn("attempt failed, retrying", "attempt", attempt, "max_attempts", maxAttempts, "retry_in", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("retry aborted after %d attempts: %w", attempt, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
 	}
-	defer metadataFile.Close()
+	return fmt.Errorf("giving up after %d attempts: %w", maxAttempts, err)
+}
 
-	if err := json.NewEncoder(metadataFile).Encode(thing); err != nil {
-		return fmt.Errorf("failed to save metadata: %v", err)
+// First non-loopback IPv4 address of the named interface, or of any
+// interface that is up when iface is empty
+func getLocalIP(iface string) (string, error) {
+	var ifaces []net.Interface
+	if iface != "" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return "", fmt.Errorf("failed to find interface %s: %v", iface, err)
+		}
+		ifaces = []net.Interface{*i}
+	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return "", fmt.Errorf("failed to list interfaces: %v", err)
+		}
+		for _, i := range all {
+			if i.Flags&net.FlagUp != 0 && i.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, i)
+			}
+		}
 	}
 
-	log.Printf("Successfully saved content and metadata for product %s", thing.ProductId)
-	return nil
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			return "", fmt.Errorf("failed to list addresses of %s: %v", i.Name, err)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() {
+				continue
+			}
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				return ip4.String(), nil
+			}
+		}
+	}
+	if iface != "" {
+		return "", fmt.Errorf("no IPv4 address on %s", iface)
+	}
+	return "", errors.New("no interface with an IPv4 address is up")
 }
 
-// Start the server and registration process
-func main() {
-	go func() {
-		cmd := exec.Command("ngrok", "http", "3000")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Run()
-	}()
+// Function to register the device with AWS
+func registerWithAWS(ctx context.Context, cfg *config.Config, publicUrl string) error {
+	logger.Info("registering device", "device_id", cfg.DeviceID, "url", publicUrl)
+
+	registration := DeviceRegistration{
+		DeviceId:     cfg.DeviceID,
+		IpAddress:    publicUrl,
+		Capabilities: &deviceCapabilities,
+	}
+	if ip, err := getLocalIP(cfg.PreferredInterface); err != nil {
+		logger.Warn("registering without a LAN address", "interface", cfg.PreferredInterface, "err", err)
+	} else {
+		registration.LocalIpAddress = ip
+	}
+	if deviceKey != nil {
+		publicKey, err := provision.PublicKeyPEM(deviceKey)
+		if err != nil {
+			return err
+		}
+		registration.PublicKey = publicKey
+	}
+
+	jsonData, err := json.Marshal(registration)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration data: %v", err)
+	}
+
+	logger.Debug("registration payload", "payload", string(jsonData))
+
+	client := outboundClient(30 * time.Second) // Increased timeout for network reliability
+	maxBackoff := time.Duration(cfg.RegistrationMaxBackoffSeconds) * time.Second
+	var respBody []byte
+	err = retryWithBackoff(ctx, cfg.RegistrationMaxAttempts, time.Second, maxBackoff, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.AWSEndpoint, bytes.NewReader(jsonData))
+		if err != nil {
+			return fmt.Errorf("failed to build registration request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
 
-	time.Sleep(5 * time.Second) // Wait for ngrok to start
-	ngrokURL, err := getNgrokURL()
+		resp, err := client.Do(req)
+		if err != nil {
+			metrics.RegistrationAttempts.WithLabelValues("failure").Inc()
+			return &apperr.RegistrationError{Cause: err}
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		logger.Debug("registration response", "status", resp.StatusCode, "body", string(body))
+
+		if resp.StatusCode != http.StatusOK {
+			metrics.RegistrationAttempts.WithLabelValues("failure").Inc()
+			return &apperr.RegistrationError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+		metrics.RegistrationAttempts.WithLabelValues("success").Inc()
+		respBody = body
+		return nil
+	})
 	if err != nil {
-		log.Fatalf("Error fetching ngrok URL: %v", err)
+		err = fmt.Errorf("registration with AWS failed: %w", err)
+		serverState.recordRegistrationError(err)
+		return err
 	}
 
-	if err := registerWithAWS(ngrokURL); err != nil {
-		log.Fatalf("Device registration failed: %v", err)
+	now := time.Now()
+	serverState.recordRegistration(publicUrl, now)
+	if err := savePersistedState(cfg.StateFile, PersistedState{RegisteredURL: publicUrl, RegisteredAt: now}); err != nil {
+		logger.Error("failed to save state file", "path", cfg.StateFile, "err", err)
 	}
 
-	startServer()
+	saveDeviceCertificate(cfg, respBody)
+
+	logger.Info("registered device", "device_id", cfg.DeviceID, "url", publicUrl)
+	return nil
+}
+
+// Keep the device certificate a registration response carries. Endpoints
+// that don't issue certificates answer with something else, which is fine.
+func saveDeviceCertificate(cfg *config.Config, body []byte) {
+	var resp RegistrationResponse
+	if deviceKey == nil || json.Unmarshal(body, &resp) != nil || resp.Certificate == "" {
+		return
+	}
+	if err := provision.SaveCertificate(cfg.DeviceCertFile, []byte(resp.Certificate), deviceKey); err != nil {
+		logger.Error("failed to save device certificate", "err", err)
+		return
+	}
+	logger.Info("saved device certificate", "path", cfg.DeviceCertFile)
 }
 
-func startServer() {
-	if err := os.MkdirAll(STORAGE_PATH, 0755); err != nil {
-		log.Fatalf("Failed to create storage directory: %v", err)
+// Reuse the registration from the state file if it is recent and its URL
+// still reaches this server, otherwise register the current tunnel URL.
+// A device with a new key always registers, so AWS learns the key.
+func ensureRegistered(ctx context.Context, cfg *config.Config, tunneler tunnel.Tunneler, newKey bool) error {
+	st, err := loadPersistedState(cfg.StateFile)
+	switch {
+	case newKey:
+		logger.Info("device key is new, registering again")
+	case err == nil:
+		maxAge := time.Duration(cfg.StateMaxAgeHours) * time.Hour
+		if time.Since(st.RegisteredAt) < maxAge && urlReachable(st.RegisteredURL) {
+			logger.Info("reusing saved registration", "url", st.RegisteredURL, "registered_at", st.RegisteredAt.Format(time.RFC3339))
+			serverState.recordRegistration(st.RegisteredURL, st.RegisteredAt)
+			return nil
+		}
+		logger.Info("saved registration is stale or unreachable, registering again")
+	case !os.IsNotExist(err):
+		logger.Warn("ignoring unreadable state file", "path", cfg.StateFile, "err", err)
+	}
+
+	publicURL, err := tunneler.PublicURL()
+	if err != nil {
+		return fmt.Errorf("error fetching tunnel URL: %v", err)
 	}
+	return registerWithAWS(ctx, cfg, publicURL)
+}
+
+// Poll the tunnel and re-register whenever the public URL changes, e.g.
+// after ngrok restarts. Runs until ctx is cancelled.
+func watchTunnelURL(ctx context.Context, cfg *config.Config, tunneler tunnel.Tunneler) {
+	ticker := time.NewTicker(time.Duration(cfg.TunnelPollIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-	http.HandleFunc("/receive-content", handleUpload)
+		publicURL, err := tunneler.PublicURL()
+		if err != nil {
+			logger.Warn("failed to poll tunnel URL", "err", err)
+			continue
+		}
+
+		serverState.mu.RLock()
+		registered := serverState.registeredURL
+		serverState.mu.RUnlock()
+		if publicURL == registered {
+			continue
+		}
 
-	log.Printf("Starting upload server on port 3000")
-	if err := http.ListenAndServe(":3000", nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		logger.Info("tunnel URL changed, re-registering", "old_url", registered, "new_url", publicURL)
+		probeCapabilities(cfg)
+		if err := registerWithAWS(ctx, cfg, publicURL); err != nil {
+			// Rejected requests need someone to look at the device's config
+			var regErr *apperr.RegistrationError
+			if errors.As(err, &regErr) && regErr.Rejected() {
+				logger.Error("re-registration rejected", "status", regErr.StatusCode, "body", regErr.Body)
+			} else {
+				logger.Warn("re-registration failed", "err", err)
+			}
+		}
 	}
 }
+
+// Check that a public URL still tunnels through to this server
+func urlReachable(publicUrl string) bool {
+	client := outboundClient(5 * time.Second)
+	resp, err := client.Head(strings.TrimRight(publicUrl, "/") + "/health")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Function to report device status for operators
+func handleHealth(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		used, err := dirSize(cfg.StoragePath)
+		if err != nil {
+			log.Warn("failed to measure storage usage", "err", err)
+		}
+
+		serverState.mu.RLock()
+		response := HealthResponse{
+			Status:           "ok",
+			DeviceId:         cfg.DeviceID,
+			Port:             cfg.HTTPPort,
+			RegisteredUrl:    serverState.registeredURL,
+			UptimeSeconds:    int64(time.Since(serverState.startedAt).Seconds()),
+			StorageBytesUsed: used,
+			LastError:        serverState.lastError,
+			Build:            banner,
+		}
+		if !serverState.lastRegistration.IsZero() {
+			last := serverState.lastRegistration
+			response.LastRegistrationTime = &last
+		}
+		serverState.mu.RUnlock()
+
+		response.CorruptFiles = integrityChecker.Corrupt()
+		if response.LastError != "" || len(response.CorruptFiles) > 0 {
+			response.Status = "degraded"
+		}
+		if jobs, err := retryQueue.Jobs(); err != nil {
+			log.Warn("failed to list retry jobs", "err", err)
+		} else {
+			response.RetryQueue = RetryQueueHealth{Depth: len(jobs), Pending: jobs}
+		}
+		caps, err := CapabilityProbe(cfg)
+		if err != nil {
+			log.Warn("capability probe incomplete", "err", err)
+		}
+		response.Capabilities = &caps
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Total size of all regular files under root
+func dirSize(root string) (int64, error) {
+	var total int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// Function to handle incoming upload requests
+func handleUpload(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		uploadsInFlight.Add(1)
+		defer uploadsInFlight.Add(-1)
+
+		ctx, span := tracer.Start(r.Context(), "handleUpload")
+		rec := middleware.NewStatusRecorder(w)
+		w = rec
+		defer func() {
+			span.SetAttributes(attribute.Int("http.status_code", rec.Status))
+			span.End()
+		}()
+
+		log.Info("received upload request", "remote_addr", r.RemoteAddr)
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req UploadRequest
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBodyBytes)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				log.Warn("upload request body too large", "limit_bytes", tooLarge.Limit)
+				http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			// The body didn't arrive within the server's read timeout
+			if isTimeout(err) {
+				log.Warn("upload request body timed out", "err", err)
+				http.Error(w, "Request body not received in time", http.StatusRequestTimeout)
+				return
+			}
+			log.Warn("failed to decode upload request", "err", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		log.Debug("decoded upload request", "deployment_id", req.DeploymentId, "project_id", req.ProjectId, "things", len(req.Things))
+		span.SetAttributes(
+			attribute.String("deployment.id", req.DeploymentId),
+			attribute.String("project.id", req.ProjectId),
+			attribute.Int("deployment.things", len(req.Things)),
+		)
+
+		// A dry run only checks the request and its media URLs
+		if r.URL.Query().Get("dry_run") == "true" {
+			log.Info("dry run", "deployment_id", req.DeploymentId)
+			report := dryRunUpload(ctx, req, true)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+			return
+		}
+
+		var invalid *ValidationError
+		if errors.As(validateUploadRequest(req), &invalid) {
+			log.Warn("rejected invalid upload request", "deployment_id", req.DeploymentId, "problems", invalid.Problems)
+			writeUploadInvalid(w, invalid.Problems)
+			return
+		}
+
+		if !checkFreeSpace(cfg, log, w) {
+			return
+		}
+
+		// Each Thing is committed to its own project, defaulting to the request's
+		for i := range req.Things {
+			if req.Things[i].ProjectId == "" {
+				req.Things[i].ProjectId = req.ProjectId
+			}
+		}
+
+		// A retried push of a deployment we've already handled is answered from the state
+		existing, started, err := deployments.Begin(req.DeploymentId, req.ProjectId)
+		if err != nil {
+			log.Error("failed to save deployment state", "err", err)
+		}
+		if !started {
+			if existing.Status == deployment.StatusInProgress {
+				log.Info("deployment already in progress", "deployment_id", req.DeploymentId)
+				http.Error(w, "Deployment already in progress", http.StatusConflict)
+				return
+			}
+			log.Info("deployment already processed, returning cached result", "deployment_id", req.DeploymentId)
+			writeUploadSuccess(w, req.DeploymentId)
+			return
+		}
+		if err := deployments.SetProjects(req.DeploymentId, thingProjects(req.Things)); err != nil {
+			log.Error("failed to save deployment state", "err", err)
+		}
+		tracked := progress.Start(req.DeploymentId, len(req.Things), 0)
+
+		// Phase 1 downloads everything into a staging directory; the live
+		// content is only touched once every Thing has arrived. Things of all
+		// projects share the staging directory and the download slots.
+		stagingDir := filepath.Join(cfg.StagingPath, req.DeploymentId)
+		log.Debug("creating staging directory", "dir", stagingDir)
+		if err := os.MkdirAll(stagingDir, 0755); err != nil {
+			log.Error("failed to create staging directory", "dir", stagingDir, "err", err)
+			finishDeployment(req.DeploymentId, deployment.StatusFailed)
+			http.Error(w, "Failed to create staging directory", http.StatusInternalServerError)
+			return
+		}
+		// Kept when some Things fail, so a retry only fetches those
+		keepStaging := false
+		defer func() {
+			if !keepStaging {
+				os.RemoveAll(stagingDir)
+			}
+		}()
+
+		staged, failed := stageThings(ctx, cfg, log, req.DeploymentId, stagingDir, req.Things, tracked)
+		if len(failed) > 0 {
+			record := deployment.Failed{DeploymentId: req.DeploymentId, ProjectId: req.ProjectId, Staged: staged, Failed: failed}
+			log.Warn("deployment failed, existing content left unchanged", "deployment_id", req.DeploymentId, "errors", record.Errors())
+			if err := deployment.SaveFailed(cfg.FailedPath, record); err != nil {
+				log.Error("failed to save failed Things for retry", "deployment_id", req.DeploymentId, "err", err)
+			} else {
+				keepStaging = true
+				queueFailedThings(log, record)
+			}
+			finishDeployment(req.DeploymentId, failedDeploymentStatus(record))
+			writeDeploymentFailure(w, record, nil)
+			return
+		}
+
+		// A full re-push supersedes whatever an earlier attempt left to retry
+		if err := deployment.RemoveFailed(cfg.FailedPath, req.DeploymentId); err != nil {
+			log.Warn("failed to remove failed Things record", "deployment_id", req.DeploymentId, "err", err)
+		}
+
+		// Content for a later activation waits in staging until its timer fires
+		if req.ActiveAt != nil && req.ActiveAt.After(time.Now()) {
+			d := deployment.Scheduled{DeploymentId: req.DeploymentId, ProjectId: req.ProjectId, Staged: staged, ActiveAt: *req.ActiveAt}
+			if err := scheduled.Schedule(d); err != nil {
+				log.Error("failed to schedule deployment", "deployment_id", req.DeploymentId, "err", err)
+				finishDeployment(req.DeploymentId, deployment.StatusFailed)
+				writeUploadFailure(w, []string{err.Error()})
+				return
+			}
+			keepStaging = true
+			log.Info("deployment scheduled", "deployment_id", req.DeploymentId, "active_at", d.ActiveAt.Format(time.RFC3339))
+			finishDeployment(req.DeploymentId, deployment.StatusScheduled)
+			writeUploadScheduled(w, d)
+			return
+		}
+		// Pushed again to go live now, so an earlier schedule no longer applies
+		if err := scheduled.Cancel(req.DeploymentId); err != nil {
+			log.Warn("failed to cancel scheduled deployment", "deployment_id", req.DeploymentId, "err", err)
+		}
+
+		if err := commitDeployment(cfg, req.DeploymentId, req.ProjectId, stagingDir, staged); err != nil {
+			log.Error("failed to commit deployment", "deployment_id", req.DeploymentId, "err", err)
+			finishDeployment(req.DeploymentId, deployment.StatusFailed)
+			writeUploadFailure(w, []string{err.Error()})
+			return
+		}
+
+		log.Info("deployment completed", "deployment_id", req.DeploymentId)
+		finishDeployment(req.DeploymentId, deployment.StatusSuccess)
+		writeUploadSuccess(w, req.DeploymentId)
+	}
+}
+
+// Phase 1 of a deployment: download things into stagingDir, sharing the
+// download slots with every other request. Returns the Things as staged,
+// with their media type and checksum filled in, and those that failed.
+func stageThings(ctx context.Context, cfg *config.Config, log *slog.Logger, deploymentId, stagingDir string, things []content.Thing, tracked *deployment.Progress) ([]content.Thing, []deployment.FailedThing) {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		staged []content.Thing
+		failed []deployment.FailedThing
+	)
+
+	if cfg.DeploymentTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.DeploymentTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	tracked.Downloading()
+	for _, thing := range things {
+		wg.Add(1)
+		downloadsInFlight.Add(1)
+		go func(t content.Thing) {
+			defer wg.Done()
+			defer downloadsInFlight.Done()
+
+			downloadSlots.Acquire()
+			defer downloadSlots.Release()
+
+			log.Info("processing thing", "deployment_id", deploymentId, "product_id", t.ProductId, "media_url", t.MediaUrl)
+			t.DeploymentId = deploymentId
+			result, err := processContent(ctx, cfg, stagingDir, t, tracked)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// The media server being down is expected now and then; the device
+				// failing to write is not
+				level := slog.LevelWarn
+				kind := apperr.Kind(err)
+				if kind == apperr.KindFileWrite || kind == apperr.KindOther {
+					level = slog.LevelError
+				}
+				log.Log(ctx, level, "failed to process thing", "deployment_id", deploymentId, "product_id", t.ProductId, "kind", kind, "err", err)
+				failed = append(failed, deployment.FailedThing{Thing: t, Error: err.Error(), Kind: kind})
+				tracked.Failed()
+			} else {
+				log.Info("processed thing", "deployment_id", deploymentId, "product_id", t.ProductId)
+				staged = append(staged, result)
+				tracked.Completed()
+			}
+		}(thing)
+	}
+
+	wg.Wait()
+	return staged, failed
+}
+
+// Projects the Things are stored under, in the order they first appear
+func thingProjects(things []content.Thing) []string {
+	var projects []string
+	seen := make(map[string]bool)
+	for _, t := range things {
+		if !seen[t.ProjectId] {
+			seen[t.ProjectId] = true
+			projects = append(projects, t.ProjectId)
+		}
+	}
+	return projects
+}
+
+// Phase 2 of a deployment: commit the staged Things project by project.
+// Things without a ProjectId, e.g. from records saved before Things had
+// one, belong to projectId. If any project fails, the ones committed before
+// it are put back as they were.
+func commitDeployment(cfg *config.Config, deploymentId, projectId, stagingDir string, staged []content.Thing) error {
+	groups := make(map[string][]content.Thing)
+	for i := range staged {
+		if staged[i].ProjectId == "" {
+			staged[i].ProjectId = projectId
+		}
+		groups[staged[i].ProjectId] = append(groups[staged[i].ProjectId], staged[i])
+	}
+	// Every project directory is checked before any goes live, and whether
+	// it had content decides how a failed commit is undone
+	projects := thingProjects(staged)
+	empty := make(map[string]bool)
+	for _, p := range projects {
+		projectDir, err := projectDirFor(cfg.StoragePath, p)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(projectDir, 0755); err != nil {
+			return &apperr.FileWriteError{Path: projectDir, Cause: err}
+		}
+		if empty[p], err = snapshot.Empty(projectDir); err != nil {
+			return fmt.Errorf("failed to read project %s: %v", p, err)
+		}
+	}
+
+	defer updateFilesOnDisk(cfg.StoragePath)
+	for i, p := range projects {
+		if err := commitProject(cfg, deploymentId, p, stagingDir, groups[p]); err != nil {
+			// Put back the projects already live, and whatever part of this
+			// one was, so the deployment is all or nothing
+			for _, done := range projects[:i+1] {
+				undoProjectCommit(cfg, deploymentId, done, groups[done], empty[done])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Undo commitProject for a deployment that failed. A project that had content
+// gets its snapshot back; one that was empty loses the Things' files. Either
+// way the registry is rebuilt from what is left.
+func undoProjectCommit(cfg *config.Config, deploymentId, projectId string, things []content.Thing, wasEmpty bool) {
+	projectDir, err := projectDirFor(cfg.StoragePath, projectId)
+	if err != nil {
+		return
+	}
+	if wasEmpty {
+		for _, thing := range things {
+			for _, name := range []string{thing.MediaFileName(), thing.ProductId + ".json"} {
+				if err := os.Remove(filepath.Join(projectDir, name)); err != nil && !os.IsNotExist(err) {
+					logger.Error("failed to undo commit", "deployment_id", deploymentId, "project_id", projectId, "file", name, "err", err)
+				}
+			}
+		}
+	} else if _, err := snapshots.Rollback(projectId, projectDir, deploymentId); err != nil {
+		// No snapshot means the commit failed before touching the project
+		if !errors.Is(err, snapshot.ErrNoSnapshot) {
+			logger.Error("failed to undo commit", "deployment_id", deploymentId, "project_id", projectId, "err", err)
+		}
+		return
+	}
+	logger.Warn("undid commit of failed deployment", "deployment_id", deploymentId, "project_id", projectId)
+	if err := tagRegistry.ReplaceUnder(projectDir, projectEntries(cfg.StoragePath, projectId)); err != nil {
+		logger.Error("failed to update registry", "err", err)
+	}
+}
+
+// Snapshot a project, then move its staged files into place and map their tags
+func commitProject(cfg *config.Config, deploymentId, projectId, stagingDir string, staged []content.Thing) error {
+	projectDir, err := projectDirFor(cfg.StoragePath, projectId)
+	if err != nil {
+		return err
+	}
+	if err := snapshots.Take(projectId, projectDir, deploymentId); err != nil {
+		return fmt.Errorf("failed to snapshot project: %v", err)
+	}
+	if err := commitStaged(stagingDir, projectDir, staged); err != nil {
+		return err
+	}
+	// Only this project's metadata changed, so only it needs its paths fixed
+	if err := content.FixContentDirectory(projectDir, logger); err != nil {
+		logger.Error("failed to fix metadata paths", "project_id", projectId, "err", err)
+	}
+	return nil
+}
+
+// Download the Things a failed deployment is still missing and, once every
+// one has arrived, commit the deployment as if the first push had worked
+func retryDeployment(ctx context.Context, cfg *config.Config, log *slog.Logger, w http.ResponseWriter, deploymentId string) {
+	record, err := deployment.LoadFailed(cfg.FailedPath, deploymentId)
+	if os.IsNotExist(err) {
+		http.Error(w, "No failed Things recorded for this deployment", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("failed to load failed Things", "deployment_id", deploymentId, "err", err)
+		http.Error(w, "Failed to load failed Things", http.StatusInternalServerError)
+		return
+	}
+
+	_, started, err := deployments.Begin(deploymentId, record.ProjectId)
+	if err != nil {
+		log.Error("failed to save deployment state", "err", err)
+	}
+	if !started {
+		http.Error(w, "Deployment already in progress", http.StatusConflict)
+		return
+	}
+	// Keeps garbage collection away while the deployment is committed
+	uploadsInFlight.Add(1)
+	defer uploadsInFlight.Add(-1)
+
+	stagingDir := filepath.Join(cfg.StagingPath, deploymentId)
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		log.Error("failed to create staging directory", "dir", stagingDir, "err", err)
+		finishDeployment(deploymentId, deployment.StatusFailed)
+		http.Error(w, "Failed to create staging directory", http.StatusInternalServerError)
+		return
+	}
+
+	things := make([]content.Thing, len(record.Failed))
+	for i, ft := range record.Failed {
+		things[i] = ft.Thing
+	}
+	log.Info("retrying failed Things", "deployment_id", deploymentId, "things", len(things))
+	tracked := progress.Start(deploymentId, len(record.Staged)+len(things), len(record.Staged))
+	staged, failed := stageThings(ctx, cfg, log, deploymentId, stagingDir, things, tracked)
+	record.Staged = append(record.Staged, staged...)
+	record.Failed = failed
+
+	if len(failed) > 0 {
+		log.Warn("retry incomplete", "deployment_id", deploymentId, "recovered", len(staged), "errors", record.Errors())
+		if err := deployment.SaveFailed(cfg.FailedPath, record); err != nil {
+			log.Error("failed to save failed Things for retry", "deployment_id", deploymentId, "err", err)
+		}
+		queueFailedThings(log, deployment.Failed{DeploymentId: deploymentId, ProjectId: record.ProjectId, Failed: failed})
+		finishDeployment(deploymentId, failedDeploymentStatus(record))
+		writeDeploymentFailure(w, record, map[string]interface{}{
+			"recovered": len(staged),
+		})
+		return
+	}
+
+	if err := commitDeployment(cfg, deploymentId, record.ProjectId, stagingDir, record.Staged); err != nil {
+		log.Error("failed to commit deployment", "deployment_id", deploymentId, "err", err)
+		finishDeployment(deploymentId, deployment.StatusFailed)
+		writeUploadFailure(w, []string{err.Error()})
+		return
+	}
+	if err := deployment.RemoveFailed(cfg.FailedPath, deploymentId); err != nil {
+		log.Warn("failed to remove failed Things record", "deployment_id", deploymentId, "err", err)
+	}
+	os.RemoveAll(stagingDir)
+
+	log.Info("deployment completed on retry", "deployment_id", deploymentId)
+	finishDeployment(deploymentId, deployment.StatusSuccess)
+	writeUploadSuccess(w, deploymentId)
+}
+
+// How often the background worker looks for retry jobs that are due
+const retryQueuePollInterval = 30 * time.Second
+
+// Queue every Thing a deployment failed to download for a background retry
+func queueFailedThings(log *slog.Logger, record deployment.Failed) {
+	for _, ft := range record.Failed {
+		if err := retryQueue.Add(record.DeploymentId, record.ProjectId, ft); err != nil {
+			log.Error("failed to queue Thing for retry", "deployment_id", record.DeploymentId, "product_id", ft.Thing.ProductId, "err", err)
+		}
+	}
+}
+
+// Body of the heartbeat POST
+type Heartbeat struct {
+	DeviceId            string     `json:"deviceId"`
+	Timestamp           time.Time  `json:"timestamp"`
+	UptimeSeconds       int64      `json:"uptime_seconds"`
+	StorageBytesFree    int64      `json:"storage_bytes_free"`
+	ActiveDeploymentIds []string   `json:"active_deployment_ids"`
+	LastNFCScanAt       *time.Time `json:"last_nfc_scan_at"`
+}
+
+// Send a heartbeat every HeartbeatIntervalSeconds until ctx is cancelled, so
+// the cloud notices a device that has gone quiet
+func runHeartbeat(ctx context.Context, cfg *config.Config) {
+	ticker := time.NewTicker(time.Duration(cfg.HeartbeatIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	misses := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := sendHeartbeat(ctx, cfg); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			misses++
+			logger.Debug("heartbeat failed", "misses", misses, "err", err)
+			if misses > cfg.HeartbeatMaxMisses {
+				logger.Error("heartbeat lost, the cloud can't see this device", "misses", misses, "endpoint", cfg.HeartbeatEndpoint, "err", err)
+				if cfg.HeartbeatExitOnFailure {
+					os.Exit(1)
+				}
+			}
+			continue
+		}
+		misses = 0
+		logger.Debug("heartbeat sent")
+	}
+}
+
+// POST the device's current status to the heartbeat endpoint
+func sendHeartbeat(ctx context.Context, cfg *config.Config) error {
+	hb := Heartbeat{
+		DeviceId:            cfg.DeviceID,
+		Timestamp:           time.Now().UTC(),
+		UptimeSeconds:       int64(time.Since(serverState.startedAt).Seconds()),
+		ActiveDeploymentIds: []string{},
+	}
+	if usage, err := diskspace.Stat(cfg.StoragePath); err != nil {
+		logger.Warn("failed to check free space", "err", err)
+	} else {
+		hb.StorageBytesFree = int64(usage.AvailableBytes)
+	}
+	for id, st := range deployments.All() {
+		// partial_success is still waiting on failed Things, so isn't live
+		if st.Status == deployment.StatusSuccess {
+			hb.ActiveDeploymentIds = append(hb.ActiveDeploymentIds, id)
+		}
+	}
+	sort.Strings(hb.ActiveDeploymentIds)
+	// lift_learn may be down too, which the heartbeat then shows as no scan
+	if scans, err := fetchScanHistory(ctx, cfg, 1); err == nil && len(scans) > 0 {
+		if t, err := time.Parse(time.RFC3339, scans[0].Timestamp); err == nil {
+			hb.LastNFCScanAt = &t
+		}
+	}
+
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.HeartbeatEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build heartbeat request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := outboundClient(30 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("heartbeat endpoint answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Retry due jobs every retryQueuePollInterval until ctx is cancelled
+func runRetryQueue(ctx context.Context, cfg *config.Config) {
+	ticker := time.NewTicker(retryQueuePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			processRetryQueue(ctx, cfg)
+		}
+	}
+}
+
+// Drop jobs older than MaxJobAgeHours and retry the due ones, a deployment
+// at a time
+func processRetryQueue(ctx context.Context, cfg *config.Config) {
+	jobs, err := retryQueue.Jobs()
+	if err != nil {
+		logger.Error("failed to list retry jobs", "err", err)
+		return
+	}
+
+	maxAge := time.Duration(cfg.MaxJobAgeHours) * time.Hour
+	now := time.Now()
+	var order []string
+	due := make(map[string][]deployment.RetryJob)
+	for _, job := range jobs {
+		if now.Sub(job.CreatedAt) > maxAge {
+			logger.Warn("discarding retry job", "deployment_id", job.DeploymentId, "product_id", job.Thing.ProductId,
+				"attempts", job.Attempts, "last_error", job.LastError)
+			if err := retryQueue.Remove(job.DeploymentId, job.Thing.ProductId); err != nil {
+				logger.Error("failed to remove retry job", "deployment_id", job.DeploymentId, "err", err)
+			}
+			continue
+		}
+		if job.NextAttemptAt.After(now) {
+			continue
+		}
+		if _, ok := due[job.DeploymentId]; !ok {
+			order = append(order, job.DeploymentId)
+		}
+		due[job.DeploymentId] = append(due[job.DeploymentId], job)
+	}
+
+	for _, deploymentId := range order {
+		if ctx.Err() != nil {
+			return
+		}
+		retryQueuedThings(ctx, cfg, deploymentId, due[deploymentId])
+	}
+}
+
+// Download the queued Things of one failed deployment, and commit it like
+// POST /deployments/{id}/retry would once nothing is missing any more
+func retryQueuedThings(ctx context.Context, cfg *config.Config, deploymentId string, jobs []deployment.RetryJob) {
+	log := logger.With("deployment_id", deploymentId)
+	record, err := deployment.LoadFailed(cfg.FailedPath, deploymentId)
+	if os.IsNotExist(err) {
+		// Retried by hand, pushed again or deleted since it was queued
+		for _, job := range jobs {
+			retryQueue.Remove(deploymentId, job.Thing.ProductId)
+		}
+		return
+	}
+	if err != nil {
+		log.Error("failed to load failed Things", "err", err)
+		return
+	}
+
+	stillFailed := make(map[string]bool)
+	for _, ft := range record.Failed {
+		stillFailed[ft.Thing.ProductId] = true
+	}
+	var things []content.Thing
+	retrying := make(map[string]bool)
+	for _, job := range jobs {
+		if !stillFailed[job.Thing.ProductId] {
+			retryQueue.Remove(deploymentId, job.Thing.ProductId)
+			continue
+		}
+		things = append(things, job.Thing)
+		retrying[job.Thing.ProductId] = true
+	}
+	if len(things) == 0 {
+		return
+	}
+
+	// Tried again on the next poll if someone else is working on it
+	if _, started, err := deployments.Begin(deploymentId, record.ProjectId); err != nil {
+		log.Error("failed to save deployment state", "err", err)
+	} else if !started {
+		return
+	}
+	// Keeps garbage collection away while the deployment is committed
+	uploadsInFlight.Add(1)
+	defer uploadsInFlight.Add(-1)
+
+	stagingDir := filepath.Join(cfg.StagingPath, deploymentId)
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		log.Error("failed to create staging directory", "dir", stagingDir, "err", err)
+		finishDeployment(deploymentId, deployment.StatusFailed)
+		return
+	}
+
+	log.Info("retrying queued Things", "things", len(things))
+	tracked := progress.Start(deploymentId, len(record.Staged)+len(record.Failed), len(record.Staged))
+	staged, failed := stageThings(ctx, cfg, log, deploymentId, stagingDir, things, tracked)
+	for _, t := range staged {
+		retryQueue.Remove(deploymentId, t.ProductId)
+	}
+	queueFailedThings(log, deployment.Failed{DeploymentId: deploymentId, ProjectId: record.ProjectId, Failed: failed})
+
+	// Things that weren't due yet are still missing too
+	for _, ft := range record.Failed {
+		if !retrying[ft.Thing.ProductId] {
+			failed = append(failed, ft)
+		}
+	}
+	record.Staged = append(record.Staged, staged...)
+	record.Failed = failed
+
+	if len(failed) > 0 {
+		log.Warn("background retry incomplete", "recovered", len(staged), "missing", len(failed))
+		if err := deployment.SaveFailed(cfg.FailedPath, record); err != nil {
+			log.Error("failed to save failed Things for retry", "err", err)
+		}
+		finishDeployment(deploymentId, failedDeploymentStatus(record))
+		return
+	}
+
+	if err := commitDeployment(cfg, deploymentId, record.ProjectId, stagingDir, record.Staged); err != nil {
+		log.Error("failed to commit deployment", "err", err)
+		finishDeployment(deploymentId, deployment.StatusFailed)
+		return
+	}
+	if err := deployment.RemoveFailed(cfg.FailedPath, deploymentId); err != nil {
+		log.Warn("failed to remove failed Things record", "err", err)
+	}
+	os.RemoveAll(stagingDir)
+
+	log.Info("deployment completed by background retry")
+	finishDeployment(deploymentId, deployment.StatusSuccess)
+}
+
+// Commit a scheduled deployment once its activeAt arrives. Called from the
+// scheduler's timer, so failures can only be logged.
+func activateScheduled(cfg *config.Config, d deployment.Scheduled) {
+	logger.Info("activating scheduled deployment", "deployment_id", d.DeploymentId, "active_at", d.ActiveAt.Format(time.RFC3339))
+	if _, started, err := deployments.Begin(d.DeploymentId, d.ProjectId); err != nil {
+		logger.Error("failed to save deployment state", "err", err)
+	} else if !started {
+		logger.Warn("deployment already in progress, not activating", "deployment_id", d.DeploymentId)
+		return
+	}
+
+	stagingDir := filepath.Join(cfg.StagingPath, d.DeploymentId)
+	defer os.RemoveAll(stagingDir)
+	if err := commitDeployment(cfg, d.DeploymentId, d.ProjectId, stagingDir, d.Staged); err != nil {
+		logger.Error("failed to commit scheduled deployment", "deployment_id", d.DeploymentId, "err", err)
+		finishDeployment(d.DeploymentId, deployment.StatusFailed)
+		return
+	}
+	logger.Info("scheduled deployment activated", "deployment_id", d.DeploymentId)
+	finishDeployment(d.DeploymentId, deployment.StatusSuccess)
+}
+
+// Refresh the content_files_on_disk gauge from what is actually in storage
+func updateFilesOnDisk(storagePath string) {
+	projects, err := content.ScanDirectory(storagePath)
+	if err != nil {
+		logger.Warn("failed to count content files", "err", err)
+		return
+	}
+	files := 0
+	for _, p := range projects {
+		for _, t := range p.Things {
+			if t.VideoPresent {
+				files++
+			}
+		}
+	}
+	metrics.ContentFilesOnDisk.Set(float64(files))
+}
+
+// Count upload requests by the status they were answered with
+func countUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := middleware.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+		metrics.UploadRequests.WithLabelValues(strconv.Itoa(rec.Status)).Inc()
+	})
+}
+
+// Lift the server's write timeout for handlers that answer only once their
+// downloads are done, which can take far longer. Reading the request is
+// still bounded by the read timeout.
+func withoutWriteTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			logger.Warn("failed to lift write timeout", "path", r.URL.Path, "err", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Refuse the upload with 507 when the storage filesystem is below the
+// configured free space. Reports whether the upload may go ahead.
+func checkFreeSpace(cfg *config.Config, log *slog.Logger, w http.ResponseWriter) bool {
+	usage, err := diskspace.Stat(cfg.StoragePath)
+	if err != nil {
+		// Not knowing is no reason to turn the deployment away
+		log.Warn("failed to check free disk space", "err", err)
+		return true
+	}
+
+	required := uint64(cfg.MinFreeDiskMB) * 1024 * 1024
+	if usage.AvailableBytes >= required {
+		return true
+	}
+
+	log.Error("refusing upload, not enough free disk space", "available_bytes", usage.AvailableBytes, "required_bytes", required)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInsufficientStorage)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":           "insufficient storage",
+		"available_bytes": usage.AvailableBytes,
+		"required_bytes":  required,
+	})
+	return false
+}
+
+// Check the storage filesystem every diskCheckInterval, keeping the
+// disk_free_bytes gauge current and warning as it fills up
+func monitorDiskSpace(ctx context.Context, storagePath string) {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		usage, err := diskspace.Stat(storagePath)
+		if err != nil {
+			logger.Warn("failed to check disk space", "err", err)
+		} else {
+			metrics.DiskFreeBytes.Set(float64(usage.AvailableBytes))
+			used := usage.UsedFraction()
+			switch {
+			case used >= diskErrorFraction:
+				logger.Error("storage almost full", "used_percent", int(used*100), "available_bytes", usage.AvailableBytes)
+			case used >= diskWarnFraction:
+				logger.Warn("storage filling up", "used_percent", int(used*100), "available_bytes", usage.AvailableBytes)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeUploadFailure(w http.ResponseWriter, errors []string) {
+	response := map[string]interface{}{
+		"status": "failed",
+		"errors": errors,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Answer a deployment some of whose Things failed, with the errors grouped
+// by kind. The status code says where the problem most likely is: 500 when
+// the device couldn't write, 502 when media didn't download and 422 when it
+// arrived but didn't match its checksum. fields are added to the response.
+func writeDeploymentFailure(w http.ResponseWriter, record deployment.Failed, fields map[string]interface{}) {
+	byKind := record.ErrorsByKind()
+	code := http.StatusUnprocessableEntity
+	switch {
+	case len(byKind[apperr.KindFileWrite]) > 0 || len(byKind[apperr.KindOther]) > 0:
+		code = http.StatusInternalServerError
+	case len(byKind[apperr.KindDownload]) > 0:
+		code = http.StatusBadGateway
+	}
+
+	response := map[string]interface{}{
+		"status":         failedDeploymentStatus(record),
+		"errors":         record.Errors(),
+		"errors_by_type": byKind,
+	}
+	for k, v := range fields {
+		response[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
+
+// The status a deployment with failed Things is recorded and answered with:
+// partial_success while some of its Things wait in staging for the rest,
+// failed when none arrived. Either way nothing of it has gone live.
+func failedDeploymentStatus(record deployment.Failed) string {
+	if len(record.Staged) > 0 {
+		return deployment.StatusPartialSuccess
+	}
+	return deployment.StatusFailed
+}
+
+func writeUploadInvalid(w http.ResponseWriter, problems []string) {
+	response := map[string]interface{}{
+		"status": "invalid",
+		"errors": problems,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeUploadSuccess(w http.ResponseWriter, deploymentId string) {
+	response := map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("Successfully processed deployment %s", deploymentId),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeUploadScheduled(w http.ResponseWriter, d deployment.Scheduled) {
+	response := map[string]string{
+		"status":   deployment.StatusScheduled,
+		"message":  fmt.Sprintf("Downloaded deployment %s, activating at %s", d.DeploymentId, d.ActiveAt.Format(time.RFC3339)),
+		"activeAt": d.ActiveAt.Format(time.RFC3339),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+func finishDeployment(deploymentId, status string) {
+	progress.Finish(deploymentId, status)
+	if err := deployments.Finish(deploymentId, status); err != nil {
+		logger.Error("failed to save deployment state", "err", err)
+	}
+}
+
+// A downloaded deployment that hasn't gone live yet, as listed by /content
+type ScheduledContent struct {
+	DeploymentId string          `json:"deploymentId"`
+	ProjectId    string          `json:"projectId"`
+	Status       string          `json:"status"`
+	ActiveAt     time.Time       `json:"activeAt"`
+	Things       []content.Thing `json:"things"`
+}
+
+// Function to list stored projects and whether their files are present,
+// along with scheduled deployments still waiting to activate
+func handleContent(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		contentCache.mu.Lock()
+		if time.Since(contentCache.scannedAt) > contentCacheTTL {
+			projects, err := content.ScanDirectory(cfg.StoragePath)
+			if err != nil {
+				contentCache.mu.Unlock()
+				log.Error("failed to scan content directory", "err", err)
+				http.Error(w, "Failed to scan content directory", http.StatusInternalServerError)
+				return
+			}
+			contentCache.projects = projects
+			contentCache.scannedAt = time.Now()
+		}
+		projects := contentCache.projects
+		contentCache.mu.Unlock()
+
+		pending := []ScheduledContent{}
+		for _, d := range scheduled.Pending() {
+			pending = append(pending, ScheduledContent{
+				DeploymentId: d.DeploymentId,
+				ProjectId:    d.ProjectId,
+				Status:       deployment.StatusScheduled,
+				ActiveAt:     d.ActiveAt,
+				Things:       d.Staged,
+			})
+		}
+		sort.Slice(pending, func(i, j int) bool { return pending[i].ActiveAt.Before(pending[j].ActiveAt) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"projects": projects, "scheduled": pending})
+	}
+}
+
+// How many deployments and scans the admin dashboard lists
+const adminRecentLimit = 20
+
+// Function to serve the HTML admin dashboard
+func handleAdmin(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		serverState.mu.RLock()
+		p := admin.Page{
+			DeviceId:      cfg.DeviceID,
+			RegisteredURL: serverState.registeredURL,
+			Uptime:        time.Since(serverState.startedAt).Truncate(time.Second),
+			GeneratedAt:   time.Now(),
+		}
+		serverState.mu.RUnlock()
+
+		if usage, err := diskspace.Stat(cfg.StoragePath); err != nil {
+			log.Warn("failed to check disk space", "err", err)
+		} else {
+			p.DiskTotal = usage.TotalBytes
+			p.DiskUsed = usage.TotalBytes - usage.AvailableBytes
+			p.DiskFraction = usage.UsedFraction()
+		}
+
+		for uid, e := range tagRegistry.Entries() {
+			m := admin.Mapping{UID: uid, ProductName: e.ProductName, VideoFile: filepath.Base(e.VideoPath)}
+			if info, err := os.Stat(e.VideoPath); err == nil {
+				m.FileSize = info.Size()
+			} else {
+				m.Missing = true
+			}
+			p.Mappings = append(p.Mappings, m)
+		}
+		sort.Slice(p.Mappings, func(i, j int) bool { return p.Mappings[i].UID < p.Mappings[j].UID })
+
+		for id, st := range deployments.All() {
+			p.Deployments = append(p.Deployments, admin.Deployment{DeploymentId: id, ProjectId: st.ProjectId, Status: st.Status, UpdatedAt: st.UpdatedAt})
+		}
+		sort.Slice(p.Deployments, func(i, j int) bool { return p.Deployments[i].UpdatedAt.After(p.Deployments[j].UpdatedAt) })
+		if len(p.Deployments) > adminRecentLimit {
+			p.Deployments = p.Deployments[:adminRecentLimit]
+		}
+
+		// Scans are only known to lift_learn, which keeps them on its control server
+		scans, err := fetchScanHistory(r.Context(), cfg, adminRecentLimit)
+		if err != nil {
+			log.Warn("failed to fetch scan history", "err", err)
+			p.ScansError = err.Error()
+		}
+		p.Scans = scans
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := admin.Render(w, p); err != nil {
+			log.Error("failed to render admin page", "err", err)
+		}
+	}
+}
+
+// Ask lift_learn's control server for its most recent scans
+func fetchScanHistory(ctx context.Context, cfg *config.Config, limit int) ([]events.HistoryEntry, error) {
+	host, port, err := net.SplitHostPort(cfg.ControlAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control_addr %q: %v", cfg.ControlAddr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	url := fmt.Sprintf("http://%s/history?limit=%d", net.JoinHostPort(host, port), limit)
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := outboundClient(0).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("lift_learn not reachable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lift_learn answered %d", resp.StatusCode)
+	}
+
+	var scans []events.HistoryEntry
+	if err := json.NewDecoder(resp.Body).Decode(&scans); err != nil {
+		return nil, fmt.Errorf("failed to parse scan history: %v", err)
+	}
+	return scans, nil
+}
+
+// Function to route /deployments/{deploymentId} requests
+func handleDeployments(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		deploymentId := strings.Trim(strings.TrimPrefix(r.URL.Path, "/deployments/"), "/")
+		action := ""
+		if i := strings.Index(deploymentId, "/"); i >= 0 {
+			deploymentId, action = deploymentId[:i], deploymentId[i+1:]
+		}
+		if deploymentId == "" || strings.Contains(action, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case action == "" && r.Method == http.MethodDelete:
+			deleteDeployment(cfg, log, w, deploymentId)
+		case action == "rollback" && r.Method == http.MethodPost:
+			rollbackDeployment(cfg, log, w, deploymentId)
+		case action == "retry" && r.Method == http.MethodPost:
+			retryDeployment(r.Context(), cfg, log, w, deploymentId)
+		case action == "status" && r.Method == http.MethodGet:
+			deploymentStatus(w, deploymentId)
+		case action == "" || action == "rollback" || action == "retry" || action == "status":
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// Report how far a deployment's downloads have got. One from before the
+// last restart only has the status that was persisted for it.
+func deploymentStatus(w http.ResponseWriter, deploymentId string) {
+	report, ok := progress.Report(deploymentId)
+	if !ok {
+		st, known := deployments.Get(deploymentId)
+		if !known {
+			http.Error(w, "Unknown deployment", http.StatusNotFound)
+			return
+		}
+		report = deployment.ProgressReport{DeploymentId: deploymentId, Status: st.Status}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Put back the project content a deployment replaced and remap its tags.
+// The deployment is forgotten so it can be pushed again.
+func rollbackDeployment(cfg *config.Config, log *slog.Logger, w http.ResponseWriter, deploymentId string) {
+	st, ok := deployments.Get(deploymentId)
+	if !ok {
+		http.Error(w, "Unknown deployment", http.StatusNotFound)
+		return
+	}
+	projectDirs := make(map[string]string)
+	for _, projectId := range st.Projects() {
+		projectDir, err := projectDirFor(cfg.StoragePath, projectId)
+		if err != nil {
+			http.Error(w, "Deployment has an invalid project id", http.StatusInternalServerError)
+			return
+		}
+		projectDirs[projectId] = projectDir
+	}
+
+	// Every project the deployment wrote to was snapshotted before it was
+	// touched, so each one is put back on its own
+	versions := make(map[string]int)
+	defer updateFilesOnDisk(cfg.StoragePath)
+	for _, projectId := range st.Projects() {
+		projectDir := projectDirs[projectId]
+		snap, err := snapshots.Rollback(projectId, projectDir, deploymentId)
+		switch {
+		case errors.Is(err, snapshot.ErrNoSnapshot), errors.Is(err, snapshot.ErrNotLatest):
+			http.Error(w, fmt.Sprintf("%s: %v", projectId, err), http.StatusConflict)
+			return
+		case err != nil:
+			log.Error("rollback failed", "deployment_id", deploymentId, "project_id", projectId, "err", err)
+			http.Error(w, "Rollback failed", http.StatusInternalServerError)
+			return
+		}
+		log.Info("rolled back deployment", "deployment_id", deploymentId, "project_id", projectId, "snapshot", snap.Version)
+		versions[projectId] = snap.Version
+
+		if err := tagRegistry.ReplaceUnder(projectDir, projectEntries(cfg.StoragePath, projectId)); err != nil {
+			log.Error("failed to update registry", "err", err)
+		}
+	}
+	if err := deployments.Remove(deploymentId); err != nil {
+		log.Error("failed to save deployment state", "err", err)
+	}
+
+	resp := map[string]interface{}{
+		"status":    "rolled_back",
+		"snapshots": versions,
+	}
+	if len(versions) == 1 {
+		resp["snapshot"] = versions[st.Projects()[0]]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Registry entries for every tagged Thing currently stored in a project
+func projectEntries(storagePath, projectId string) []registry.Entry {
+	projects, err := content.ScanDirectory(storagePath)
+	if err != nil {
+		logger.Warn("failed to scan content directory", "err", err)
+		return nil
+	}
+
+	var entries []registry.Entry
+	for _, p := range projects {
+		if p.ProjectId != projectId {
+			continue
+		}
+		for _, t := range p.Things {
+			if !t.MetadataPresent || t.NfcTagId == "" {
+				continue
+			}
+			entries = append(entries, registry.Entry{
+				NfcTagId:     t.NfcTagId,
+				ProductId:    t.ProductId,
+				ProductName:  t.ProductName,
+				ProjectId:    projectId,
+				MediaType:    t.MediaType,
+				VideoPath:    t.LocalVideoPath,
+				MetadataPath: t.MetadataPath,
+			})
+		}
+	}
+	return entries
+}
+
+// Remove a deployment's project directory, its state entry and any tag
+// mappings pointing into the deleted directory
+func deleteDeployment(cfg *config.Config, log *slog.Logger, w http.ResponseWriter, deploymentId string) {
+	st, ok := deployments.Get(deploymentId)
+	if !ok {
+		http.Error(w, "Unknown deployment", http.StatusNotFound)
+		return
+	}
+
+	// Never went live, so there is only its staging directory to drop
+	if st.Status == deployment.StatusScheduled {
+		if err := scheduled.Cancel(deploymentId); err != nil {
+			log.Error("failed to cancel scheduled deployment", "deployment_id", deploymentId, "err", err)
+		}
+		os.RemoveAll(filepath.Join(cfg.StagingPath, deploymentId))
+		if err := deployments.Remove(deploymentId); err != nil {
+			log.Error("failed to save deployment state", "err", err)
+		}
+		log.Info("cancelled scheduled deployment", "deployment_id", deploymentId)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var projectDirs []string
+	for _, projectId := range st.Projects() {
+		projectDir, err := projectDirFor(cfg.StoragePath, projectId)
+		if err != nil {
+			log.Error("refusing to delete deployment", "deployment_id", deploymentId, "project_id", projectId)
+			http.Error(w, "Deployment has no deletable project directory", http.StatusInternalServerError)
+			return
+		}
+		projectDirs = append(projectDirs, projectDir)
+	}
+	for _, projectDir := range projectDirs {
+		log.Info("deleting deployment", "deployment_id", deploymentId, "dir", projectDir)
+		if err := os.RemoveAll(projectDir); err != nil {
+			log.Error("failed to remove project directory", "dir", projectDir, "err", err)
+			http.Error(w, "Failed to remove project directory", http.StatusInternalServerError)
+			return
+		}
+
+		if removed, err := tagRegistry.RemoveUnder(projectDir); err != nil {
+			log.Error("failed to update registry", "err", err)
+		} else if removed > 0 {
+			log.Info("removed tag mappings", "count", removed, "dir", projectDir)
+		}
+	}
+	if err := deployments.Remove(deploymentId); err != nil {
+		log.Error("failed to save deployment state", "err", err)
+	}
+
+	collectStoreGarbage(cfg.StoragePath)
+	log.Info("deleted deployment", "deployment_id", deploymentId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Function to download a Thing's media and metadata into the staging
+// directory. Returns the Thing as saved, with its media type and checksum
+// filled in. Downloaded bytes are counted in tracked.
+func processContent(ctx context.Context, cfg *config.Config, stagingDir string, thing content.Thing, tracked io.Writer) (_ content.Thing, err error) {
+	_, span := tracer.Start(ctx, "processContent", trace.WithAttributes(
+		attribute.String("deployment.id", thing.DeploymentId),
+		attribute.String("product.id", thing.ProductId),
+		attribute.String("media.url", thing.MediaUrl),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	logger.Debug("downloading content", "product_id", thing.ProductId, "url", thing.MediaUrl)
+
+	if thing.MediaType == "" {
+		thing.MediaType = sniffMediaType(thing.MediaUrl)
+	}
+
+	filename := filepath.Join(stagingDir, thing.MediaFileName())
+	if contentStore.Has(thing.Checksum) {
+		metrics.StoreHits.Inc()
+		span.SetAttributes(attribute.Bool("store.hit", true))
+		logger.Info("reusing stored media", "product_id", thing.ProductId, "checksum", thing.Checksum)
+		if thing.Extension == "" {
+			// Nothing is downloaded, so ask the server what the file is
+			if contentType, err := headContentType(thing.MediaUrl); err == nil {
+				thing.Extension = content.ExtensionForContentType(contentType)
+			}
+			filename = filepath.Join(stagingDir, thing.MediaFileName())
+		}
+		if err := contentStore.LinkTo(thing.Checksum, filename); err != nil {
+			return thing, &apperr.FileWriteError{Path: filename, Cause: fmt.Errorf("failed to reuse stored media: %v", err)}
+		}
+	} else {
+		metrics.StoreMisses.Inc()
+		timeout := time.Duration(cfg.PerThingDownloadTimeoutSeconds) * time.Second
+		started := time.Now()
+		digest, contentType, err := downloadMedia(ctx, thing.MediaUrl, filename, thing.Checksum, timeout, tracked)
+		// A slow server gets another go only if asked for; each retry resumes
+		// from the partial file the last attempt left behind
+		for retry := 1; retry <= cfg.MaxDownloadRetries && errors.Is(err, errDownloadTimeout) && ctx.Err() == nil; retry++ {
+			logger.Warn("download timed out, retrying", "product_id", thing.ProductId, "retry", retry, "max_retries", cfg.MaxDownloadRetries)
+			span.AddEvent("download retry", trace.WithAttributes(attribute.Int("retry", retry), attribute.String("reason", err.Error())))
+			digest, contentType, err = downloadMedia(ctx, thing.MediaUrl, filename, thing.Checksum, timeout, tracked)
+		}
+		span.SetAttributes(attribute.Int64("download.duration_ms", time.Since(started).Milliseconds()))
+		var downloadErr *apperr.DownloadError
+		if errors.As(err, &downloadErr) {
+			downloadErr.ProductId = thing.ProductId
+		}
+		var checksumErr *apperr.ChecksumError
+		if errors.As(err, &checksumErr) {
+			checksumErr.ProductId = thing.ProductId
+			span.AddEvent("checksum mismatch", trace.WithAttributes(attribute.String("expected", thing.Checksum)))
+		}
+		if err != nil {
+			metrics.ContentDownloads.WithLabelValues("failure").Inc()
+			return thing, err
+		}
+		metrics.ContentDownloads.WithLabelValues("success").Inc()
+
+		// Name the file after what the server actually sent, so a .webm
+		// or .mov isn't saved as .mp4
+		if thing.Extension == "" {
+			thing.Extension = content.ExtensionForContentType(contentType)
+			if named := filepath.Join(stagingDir, thing.MediaFileName()); named != filename {
+				if err := os.Rename(filename, named); err != nil {
+					return thing, &apperr.FileWriteError{Path: named, Cause: err}
+				}
+				filename = named
+			}
+		}
+
+		// Recorded in the metadata so the store's GC can see the file is in use
+		thing.Checksum = digest
+		if err := contentStore.Add(filename, digest); err != nil {
+			logger.Warn("failed to add media to content store", "product_id", thing.ProductId, "err", err)
+		}
+	}
+
+	metadataFilename := filepath.Join(stagingDir, fmt.Sprintf("%s.json", thing.ProductId))
+	if err := content.WriteThing(fsys.OS{}, metadataFilename, thing); err != nil {
+		return thing, &apperr.FileWriteError{Path: metadataFilename, Cause: err}
+	}
+
+	logger.Debug("staged content and metadata", "product_id", thing.ProductId, "media_type", thing.MediaType)
+	return thing, nil
+}
+
+// Work out what a Thing without a mediaType is from the Content-Type its
+// URL is served with, assuming video when the server won't say
+func sniffMediaType(url string) string {
+	contentType, err := headContentType(url)
+	if err != nil {
+		logger.Warn("failed to sniff media type, assuming video", "url", url, "err", err)
+		return content.MediaVideo
+	}
+	return content.MediaTypeForContentType(contentType)
+}
+
+// Content-Type url is served with, from a HEAD request
+func headContentType(url string) (string, error) {
+	resp, err := outboundClient(10 * time.Second).Head(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Content-Type"), nil
+}
+
+// Move every staged media and metadata file into projectDir, then map all
+// their tags in a single registry save. The staging path has to be on the
+// same filesystem as the storage path so each move is a rename.
+func commitStaged(stagingDir, projectDir string, things []content.Thing) error {
+	if err := os.MkdirAll(projectDir, 0755); err != nil {
+		return &apperr.FileWriteError{Path: projectDir, Cause: err}
+	}
+
+	var entries []registry.Entry
+	for _, thing := range things {
+		videoName := thing.MediaFileName()
+		metadataName := fmt.Sprintf("%s.json", thing.ProductId)
+		for _, name := range []string{videoName, metadataName} {
+			if err := os.Rename(filepath.Join(stagingDir, name), filepath.Join(projectDir, name)); err != nil {
+				return &apperr.FileWriteError{Path: filepath.Join(projectDir, name), Cause: err}
+			}
+		}
+
+		if err := scheduleExpiry(thing, filepath.Join(projectDir, videoName), filepath.Join(projectDir, metadataName)); err != nil {
+			logger.Error("failed to schedule expiration", "product_id", thing.ProductId, "err", err)
+		}
+
+		if thing.NfcTagId != "" {
+			entries = append(entries, registry.Entry{
+				NfcTagId:     thing.NfcTagId,
+				ProductId:    thing.ProductId,
+				ProductName:  thing.ProductName,
+				ProjectId:    filepath.Base(projectDir),
+				MediaType:    thing.MediaType,
+				VideoPath:    filepath.Join(projectDir, videoName),
+				MetadataPath: filepath.Join(projectDir, metadataName),
+			})
+		}
+	}
+
+	if err := tagRegistry.SetAll(entries); err != nil {
+		return fmt.Errorf("failed to update registry: %v", err)
+	}
+	return nil
+}
+
+// Arrange for a committed Thing to be deleted at its ExpiresAt. One that is
+// already past it is still deployed but expires straight away. A Thing
+// without an expiry cancels whatever was pending for an older copy.
+func scheduleExpiry(thing content.Thing, videoPath, metadataPath string) error {
+	if thing.ExpiresAt == nil {
+		return expirations.Cancel(videoPath)
+	}
+
+	e := expiry.Expiration{
+		VideoPath:    videoPath,
+		MetadataPath: metadataPath,
+		NfcTagId:     thing.NfcTagId,
+		ExpiresAt:    *thing.ExpiresAt,
+	}
+	if err := expirations.Schedule(e); err != nil {
+		return err
+	}
+	logger.Info("scheduled expiration", "product_id", thing.ProductId, "video", videoPath, "expires_at", e.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// Delete expired content and unmap its tag
+func expireContent(cfg *config.Config, e expiry.Expiration) {
+	logger.Info("expiring content", "video", e.VideoPath, "expires_at", e.ExpiresAt.Format(time.RFC3339))
+	for _, path := range []string{e.VideoPath, e.MetadataPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Error("failed to delete expired file", "path", path, "err", err)
+		}
+	}
+	if removed, err := tagRegistry.RemoveVideo(e.VideoPath); err != nil {
+		logger.Error("failed to update registry", "err", err)
+	} else if removed > 0 {
+		logger.Info("removed tag mappings", "count", removed, "video", e.VideoPath)
+	}
+	updateFilesOnDisk(cfg.StoragePath)
+	collectStoreGarbage(cfg.StoragePath)
+}
+
+// Remove staging directories left behind by deployments that were
+// interrupted before they could be committed or cleaned up. Those of failed
+// deployments waiting for a retry, and of scheduled ones, are kept.
+func cleanupStagingDirs(stagingPath, failedPath string) error {
+	dirs, err := os.ReadDir(stagingPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		path := filepath.Join(stagingPath, d.Name())
+		if deployment.HasFailed(failedPath, d.Name()) || scheduled.Has(d.Name()) {
+			// Still holds the Things a retry or activation will commit
+			continue
+		}
+		logger.Info("removing orphaned staging directory", "dir", path)
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wrapped in the DownloadError downloadMedia returns when the per-Thing
+// timeout runs out, as opposed to the server failing or the connection dropping
+var errDownloadTimeout = errors.New("download timed out")
+
+// Reports whether err is a client or network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Download url into finalPath+".partial" and rename it into place once the
+// download completes and the checksum matches. If a partial file is left over
+// from an interrupted attempt, only the remaining bytes are requested with a
+// Range header. A failed transfer keeps the partial file so the next attempt
+// can resume; a checksum mismatch deletes it. Returns the file's SHA-256 and
+// the Content-Type it was served with. Failures are an *apperr.DownloadError,
+// *apperr.ChecksumError or *apperr.FileWriteError; a transfer still running
+// after timeout wraps errDownloadTimeout. Cancelling ctx aborts the transfer
+// and deletes the partial file; only timeouts and dropped connections leave
+// one to resume from. Bytes received are also written to counter.
+func downloadMedia(ctx context.Context, url, finalPath, checksum string, timeout time.Duration, counter io.Writer) (string, string, error) {
+	partialPath := finalPath + partialSuffix
+
+	// Downloads cut short by a shutdown were set aside as incomplete
+	if _, err := os.Stat(partialPath); os.IsNotExist(err) {
+		os.Rename(finalPath+incompleteSuffix, partialPath)
+	}
+
+	var offset int64
+	if info, err := os.Stat(partialPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", "", &apperr.DownloadError{URL: url, Cause: err}
+	}
+	if offset > 0 {
+		logger.Info("resuming download", "url", url, "offset", offset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := outboundClient(timeout).Do(req)
+	if ctx.Err() != nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		os.Remove(partialPath)
+		return "", "", &apperr.DownloadError{URL: url, Cause: fmt.Errorf("download cancelled: %v", ctx.Err())}
+	}
+	if isTimeout(err) {
+		return "", "", &apperr.DownloadError{URL: url, Cause: fmt.Errorf("%w after %s waiting for a response", errDownloadTimeout, timeout)}
+	}
+	if err != nil {
+		return "", "", &apperr.DownloadError{URL: url, Cause: err}
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			logger.Info("server does not support range requests, restarting download", "url", url)
+			offset = 0
+		}
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file doesn't line up with the remote file any more
+		logger.Info("discarding stale partial file", "path", partialPath)
+		resp.Body.Close()
+		os.Remove(partialPath)
+		return downloadMedia(ctx, url, finalPath, checksum, timeout, counter)
+	default:
+		return "", "", &apperr.DownloadError{URL: url, StatusCode: resp.StatusCode}
+	}
+
+	// The checksum covers the whole file, including bytes from earlier attempts
+	hasher := sha256.New()
+	if offset > 0 {
+		if err := hashFile(partialPath, hasher); err != nil {
+			return "", "", err
+		}
+	}
+
+	out, err := os.OpenFile(partialPath, flags, 0644)
+	if err != nil {
+		return "", "", &apperr.FileWriteError{Path: partialPath, Cause: err}
+	}
+	_, copyErr := io.Copy(out, io.TeeReader(resp.Body, io.MultiWriter(hasher, counter)))
+	closeErr := out.Close()
+	if copyErr != nil && ctx.Err() != nil {
+		os.Remove(partialPath)
+		return "", "", &apperr.DownloadError{URL: url, Cause: fmt.Errorf("download cancelled: %v", ctx.Err())}
+	}
+	if isTimeout(copyErr) {
+		return "", "", &apperr.DownloadError{URL: url, Cause: fmt.Errorf("%w after %s reading the body (partial download kept for resume)", errDownloadTimeout, timeout)}
+	}
+	if copyErr != nil {
+		return "", "", &apperr.DownloadError{URL: url, Cause: fmt.Errorf("transfer interrupted (partial download kept for resume): %v", copyErr)}
+	}
+	if closeErr != nil {
+		return "", "", &apperr.FileWriteError{Path: partialPath, Cause: closeErr}
+	}
+
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	if err := content.VerifyChecksum(checksum, digest); err != nil {
+		os.Remove(partialPath)
+		return "", "", err
+	}
+
+	if err := os.Rename(partialPath, finalPath); err != nil {
+		return "", "", &apperr.FileWriteError{Path: finalPath, Cause: err}
+	}
+	return digest, resp.Header.Get("Content-Type"), nil
+}
+
+// Delete media in the project directories that no metadata refers to, then
+// drop the tag mappings and store copies that pointed at it. Staging and idle
+// videos are left alone.
+func collectContentGarbage(cfg *config.Config, log *slog.Logger) ([]string, int64, error) {
+	keep := []string{cfg.StagingPath, cfg.StorePath, cfg.IdleVideoPath}
+	for _, s := range cfg.Screens {
+		keep = append(keep, s.IdleVideoPath)
+	}
+
+	deleted, freed, err := content.GarbageCollect(cfg.StoragePath, keep...)
+	for _, path := range deleted {
+		log.Info("deleted orphaned media", "path", path)
+		if _, err := tagRegistry.RemoveVideo(path); err != nil {
+			log.Error("failed to update registry", "err", err)
+		}
+	}
+	if len(deleted) > 0 {
+		log.Info("content garbage collection finished", "deleted", len(deleted), "freed_bytes", freed)
+		collectStoreGarbage(cfg.StoragePath)
+		updateFilesOnDisk(cfg.StoragePath)
+	}
+	return deleted, freed, err
+}
+
+// Function to bring the stored content in line with a ContentManifest
+func handleSync(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var manifest ContentManifest
+		if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+			log.Warn("failed to decode content manifest", "err", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		for _, p := range manifest.Projects {
+			if p.ProjectId == "" || strings.Contains(p.ProjectId, "..") || strings.ContainsRune(p.ProjectId, filepath.Separator) {
+				http.Error(w, fmt.Sprintf("Invalid projectId %q", p.ProjectId), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !syncMu.TryLock() {
+			http.Error(w, "Sync already in progress", http.StatusConflict)
+			return
+		}
+		defer syncMu.Unlock()
+		// Counted as an upload so garbage collection waits for it
+		uploadsInFlight.Add(1)
+		defer uploadsInFlight.Add(-1)
+
+		if !checkFreeSpace(cfg, log, w) {
+			return
+		}
+
+		report := syncContent(r.Context(), cfg, log, manifest)
+		w.Header().Set("Content-Type", "application/json")
+		if len(report.Errors) > 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// Download the manifest's Things that are missing or whose checksum changed,
+// delete stored Things the manifest no longer lists, then rebuild the tag
+// registry from what is on disk in a single write. A Thing that fails to
+// download keeps whatever version was stored before.
+func syncContent(ctx context.Context, cfg *config.Config, log *slog.Logger, manifest ContentManifest) SyncReport {
+	report := SyncReport{Added: []string{}, Deleted: []string{}, Errors: []string{}}
+	syncId := fmt.Sprintf("sync-%d", time.Now().Unix())
+
+	// Skipping a bad project would delete its content as no longer wanted,
+	// so nothing is synced until the whole manifest is usable
+	for _, p := range manifest.Projects {
+		if _, err := projectDirFor(cfg.StoragePath, p.ProjectId); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	if len(report.Errors) > 0 {
+		return report
+	}
+
+	projects, err := content.ScanDirectory(cfg.StoragePath)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to scan content directory: %v", err))
+		return report
+	}
+	stored := make(map[string]map[string]content.ThingStatus)
+	for _, p := range projects {
+		stored[p.ProjectId] = make(map[string]content.ThingStatus)
+		for _, t := range p.Things {
+			if t.MetadataPresent {
+				stored[p.ProjectId][t.ProductId] = t
+			}
+		}
+	}
+
+	// Work out what each project is missing before downloading anything, so
+	// the progress covers the whole sync
+	wanted := make(map[string]map[string]bool)
+	fetch := make(map[string][]content.Thing)
+	total := 0
+	for _, p := range manifest.Projects {
+		if wanted[p.ProjectId] == nil {
+			wanted[p.ProjectId] = make(map[string]bool)
+		}
+		for _, thing := range p.Things {
+			wanted[p.ProjectId][thing.ProductId] = true
+			if current, ok := stored[p.ProjectId][thing.ProductId]; ok && current.VideoPresent && !checksumChanged(current.MetadataPath, thing.Checksum) {
+				report.Unchanged++
+				continue
+			}
+			thing.ProjectId = p.ProjectId
+			fetch[p.ProjectId] = append(fetch[p.ProjectId], thing)
+			total++
+		}
+	}
+
+	tracked := progress.Start(syncId, total, 0)
+	for projectId, things := range fetch {
+		stagingDir := filepath.Join(cfg.StagingPath, syncId, projectId)
+		if err := os.MkdirAll(stagingDir, 0755); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to create staging directory for %s: %v", projectId, err))
+			continue
+		}
+		staged, failed := stageThings(ctx, cfg, log, syncId, stagingDir, things, tracked)
+		for _, ft := range failed {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to process %s/%s: %s", projectId, ft.Thing.ProductId, ft.Error))
+		}
+		if len(staged) > 0 {
+			if err := commitDeployment(cfg, syncId, projectId, stagingDir, staged); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to commit %s: %v", projectId, err))
+			} else {
+				for _, t := range staged {
+					report.Added = append(report.Added, projectId+"/"+t.ProductId)
+				}
+			}
+		}
+	}
+	os.RemoveAll(filepath.Join(cfg.StagingPath, syncId))
+
+	for projectId, things := range stored {
+		for productId, t := range things {
+			if wanted[projectId][productId] {
+				continue
+			}
+			log.Info("deleting Thing not in manifest", "project_id", projectId, "product_id", productId)
+			if err := removeStoredThing(t); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to delete %s/%s: %v", projectId, productId, err))
+				continue
+			}
+			report.Deleted = append(report.Deleted, projectId+"/"+productId)
+		}
+		if projectId != "" && len(wanted[projectId]) == 0 {
+			// Only succeeds once the project directory is empty
+			os.Remove(filepath.Join(cfg.StoragePath, projectId))
+		}
+	}
+
+	// Media replaced by a different format is only orphaned now. Skipped
+	// while another upload could be halfway through moving files into place.
+	if uploadsInFlight.Load() == 1 {
+		if _, _, err := collectContentGarbage(cfg, log); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to remove orphaned media: %v", err))
+		}
+	}
+	if err := tagRegistry.Rebuild(cfg.StoragePath); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	updateFilesOnDisk(cfg.StoragePath)
+
+	status := deployment.StatusSuccess
+	if len(report.Errors) > 0 {
+		status = deployment.StatusPartialSuccess
+	}
+	progress.Finish(syncId, status)
+	log.Info("sync finished", "added", len(report.Added), "deleted", len(report.Deleted), "unchanged", report.Unchanged, "errors", len(report.Errors))
+	return report
+}
+
+// Whether a manifest checksum differs from the one in a stored Thing's
+// metadata. Without a checksum to compare, the stored copy is kept.
+func checksumChanged(metadataPath, checksum string) bool {
+	if checksum == "" {
+		return false
+	}
+	thing, err := content.ReadThing(metadataPath)
+	if err != nil {
+		return true
+	}
+	return !strings.EqualFold(thing.Checksum, checksum)
+}
+
+// Delete a stored Thing's media and metadata and forget its expiry
+func removeStoredThing(t content.ThingStatus) error {
+	if t.LocalVideoPath != "" {
+		if err := os.Remove(t.LocalVideoPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := expirations.Cancel(t.LocalVideoPath); err != nil {
+			logger.Warn("failed to cancel expiration", "video", t.LocalVideoPath, "err", err)
+		}
+	}
+	if err := os.Remove(t.MetadataPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Body of POST /things/{productId}/assign-tag
+type AssignTagRequest struct {
+	NfcTagId string `json:"nfcTagId"`
+}
+
+// Point a stored Thing at a new NFC tag, e.g. after its sticker was
+// replaced, without redeploying it. The Thing's metadata and the registry
+// are both updated; lift_learn picks the change up from the registry file.
+func handleAssignTag(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		productId, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/things/"), "/"), "/")
+		if productId == "" || action != "assign-tag" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req AssignTagRequest
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBodyBytes)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NfcTagId == "" {
+			http.Error(w, "Invalid request body, nfcTagId is required", http.StatusBadRequest)
+			return
+		}
+		// Match the registry's key so another spelling of the same tag
+		// conflicts instead of adding a second mapping
+		req.NfcTagId = registry.NormalizeUID(req.NfcTagId)
+		if req.NfcTagId == "" {
+			http.Error(w, "Invalid nfcTagId", http.StatusBadRequest)
+			return
+		}
+
+		found, projectId, ok := findStoredThing(cfg.StoragePath, productId)
+		if !ok {
+			http.Error(w, "Unknown product", http.StatusNotFound)
+			return
+		}
+		change := tagChange{
+			thing:    storedThing{ThingStatus: found, ProjectId: projectId},
+			oldTagId: found.NfcTagId,
+			newTagId: req.NfcTagId,
+		}
+		oldTagId := change.oldTagId
+
+		// Checked and written under the registry's lock, so two calls can't
+		// both claim the same tag
+		var mappedTo string
+		written := false
+		err := tagRegistry.Update(func(entries map[string]registry.Entry) error {
+			if e, mapped := entries[req.NfcTagId]; mapped && e.ProductId != productId {
+				mappedTo = e.ProductId
+				return errTagMapped
+			}
+			// Metadata goes first so a failed write leaves the registry as it was
+			if err := writeTagChanges([]tagChange{change}); err != nil {
+				return err
+			}
+			written = true
+			if e, ok := entries[registry.NormalizeUID(oldTagId)]; ok && e.ProductId == productId {
+				delete(entries, registry.NormalizeUID(oldTagId))
+			}
+			entries[req.NfcTagId] = registry.Entry{
+				NfcTagId:     req.NfcTagId,
+				ProductId:    productId,
+				ProductName:  found.ProductName,
+				ProjectId:    projectId,
+				MediaType:    found.MediaType,
+				VideoPath:    found.LocalVideoPath,
+				MetadataPath: found.MetadataPath,
+			}
+			return nil
+		})
+		switch {
+		case errors.Is(err, errTagMapped):
+			http.Error(w, fmt.Sprintf("Tag %s is already mapped to product %s", req.NfcTagId, mappedTo), http.StatusConflict)
+			return
+		case err != nil:
+			log.Error("failed to assign tag", "product_id", productId, "err", err)
+			// The registry wasn't saved, so the metadata goes back to match it
+			if written {
+				if err := writeTagChanges([]tagChange{{thing: change.thing, oldTagId: req.NfcTagId, newTagId: oldTagId}}); err != nil {
+					log.Error("failed to restore metadata", "path", found.MetadataPath, "err", err)
+				}
+			}
+			http.Error(w, "Failed to assign tag", http.StatusInternalServerError)
+			return
+		}
+		log.Info("assigned tag", "product_id", productId, "project_id", projectId, "old_nfc_tag_id", oldTagId, "nfc_tag_id", req.NfcTagId)
+		updateFilesOnDisk(cfg.StoragePath)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"productId":   productId,
+			"projectId":   projectId,
+			"oldNfcTagId": oldTagId,
+			"nfcTagId":    req.NfcTagId,
+		})
+	}
+}
+
+// The stored Thing with metadata for productId and the project it is in
+func findStoredThing(storagePath, productId string) (content.ThingStatus, string, bool) {
+	t, ok := storedThings(storagePath)[productId]
+	return t.ThingStatus, t.ProjectId, ok
+}
+
+// A Thing on disk together with the project holding it
+type storedThing struct {
+	content.ThingStatus
+	ProjectId string
+}
+
+// Every stored Thing with metadata, by productId. Projects are searched in
+// name order, so the first one holding a product wins when several do.
+func storedThings(storagePath string) map[string]storedThing {
+	projects, err := content.ScanDirectory(storagePath)
+	if err != nil {
+		logger.Warn("failed to scan content directory", "err", err)
+		return nil
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].ProjectId < projects[j].ProjectId })
+
+	things := make(map[string]storedThing)
+	for _, p := range projects {
+		for _, t := range p.Things {
+			if _, seen := things[t.ProductId]; !seen && t.MetadataPresent {
+				things[t.ProductId] = storedThing{ThingStatus: t, ProjectId: p.ProjectId}
+			}
+		}
+	}
+	return things
+}
+
+// Body of PATCH /tag-mappings
+type TagMappingsRequest struct {
+	Mappings []TagMapping `json:"mappings"`
+}
+
+// One tag assignment in a TagMappingsRequest
+type TagMapping struct {
+	NfcTagId  string `json:"nfcTagId"`
+	ProductId string `json:"productId"`
+}
+
+// Why one entry of a TagMappingsRequest was refused
+type TagMappingError struct {
+	Index     int    `json:"index"`
+	NfcTagId  string `json:"nfcTagId"`
+	ProductId string `json:"productId"`
+	Error     string `json:"error"`
+}
+
+// Assign tags to many stored Things at once, e.g. when setting up a store.
+// The batch is checked as a whole against the registry and applied only if
+// every entry is valid; otherwise nothing changes and each problem is
+// listed against its entry.
+func handleTagMappings(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		if r.Method != http.MethodPatch {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req TagMappingsRequest
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBodyBytes)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Mappings) == 0 {
+			http.Error(w, "Invalid request body, mappings is required", http.StatusBadRequest)
+			return
+		}
+
+		things := storedThings(cfg.StoragePath)
+		var changes []tagChange
+		var problems []TagMappingError
+		unchanged := 0
+		err := tagRegistry.Update(func(entries map[string]registry.Entry) error {
+			changes, problems, unchanged = planTagMappings(req.Mappings, things, entries)
+			if len(problems) > 0 {
+				return errTagMappingsInvalid
+			}
+			// Metadata goes first so a failed write leaves the registry as it was
+			if err := writeTagChanges(changes); err != nil {
+				return err
+			}
+			for _, c := range changes {
+				oldTagId := registry.NormalizeUID(c.oldTagId)
+				if e, ok := entries[oldTagId]; ok && e.ProductId == c.thing.ProductId {
+					delete(entries, oldTagId)
+				}
+			}
+			for _, c := range changes {
+				entries[c.newTagId] = registry.Entry{
+					NfcTagId:     c.newTagId,
+					ProductId:    c.thing.ProductId,
+					ProductName:  c.thing.ProductName,
+					ProjectId:    c.thing.ProjectId,
+					MediaType:    c.thing.MediaType,
+					VideoPath:    c.thing.LocalVideoPath,
+					MetadataPath: c.thing.MetadataPath,
+				}
+			}
+			return nil
+		})
+		switch {
+		case errors.Is(err, errTagMappingsInvalid):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "invalid",
+				"errors": problems,
+			})
+			return
+		case err != nil:
+			log.Error("failed to update tag mappings", "err", err)
+			http.Error(w, "Failed to update tag mappings", http.StatusInternalServerError)
+			return
+		}
+		log.Info("updated tag mappings", "updated", len(changes), "unchanged", unchanged)
+		if len(changes) > 0 {
+			updateFilesOnDisk(cfg.StoragePath)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{
+			"updated":   len(changes),
+			"unchanged": unchanged,
+		})
+	}
+}
+
+var (
+	errTagMappingsInvalid = errors.New("invalid tag mappings")
+	errTagMapped          = errors.New("tag already mapped")
+)
+
+// A stored Thing moving from one tag to another
+type tagChange struct {
+	thing    storedThing
+	oldTagId string
+	newTagId string
+}
+
+// Work out what a batch of mappings would change given the stored Things and
+// the current registry entries, or why it can't be applied. A tag mapped to
+// another product may only be claimed when that product is given a different
+// tag in the same batch. Tags are compared by their normalized UID, the form
+// the registry keys them by.
+func planTagMappings(mappings []TagMapping, things map[string]storedThing, entries map[string]registry.Entry) (changes []tagChange, problems []TagMappingError, unchanged int) {
+	refuse := func(i int, m TagMapping, format string, args ...interface{}) {
+		problems = append(problems, TagMappingError{Index: i, NfcTagId: m.NfcTagId, ProductId: m.ProductId, Error: fmt.Sprintf(format, args...)})
+	}
+
+	normalized := make([]TagMapping, len(mappings))
+	for i, m := range mappings {
+		m.NfcTagId = registry.NormalizeUID(m.NfcTagId)
+		normalized[i] = m
+	}
+	mappings = normalized
+
+	tagUsedBy := make(map[string]int)
+	productUsedBy := make(map[string]int)
+	for i, m := range mappings {
+		if m.NfcTagId == "" || m.ProductId == "" {
+			refuse(i, m, "nfcTagId and productId are required")
+			continue
+		}
+		if j, dup := tagUsedBy[m.NfcTagId]; dup {
+			refuse(i, m, "nfcTagId is also used by mappings[%d]", j)
+		} else {
+			tagUsedBy[m.NfcTagId] = i
+		}
+		if j, dup := productUsedBy[m.ProductId]; dup {
+			refuse(i, m, "productId is also used by mappings[%d]", j)
+		} else {
+			productUsedBy[m.ProductId] = i
+		}
+	}
+
+	for i, m := range mappings {
+		if m.NfcTagId == "" || m.ProductId == "" {
+			continue
+		}
+		thing, ok := things[m.ProductId]
+		if !ok {
+			refuse(i, m, "unknown product")
+			continue
+		}
+		if e, mapped := entries[m.NfcTagId]; mapped && e.ProductId != m.ProductId {
+			if j, moving := productUsedBy[e.ProductId]; !moving || mappings[j].NfcTagId == m.NfcTagId {
+				refuse(i, m, "nfcTagId is already mapped to product %s", e.ProductId)
+				continue
+			}
+		}
+		if registry.NormalizeUID(thing.NfcTagId) == m.NfcTagId {
+			unchanged++
+			continue
+		}
+		changes = append(changes, tagChange{thing: thing, oldTagId: thing.NfcTagId, newTagId: m.NfcTagId})
+	}
+	return changes, problems, unchanged
+}
+
+// Rewrite the metadata of every changed Thing with its new tag. On failure
+// the files already rewritten get their old tag back.
+func writeTagChanges(changes []tagChange) error {
+	setTag := func(path, tagId string) error {
+		thing, err := content.ReadThing(path)
+		if err != nil {
+			return err
+		}
+		thing.NfcTagId = tagId
+		return atomicfile.Write(path, 0644, func(f *os.File) error {
+			return json.NewEncoder(f).Encode(thing)
+		})
+	}
+
+	for i, c := range changes {
+		if err := setTag(c.thing.MetadataPath, c.newTagId); err != nil {
+			for _, done := range changes[:i] {
+				if err := setTag(done.thing.MetadataPath, done.oldTagId); err != nil {
+					logger.Error("failed to restore metadata", "path", done.thing.MetadataPath, "err", err)
+				}
+			}
+			return fmt.Errorf("failed to write metadata %s: %v", c.thing.MetadataPath, err)
+		}
+	}
+	return nil
+}
+
+// Re-hash stored media every IntegrityCheckIntervalHours until ctx is
+// cancelled. A check due while a deployment is running waits for the next.
+func runIntegrityChecks(ctx context.Context, cfg *config.Config) {
+	ticker := time.NewTicker(time.Duration(cfg.IntegrityCheckIntervalHours) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if uploadsInFlight.Load() > 0 {
+			logger.Info("deployment in progress, skipping integrity check")
+			continue
+		}
+		result, err := integrityChecker.Check()
+		if err != nil {
+			logger.Error("integrity check failed", "err", err)
+			continue
+		}
+		logger.Info("integrity check complete", "checked", result.Checked, "corrupt", len(result.Corrupt), "repaired", len(result.Repaired))
+	}
+}
+
+// Replace a corrupt media file with a fresh download of thing's mediaUrl.
+// The content store copy is dropped first, as it may be the same file.
+func redownloadMedia(ctx context.Context, cfg *config.Config, thing content.Thing, mediaPath string) error {
+	if err := contentStore.Remove(thing.Checksum); err != nil {
+		logger.Warn("failed to drop stored copy of corrupt media", "checksum", thing.Checksum, "err", err)
+	}
+	timeout := time.Duration(cfg.PerThingDownloadTimeoutSeconds) * time.Second
+	digest, _, err := downloadMedia(ctx, thing.MediaUrl, mediaPath, thing.Checksum, timeout, io.Discard)
+	if err != nil {
+		return err
+	}
+	if err := contentStore.Add(mediaPath, digest); err != nil {
+		logger.Warn("failed to add media to content store", "path", mediaPath, "err", err)
+	}
+	return nil
+}
+
+// Run an integrity check now and report what it found
+func handleIntegrityCheck(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Media being committed can't be told apart from corrupt media
+		if uploadsInFlight.Load() > 0 {
+			http.Error(w, "Deployment in progress, try again later", http.StatusConflict)
+			return
+		}
+
+		result, err := integrityChecker.Check()
+		if errors.Is(err, integrity.ErrRunning) {
+			http.Error(w, "Integrity check already running", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Error("integrity check failed", "err", err)
+			http.Error(w, "Integrity check failed", http.StatusInternalServerError)
+			return
+		}
+		log.Info("integrity check complete", "checked", result.Checked, "corrupt", len(result.Corrupt), "repaired", len(result.Repaired))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// Function to run content garbage collection on demand
+func handleGC(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// A deployment being committed has media in place before its metadata
+		if uploadsInFlight.Load() > 0 {
+			http.Error(w, "Deployment in progress, try again later", http.StatusConflict)
+			return
+		}
+
+		deleted, freed, err := collectContentGarbage(cfg, log)
+		if err != nil {
+			log.Error("content garbage collection failed", "err", err)
+			http.Error(w, "Garbage collection failed", http.StatusInternalServerError)
+			return
+		}
+		if deleted == nil {
+			deleted = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"deleted_files": deleted,
+			"freed_bytes":   freed,
+		})
+	}
+}
+
+// Body of POST /update
+type UpdateRequest struct {
+	BinaryUrl string `json:"binaryUrl"`
+	Sha256    string `json:"sha256"`
+}
+
+// Replace the upload server binary with the build at BinaryUrl and restart
+// into it. The response is sent before the restart, so a client only sees a
+// failure when nothing was replaced.
+func handleUpdate(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req UpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if req.BinaryUrl == "" {
+			http.Error(w, "binaryUrl is required", http.StatusBadRequest)
+			return
+		}
+		if sum, err := hex.DecodeString(req.Sha256); err != nil || len(sum) != sha256.Size {
+			http.Error(w, "sha256 must be a hex SHA-256 digest", http.StatusBadRequest)
+			return
+		}
+		// The restart would cut running downloads short
+		if uploadsInFlight.Load() > 0 {
+			http.Error(w, "Deployment in progress, try again later", http.StatusConflict)
+			return
+		}
+
+		updater := &selfupdate.Updater{
+			Client: outboundClient(time.Duration(cfg.PerThingDownloadTimeoutSeconds) * time.Second),
+			Backup: cfg.BackupBinary,
+		}
+		path, err := updater.Install(req.BinaryUrl, req.Sha256)
+		if err != nil {
+			log.Error("binary update failed", "url", req.BinaryUrl, "err", err)
+			http.Error(w, "Update failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Info("installed new binary, restarting", "path", path, "sha256", req.Sha256)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "restarting", "sha256": req.Sha256})
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		go func() {
+			// Let the response reach the client before the process is replaced
+			time.Sleep(time.Second)
+			if err := selfupdate.Restart(path); err != nil {
+				logger.Error("failed to restart into new binary", "err", err)
+			}
+		}()
+	}
+}
+
+// Reboot modes accepted by POST /reboot
+const (
+	rebootProcess = "process"
+	rebootSystem  = "system"
+)
+
+// Body of POST /reboot
+type RebootRequest struct {
+	Mode string `json:"mode"`
+}
+
+// Message on the AWS IoT command topic. Action names the endpoint to call
+// ("sync", "integrity-check", "update", "gc" or "reboot") and Body is what
+// it would be POSTed.
+type IoTCommand struct {
+	Action string          `json:"action"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Connect to AWS IoT Core and serve each message in the background with
+// ctx, the context HTTP requests are served with
+func connectAWSIoT(ctx context.Context, cfg *config.Config, upload http.Handler, commands map[string]http.Handler) (*mqtt.IoTClient, error) {
+	onDeploy := func(payload []byte) {
+		go serveIoTMessage(ctx, upload, "/receive-content", payload)
+	}
+	onCommand := func(payload []byte) {
+		var cmd IoTCommand
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			logger.Warn("ignoring malformed AWS IoT command", "err", err)
+			return
+		}
+		handler, ok := commands[cmd.Action]
+		if !ok {
+			logger.Warn("ignoring unknown AWS IoT command", "action", cmd.Action)
+			return
+		}
+		go serveIoTMessage(ctx, handler, "/"+cmd.Action, cmd.Body)
+	}
+	return mqtt.ConnectAWSIoT(cfg.AWSIoT, cfg.DeviceID, logger, onDeploy, onCommand)
+}
+
+// Hand payload to handler as a POST to path, so it is processed exactly as
+// if it had arrived over HTTP, and log the response it wrote
+func serveIoTMessage(ctx context.Context, handler http.Handler, path string, payload []byte) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(payload))
+	if err != nil {
+		logger.Error("failed to build request for AWS IoT message", "path", path, "err", err)
+		return
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = "aws-iot"
+	rec := middleware.NewResponseRecorder()
+	middleware.LoggingMiddleware(logger)(middleware.RecoverMiddleware(logger, handler)).ServeHTTP(rec, r)
+
+	level := slog.LevelInfo
+	if rec.Status >= http.StatusBadRequest {
+		level = slog.LevelWarn
+	}
+	logger.Log(ctx, level, "handled AWS IoT message", "path", path, "status", rec.Status, "response", strings.TrimSpace(rec.Body.String()))
+}
+
+// Restart the upload server in place, or reboot the whole device. As with
+// /update the response is sent first, so the client hears back either way.
+func handleReboot(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := middleware.RequestLogger(r, logger)
+		// Every call is logged, including those refused below
+		log.Info("reboot requested", "method", r.Method, "remote_ip", middleware.ClientIP(r), "at", time.Now().UTC().Format(time.RFC3339))
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req RebootRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if req.Mode != rebootProcess && req.Mode != rebootSystem {
+			http.Error(w, `mode must be "process" or "system"`, http.StatusBadRequest)
+			return
+		}
+		// Either restart would cut running downloads short
+		if uploadsInFlight.Load() > 0 {
+			http.Error(w, "Deployment in progress, try again later", http.StatusConflict)
+			return
+		}
+
+		var exe string
+		if req.Mode == rebootProcess {
+			var err error
+			if exe, err = os.Executable(); err != nil {
+				log.Error("failed to find own executable", "err", err)
+				http.Error(w, "Restart failed", http.StatusInternalServerError)
+				return
+			}
+			if err := saveServerState(cfg); err != nil {
+				log.Error("failed to save state before restart", "err", err)
+				http.Error(w, "Failed to save state", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		log.Info("rebooting", "mode", req.Mode)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "rebooting", "mode": req.Mode})
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		go func() {
+			// Let the response reach the client before going down
+			time.Sleep(time.Second)
+			if req.Mode == rebootSystem {
+				if out, err := exec.Command("sudo", "reboot").CombinedOutput(); err != nil {
+					logger.Error("system reboot failed", "err", err, "output", strings.TrimSpace(string(out)))
+				}
+				return
+			}
+			if err := selfupdate.Restart(exe); err != nil {
+				logger.Error("failed to restart", "err", err)
+			}
+		}()
+	}
+}
+
+// Persist what only lives in memory, so a restarted process picks up where
+// this one left off. Deployments, the registry and the retry queue are
+// already saved on every change; the registration is the one thing left.
+func saveServerState(cfg *config.Config) error {
+	serverState.mu.RLock()
+	st := PersistedState{RegisteredURL: serverState.registeredURL, RegisteredAt: serverState.lastRegistration}
+	serverState.mu.RUnlock()
+	if st.RegisteredURL == "" {
+		return nil
+	}
+	return savePersistedState(cfg.StateFile, st)
+}
+
+// Delete stored videos that no Thing's metadata refers to any more
+func collectStoreGarbage(storagePath string) {
+	referenced, err := content.Checksums(storagePath)
+	if err != nil {
+		logger.Warn("failed to collect content checksums", "err", err)
+		return
+	}
+	removed, err := contentStore.GC(referenced)
+	if err != nil {
+		logger.Warn("failed to clean up content store", "err", err)
+	}
+	if removed > 0 {
+		logger.Info("removed unreferenced videos from content store", "count", removed)
+	}
+}
+
+// Feed the contents of an existing file into h
+func hashFile(path string, h io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, bufio.NewReader(f)); err != nil {
+		return fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+	return nil
+}
+
+// Start the server and registration process
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate-deployment":
+			runValidateDeployment(os.Args[2:])
+			return
+		case "fix-json":
+			runFixJSON(os.Args[2:])
+			return
+		case "register":
+			runRegister(os.Args[2:])
+			return
+		case "deregister":
+			runDeregister(os.Args[2:])
+			return
+		case "discover":
+			runDiscover(os.Args[2:])
+			return
+		case "show-public-key":
+			runShowPublicKey(os.Args[2:])
+			return
+		}
+	}
+
+	configPath := flag.String("config", config.DefaultPath, "path to the YAML config file")
+	clearDeployments := flag.Bool("clear-deployments", false, "forget all processed deployments on startup")
+	rebuildRegistry := flag.Bool("rebuild-registry", false, "rebuild the tag registry from stored metadata on startup")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	enablePprof := flag.Bool("enable-pprof", false, "serve runtime profiles on localhost:<pprof_port>")
+	checkConfig := flag.Bool("check-config", false, "validate the config file and the files it points to, then exit")
+	provisionKey := flag.Bool("provision", false, "generate a new device keypair before registering, replacing any existing one")
+	port := flag.Int("port", 0, "port to listen on, overriding http_port (3000 by default)")
+	noReboot := flag.Bool("no-reboot-endpoint", false, "don't serve POST /reboot")
+	logOpts := logging.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("upload_server %s (built %s)\n", Version, BuildTime)
+		return
+	}
+	if *checkConfig {
+		runCheckConfig(*configPath)
+		return
+	}
+
+	var err error
+	logger, err = logOpts.Logger()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	cfg := loadConfig(*configPath)
+	if cfg.LogLevel != "" {
+		if err := logging.SetLevel(cfg.LogLevel); err != nil {
+			fatal("invalid log_level", "err", err)
+		}
+	}
+	if *port != 0 {
+		if *port < 0 || *port > 65535 {
+			fatal("invalid --port", "port", *port)
+		}
+		cfg.HTTPPort = *port
+	}
+	newKey, err := provisionDevice(cfg, *provisionKey)
+	if err != nil {
+		fatal("device provisioning failed", "err", err)
+	}
+
+	deployments, err = deployment.Load(cfg.DeploymentsFile)
+	if err != nil {
+		fatal("failed to load deployment state", "err", err)
+	}
+	if *clearDeployments {
+		logger.Info("clearing deployment state", "path", cfg.DeploymentsFile)
+		if err := deployments.Clear(); err != nil {
+			fatal("failed to clear deployment state", "err", err)
+		}
+	}
+
+	tagRegistry, err = registry.Load(cfg.RegistryFile)
+	if err != nil {
+		fatal("failed to load registry", "err", err)
+	}
+	if *rebuildRegistry {
+		logger.Info("rebuilding registry", "path", cfg.RegistryFile, "storage", cfg.StoragePath)
+		if err := tagRegistry.Rebuild(cfg.StoragePath); err != nil {
+			fatal("failed to rebuild registry", "err", err)
+		}
+	}
+
+	banner = buildinfo.NewBanner(Version, BuildTime, cfg.DeviceID, cfg.StoragePath, nil, len(tagRegistry.Entries()))
+	banner.Print(os.Stdout, "upload_server")
+
+	snapshots, err = snapshot.Load(cfg.SnapshotsFile, cfg.MaxSnapshots)
+	if err != nil {
+		fatal("failed to load snapshots", "err", err)
+	}
+
+	contentStore, err = store.New(cfg.StorePath)
+	if err != nil {
+		fatal("failed to open content store", "err", err)
+	}
+
+	integrityChecker, err = integrity.Load(cfg.CorruptFile, cfg.StoragePath, logger)
+	if err != nil {
+		fatal("failed to load corrupt file index", "err", err)
+	}
+	integrityChecker.Redownload = func(thing content.Thing, mediaPath string) error {
+		return redownloadMedia(context.Background(), cfg, thing, mediaPath)
+	}
+
+	expirations, err = expiry.Load(cfg.ExpirationsFile, func(e expiry.Expiration) { expireContent(cfg, e) })
+	if err != nil {
+		fatal("failed to load expirations", "err", err)
+	}
+	for _, e := range expirations.Pending() {
+		logger.Info("rescheduled expiration", "video", e.VideoPath, "expires_at", e.ExpiresAt.Format(time.RFC3339))
+	}
+
+	scheduled, err = deployment.LoadScheduler(cfg.ScheduledFile, func(d deployment.Scheduled) { activateScheduled(cfg, d) })
+	if err != nil {
+		fatal("failed to load scheduled deployments", "err", err)
+	}
+	for _, d := range scheduled.Pending() {
+		logger.Info("rescheduled deployment", "deployment_id", d.DeploymentId, "active_at", d.ActiveAt.Format(time.RFC3339))
+	}
+
+	retryQueue, err = deployment.NewQueue(cfg.RetryQueuePath)
+	if err != nil {
+		fatal("failed to open retry queue", "err", err)
+	}
+
+	// SIGINT/SIGTERM stop accepting uploads and let in-flight downloads finish
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go runRetryQueue(ctx, cfg)
+	go runIntegrityChecks(ctx, cfg)
+	if cfg.HeartbeatEndpoint != "" {
+		go runHeartbeat(ctx, cfg)
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.OTLPEndpoint, "upload_server", Version, cfg.DeviceID)
+	if err != nil {
+		logger.Warn("tracing disabled", "err", err)
+	} else {
+		defer func() {
+			// ctx is already cancelled by the time this runs
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(flushCtx); err != nil {
+				logger.Warn("failed to flush traces", "err", err)
+			}
+		}()
+	}
+
+	// Lets the device be found on the LAN without going through the tunnel
+	if err := discovery.Announce(ctx, cfg.DeviceID, Version, apiVersion, cfg.HTTPPort); err != nil {
+		logger.Warn("mDNS announcement disabled", "err", err)
+	} else {
+		logger.Info("announcing over mDNS", "service", discovery.ServiceType, "device_id", cfg.DeviceID)
+	}
+
+	tunneler, err := newTunneler(cfg)
+	if err != nil {
+		fatal("failed to set up tunnel", "err", err)
+	}
+	if err := tunneler.Start(ctx); err != nil {
+		// The tunnel may already be running, e.g. started by run_all.sh
+		logger.Warn("failed to start tunnel", "err", err)
+	}
+
+	// Registration runs alongside the server so a saved URL can be checked
+	// end-to-end through the tunnel
+	probeCapabilities(cfg)
+	go func() {
+		time.Sleep(5 * time.Second) // Wait for the tunnel to start
+		if err := ensureRegistered(ctx, cfg, tunneler, newKey); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fatal("device registration failed", "err", err)
+		}
+		watchTunnelURL(ctx, cfg, tunneler)
+	}()
+
+	startServer(ctx, cfg, *configPath, *enablePprof, !*noReboot)
+}
+
+// Shared client for every outbound request, retrying transient failures and
+// trusting any CA bundle from the config. Replaced once main has loaded it.
+var outboundHTTP = &http.Client{}
+
+// Copy of outboundHTTP with its own timeout, which covers the retries too;
+// 0 means no timeout
+func outboundClient(timeout time.Duration) *http.Client {
+	client := *outboundHTTP
+	client.Timeout = timeout
+	return &client
+}
+
+// TLS settings that verify client certificates against the CAs in caFile.
+// Certificates are optional at the handshake so /health and the rest keep
+// working without one; /receive-content rejects requests that had none.
+func clientCATLSConfig(caFile string) (*tls.Config, error) {
+	bundle, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+// Log msg at error level and exit, the slog counterpart of log.Fatal
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Serve until ctx is cancelled, then shut down gracefully: stop accepting
+// connections and give in-flight uploads up to ShutdownTimeoutSeconds to
+// finish their downloads, cancelling those still running after that
+func startServer(ctx context.Context, cfg *config.Config, configPath string, enablePprof, enableReboot bool) {
+	if err := os.MkdirAll(cfg.StoragePath, 0755); err != nil {
+		fatal("failed to create storage directory", "err", err)
+	}
+
+	if err := cleanupStagingDirs(cfg.StagingPath, cfg.FailedPath); err != nil {
+		logger.Warn("failed to clean up staging directories", "err", err)
+	}
+	if cfg.RunGCOnStartup {
+		if _, _, err := collectContentGarbage(cfg, logger); err != nil {
+			logger.Warn("content garbage collection failed", "err", err)
+		}
+	}
+	collectStoreGarbage(cfg.StoragePath)
+
+	downloadSlots = slots.NewPool(cfg.MaxConcurrentDownloads)
+	go monitorDiskSpace(ctx, cfg.StoragePath)
+
+	limiter := middleware.NewRateLimiter(cfg.RateLimitRequestsPerMinute, cfg.RateLimitBurst,
+		time.Duration(cfg.RateLimitTTLMinutes)*time.Minute)
+
+	// Only the settings below follow the file; the rest need a restart
+	watcher := config.NewConfigWatcher(configPath, cfg, logger, func(next *config.Config) {
+		downloadSlots.Resize(next.MaxConcurrentDownloads)
+		limiter.SetLimit(next.RateLimitRequestsPerMinute)
+		if err := logging.SetLevel(next.LogLevel); err != nil {
+			logger.Warn("ignoring log_level", "err", err)
+		}
+	})
+	go func() {
+		if err := watcher.Run(ctx); err != nil && ctx.Err() == nil {
+			logger.Warn("config hot-reload disabled", "err", err)
+		}
+	}()
+
+	updateFilesOnDisk(cfg.StoragePath)
+
+	upload := middleware.RequireAPIKey(cfg.APIKey, handleUpload(cfg))
+	if cfg.ClientCAFile != "" {
+		upload = middleware.RequireClientCert(upload)
+	}
+	http.Handle("/receive-content", withoutWriteTimeout(countUploads(limiter.Middleware(upload))))
+	http.Handle("/deployments/", withoutWriteTimeout(limiter.Middleware(middleware.RequireAPIKey(cfg.APIKey, handleDeployments(cfg)))))
+	http.HandleFunc("/health", handleHealth(cfg))
+	http.HandleFunc("/content", handleContent(cfg))
+	http.Handle("/tag-mappings", limiter.Middleware(middleware.RequireAPIKey(cfg.APIKey, handleTagMappings(cfg))))
+	http.Handle("/things/", limiter.Middleware(middleware.RequireAPIKey(cfg.APIKey, handleAssignTag(cfg))))
+	http.Handle("/gc", limiter.Middleware(middleware.RequireAPIKey(cfg.APIKey, handleGC(cfg))))
+	http.Handle("/integrity-check", withoutWriteTimeout(limiter.Middleware(middleware.RequireAPIKey(cfg.APIKey, handleIntegrityCheck(cfg)))))
+	// Installing a binary from a URL runs whatever the caller points it at,
+	// so the endpoint only exists behind a configured key
+	enableUpdate := cfg.APIKey != ""
+	if enableUpdate {
+		http.Handle("/update", withoutWriteTimeout(limiter.Middleware(middleware.RequireAPIKey(cfg.APIKey, handleUpdate(cfg)))))
+	} else {
+		logger.Warn("update endpoint disabled, set api_key to enable it")
+	}
+	// Same for rebooting, which --no-reboot-endpoint can also turn off
+	enableReboot = enableReboot && cfg.APIKey != ""
+	if enableReboot {
+		http.Handle("/reboot", limiter.Middleware(middleware.RequireAPIKey(cfg.APIKey, handleReboot(cfg))))
+	} else if cfg.APIKey == "" {
+		logger.Warn("reboot endpoint disabled, set api_key to enable it")
+	}
+	http.Handle("/sync", withoutWriteTimeout(countUploads(limiter.Middleware(middleware.RequireAPIKey(cfg.APIKey, handleSync(cfg))))))
+	if cfg.AdminUsername != "" && cfg.AdminPassword != "" {
+		http.Handle("/admin", middleware.RequireBasicAuth(cfg.AdminUsername, cfg.AdminPassword, "lift_learn admin", handleAdmin(cfg)))
+	} else {
+		logger.Info("admin dashboard disabled, set admin_username and admin_password to enable it")
+	}
+	http.Handle("/metrics", metrics.Handler())
+
+	// Handlers run with this rather than the signal context, so shutdown
+	// lets them finish; it is only cancelled if the shutdown timeout runs
+	// out with downloads still going
+	handlerCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelHandlers()
+
+	// Deployments and commands from AWS IoT go through the same handlers as
+	// over HTTP; the device certificate stands in for the API key
+	if cfg.AWSIoT != nil {
+		commands := map[string]http.Handler{
+			"sync":            countUploads(handleSync(cfg)),
+			"integrity-check": handleIntegrityCheck(cfg),
+			"gc":              handleGC(cfg),
+		}
+		if enableUpdate {
+			commands["update"] = handleUpdate(cfg)
+		}
+		if enableReboot {
+			commands["reboot"] = handleReboot(cfg)
+		}
+		iot, err := connectAWSIoT(handlerCtx, cfg, countUploads(handleUpload(cfg)), commands)
+		if err != nil {
+			logger.Error("AWS IoT disabled", "err", err)
+		} else {
+			logger.Info("receiving deployments from AWS IoT", "deploy_topic", iot.DeployTopic(), "command_topic", iot.CommandTopic())
+			// Nothing new is taken on once shutdown starts
+			context.AfterFunc(ctx, func() { iot.Close() })
+		}
+	}
+
+	srv := newHTTPServer(cfg, middleware.LoggingMiddleware(logger)(middleware.RecoverMiddleware(logger, middleware.CORSMiddleware(cfg.CORS)(http.DefaultServeMux))), handlerCtx)
+	if cfg.ClientCAFile != "" {
+		tlsConfig, err := clientCATLSConfig(cfg.ClientCAFile)
+		if err != nil {
+			fatal("failed to load client CA bundle", "err", err)
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	serveErr := make(chan error, 1)
+	if cfg.TLSEnabled() {
+		if cfg.GenerateSelfSigned {
+			if err := ensureSelfSignedCert(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+				fatal("failed to generate self-signed certificate", "err", err)
+			}
+		}
+
+		logger.Info("starting upload server", "port", cfg.HTTPPort, "tls", true)
+		go func() { serveErr <- srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile) }()
+	} else {
+		logger.Info("starting upload server", "port", cfg.HTTPPort, "tls", false)
+		go func() { serveErr <- srv.ListenAndServe() }()
+	}
+
+	// Profiles get a server of their own so they never share the upload port
+	var pprofSrv *http.Server
+	if enablePprof {
+		pprofSrv = profiling.NewServer(cfg.PProfListenPort())
+		logger.Info("starting pprof server", "addr", pprofSrv.Addr)
+		go func() {
+			if err := pprofSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("pprof server stopped", "err", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		fatal("server stopped", "err", err)
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down", "in_flight_requests", uploadsInFlight.Load())
+	timeout := time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("shutdown timed out with requests still running", "err", err)
+	}
+	if pprofSrv != nil {
+		pprofSrv.Shutdown(shutdownCtx)
+	}
+	if !waitWithContext(shutdownCtx, &downloadsInFlight) {
+		logger.Warn("shutdown timed out with downloads still running, cancelling them")
+		cancelHandlers()
+		graceCtx, cancelGrace := context.WithTimeout(context.Background(), cancelGracePeriod)
+		if !waitWithContext(graceCtx, &downloadsInFlight) {
+			logger.Warn("cancelled downloads did not stop in time")
+		}
+		cancelGrace()
+	}
+
+	marked, err := markIncompleteDownloads(cfg.StoragePath)
+	if err != nil {
+		logger.Error("failed to mark incomplete downloads", "err", err)
+	} else if marked > 0 {
+		logger.Info("marked incomplete downloads", "count", marked)
+	}
+	logger.Info("shutdown complete")
+}
+
+// Server for handler with the timeouts in cfg. Shutdown never cancels
+// request contexts by itself, so they all derive from base instead.
+func newHTTPServer(cfg *config.Config, handler http.Handler, base context.Context) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.HTTPPort),
+		Handler:           handler,
+		ReadTimeout:       time.Duration(cfg.Server.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(cfg.Server.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(cfg.Server.IdleTimeoutSeconds) * time.Second,
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeoutSeconds) * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return base },
+	}
+}
+
+// Wait for wg, giving up when ctx is done. Reports whether wg finished.
+func waitWithContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Rename every leftover .partial under storagePath to .incomplete so it is
+// obvious which downloads never finished. The next download of the same
+// file picks the bytes up again from there.
+func markIncompleteDownloads(storagePath string) (int, error) {
+	marked := 0
+	err := filepath.Walk(storagePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, partialSuffix) {
+			return nil
+		}
+		finalPath := strings.TrimSuffix(path, partialSuffix)
+		if err := os.Rename(path, finalPath+incompleteSuffix); err != nil {
+			return err
+		}
+		marked++
+		return nil
+	})
+	return marked, err
+}
+
+// Create a self-signed certificate and key at the given paths unless both already exist
+func ensureSelfSignedCert(certFile, keyFile string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	logger.Info("generating self-signed certificate", "host", host)
+
+	certPEM, keyPEM, err := generateSelfSignedCert(host)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	return nil
+}
+
+// Generate a PEM-encoded self-signed certificate valid for host and localhost
+func generateSelfSignedCert(host string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if host != "localhost" {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal private key: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}